@@ -0,0 +1,400 @@
+// Package api exposes a running conversation server to local scripts and bots over
+// HTTP and JSON. The API only listens on loopback addresses and every request needs the
+// bearer token generated when the server is created.
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/server"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Address the API listens on by default.
+const DefaultAddress = "127.0.0.1:8717"
+
+// Conversation describes a conversation in API responses.
+type Conversation struct {
+	ID            string `json:"id"`
+	Alias         string `json:"alias"`
+	State         string `json:"state"`
+	KeyType       string `json:"key_type"`
+	RemoteAddress string `json:"remote_address,omitempty"`
+	Verified      bool   `json:"verified"`
+	// Result of checking the contact's key against the contact book, see server.KeyStatus
+	KeyStatus string `json:"key_status"`
+}
+
+// Message describes a message in API responses and events.
+type Message struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Text   string `json:"text,omitempty"`
+	Time   int    `json:"time"`
+	Self   bool   `json:"self"`
+	Status string `json:"status,omitempty"`
+	Sender string `json:"sender,omitempty"`
+}
+
+// Event is streamed to subscribers of the events endpoint.
+type Event struct {
+	Type           string   `json:"type"`
+	ConversationID string   `json:"conversation_id,omitempty"`
+	GroupID        string   `json:"group_id,omitempty"`
+	Message        *Message `json:"message,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// SendRequest is the body of a request sending a message.
+type SendRequest struct {
+	Text  string `json:"text"`
+	Final bool   `json:"final,omitempty"`
+}
+
+// TokenRequest is the body of a request generating or importing a bootstrap token. The
+// public key of the other party is PEM encoded.
+type TokenRequest struct {
+	PublicKey string `json:"public_key"`
+	Alias     string `json:"alias"`
+	Token     string `json:"token,omitempty"`
+}
+
+// TokenResponse holds a generated bootstrap token.
+type TokenResponse struct {
+	Token string `json:"token"`
+}
+
+// Invitation describes a generated token that was not used yet.
+type Invitation struct {
+	ConversationID string    `json:"conversation_id"`
+	Alias          string    `json:"alias"`
+	Created        time.Time `json:"created"`
+	Expires        time.Time `json:"expires"`
+}
+
+// Server serves the API for a RouteHandler. Conversations created through the API use
+// the identity the server was created with.
+type Server struct {
+	Handler *server.RouteHandler
+	// Token every request has to present as "Authorization: Bearer <token>"
+	Token string
+
+	keyType    string
+	privateKey any
+	publicKey  []byte
+	echo       *echo.Echo
+	listener   net.Listener
+}
+
+// Creates an API server for the handler with a new random token.
+func NewServer(rh *server.RouteHandler, privateKey any) (*Server, error) {
+	keyType, err := crypt.KeyType(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := crypt.PublicKeyToBytes(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Handler:    rh,
+		Token:      hex.EncodeToString(token),
+		keyType:    keyType,
+		privateKey: privateKey,
+		publicKey:  publicKey,
+	}
+
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Use(s.authenticate)
+
+	e.GET("/v1/conversations", s.listConversations)
+	e.GET("/v1/conversations/:id/messages", s.listMessages)
+	e.POST("/v1/conversations/:id/messages", s.sendMessage)
+	e.POST("/v1/tokens", s.generateToken)
+	e.POST("/v1/tokens/import", s.importToken)
+	e.GET("/v1/invitations", s.listInvitations)
+	e.DELETE("/v1/invitations/:id", s.revokeInvitation)
+	e.GET("/v1/events", s.streamEvents)
+
+	s.echo = e
+	return s, nil
+}
+
+// Starts serving on a loopback address, other addresses are refused.
+func (s *Server) Listen(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !isLoopback(host) {
+		return fmt.Errorf("The API only listens on loopback addresses, not %q", host)
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	s.listener = l
+	s.echo.Listener = l
+	go s.echo.Start("")
+	return nil
+}
+
+// Returns the address the API listens on.
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Stops the API, the conversation server keeps running.
+func (s *Server) Close() error {
+	return s.echo.Close()
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Checks the bearer token. Requests naming another host are refused so web pages cannot
+// reach the API by rebinding a domain to the loopback address.
+func (s *Server) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		host, _, err := net.SplitHostPort(c.Request().Host)
+		if err != nil {
+			host = c.Request().Host
+		}
+		if !isLoopback(host) {
+			return echo.ErrForbidden
+		}
+
+		token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			return echo.ErrUnauthorized
+		}
+
+		return next(c)
+	}
+}
+
+func conversationState(c server.ConversationInfo) string {
+	switch {
+	case c.Ended:
+		return "ended"
+	case c.Established:
+		return "active"
+	default:
+		return "pending"
+	}
+}
+
+func newMessage(m *server.Message) *Message {
+	if m == nil {
+		return nil
+	}
+
+	msg := &Message{
+		ID:     m.ID,
+		Kind:   string(m.Kind),
+		Text:   m.Text,
+		Time:   m.Time,
+		Self:   m.Self,
+		Sender: m.Sender,
+	}
+	if m.Status != server.StatusNone {
+		msg.Status = m.Status.String()
+	}
+
+	return msg
+}
+
+func newEvent(e server.Event) Event {
+	event := Event{
+		Type:           e.Type.String(),
+		ConversationID: e.ConversationID,
+		GroupID:        e.GroupID,
+		Message:        newMessage(e.Message),
+	}
+	if e.Err != nil {
+		event.Error = e.Err.Error()
+	}
+
+	return event
+}
+
+func (s *Server) listConversations(c echo.Context) error {
+	conversations := make([]Conversation, 0)
+	for _, id := range s.Handler.ConversationIDs() {
+		convo, ok := s.Handler.ConversationInfo(id)
+		if !ok {
+			continue
+		}
+
+		conversations = append(conversations, Conversation{
+			ID:            convo.ID,
+			Alias:         convo.Alias,
+			State:         conversationState(convo),
+			KeyType:       convo.KeyType,
+			RemoteAddress: convo.RemoteAddress,
+			Verified:      convo.Verified,
+			KeyStatus:     convo.KeyStatus.String(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, conversations)
+}
+
+func (s *Server) listMessages(c echo.Context) error {
+	id := c.Param("id")
+	if _, ok := s.Handler.Conversation(id); !ok {
+		return echo.ErrNotFound
+	}
+
+	messages := make([]*Message, 0)
+	for _, m := range s.Handler.Messages(id) {
+		messages = append(messages, newMessage(m))
+	}
+
+	return c.JSON(http.StatusOK, messages)
+}
+
+func (s *Server) sendMessage(c echo.Context) error {
+	var request SendRequest
+	if err := c.Bind(&request); err != nil {
+		return err
+	}
+
+	id := c.Param("id")
+	if _, ok := s.Handler.Conversation(id); !ok {
+		return echo.ErrNotFound
+	}
+	if request.Text == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Empty Message")
+	}
+
+	msg, err := s.Handler.Send(id, request.Text, request.Final)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, newMessage(msg))
+}
+
+func (s *Server) generateToken(c echo.Context) error {
+	var request TokenRequest
+	if err := c.Bind(&request); err != nil {
+		return err
+	}
+
+	remotePublicKey, err := crypt.PublicKeyToMem(s.keyType, []byte(request.PublicKey))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	token, err := s.Handler.GenerateConversation(s.privateKey, s.publicKey, remotePublicKey, s.keyType, request.Alias)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, TokenResponse{Token: token})
+}
+
+func (s *Server) importToken(c echo.Context) error {
+	var request TokenRequest
+	if err := c.Bind(&request); err != nil {
+		return err
+	}
+
+	remotePublicKey, err := crypt.PublicKeyToMem(s.keyType, []byte(request.PublicKey))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	err = s.Handler.BootstrapConversation(request.Token, s.privateKey, s.publicKey, remotePublicKey, request.Alias)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) listInvitations(c echo.Context) error {
+	invitations := make([]Invitation, 0)
+	for _, inv := range s.Handler.Invitations() {
+		invitations = append(invitations, Invitation{
+			ConversationID: inv.ConversationID,
+			Alias:          inv.Alias,
+			Created:        inv.Created,
+			Expires:        inv.Expires,
+		})
+	}
+
+	return c.JSON(http.StatusOK, invitations)
+}
+
+func (s *Server) revokeInvitation(c echo.Context) error {
+	if err := s.Handler.RevokeInvitation(c.Param("id")); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Streams every event of the handler as server-sent events until the client disconnects.
+func (s *Server) streamEvents(c echo.Context) error {
+	events, unsubscribe := s.Handler.Subscribe()
+	defer unsubscribe()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			data, err := json.Marshal(newEvent(e))
+			if err != nil {
+				return err
+			}
+
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return nil
+			}
+			w.Flush()
+		}
+	}
+}
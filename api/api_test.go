@@ -0,0 +1,187 @@
+package api_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/api"
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/server"
+)
+
+type peer struct {
+	rh         *server.RouteHandler
+	privateKey any
+	publicKey  []byte
+}
+
+func newPeer(t *testing.T) *peer {
+	t.Helper()
+
+	privateKey, _, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	publicKey, err := crypt.PublicKeyToBytes(privateKey)
+	if err != nil {
+		t.Fatalf("Error encoding public key: %s", err)
+	}
+
+	lt, err := server.NewLoopbackTransport()
+	if err != nil {
+		t.Fatalf("Error creating transport: %s", err)
+	}
+
+	rh := server.NewRouteHandlerWithTransport(lt)
+	rh.Start()
+	t.Cleanup(rh.Close)
+
+	return &peer{rh: rh, privateKey: privateKey, publicKey: publicKey}
+}
+
+type client struct {
+	t     *testing.T
+	url   string
+	token string
+}
+
+func (c *client) do(method, path string, body, response any) int {
+	c.t.Helper()
+
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			c.t.Fatalf("Error encoding request: %s", err)
+		}
+	}
+
+	r, err := http.NewRequest(method, c.url+path, bytes.NewReader(data))
+	if err != nil {
+		c.t.Fatalf("Error creating request: %s", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		c.t.Fatalf("Error sending request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if response != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			c.t.Fatalf("Error decoding response: %s", err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func TestAPI(t *testing.T) {
+	alice := newPeer(t)
+	bob := newPeer(t)
+
+	s, err := api.NewServer(alice.rh, alice.privateKey)
+	if err != nil {
+		t.Fatalf("Error creating API server: %s", err)
+	}
+	if err := s.Listen("0.0.0.0:0"); err == nil {
+		t.Fatalf("Expected a public address to be refused")
+	}
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Error starting API server: %s", err)
+	}
+	defer s.Close()
+
+	c := &client{t: t, url: "http://" + s.Addr(), token: "wrong"}
+	if status := c.do("GET", "/v1/conversations", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong token to be refused, got %d", status)
+	}
+	c.token = s.Token
+
+	var token api.TokenResponse
+	c.do("POST", "/v1/tokens", api.TokenRequest{PublicKey: string(bob.publicKey), Alias: "Bob"}, &token)
+
+	err = bob.rh.BootstrapConversation(token.Token, bob.privateKey, bob.publicKey, mustPublicKey(t, alice.publicKey), "Alice")
+	if err != nil {
+		t.Fatalf("Error bootstrapping conversation: %s", err)
+	}
+
+	var conversations []api.Conversation
+	c.do("GET", "/v1/conversations", nil, &conversations)
+	if len(conversations) != 1 || conversations[0].Alias != "Bob" || conversations[0].State != "active" {
+		t.Fatalf("Unexpected conversations %+v", conversations)
+	}
+	id := conversations[0].ID
+
+	// Messages from Bob are streamed as events
+	r, _ := http.NewRequest("GET", c.url+"/v1/events", nil)
+	r.Header.Set("Authorization", "Bearer "+s.Token)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("Error opening event stream: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := bob.rh.Send(id, "Hello Alice", false); err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+
+	received := make(chan api.Event)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+
+			var e api.Event
+			if json.Unmarshal([]byte(data), &e) == nil && e.Type == server.EventMessageReceived.String() {
+				received <- e
+				return
+			}
+		}
+	}()
+
+	select {
+	case e := <-received:
+		if e.ConversationID != id || e.Message.Text != "Hello Alice" {
+			t.Fatalf("Unexpected event %+v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the message event")
+	}
+
+	var sent api.Message
+	if status := c.do("POST", "/v1/conversations/"+id+"/messages", api.SendRequest{Text: "Hello Bob"}, &sent); status != http.StatusOK {
+		t.Fatalf("Error sending message through the API: %d", status)
+	}
+
+	var messages []api.Message
+	c.do("GET", "/v1/conversations/"+id+"/messages", nil, &messages)
+	if len(messages) != 2 || messages[1].ID != sent.ID || !messages[1].Self {
+		t.Fatalf("Unexpected messages %+v", messages)
+	}
+
+	if status := c.do("GET", "/v1/conversations/unknown/messages", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("Expected an unknown conversation to be reported, got %d", status)
+	}
+}
+
+func mustPublicKey(t *testing.T, publicKey []byte) any {
+	t.Helper()
+
+	key, err := crypt.PublicKeyToMem("x25519", publicKey)
+	if err != nil {
+		t.Fatalf("Error decoding public key: %s", err)
+	}
+	return key
+}
@@ -0,0 +1,311 @@
+// Package client embeds OnionSoup conversations in Go programs without the GUI.
+//
+// A Node runs a conversation server for an Identity. Conversations start with an
+// invitation: one party creates a token with Invite and hands it to the other party out
+// of band together with its public key, the other party passes it to Accept. Received
+// messages are delivered on a channel from Messages or to a callback from OnMessage.
+//
+//	id, _ := client.GenerateIdentity("x25519", "Build Bot")
+//	node, _ := client.Start(id, client.Options{})
+//	defer node.Close()
+//
+//	invitation, _ := node.Invite(peerPublicKey, "Alice")
+//	// send invitation.Token and id.PublicKey() to Alice
+//	node.WaitEstablished(ctx, invitation.ConversationID)
+//	node.Send(invitation.ConversationID, "Build passed")
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/server"
+)
+
+// Options configures a Node.
+type Options struct {
+	// Tor configures the onion service the node is reachable at.
+	Tor server.Config
+	// Loopback serves on a local address without tor. It provides no anonymity and is
+	// meant for tests and local development.
+	Loopback bool
+
+	// History stores messages and Store keeps conversations across restarts, nil keeps
+	// them in memory only.
+	History *server.History
+	Store   *server.ConversationStore
+	// Contacts pins the keys of contacts and reports new or changed keys as
+	// server.EventKeyWarning, nil skips the checks.
+	Contacts *server.ContactBook
+	// ReadReceipts tells contacts when their messages were marked read.
+	ReadReceipts bool
+	// TokenTTL is how long invitations are accepted, zero uses server.DefaultTokenTTL.
+	TokenTTL time.Duration
+}
+
+// Node is a running conversation server for an identity.
+type Node struct {
+	identity *Identity
+	rh       *server.RouteHandler
+}
+
+// Invitation is a bootstrap token for a new conversation. The token is single use and
+// only meant for the contact whose public key it was created for.
+type Invitation struct {
+	Token          string
+	ConversationID string
+	// Zero when the token does not expire, see Options.TokenTTL
+	Expires time.Time
+}
+
+// Message is a message received in a conversation or a group.
+type Message struct {
+	ConversationID string
+	GroupID        string
+	*server.Message
+}
+
+// Starts a node for the identity. Stored conversations are restored and resumed.
+func Start(identity *Identity, opts Options) (*Node, error) {
+	var (
+		rh  *server.RouteHandler
+		err error
+	)
+
+	if opts.Loopback {
+		var lt *server.LoopbackTransport
+		lt, err = server.NewLoopbackTransport()
+		if err == nil {
+			rh = server.NewRouteHandlerWithTransport(lt)
+		}
+	} else {
+		rh, err = server.NewRouteHandler(opts.Tor)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rh.History = opts.History
+	rh.Store = opts.Store
+	rh.Contacts = opts.Contacts
+	rh.ReadReceipts = opts.ReadReceipts
+	if opts.TokenTTL > 0 {
+		rh.TokenTTL = opts.TokenTTL
+	}
+	rh.Start()
+
+	if err := rh.LoadConversations(); err != nil {
+		rh.Close()
+		return nil, err
+	}
+
+	return &Node{identity: identity, rh: rh}, nil
+}
+
+// Returns the address contacts reach the node at.
+func (n *Node) Address() string {
+	return n.rh.URL
+}
+
+// Returns the identity the node was started with.
+func (n *Node) Identity() *Identity {
+	return n.identity
+}
+
+// Returns the underlying handler for features this package does not wrap, such as groups.
+func (n *Node) Handler() *server.RouteHandler {
+	return n.rh
+}
+
+// Creates an invitation for the contact with the PEM encoded public key.
+func (n *Node) Invite(peerPublicKey []byte, alias string) (*Invitation, error) {
+	remotePublicKey, err := crypt.PublicKeyToMem(n.identity.KeyType, peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := n.rh.GenerateConversation(n.identity.privateKey, n.identity.publicKey, remotePublicKey, n.identity.KeyType, alias)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := invitationConversation(token)
+	if err != nil {
+		return nil, err
+	}
+
+	invitation := &Invitation{Token: token, ConversationID: id}
+	if c, ok := n.rh.ConversationInfo(id); ok {
+		invitation.Expires = c.Expires
+	}
+	return invitation, nil
+}
+
+// Refuses the token of an invitation that was not accepted yet.
+func (n *Node) Revoke(id string) error {
+	return n.rh.RevokeInvitation(id)
+}
+
+// Accepts an invitation of the contact with the PEM encoded public key and returns the
+// id of the established conversation.
+func (n *Node) Accept(token string, peerPublicKey []byte, alias string) (string, error) {
+	remotePublicKey, err := crypt.PublicKeyToMem(n.identity.KeyType, peerPublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := invitationConversation(token)
+	if err != nil {
+		return "", err
+	}
+
+	err = n.rh.BootstrapConversation(token, n.identity.privateKey, n.identity.publicKey, remotePublicKey, alias)
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Reads the conversation id out of a bootstrap token.
+func invitationConversation(token string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("Invalid invitation: %s", err)
+	}
+
+	var request server.StartConversationWrapper
+	if err := json.Unmarshal(data, &request); err != nil || request.ID == "" {
+		return "", fmt.Errorf("Invalid invitation")
+	}
+
+	return request.ID, nil
+}
+
+// Waits until the contact accepted the invitation of the conversation or the context
+// is done.
+func (n *Node) WaitEstablished(ctx context.Context, id string) error {
+	// Subscribed before the state is checked so the event cannot be missed
+	events, unsubscribe := n.rh.Subscribe()
+	defer unsubscribe()
+
+	c, ok := n.rh.ConversationInfo(id)
+	if !ok {
+		return fmt.Errorf("Unknown conversation")
+	}
+	if c.Established {
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-events:
+			if !ok {
+				return fmt.Errorf("Node was closed")
+			}
+			if e.Type == server.EventConversationEstablished && e.ConversationID == id {
+				return nil
+			}
+		}
+	}
+}
+
+// Returns the ids of all conversations.
+func (n *Node) ConversationIDs() []string {
+	return n.rh.ConversationIDs()
+}
+
+// Returns a snapshot of the conversation with the given id.
+func (n *Node) Conversation(id string) (server.ConversationInfo, bool) {
+	return n.rh.ConversationInfo(id)
+}
+
+// Returns copies of the messages exchanged in a conversation.
+func (n *Node) History(id string) []*server.Message {
+	return n.rh.Messages(id)
+}
+
+// Sends a text. The message is queued and retried until it is delivered or expires,
+// its status changes are published as events.
+func (n *Node) Send(id, text string) (*server.Message, error) {
+	return n.rh.Send(id, text, false)
+}
+
+// Sends a file of up to server.MaxAttachmentSize bytes.
+func (n *Node) SendFile(id, name string, data []byte) (*server.Message, error) {
+	return n.rh.SendAttachment(id, name, data)
+}
+
+// Sends a final message, nothing can be sent in the conversation afterwards.
+func (n *Node) End(id, text string) error {
+	_, err := n.rh.Send(id, text, true)
+	return err
+}
+
+// Tells contacts the received messages of a conversation were read when read receipts
+// are enabled.
+func (n *Node) MarkRead(id string) {
+	n.rh.MarkRead(id)
+}
+
+// Returns a channel receiving every event of the node and a function cancelling the
+// subscription, see server.Event.
+func (n *Node) Events() (<-chan server.Event, func()) {
+	return n.rh.Subscribe()
+}
+
+// Returns a channel receiving the messages of contacts and a function cancelling the
+// subscription. Messages queue up until they are read, the channel is closed once the
+// subscription is cancelled or the node is closed.
+func (n *Node) Messages() (<-chan Message, func()) {
+	events, unsubscribe := n.rh.Subscribe()
+	messages := make(chan Message)
+
+	go func() {
+		defer close(messages)
+
+		for e := range events {
+			if e.Message == nil || e.Message.Self {
+				continue
+			}
+			if e.Type != server.EventMessageReceived && e.Type != server.EventGroupMessage {
+				continue
+			}
+
+			messages <- Message{ConversationID: e.ConversationID, GroupID: e.GroupID, Message: e.Message}
+		}
+	}()
+
+	return messages, func() {
+		unsubscribe()
+		// The forwarder may be blocked on a message nobody reads anymore
+		for range messages {
+		}
+	}
+}
+
+// Calls the handler with every message of a contact, one at a time, until the returned
+// function is called.
+func (n *Node) OnMessage(handler func(Message)) func() {
+	messages, cancel := n.Messages()
+
+	go func() {
+		for msg := range messages {
+			handler(msg)
+		}
+	}()
+
+	return cancel
+}
+
+// Stops the node. Conversations stay open on the contact's side and can be resumed when
+// the node was started with a Store.
+func (n *Node) Close() {
+	n.rh.Close()
+}
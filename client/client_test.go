@@ -0,0 +1,94 @@
+package client_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/client"
+)
+
+func startNode(t *testing.T, label string) *client.Node {
+	t.Helper()
+
+	id, err := client.GenerateIdentity("x25519", label)
+	if err != nil {
+		t.Fatalf("Error generating identity: %s", err)
+	}
+
+	// Identities survive a round trip through their key file
+	sealed, err := id.Seal("password")
+	if err != nil {
+		t.Fatalf("Error sealing identity: %s", err)
+	}
+	id, err = client.LoadIdentity(sealed, "password")
+	if err != nil {
+		t.Fatalf("Error loading identity: %s", err)
+	}
+	if id.Label != label {
+		t.Fatalf("Expected label %q, got %q", label, id.Label)
+	}
+
+	node, err := client.Start(id, client.Options{Loopback: true})
+	if err != nil {
+		t.Fatalf("Error starting node: %s", err)
+	}
+	t.Cleanup(node.Close)
+
+	return node
+}
+
+func TestNode(t *testing.T) {
+	alice := startNode(t, "Alice")
+	bob := startNode(t, "Bob")
+
+	invitation, err := alice.Invite(bob.Identity().PublicKey(), "Bob")
+	if err != nil {
+		t.Fatalf("Error creating invitation: %s", err)
+	}
+
+	messages, cancel := alice.Messages()
+	defer cancel()
+
+	id, err := bob.Accept(invitation.Token, alice.Identity().PublicKey(), "Alice")
+	if err != nil {
+		t.Fatalf("Error accepting invitation: %s", err)
+	}
+	if id != invitation.ConversationID {
+		t.Fatalf("Expected conversation %s, got %s", invitation.ConversationID, id)
+	}
+
+	ctx, done := context.WithTimeout(context.Background(), 10*time.Second)
+	defer done()
+	if err := alice.WaitEstablished(ctx, id); err != nil {
+		t.Fatalf("Error waiting for the conversation: %s", err)
+	}
+
+	received := make(chan client.Message, 1)
+	stop := bob.OnMessage(func(msg client.Message) {
+		received <- msg
+	})
+	defer stop()
+
+	if _, err := bob.Send(id, "Hello Alice"); err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+	if _, err := alice.Send(id, "Hello Bob"); err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+
+	for _, ch := range []<-chan client.Message{messages, received} {
+		select {
+		case msg := <-ch:
+			if msg.ConversationID != id || msg.Text == "" {
+				t.Fatalf("Unexpected message %+v", msg)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for a message")
+		}
+	}
+
+	if _, err := bob.Accept("not a token", alice.Identity().PublicKey(), "Alice"); err == nil {
+		t.Fatalf("Expected an invalid invitation to be refused")
+	}
+}
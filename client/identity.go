@@ -0,0 +1,100 @@
+package client
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+)
+
+// Identity is a long term key pair. Its public key is shared with contacts out of band
+// and authenticates every conversation started with it.
+type Identity struct {
+	// rsa, pgp or x25519
+	KeyType string
+	// Name stored with the private key
+	Label string
+
+	privateKey any
+	publicKey  []byte
+}
+
+// Generates a new identity of the key type, rsa, pgp or x25519.
+func GenerateIdentity(keyType, label string) (*Identity, error) {
+	var (
+		privateKey any
+		err        error
+	)
+
+	switch keyType {
+	case "rsa":
+		privateKey, _, err = crypt.RSAGenerateKeyPair(4096)
+	case "pgp":
+		privateKey, err = crypt.PGPGenerateKeyPair(label)
+	case "x25519":
+		privateKey, _, err = crypt.CurveGenerateKeyPair()
+	default:
+		return nil, fmt.Errorf("Invalid key type: %q", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newIdentity(keyType, label, privateKey)
+}
+
+// Loads an identity from a private key file written by Seal, the onionsoup keygen
+// command or the GUI. An empty password opens unencrypted keys.
+func LoadIdentity(data []byte, password string) (*Identity, error) {
+	kc, privateKey, err := crypt.LoadPrivateKey(data, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return newIdentity(kc.KeyType, kc.Label, privateKey)
+}
+
+// Reads and loads a private key file, see LoadIdentity.
+func LoadIdentityFile(path, password string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadIdentity(data, password)
+}
+
+func newIdentity(keyType, label string, privateKey any) (*Identity, error) {
+	publicKey, err := crypt.PublicKeyToBytes(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{KeyType: keyType, Label: label, privateKey: privateKey, publicKey: publicKey}, nil
+}
+
+// Serializes the private key, encrypted with the password unless it is empty.
+func (i *Identity) Seal(password string) ([]byte, error) {
+	return crypt.SealPrivateKey(i.KeyType, i.privateKey, password, i.Label)
+}
+
+// Returns the PEM encoded public key to share with contacts.
+func (i *Identity) PublicKey() []byte {
+	return i.publicKey
+}
+
+// Returns the private key for use with the crypt and server packages.
+func (i *Identity) PrivateKey() any {
+	return i.privateKey
+}
+
+// Returns the hex encoded fingerprint of the public key.
+func (i *Identity) Fingerprint() (string, error) {
+	fingerprint, err := crypt.Fingerprint(i.privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(fingerprint), nil
+}
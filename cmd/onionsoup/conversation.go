@@ -0,0 +1,786 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/api"
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/server"
+	"github.com/JustinTimperio/onionsoup/storage"
+)
+
+// Flags shared by every command that runs a conversation server.
+type serverFlags struct {
+	keyFile             string
+	passwordFile        string
+	transport           string
+	torMode             string
+	controlAddress      string
+	controlSocket       string
+	persistent          bool
+	rotate              bool
+	addressPasswordFile string
+	storage             string
+	storagePasswordFile string
+	history             bool
+	retention           time.Duration
+	resume              bool
+	readReceipts        bool
+	downloads           string
+	api                 string
+	apiTokenFile        string
+	tokenTTL            time.Duration
+}
+
+func (sf *serverFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&sf.keyFile, "key", "", "private key file")
+	fs.StringVar(&sf.passwordFile, "password-file", "", "file holding the private key password")
+	fs.StringVar(&sf.transport, "transport", "tor", "tor, or loopback for local testing without anonymity")
+	fs.StringVar(&sf.torMode, "tor-mode", server.TorModeAuto, "auto, system or embedded")
+	fs.StringVar(&sf.controlAddress, "control-address", "", "control port of a running tor, defaults to "+server.DefaultControlAddress)
+	fs.StringVar(&sf.controlSocket, "control-socket", "", "control socket of a running tor")
+	fs.BoolVar(&sf.persistent, "persistent", false, "keep the same .onion address across restarts")
+	fs.BoolVar(&sf.rotate, "rotate", false, "replace the stored .onion address with a new one")
+	fs.StringVar(&sf.addressPasswordFile, "address-password-file", "", "file holding the password of the stored .onion address key, defaults to ONIONSOUP_ADDRESS_PASSWORD, required with -persistent")
+	fs.StringVar(&sf.storage, "storage", "off", "keep local state encrypted with the private key (key) or a passphrase (passphrase)")
+	fs.StringVar(&sf.storagePasswordFile, "storage-password-file", "", "file holding the storage passphrase, defaults to ONIONSOUP_STORAGE_PASSWORD")
+	fs.BoolVar(&sf.history, "history", true, "store message history when local storage is enabled")
+	fs.DurationVar(&sf.retention, "retention", 0, "how long stored messages are kept, zero keeps them forever")
+	fs.BoolVar(&sf.resume, "resume", false, "store conversations so they can be resumed after a restart, requires local storage")
+	fs.BoolVar(&sf.readReceipts, "read-receipts", false, "tell the other party when received messages were printed or marked read")
+	fs.StringVar(&sf.downloads, "downloads", "", "directory received attachments are saved to, they are not saved without it")
+	fs.DurationVar(&sf.tokenTTL, "token-ttl", server.DefaultTokenTTL, "how long generated tokens are accepted, zero until they are used or revoked")
+	fs.StringVar(&sf.api, "api", "", "serve the local automation API on this loopback address, for example "+api.DefaultAddress)
+	fs.StringVar(&sf.apiTokenFile, "api-token-file", "", "write the API bearer token to this file instead of printing it")
+}
+
+func (sf *serverFlags) openStorage(privateKey any) (*storage.Vault, error) {
+	var (
+		vault *storage.Vault
+		err   error
+	)
+
+	switch sf.storage {
+	case "off", "":
+		if sf.resume {
+			return nil, fmt.Errorf("-resume requires -storage")
+		}
+		return nil, nil
+	case "key":
+		vault, err = server.OpenKeyVault(privateKey)
+	case "passphrase":
+		var passphrase string
+		passphrase, err = readPassword(sf.storagePasswordFile, "ONIONSOUP_STORAGE_PASSWORD")
+		if err == nil {
+			vault, err = server.OpenPassphraseVault(passphrase)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid storage mode: %q", sf.storage)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening local storage: %s", err)
+	}
+
+	return vault, nil
+}
+
+// A running conversation server and the identity it uses.
+type conversationServer struct {
+	rh         *server.RouteHandler
+	keyType    string
+	privateKey any
+	publicKey  []byte
+	// Directory received attachments are saved to, empty leaves them unsaved
+	downloads string
+	// Local automation API, nil when it is off
+	api *api.Server
+}
+
+func (sf *serverFlags) start() (*conversationServer, error) {
+	keyType, privateKey, err := loadPrivateKey(sf.keyFile, sf.passwordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := crypt.PublicKeyToBytes(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	vault, err := sf.openStorage(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var rh *server.RouteHandler
+	switch sf.transport {
+	case "tor":
+		conf := server.Config{
+			TorMode:         sf.torMode,
+			ControlAddress:  sf.controlAddress,
+			ControlSocket:   sf.controlSocket,
+			ControlPassword: os.Getenv("ONIONSOUP_CONTROL_PASSWORD"),
+		}
+
+		if sf.persistent {
+			password, err := readPassword(sf.addressPasswordFile, "ONIONSOUP_ADDRESS_PASSWORD")
+			if err != nil {
+				return nil, err
+			}
+
+			path, err := server.DefaultOnionKeyPath()
+			if err != nil {
+				return nil, err
+			}
+
+			conf.OnionKey, err = server.LoadOrCreateOnionKey(path, password, sf.rotate)
+			if err != nil {
+				return nil, fmt.Errorf("Error loading onion address key: %s", err)
+			}
+		}
+
+		rh, err = server.NewRouteHandler(conf)
+		if err != nil {
+			return nil, fmt.Errorf("Error starting route handler: %s", err)
+		}
+
+	case "loopback":
+		lt, err := server.NewLoopbackTransport()
+		if err != nil {
+			return nil, err
+		}
+		rh = server.NewRouteHandlerWithTransport(lt)
+
+	default:
+		return nil, fmt.Errorf("Invalid transport: %q", sf.transport)
+	}
+
+	if vault != nil && sf.history {
+		rh.History = server.NewHistory(vault)
+		rh.History.DefaultRetention = sf.retention
+	}
+	if vault != nil && sf.resume {
+		rh.Store = server.NewConversationStore(vault)
+	}
+	if vault != nil {
+		rh.Contacts = server.NewContactBook(vault)
+	}
+	rh.ReadReceipts = sf.readReceipts
+	rh.TokenTTL = sf.tokenTTL
+	rh.Start()
+
+	cs := &conversationServer{rh: rh, keyType: keyType, privateKey: privateKey, publicKey: publicKey, downloads: sf.downloads}
+	if sf.api != "" {
+		if err := cs.startAPI(sf.api, sf.apiTokenFile); err != nil {
+			rh.Close()
+			return nil, fmt.Errorf("Error starting API: %s", err)
+		}
+	}
+
+	return cs, nil
+}
+
+// Loads the public key of the other party from a file or the contact book. A contact's
+// alias is used when no other alias is given.
+func (cs *conversationServer) peerKey(peer, alias string) (any, string, error) {
+	if cs.rh.Contacts != nil {
+		if c, ok := cs.rh.Contacts.Contact(peer); ok {
+			if c.KeyType != cs.keyType {
+				return nil, "", fmt.Errorf("%s has a %s key", c.Alias, c.KeyType)
+			}
+			if alias == "" {
+				alias = c.Alias
+			}
+
+			key, err := crypt.PublicKeyToMem(c.KeyType, c.PublicKey)
+			return key, alias, err
+		}
+	}
+
+	key, err := loadPublicKey(cs.keyType, peer)
+	return key, alias, err
+}
+
+func (cs *conversationServer) generate(peer, alias string) (string, error) {
+	key, alias, err := cs.peerKey(peer, alias)
+	if err != nil {
+		return "", err
+	}
+
+	return cs.rh.GenerateConversation(cs.privateKey, cs.publicKey, key, cs.keyType, alias)
+}
+
+func (cs *conversationServer) bootstrap(peer, token, alias string) error {
+	key, alias, err := cs.peerKey(peer, alias)
+	if err != nil {
+		return err
+	}
+
+	return cs.rh.BootstrapConversation(token, cs.privateKey, cs.publicKey, key, alias)
+}
+
+// Serves the local API, the token is written to tokenFile when it is set.
+func (cs *conversationServer) startAPI(address, tokenFile string) error {
+	s, err := api.NewServer(cs.rh, cs.privateKey)
+	if err != nil {
+		return err
+	}
+
+	if tokenFile != "" {
+		if err := os.WriteFile(tokenFile, []byte(s.Token+"\n"), 0600); err != nil {
+			return err
+		}
+	}
+
+	if err := s.Listen(address); err != nil {
+		return err
+	}
+
+	cs.api = s
+	return nil
+}
+
+// Sends a final message to every active conversation and shuts the server down. Stored
+// conversations are left open so they can be resumed.
+func (cs *conversationServer) close() {
+	for _, id := range cs.rh.ConversationIDs() {
+		c, ok := cs.rh.Conversation(id)
+		if ok && c.Established && !c.Ended && cs.rh.Store == nil {
+			cs.rh.Send(id, "Ended Conversation", true)
+		}
+	}
+
+	if cs.api != nil {
+		cs.api.Close()
+	}
+	cs.rh.Close()
+}
+
+// Runs a group subcommand of serve.
+func (cs *conversationServer) group(out io.Writer, command string, params []string) error {
+	switch {
+	case command == "create" && len(params) >= 1:
+		g, err := cs.rh.CreateGroup(params[0], params[1:])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "group %s\n", g.GroupID)
+
+	case command == "add" && len(params) == 2:
+		return cs.rh.AddGroupMember(params[0], params[1])
+
+	case command == "remove" && len(params) == 2:
+		return cs.rh.RemoveGroupMember(params[0], params[1])
+
+	case command == "send" && len(params) >= 2:
+		_, err := cs.rh.SendGroup(params[0], strings.Join(params[1:], " "))
+		return err
+
+	case command == "members" && len(params) == 1:
+		g, ok := cs.rh.Group(params[0])
+		if !ok {
+			return fmt.Errorf("Unknown group")
+		}
+
+		for _, m := range cs.rh.GroupMembers(params[0]) {
+			self := ""
+			if m.ID == g.SelfID {
+				self = " (you)"
+			}
+			fmt.Fprintf(out, "member %s %q%s\n", m.ID, m.Alias, self)
+		}
+
+	case command == "leave" && len(params) == 1:
+		return cs.rh.LeaveGroup(params[0])
+
+	default:
+		fmt.Fprint(out, serveUsage)
+	}
+
+	return nil
+}
+
+// Runs a contact subcommand.
+func (cs *conversationServer) contact(command string, params []string) error {
+	if cs.rh.Contacts == nil {
+		return fmt.Errorf("The contact book requires -storage")
+	}
+
+	switch {
+	case command == "add" && len(params) == 2:
+		data, err := os.ReadFile(params[1])
+		if err != nil {
+			return err
+		}
+
+		_, err = cs.rh.Contacts.Add(params[0], cs.keyType, data, server.TrustUnverified)
+		return err
+
+	case command == "remove" && len(params) == 1:
+		return cs.rh.Contacts.Remove(params[0])
+
+	case command == "trust" && len(params) == 2:
+		trust, err := server.ParseTrustLevel(params[1])
+		if err != nil {
+			return err
+		}
+
+		return cs.rh.Contacts.SetTrust(params[0], trust)
+
+	default:
+		return fmt.Errorf("Unknown contact command: %q", command)
+	}
+}
+
+// Sends a file as an attachment.
+func (cs *conversationServer) attach(id, file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if info.Size() > server.MaxAttachmentSize {
+		return fmt.Errorf("File is larger than %d MiB", server.MaxAttachmentSize/1024/1024)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	_, err = cs.rh.SendAttachment(id, filepath.Base(file), data)
+	return err
+}
+
+// Saves a received attachment to the downloads directory and prints where, an existing
+// file is never replaced.
+func (cs *conversationServer) printDownload(w io.Writer, a *server.Attachment) {
+	if cs.downloads == "" {
+		fmt.Fprintf(w, "attachment %s not saved, use -downloads to keep received files\n", a.Name)
+		return
+	}
+
+	path, err := saveDownload(cs.downloads, a)
+	if err != nil {
+		fmt.Fprintf(w, "error %s\n", err)
+		return
+	}
+	fmt.Fprintf(w, "saved %s\n", path)
+}
+
+func saveDownload(dir string, a *server.Attachment) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	ext := filepath.Ext(a.Name)
+	base := strings.TrimSuffix(a.Name, ext)
+	for i := 0; ; i++ {
+		name := a.Name
+		if i > 0 {
+			name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+
+		path := filepath.Join(dir, name)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		_, err = f.Write(a.Data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return path, err
+	}
+}
+
+func (e *env) tokenGenerate(args []string) error {
+	var sf serverFlags
+	fs := e.flagSet("token generate")
+	sf.register(fs)
+	peer := fs.String("peer", "", "public key file or contact of the other party")
+	alias := fs.String("alias", "", "name for the conversation")
+
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *peer == "" {
+		return fmt.Errorf("token generate requires -peer")
+	}
+
+	cs, err := sf.start()
+	if err != nil {
+		return err
+	}
+	defer cs.close()
+
+	events, unsubscribe := cs.rh.Subscribe()
+	defer unsubscribe()
+
+	token, err := cs.generate(*peer, *alias)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(e.stdout, token)
+	fmt.Fprintln(e.stderr, "Waiting for the other party to import the token...")
+
+	created := <-events
+	return e.chat(cs, created.ConversationID, events, false)
+}
+
+func (e *env) tokenImport(args []string) error {
+	var sf serverFlags
+	fs := e.flagSet("token import")
+	sf.register(fs)
+	peer := fs.String("peer", "", "public key file or contact of the other party")
+	alias := fs.String("alias", "", "name for the conversation")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *peer == "" || len(positional) != 1 {
+		return fmt.Errorf("token import requires -peer and a token")
+	}
+
+	cs, err := sf.start()
+	if err != nil {
+		return err
+	}
+	defer cs.close()
+
+	events, unsubscribe := cs.rh.Subscribe()
+	defer unsubscribe()
+
+	if err := cs.bootstrap(*peer, positional[0], *alias); err != nil {
+		return err
+	}
+
+	created := <-events
+	return e.chat(cs, created.ConversationID, events, true)
+}
+
+// Relays lines from stdin to the conversation and prints received messages until
+// either party ends it. Reaching the end of stdin ends the conversation.
+func (e *env) chat(cs *conversationServer, id string, events <-chan server.Event, established bool) error {
+	var lines chan string
+	readLines := func() {
+		lines = make(chan string)
+		go func() {
+			defer close(lines)
+
+			scanner := bufio.NewScanner(e.stdin)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		}()
+	}
+
+	// Nothing can be sent until the other party completed the bootstrap
+	if established {
+		readLines()
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			if event.ConversationID != id {
+				continue
+			}
+
+			switch event.Type {
+			case server.EventConversationEstablished:
+				fmt.Fprintln(e.stderr, "Conversation established")
+				if lines == nil {
+					readLines()
+				}
+			case server.EventMessageReceived:
+				fmt.Fprintln(e.stdout, event.Message.Text)
+				if a := event.Message.Attachment; a != nil {
+					cs.printDownload(e.stderr, a)
+				}
+				cs.rh.MarkRead(id)
+			case server.EventConversationEnded:
+				fmt.Fprintln(e.stderr, "Conversation ended")
+				return nil
+			case server.EventDeliveryFailed:
+				fmt.Fprintf(e.stderr, "Message not delivered: %s\n", event.Err)
+			case server.EventKeyWarning:
+				fmt.Fprintf(e.stderr, "WARNING: %s\n", event.Err)
+			}
+
+		case line, ok := <-lines:
+			if !ok {
+				_, err := cs.rh.Send(id, "Ended Conversation", true)
+				return err
+			}
+
+			if line != "" {
+				cs.rh.Send(id, line, false)
+			}
+		}
+	}
+}
+
+// Serializes writes from the event printer and the command loop.
+type lockedWriter struct {
+	w   io.Writer
+	mux sync.Mutex
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mux.Lock()
+	defer lw.mux.Unlock()
+
+	return lw.w.Write(p)
+}
+
+const serveUsage = `Commands:
+  generate PEER [ALIAS]                   print a conversation token, PEER is a key file or contact
+  import PEER TOKEN [ALIAS]               start a conversation from a token
+  send ID TEXT                            send a message
+  end ID [TEXT]                           send a final message
+  attach ID FILE                          send a file
+  retry ID MESSAGE_ID                     send a failed message again
+  read ID                                 send a read receipt for received messages
+  ping ID                                 check that the other party is reachable
+  group create NAME ID...                 create a group with the parties of the conversations
+  group add GROUP_ID ID                   add the party of a conversation to a group
+  group remove GROUP_ID MEMBER_ID         remove a member from a group
+  group send GROUP_ID TEXT                send a message to a group
+  group members GROUP_ID                  print the members of a group
+  group leave GROUP_ID                    leave a group, ends it when you are the admin
+  invitations                             print generated tokens that were not used yet
+  revoke ID                               refuse the token of a conversation that was not started
+  list                                    print all conversations and groups
+  contacts                                print the contact book, requires -storage
+  contact add ALIAS KEY_FILE              add a contact
+  contact remove ALIAS                    remove a contact
+  contact trust ALIAS LEVEL               mark a contact verified, unverified or untrusted
+  accept-key ID                           pin the changed key of a conversation's contact
+  quit                                    end all conversations and exit
+`
+
+func (e *env) serve(args []string) error {
+	var sf serverFlags
+	fs := e.flagSet("serve")
+	sf.register(fs)
+
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	cs, err := sf.start()
+	if err != nil {
+		return err
+	}
+	defer cs.close()
+
+	out := &lockedWriter{w: e.stdout}
+	fmt.Fprintf(e.stderr, "Listening on %s\n", cs.rh.URL)
+	if cs.api != nil {
+		fmt.Fprintf(e.stderr, "API listening on %s\n", cs.api.Addr())
+		if sf.apiTokenFile == "" {
+			fmt.Fprintf(e.stderr, "API token %s\n", cs.api.Token)
+		}
+	}
+
+	// Every event is printed as a line of the event name, conversation id and text,
+	// status changes print the message id and status instead of the text
+	events, unsubscribe := cs.rh.Subscribe()
+	defer unsubscribe()
+	go func() {
+		for event := range events {
+			switch {
+			case event.Type == server.EventGroupMessage:
+				if !event.Message.Self || event.Message.Status == server.StatusSent {
+					fmt.Fprintf(out, "%s %s %s %s: %s\n", event.Type, event.GroupID, event.Message.ID, event.Message.Sender, event.Message.Text)
+				}
+			case event.Type == server.EventGroupUpdated:
+				fmt.Fprintf(out, "%s %s\n", event.Type, event.GroupID)
+			case event.Type == server.EventMessageStatus:
+				fmt.Fprintf(out, "%s %s %s %s\n", event.Type, event.ConversationID, event.Message.ID, event.Message.Status)
+			case event.Err != nil:
+				fmt.Fprintf(out, "%s %s %s\n", event.Type, event.ConversationID, event.Err)
+			case event.Type == server.EventMessageReceived && event.Message.Attachment != nil:
+				fmt.Fprintf(out, "%s %s %s\n", event.Type, event.ConversationID, event.Message.Text)
+				cs.printDownload(out, event.Message.Attachment)
+			case event.Message != nil:
+				fmt.Fprintf(out, "%s %s %s\n", event.Type, event.ConversationID, event.Message.Text)
+			default:
+				fmt.Fprintf(out, "%s %s\n", event.Type, event.ConversationID)
+			}
+		}
+	}()
+
+	// Stored conversations are resumed once their events can be printed
+	if err := cs.rh.LoadConversations(); err != nil {
+		return fmt.Errorf("Error loading stored conversations: %s", err)
+	}
+
+	scanner := bufio.NewScanner(e.stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		command, params := fields[0], fields[1:]
+		rest := func(i int) string {
+			if len(params) <= i {
+				return ""
+			}
+			return strings.Join(params[i:], " ")
+		}
+
+		switch {
+		case command == "generate" && len(params) >= 1:
+			token, err := cs.generate(params[0], rest(1))
+			if err != nil {
+				fmt.Fprintf(out, "error %s\n", err)
+				continue
+			}
+			fmt.Fprintf(out, "token %s\n", token)
+
+		case command == "import" && len(params) >= 2:
+			if err := cs.bootstrap(params[0], params[1], rest(2)); err != nil {
+				fmt.Fprintf(out, "error %s\n", err)
+			}
+
+		case command == "send" && len(params) >= 2:
+			// Failures are printed by the event loop
+			cs.rh.Send(params[0], rest(1), false)
+
+		case command == "end" && len(params) >= 1:
+			text := rest(1)
+			if text == "" {
+				text = "Ended Conversation"
+			}
+			cs.rh.Send(params[0], text, true)
+
+		case command == "ping" && len(params) == 1:
+			if err := cs.rh.Ping(params[0]); err != nil {
+				fmt.Fprintf(out, "error %s\n", err)
+				continue
+			}
+			fmt.Fprintf(out, "pong %s\n", params[0])
+
+		case command == "read" && len(params) == 1:
+			cs.rh.MarkRead(params[0])
+
+		case command == "attach" && len(params) >= 2:
+			if err := cs.attach(params[0], rest(1)); err != nil {
+				fmt.Fprintf(out, "error %s\n", err)
+			}
+
+		case command == "retry" && len(params) == 2:
+			if err := cs.rh.RetryMessage(params[0], params[1]); err != nil {
+				fmt.Fprintf(out, "error %s\n", err)
+			}
+
+		case command == "group" && len(params) >= 2:
+			if err := cs.group(out, params[0], params[1:]); err != nil {
+				fmt.Fprintf(out, "error %s\n", err)
+			}
+
+		case command == "invitations":
+			for _, inv := range cs.rh.Invitations() {
+				expires := "never"
+				if !inv.Expires.IsZero() {
+					expires = inv.Expires.Format(time.RFC3339)
+				}
+				fmt.Fprintf(out, "invitation %s %s %q\n", inv.ConversationID, expires, inv.Alias)
+			}
+
+		case command == "revoke" && len(params) == 1:
+			if err := cs.rh.RevokeInvitation(params[0]); err != nil {
+				fmt.Fprintf(out, "error %s\n", err)
+			}
+
+		case command == "contacts":
+			if cs.rh.Contacts == nil {
+				fmt.Fprintln(out, "error The contact book requires -storage")
+				continue
+			}
+
+			contacts, err := cs.rh.Contacts.Contacts()
+			if err != nil {
+				fmt.Fprintf(out, "error %s\n", err)
+				continue
+			}
+			for _, c := range contacts {
+				fmt.Fprintf(out, "contact %q %s %s %s %s\n", c.Alias, c.KeyType, c.Fingerprint, c.Trust, c.Address)
+			}
+
+		case command == "contact" && len(params) >= 2:
+			if err := cs.contact(params[0], params[1:]); err != nil {
+				fmt.Fprintf(out, "error %s\n", err)
+			}
+
+		case command == "accept-key" && len(params) == 1:
+			if err := cs.rh.AcceptKey(params[0]); err != nil {
+				fmt.Fprintf(out, "error %s\n", err)
+			}
+
+		case command == "list":
+			for _, id := range cs.rh.ConversationIDs() {
+				c, ok := cs.rh.Conversation(id)
+				if !ok {
+					continue
+				}
+
+				state := "pending"
+				switch {
+				case c.Ended:
+					state = "ended"
+				case c.Established:
+					state = "active"
+				}
+				fmt.Fprintf(out, "conversation %s %s %q\n", id, state, c.ConversationAlias)
+			}
+
+			for _, id := range cs.rh.GroupIDs() {
+				g, ok := cs.rh.Group(id)
+				if !ok {
+					continue
+				}
+
+				state := "member"
+				switch {
+				case g.Left:
+					state = "left"
+				case g.Admin:
+					state = "admin"
+				}
+				fmt.Fprintf(out, "group %s %s %q\n", id, state, g.Name)
+			}
+
+		case command == "quit":
+			return nil
+
+		default:
+			fmt.Fprint(out, serveUsage)
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+)
+
+func (e *env) keygen(args []string) error {
+	fs := e.flagSet("keygen")
+	out := fs.String("out", "", "file the private key is written to")
+	pub := fs.String("pub", "", "file the public key is written to, stdout when empty")
+	bits := fs.Int("bits", 4096, "RSA key size")
+	name := fs.String("name", "OnionSoup", "PGP account name, also used as the label")
+	label := fs.String("label", "", "label stored with the private key")
+	passwordFile := fs.String("password-file", "", "file holding the password protecting the private key")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return fmt.Errorf("keygen requires a key type: rsa, pgp or x25519")
+	}
+
+	if *out == "" {
+		return fmt.Errorf("keygen requires -out")
+	}
+
+	password, err := readPassword(*passwordFile, "ONIONSOUP_PASSWORD")
+	if err != nil {
+		return err
+	}
+
+	var privateKey any
+	keyType := positional[0]
+	switch keyType {
+	case "rsa":
+		privateKey, _, err = crypt.RSAGenerateKeyPair(*bits)
+	case "pgp":
+		privateKey, err = crypt.PGPGenerateKeyPair(*name)
+		if *label == "" {
+			*label = *name
+		}
+	case "x25519":
+		privateKey, _, err = crypt.CurveGenerateKeyPair()
+	default:
+		return fmt.Errorf("Invalid key type: %q", keyType)
+	}
+	if err != nil {
+		return err
+	}
+
+	sealed, err := crypt.SealPrivateKey(keyType, privateKey, password, *label)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(*out, sealed, 0600); err != nil {
+		return err
+	}
+
+	publicKey, err := crypt.PublicKeyToBytes(privateKey)
+	if err != nil {
+		return err
+	}
+
+	if password == "" {
+		fmt.Fprintln(e.stderr, "Warning: the private key is stored without a password")
+	}
+
+	return e.writeOutput(*pub, publicKey, 0644)
+}
+
+func (e *env) pubkey(args []string) error {
+	fs := e.flagSet("pubkey")
+	keyFile := fs.String("key", "", "private key file")
+	passwordFile := fs.String("password-file", "", "file holding the private key password")
+	fingerprint := fs.Bool("fingerprint", false, "print the fingerprint after the public key")
+
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	_, privateKey, err := loadPrivateKey(*keyFile, *passwordFile)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := crypt.PublicKeyToBytes(privateKey)
+	if err != nil {
+		return err
+	}
+
+	if _, err := e.stdout.Write(publicKey); err != nil {
+		return err
+	}
+
+	if *fingerprint {
+		sum, err := crypt.Fingerprint(privateKey)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(e.stdout, "\n%s\n%s\n", crypt.FingerprintHexGrid(sum), strings.Join(crypt.FingerprintWords(sum), " "))
+	}
+
+	return nil
+}
+
+// Loads a private key file of any supported format and returns its type and the key.
+func loadPrivateKey(keyFile, passwordFile string) (string, any, error) {
+	if keyFile == "" {
+		return "", nil, fmt.Errorf("A private key is required, set -key")
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", nil, err
+	}
+
+	password, err := readPassword(passwordFile, "ONIONSOUP_PASSWORD")
+	if err != nil {
+		return "", nil, err
+	}
+
+	kc, privateKey, err := crypt.LoadPrivateKey(data, password)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return kc.KeyType, privateKey, nil
+}
+
+// Loads a public key file of the given key type.
+func loadPublicKey(keyType, keyFile string) (any, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return crypt.PublicKeyToMem(keyType, data)
+}
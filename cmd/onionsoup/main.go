@@ -0,0 +1,153 @@
+// Command onionsoup is a headless frontend to OnionSoup for machines without a display.
+// It generates keys, encrypts and decrypts single messages and runs conversations using
+// the same formats as the GUI.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const usage = `Usage: onionsoup <command> [flags] [arguments]
+
+Keys
+  keygen rsa|pgp|x25519 -out FILE   Generate a key pair, the public key is written to stdout
+  pubkey -key FILE                   Print the public key and fingerprint of a private key
+
+Single Messages
+  encrypt -key FILE -to FILE         Encrypt stdin for the recipient
+  decrypt -key FILE                  Decrypt and verify a message read from stdin
+
+Files
+  encrypt-file -key FILE -to FILE -in FILE     Encrypt a file of any size to FILE.onionsoup
+  decrypt-file -key FILE -in FILE.onionsoup    Decrypt and verify an encrypted file
+
+Conversations
+  token generate -key FILE -peer FILE         Print a conversation token and chat once it is imported
+  token import -key FILE -peer FILE TOKEN     Start a conversation from a token and chat
+  serve -key FILE                             Run a server controlled through stdin
+
+Passwords are read from the file given with -password-file or from the
+ONIONSOUP_PASSWORD environment variable. Run "onionsoup <command> -h" for the
+flags of a command.
+`
+
+// The streams a command reads from and writes to.
+type env struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	e := &env{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}
+	if err := e.run(os.Args[1:]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "onionsoup: %s\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func (e *env) run(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(e.stderr, usage)
+		return flag.ErrHelp
+	}
+
+	switch args[0] {
+	case "keygen":
+		return e.keygen(args[1:])
+	case "pubkey":
+		return e.pubkey(args[1:])
+	case "encrypt":
+		return e.encrypt(args[1:])
+	case "decrypt":
+		return e.decrypt(args[1:])
+	case "encrypt-file":
+		return e.encryptFile(args[1:])
+	case "decrypt-file":
+		return e.decryptFile(args[1:])
+	case "token":
+		if len(args) < 2 {
+			return fmt.Errorf("token requires generate or import")
+		}
+
+		switch args[1] {
+		case "generate":
+			return e.tokenGenerate(args[2:])
+		case "import":
+			return e.tokenImport(args[2:])
+		default:
+			return fmt.Errorf("Unknown token command: %q", args[1])
+		}
+	case "serve":
+		return e.serve(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(e.stdout, usage)
+		return nil
+	default:
+		return fmt.Errorf("Unknown command: %q", args[0])
+	}
+}
+
+func (e *env) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	return fs
+}
+
+// Parses flags that may appear before or after positional arguments and returns the
+// positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// Returns the password stored in file, or the environment variable when no file is given.
+func readPassword(file, variable string) (string, error) {
+	if file == "" {
+		return os.Getenv(variable), nil
+	}
+
+	password, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
+
+// Reads the named file, or stdin when the name is empty or "-".
+func (e *env) readInput(name string) ([]byte, error) {
+	if name == "" || name == "-" {
+		return io.ReadAll(e.stdin)
+	}
+
+	return os.ReadFile(name)
+}
+
+// Writes to the named file, or stdout when the name is empty or "-".
+func (e *env) writeOutput(name string, data []byte, perm os.FileMode) error {
+	if name == "" || name == "-" {
+		_, err := e.stdout.Write(data)
+		return err
+	}
+
+	return os.WriteFile(name, data, perm)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEnv(stdin io.Reader) (*env, *bytes.Buffer) {
+	stdout := &bytes.Buffer{}
+	return &env{stdin: stdin, stdout: stdout, stderr: io.Discard}, stdout
+}
+
+// Generates a key pair and returns the private and public key files.
+func keygen(t *testing.T, dir, name, keyType string) (string, string) {
+	t.Helper()
+
+	privateFile := filepath.Join(dir, name+".key")
+	publicFile := filepath.Join(dir, name+".pub")
+
+	e, _ := testEnv(nil)
+	if err := e.run([]string{"keygen", keyType, "-out", privateFile, "-pub", publicFile}); err != nil {
+		t.Fatalf("Error generating keys: %s", err)
+	}
+
+	return privateFile, publicFile
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("ONIONSOUP_PASSWORD", "password")
+
+	for _, keyType := range []string{"pgp", "x25519"} {
+		t.Run(keyType, func(t *testing.T) {
+			alicePrivate, alicePublic := keygen(t, dir, "alice-"+keyType, keyType)
+			bobPrivate, bobPublic := keygen(t, dir, "bob-"+keyType, keyType)
+
+			e, encrypted := testEnv(strings.NewReader("Hello Bob"))
+			if err := e.run([]string{"encrypt", "-key", alicePrivate, "-to", bobPublic}); err != nil {
+				t.Fatalf("Error encrypting message: %s", err)
+			}
+
+			e, decrypted := testEnv(bytes.NewReader(encrypted.Bytes()))
+			if err := e.run([]string{"decrypt", "-key", bobPrivate, "-from", alicePublic}); err != nil {
+				t.Fatalf("Error decrypting message: %s", err)
+			}
+
+			if decrypted.String() != "Hello Bob" {
+				t.Fatalf("Message mismatch: %q", decrypted.String())
+			}
+
+			e, _ = testEnv(bytes.NewReader(encrypted.Bytes()))
+			if err := e.run([]string{"decrypt", "-key", bobPrivate, "-from", bobPublic}); err == nil {
+				t.Fatalf("Expected error verifying with the wrong sender key")
+			}
+		})
+	}
+}
+
+func TestEncryptDecryptFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("ONIONSOUP_PASSWORD", "password")
+
+	alicePrivate, alicePublic := keygen(t, dir, "alice", "x25519")
+	bobPrivate, bobPublic := keygen(t, dir, "bob", "x25519")
+
+	report := filepath.Join(dir, "report.bin")
+	data := bytes.Repeat([]byte("Hello Bob! "), 20000)
+	if err := os.WriteFile(report, data, 0600); err != nil {
+		t.Fatalf("Error writing file: %s", err)
+	}
+
+	e, _ := testEnv(nil)
+	if err := e.run([]string{"encrypt-file", "-key", alicePrivate, "-to", bobPublic, "-in", report}); err != nil {
+		t.Fatalf("Error encrypting file: %s", err)
+	}
+
+	// The stored name is used next to the encrypted file
+	if err := os.Remove(report); err != nil {
+		t.Fatalf("Error removing file: %s", err)
+	}
+
+	e, _ = testEnv(nil)
+	if err := e.run([]string{"decrypt-file", "-key", bobPrivate, "-from", bobPublic, "-in", report + ".onionsoup"}); err == nil {
+		t.Fatalf("Expected error verifying with the wrong sender key")
+	}
+	if _, err := os.Stat(report); err == nil {
+		t.Fatalf("A file that failed verification must not be written")
+	}
+
+	e, _ = testEnv(nil)
+	if err := e.run([]string{"decrypt-file", "-key", bobPrivate, "-from", alicePublic, "-in", report + ".onionsoup"}); err != nil {
+		t.Fatalf("Error decrypting file: %s", err)
+	}
+
+	decrypted, err := os.ReadFile(report)
+	if err != nil || !bytes.Equal(decrypted, data) {
+		t.Fatalf("File mismatch: %v", err)
+	}
+
+	e, _ = testEnv(nil)
+	if err := e.run([]string{"decrypt-file", "-key", bobPrivate, "-in", report + ".onionsoup"}); err == nil {
+		t.Fatalf("Expected an existing file not to be replaced")
+	}
+}
+
+func TestTokenConversation(t *testing.T) {
+	dir := t.TempDir()
+	alicePrivate, alicePublic := keygen(t, dir, "alice", "x25519")
+	bobPrivate, bobPublic := keygen(t, dir, "bob", "x25519")
+
+	aliceIn, aliceInWriter := io.Pipe()
+	aliceOutReader, aliceOut := io.Pipe()
+	aliceDone := make(chan error, 1)
+	go func() {
+		e := &env{stdin: aliceIn, stdout: aliceOut, stderr: io.Discard}
+		aliceDone <- e.run([]string{"token", "generate", "-transport", "loopback", "-key", alicePrivate, "-peer", bobPublic})
+		aliceOut.Close()
+	}()
+
+	aliceLines := bufio.NewScanner(aliceOutReader)
+	if !aliceLines.Scan() {
+		t.Fatalf("No token was printed")
+	}
+	token := aliceLines.Text()
+
+	bobIn, bobInWriter := io.Pipe()
+	bobDone := make(chan error, 1)
+	go func() {
+		e := &env{stdin: bobIn, stdout: io.Discard, stderr: io.Discard}
+		bobDone <- e.run([]string{"token", "import", "-transport", "loopback", "-key", bobPrivate, "-peer", alicePublic, token})
+	}()
+
+	if _, err := io.WriteString(bobInWriter, "Hello Alice\n"); err != nil {
+		t.Fatalf("Error writing message: %s", err)
+	}
+
+	if !aliceLines.Scan() || aliceLines.Text() != "Hello Alice" {
+		t.Fatalf("Alice did not receive the message")
+	}
+
+	// Closing stdin ends the conversation on both sides
+	go io.Copy(io.Discard, aliceOutReader)
+	bobInWriter.Close()
+	for name, done := range map[string]chan error{"bob": bobDone, "alice": aliceDone} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Error running %s: %s", name, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s did not exit after the conversation ended", name)
+		}
+	}
+
+	aliceInWriter.Close()
+}
+
+func TestDecryptContact(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("ONIONSOUP_PASSWORD", "password")
+
+	alicePrivate, alicePublic := keygen(t, dir, "alice", "x25519")
+	bobPrivate, bobPublic := keygen(t, dir, "bob", "x25519")
+	malloryPrivate, _ := keygen(t, dir, "mallory", "x25519")
+
+	e, _ := testEnv(strings.NewReader("contact add Alice " + alicePublic + "\nquit\n"))
+	if err := e.run([]string{"serve", "-transport", "loopback", "-storage", "key", "-key", bobPrivate}); err != nil {
+		t.Fatalf("Error adding contact: %s", err)
+	}
+
+	e, encrypted := testEnv(strings.NewReader("Hello Bob"))
+	if err := e.run([]string{"encrypt", "-key", alicePrivate, "-to", bobPublic}); err != nil {
+		t.Fatalf("Error encrypting message: %s", err)
+	}
+
+	e, decrypted := testEnv(bytes.NewReader(encrypted.Bytes()))
+	if err := e.run([]string{"decrypt", "-key", bobPrivate, "-storage", "key", "-from", "Alice"}); err != nil || decrypted.String() != "Hello Bob" {
+		t.Fatalf("Error decrypting message from a contact: %v", err)
+	}
+
+	// Mallory signs with their own key, which only verifies against the packed key
+	e, encrypted = testEnv(strings.NewReader("Hello Bob, this is Alice"))
+	if err := e.run([]string{"encrypt", "-key", malloryPrivate, "-to", bobPublic}); err != nil {
+		t.Fatalf("Error encrypting message: %s", err)
+	}
+
+	e, _ = testEnv(bytes.NewReader(encrypted.Bytes()))
+	if err := e.run([]string{"decrypt", "-key", bobPrivate, "-storage", "key", "-from", "Alice"}); err == nil {
+		t.Fatalf("Expected a message from another key to be refused")
+	}
+
+	stderr := &bytes.Buffer{}
+	e = &env{stdin: bytes.NewReader(encrypted.Bytes()), stdout: io.Discard, stderr: stderr}
+	if err := e.run([]string{"decrypt", "-key", bobPrivate, "-storage", "key"}); err != nil {
+		t.Fatalf("Error decrypting message: %s", err)
+	}
+	if !strings.Contains(stderr.String(), "does not belong to any contact") {
+		t.Fatalf("Expected an unknown key warning, got %q", stderr.String())
+	}
+}
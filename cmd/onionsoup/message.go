@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/server"
+	"github.com/JustinTimperio/onionsoup/storage"
+)
+
+func (e *env) encrypt(args []string) error {
+	fs := e.flagSet("encrypt")
+	keyFile := fs.String("key", "", "sender private key file")
+	passwordFile := fs.String("password-file", "", "file holding the private key password")
+	to := fs.String("to", "", "recipient public key files, separated by commas")
+	in := fs.String("in", "", "message file, stdin when empty")
+	out := fs.String("out", "", "encrypted message file, stdout when empty")
+
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *to == "" {
+		return fmt.Errorf("encrypt requires -to")
+	}
+
+	keyType, privateKey, err := loadPrivateKey(*keyFile, *passwordFile)
+	if err != nil {
+		return err
+	}
+
+	var recipients []any
+	for _, keyFile := range strings.Split(*to, ",") {
+		recipient, err := loadPublicKey(keyType, strings.TrimSpace(keyFile))
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	message, err := e.readInput(*in)
+	if err != nil {
+		return err
+	}
+
+	packed, err := crypt.MultiEncryptAndPackMessage(privateKey, recipients, message)
+	if err != nil {
+		return err
+	}
+
+	return e.writeOutput(*out, []byte(packed+"\n"), 0644)
+}
+
+func (e *env) decrypt(args []string) error {
+	fs := e.flagSet("decrypt")
+	keyFile := fs.String("key", "", "recipient private key file")
+	passwordFile := fs.String("password-file", "", "file holding the private key password")
+	from := fs.String("from", "", "sender public key file or contact, the key packed into the message is used when empty")
+	in := fs.String("in", "", "encrypted message file, stdin when empty")
+	out := fs.String("out", "", "decrypted message file, stdout when empty")
+	// The contact book lives in the local storage of the conversation commands
+	var sf serverFlags
+	fs.StringVar(&sf.storage, "storage", "off", "resolve the sender in the contact book kept with the private key (key) or a passphrase (passphrase)")
+	fs.StringVar(&sf.storagePasswordFile, "storage-password-file", "", "file holding the storage passphrase, defaults to ONIONSOUP_STORAGE_PASSWORD")
+
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	keyType, privateKey, err := loadPrivateKey(*keyFile, *passwordFile)
+	if err != nil {
+		return err
+	}
+
+	vault, err := sf.openStorage(privateKey)
+	if err != nil {
+		return err
+	}
+
+	var sender any
+	if c, ok := lookupContact(vault, *from); ok {
+		if sender, err = crypt.PublicKeyToMem(c.KeyType, c.PublicKey); err != nil {
+			return err
+		}
+	} else if *from != "" {
+		sender, err = loadPublicKey(keyType, *from)
+		if err != nil {
+			return err
+		}
+	}
+
+	packed, err := e.readInput(*in)
+	if err != nil {
+		return err
+	}
+
+	message, err := crypt.UnpackAndDecryptMessage(privateKey, sender, strings.TrimSpace(string(packed)))
+	if err != nil && sender != nil {
+		return fmt.Errorf("The message was not signed by %s: %s", *from, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case sender == nil && vault != nil:
+		if err := e.printSender(server.NewContactBook(vault), keyType, strings.TrimSpace(string(packed))); err != nil {
+			return err
+		}
+	case sender == nil:
+		fmt.Fprintln(e.stderr, "Warning: the signature was checked against the key inside the message, use -from or -storage to confirm the sender")
+	}
+
+	return e.writeOutput(*out, message, 0600)
+}
+
+// Returns the contact named alias when the contact book is open.
+func lookupContact(vault *storage.Vault, alias string) (*server.Contact, bool) {
+	if vault == nil || alias == "" {
+		return nil, false
+	}
+
+	return server.NewContactBook(vault).Contact(alias)
+}
+
+// Resolves the key packed into a message against the contact book and prints who signed
+// it, or a warning when the key is unknown.
+func (e *env) printSender(contacts *server.ContactBook, keyType, packed string) error {
+	wrapper, err := crypt.UnpackMessage(packed)
+	if err != nil {
+		return err
+	}
+
+	fingerprint, err := server.PublicKeyFingerprint(keyType, wrapper.Pubkey)
+	if err != nil {
+		return err
+	}
+
+	contact, status, err := contacts.Resolve("", keyType, wrapper.Pubkey)
+	if err != nil {
+		return err
+	}
+
+	if warning := server.KeyWarning(contact, status, fingerprint); warning != "" {
+		fmt.Fprintf(e.stderr, "WARNING: %s\n", warning)
+	} else {
+		fmt.Fprintf(e.stderr, "Signed by %s (%s)\n", contact.Alias, contact.Trust)
+	}
+
+	return nil
+}
+
+func (e *env) encryptFile(args []string) error {
+	fs := e.flagSet("encrypt-file")
+	keyFile := fs.String("key", "", "sender private key file")
+	passwordFile := fs.String("password-file", "", "file holding the private key password")
+	to := fs.String("to", "", "recipient public key files, separated by commas")
+	in := fs.String("in", "", "file to encrypt")
+	out := fs.String("out", "", "encrypted file, the input file with "+crypt.StreamExtension+" appended when empty")
+
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *to == "" || *in == "" {
+		return fmt.Errorf("encrypt-file requires -to and -in")
+	}
+	if *out == "" {
+		*out = *in + crypt.StreamExtension
+	}
+
+	keyType, privateKey, err := loadPrivateKey(*keyFile, *passwordFile)
+	if err != nil {
+		return err
+	}
+
+	var recipients []any
+	for _, keyFile := range strings.Split(*to, ",") {
+		recipient, err := loadPublicKey(keyType, strings.TrimSpace(keyFile))
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	src, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = crypt.EncryptStream(dst, src, privateKey, recipients, filepath.Base(*in), info.Size())
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*out)
+	}
+
+	return err
+}
+
+func (e *env) decryptFile(args []string) error {
+	fs := e.flagSet("decrypt-file")
+	keyFile := fs.String("key", "", "recipient private key file")
+	passwordFile := fs.String("password-file", "", "file holding the private key password")
+	from := fs.String("from", "", "sender public key file, the key stored in the file is used when empty")
+	in := fs.String("in", "", "encrypted file")
+	out := fs.String("out", "", "decrypted file, the name stored in the encrypted file next to it when empty")
+
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *in == "" {
+		return fmt.Errorf("decrypt-file requires -in")
+	}
+
+	keyType, privateKey, err := loadPrivateKey(*keyFile, *passwordFile)
+	if err != nil {
+		return err
+	}
+
+	var sender any
+	if *from != "" {
+		if sender, err = loadPublicKey(keyType, *from); err != nil {
+			return err
+		}
+	}
+
+	src, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	r := bufio.NewReader(src)
+	header, err := crypt.ReadStreamHeader(r)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		// Only the base name is trusted, the sender picks the stored name
+		name := filepath.Base(header.Name)
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			name = strings.TrimSuffix(filepath.Base(*in), crypt.StreamExtension)
+		}
+		*out = filepath.Join(filepath.Dir(*in), name)
+	}
+
+	// An existing file is never replaced
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("%s already exists", *out)
+	}
+
+	if err := crypt.DecryptStreamToFile(*out, r, header, privateKey, sender); err != nil {
+		return err
+	}
+
+	if sender == nil {
+		fmt.Fprintln(e.stderr, "Warning: the signature was checked against the key inside the file, use -from to confirm the sender")
+	}
+	fmt.Fprintf(e.stderr, "Decrypted %s\n", *out)
+
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"fmt"
 
 	"golang.org/x/crypto/scrypt"
 )
@@ -14,6 +15,32 @@ func AESEncrypt(password []byte, data []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	sealed, err := AESSeal(key, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(sealed, salt...), nil
+}
+
+func AESDecrypt(password, data []byte) ([]byte, error) {
+	if len(data) < 32 {
+		return nil, fmt.Errorf("Ciphertext is too short")
+	}
+
+	salt, data := data[len(data)-32:], data[:len(data)-32]
+
+	key, _, err := deriveKey(password, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return AESOpen(key, data, nil)
+}
+
+// Encrypts the data with AES-GCM under the given key and prepends the random nonce.
+// The additional data is authenticated but not encrypted and may be nil.
+func AESSeal(key []byte, data []byte, additionalData []byte) ([]byte, error) {
 	blockCipher, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -29,17 +56,11 @@ func AESEncrypt(password []byte, data []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	return append(gcm.Seal(nonce, nonce, data, nil), salt...), nil
+	return gcm.Seal(nonce, nonce, data, additionalData), nil
 }
 
-func AESDecrypt(password, data []byte) ([]byte, error) {
-	salt, data := data[len(data)-32:], data[:len(data)-32]
-
-	key, _, err := deriveKey(password, salt)
-	if err != nil {
-		return nil, err
-	}
-
+// Decrypts data produced by AESSeal under the given key.
+func AESOpen(key []byte, data []byte, additionalData []byte) ([]byte, error) {
 	blockCipher, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -50,9 +71,13 @@ func AESDecrypt(password, data []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("Ciphertext is too short")
+	}
+
 	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
 
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,114 @@
+package crypt_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+)
+
+func TestKeyContainer(t *testing.T) {
+	privateKey, _, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	sealed, err := crypt.SealPrivateKey("x25519", privateKey, "password", "Alice\nLaptop")
+	if err != nil {
+		t.Fatalf("Error sealing key: %s", err)
+	}
+
+	kc, loaded, err := crypt.LoadPrivateKey(sealed, "password")
+	if err != nil {
+		t.Fatalf("Error loading key: %s", err)
+	}
+
+	if kc.Version != crypt.ContainerVersion || kc.KeyType != "x25519" || kc.KDF != crypt.KDFArgon2id {
+		t.Fatalf("Unexpected container description: %+v", kc)
+	}
+
+	if kc.Label != "Alice Laptop" || kc.Created.IsZero() {
+		t.Fatalf("Unexpected container metadata: %+v", kc)
+	}
+
+	if !loaded.(*crypt.CurvePrivateKey).SigningKey.Equal(privateKey.SigningKey) {
+		t.Fatalf("Private key mismatch")
+	}
+
+	if _, _, err := crypt.LoadPrivateKey(sealed, "wrong"); err == nil {
+		t.Fatalf("Expected error with the wrong password")
+	}
+
+	// The metadata is authenticated along with the key
+	tampered := bytes.Replace(sealed, []byte("Alice Laptop"), []byte("Mallory"), 1)
+	if _, _, err := crypt.LoadPrivateKey(tampered, "password"); err == nil {
+		t.Fatalf("Expected error with tampered metadata")
+	}
+
+	// Costs beyond the limits are refused before the key is derived
+	expensive := bytes.Replace(sealed, []byte("m=65536"), []byte("m=4294967295"), 1)
+	if bytes.Equal(expensive, sealed) {
+		t.Fatalf("Container does not carry the expected KDF parameters")
+	}
+	if _, _, err := crypt.LoadPrivateKey(expensive, "password"); err == nil {
+		t.Fatalf("Expected error with excessive KDF parameters")
+	}
+
+	unencrypted, err := crypt.SealPrivateKey("x25519", privateKey, "", "")
+	if err != nil {
+		t.Fatalf("Error sealing key: %s", err)
+	}
+
+	kc, _, err = crypt.LoadPrivateKey(unencrypted, "")
+	if err != nil {
+		t.Fatalf("Error loading key: %s", err)
+	}
+
+	if kc.KDF != crypt.KDFNone {
+		t.Fatalf("Expected unencrypted container, got %s", kc.KDF)
+	}
+}
+
+func TestKeyContainerLegacy(t *testing.T) {
+	curveKey, _, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	legacyCurve, err := crypt.CurvePrivateKeyToBytes(curveKey, "password")
+	if err != nil {
+		t.Fatalf("Error encoding key: %s", err)
+	}
+
+	kc, _, err := crypt.LoadPrivateKey(legacyCurve, "password")
+	if err != nil {
+		t.Fatalf("Error loading legacy key: %s", err)
+	}
+
+	if kc.Version != 0 || kc.KeyType != "x25519" || kc.KDF != crypt.KDFScrypt {
+		t.Fatalf("Unexpected container description: %+v", kc)
+	}
+
+	if _, _, err := crypt.LoadPrivateKey(legacyCurve[:16], "password"); err == nil {
+		t.Fatalf("Expected error with a truncated key file")
+	}
+
+	pgpKey, err := crypt.PGPGenerateKeyPair("Alice")
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	legacyPGP, err := crypt.PGPPrivateKeyToBytes(pgpKey, "password")
+	if err != nil {
+		t.Fatalf("Error encoding key: %s", err)
+	}
+
+	kc, _, err = crypt.LoadPrivateKey(legacyPGP, "password")
+	if err != nil {
+		t.Fatalf("Error loading legacy key: %s", err)
+	}
+
+	if kc.KeyType != "pgp" {
+		t.Fatalf("Expected pgp key, got %s", kc.KeyType)
+	}
+}
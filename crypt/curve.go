@@ -0,0 +1,315 @@
+package crypt
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// A Curve25519 identity pairs an X25519 key used for key agreement with an
+// Ed25519 key used for signatures.
+type CurvePrivateKey struct {
+	SigningKey  ed25519.PrivateKey
+	ExchangeKey *ecdh.PrivateKey
+}
+
+type CurvePublicKey struct {
+	SigningKey  ed25519.PublicKey
+	ExchangeKey *ecdh.PublicKey
+}
+
+// Returns the public half of the key pair.
+func (k *CurvePrivateKey) Public() *CurvePublicKey {
+	return &CurvePublicKey{
+		SigningKey:  k.SigningKey.Public().(ed25519.PublicKey),
+		ExchangeKey: k.ExchangeKey.PublicKey(),
+	}
+}
+
+// Encrypts the message to the recipient's X25519 key using an ephemeral key agreement and
+// AES-GCM, then signs the encrypted message using the sender's Ed25519 key.
+// Returns the encrypted message and signature on success and an error otherwise.
+func CurveEncryptAndSignMessage(senderPrivateKey *CurvePrivateKey, recipientPublicKey *CurvePublicKey, message []byte) ([]byte, []byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := curveMessageKey(ephemeral, recipientPublicKey.ExchangeKey, ephemeral.PublicKey())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sealed, err := AESSeal(key, message, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error encrypting message: %v", err)
+	}
+
+	encryptedMessage := append(ephemeral.PublicKey().Bytes(), sealed...)
+	signature := ed25519.Sign(senderPrivateKey.SigningKey, encryptedMessage)
+
+	return encryptedMessage, signature, nil
+}
+
+// Verifies and decrypts a message produced by CurveEncryptAndSignMessage using the
+// recipient's private key and sender's public key.
+// Returns the decrypted message on success and an error otherwise.
+func CurveDecryptAndVerifyMessage(receiverPrivateKey *CurvePrivateKey, senderPublicKey *CurvePublicKey, message []byte, signature []byte) ([]byte, error) {
+	// Safety check that the message and signature are not empty
+	if message == nil || signature == nil {
+		return nil, fmt.Errorf("Message and Signature cannot be empty")
+	}
+
+	if !ed25519.Verify(senderPublicKey.SigningKey, message, signature) {
+		return nil, fmt.Errorf("Error verifying message signature")
+	}
+
+	if len(message) < 32 {
+		return nil, fmt.Errorf("Message is too short")
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(message[:32])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := curveMessageKey(receiverPrivateKey.ExchangeKey, ephemeral, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	decryptedMessage, err := AESOpen(key, message[32:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting message: %v", err)
+	}
+
+	return decryptedMessage, nil
+}
+
+// Encrypts the message under a random AES-GCM session key and wraps the session key to
+// every recipient's X25519 key using an ephemeral key agreement each, then signs the
+// encrypted message using the sender's Ed25519 key.
+// Returns the encrypted message and signature on success and an error otherwise.
+func CurveMultiEncryptAndSignMessage(senderPrivateKey *CurvePrivateKey, recipientPublicKeys []*CurvePublicKey, message []byte) ([]byte, []byte, error) {
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, nil, err
+	}
+
+	wrappedKeys := make([][]byte, 0, len(recipientPublicKeys))
+	for _, recipientPublicKey := range recipientPublicKeys {
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key, err := curveMessageKey(ephemeral, recipientPublicKey.ExchangeKey, ephemeral.PublicKey())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		wrappedKey, err := AESSeal(key, sessionKey, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error wrapping session key: %v", err)
+		}
+		wrappedKeys = append(wrappedKeys, append(ephemeral.PublicKey().Bytes(), wrappedKey...))
+	}
+
+	sealed, err := AESSeal(sessionKey, message, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error encrypting message: %v", err)
+	}
+
+	encryptedMessage, err := packSessionKeys(wrappedKeys, sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	signature := ed25519.Sign(senderPrivateKey.SigningKey, encryptedMessage)
+
+	return encryptedMessage, signature, nil
+}
+
+// Verifies and decrypts a message produced by CurveMultiEncryptAndSignMessage using the
+// recipient's private key and sender's public key.
+// Returns the decrypted message on success and an error otherwise.
+func CurveMultiDecryptAndVerifyMessage(receiverPrivateKey *CurvePrivateKey, senderPublicKey *CurvePublicKey, message []byte, signature []byte) ([]byte, error) {
+	// Safety check that the message and signature are not empty
+	if message == nil || signature == nil {
+		return nil, fmt.Errorf("Message and Signature cannot be empty")
+	}
+
+	if !ed25519.Verify(senderPublicKey.SigningKey, message, signature) {
+		return nil, fmt.Errorf("Error verifying message signature")
+	}
+
+	wrappedKeys, sealed, err := unpackSessionKeys(message)
+	if err != nil {
+		return nil, err
+	}
+
+	// The recipients are not named, so every wrapped key is tried
+	var sessionKey []byte
+	for _, wrappedKey := range wrappedKeys {
+		if len(wrappedKey) < 32 {
+			continue
+		}
+
+		ephemeral, err := ecdh.X25519().NewPublicKey(wrappedKey[:32])
+		if err != nil {
+			continue
+		}
+
+		key, err := curveMessageKey(receiverPrivateKey.ExchangeKey, ephemeral, ephemeral)
+		if err != nil {
+			continue
+		}
+
+		if sessionKey, err = AESOpen(key, wrappedKey[32:], nil); err == nil {
+			break
+		}
+	}
+	if sessionKey == nil {
+		return nil, fmt.Errorf("Error unwrapping session key: the message was not encrypted to this key")
+	}
+
+	decryptedMessage, err := AESOpen(sessionKey, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting message: %v", err)
+	}
+
+	return decryptedMessage, nil
+}
+
+// Signs the message using the sender's Ed25519 key without encrypting it.
+func CurveSignMessage(senderPrivateKey *CurvePrivateKey, message []byte) []byte {
+	return ed25519.Sign(senderPrivateKey.SigningKey, message)
+}
+
+// Verifies a signature produced by CurveSignMessage using the sender's public key.
+func CurveVerifyMessage(senderPublicKey *CurvePublicKey, message []byte, signature []byte) error {
+	if !ed25519.Verify(senderPublicKey.SigningKey, message, signature) {
+		return fmt.Errorf("Error verifying message signature")
+	}
+
+	return nil
+}
+
+// Derives the AES key for a single message from an X25519 agreement, the ephemeral
+// public key is mixed in so every message gets a distinct key.
+func curveMessageKey(private *ecdh.PrivateKey, public *ecdh.PublicKey, ephemeral *ecdh.PublicKey) ([]byte, error) {
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, shared, ephemeral.Bytes(), []byte("OnionSoup X25519 Message"))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Generates a new Curve25519 Key Pair and returns them as pointers.
+func CurveGenerateKeyPair() (*CurvePrivateKey, *CurvePublicKey, error) {
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exchangeKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKey := &CurvePrivateKey{SigningKey: signingKey, ExchangeKey: exchangeKey}
+	return privateKey, privateKey.Public(), nil
+}
+
+// Converts a Private Key to a PEM encoded byte array.
+// The block holds the Ed25519 seed followed by the X25519 scalar.
+func CurvePrivateKeyToBytes(privateKey *CurvePrivateKey, password string) ([]byte, error) {
+	privateKeyBytes := append(privateKey.SigningKey.Seed(), privateKey.ExchangeKey.Bytes()...)
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CURVE25519 PRIVATE KEY",
+		Bytes: privateKeyBytes,
+	})
+
+	// Encrypt the Private Key using a password if one is provided
+	if len(password) > 0 {
+		var err error
+		privateKeyPEM, err = AESEncrypt([]byte(password), privateKeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to encrypt private key: %v", err)
+		}
+	}
+
+	return privateKeyPEM, nil
+}
+
+// Converts a PEM encoded byte array to a Private Key Pointer.
+func CurvePrivateKeyToMem(privateKeyBytes []byte, password string) (*CurvePrivateKey, error) {
+
+	// Decrypt the Private Key using a password if one is provided
+	if len(password) > 0 {
+		var err error
+		privateKeyBytes, err = AESDecrypt([]byte(password), privateKeyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt private key: %v", err)
+		}
+	}
+
+	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil || block.Type != "CURVE25519 PRIVATE KEY" || len(block.Bytes) != 64 {
+		return nil, fmt.Errorf("Failed to decode PEM block containing private key")
+	}
+
+	exchangeKey, err := ecdh.X25519().NewPrivateKey(block.Bytes[32:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &CurvePrivateKey{
+		SigningKey:  ed25519.NewKeyFromSeed(block.Bytes[:32]),
+		ExchangeKey: exchangeKey,
+	}, nil
+}
+
+// Converts a Public Key to a PEM encoded byte array.
+// The block holds the Ed25519 public key followed by the X25519 public key.
+func CurvePublicKeyToBytes(publicKey *CurvePublicKey) ([]byte, error) {
+	publicKeyBytes := append([]byte{}, publicKey.SigningKey...)
+	publicKeyBytes = append(publicKeyBytes, publicKey.ExchangeKey.Bytes()...)
+
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CURVE25519 PUBLIC KEY",
+		Bytes: publicKeyBytes,
+	})
+
+	return publicKeyPEM, nil
+}
+
+// Converts a PEM encoded byte array to a Public Key Pointer.
+func CurvePublicKeyToMem(publicKeyPEM []byte) (*CurvePublicKey, error) {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil || block.Type != "CURVE25519 PUBLIC KEY" || len(block.Bytes) != 64 {
+		return nil, fmt.Errorf("Failed to decode PEM block containing public key")
+	}
+
+	exchangeKey, err := ecdh.X25519().NewPublicKey(block.Bytes[32:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &CurvePublicKey{
+		SigningKey:  ed25519.PublicKey(append([]byte{}, block.Bytes[:32]...)),
+		ExchangeKey: exchangeKey,
+	}, nil
+}
@@ -0,0 +1,76 @@
+package crypt_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+)
+
+func TestCurve(t *testing.T) {
+	alicePrivate, alicePublic, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	bobPrivate, bobPublic, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	message := []byte(strings.Repeat("Hello World! ", 1024))
+
+	emsg, sig, err := crypt.CurveEncryptAndSignMessage(alicePrivate, bobPublic, message)
+	if err != nil {
+		t.Fatalf("Error encrypting message: %s", err)
+	}
+
+	msg, err := crypt.CurveDecryptAndVerifyMessage(bobPrivate, alicePublic, emsg, sig)
+	if err != nil {
+		t.Fatalf("Error decrypting message: %s", err)
+	}
+
+	if string(msg) != string(message) {
+		t.Fatalf("Message mismatch")
+	}
+
+	_, err = crypt.CurveDecryptAndVerifyMessage(bobPrivate, bobPublic, emsg, sig)
+	if err == nil {
+		t.Fatalf("Expected error verifying with the wrong key")
+	}
+}
+
+func TestCurveKeyFiles(t *testing.T) {
+	privateKey, publicKey, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	privateBytes, err := crypt.CurvePrivateKeyToBytes(privateKey, "password")
+	if err != nil {
+		t.Fatalf("Error encoding private key: %s", err)
+	}
+
+	loadedPrivate, err := crypt.CurvePrivateKeyToMem(privateBytes, "password")
+	if err != nil {
+		t.Fatalf("Error decoding private key: %s", err)
+	}
+
+	publicBytes, err := crypt.CurvePublicKeyToBytes(publicKey)
+	if err != nil {
+		t.Fatalf("Error encoding public key: %s", err)
+	}
+
+	loadedPublic, err := crypt.CurvePublicKeyToMem(publicBytes)
+	if err != nil {
+		t.Fatalf("Error decoding public key: %s", err)
+	}
+
+	if !loadedPrivate.SigningKey.Equal(privateKey.SigningKey) || !loadedPrivate.ExchangeKey.Equal(privateKey.ExchangeKey) {
+		t.Fatalf("Private key mismatch")
+	}
+
+	if !loadedPublic.SigningKey.Equal(publicKey.SigningKey) || !loadedPublic.ExchangeKey.Equal(publicKey.ExchangeKey) {
+		t.Fatalf("Public key mismatch")
+	}
+}
@@ -0,0 +1,89 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+)
+
+// Number of leading bytes read out by FingerprintWords.
+const fingerprintWordCount = 12
+
+// Returns the SHA-256 fingerprint of a key. Private keys are fingerprinted by their
+// public half so both parties compute the same value.
+func Fingerprint(key any) ([]byte, error) {
+	var material []byte
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return Fingerprint(&k.PublicKey)
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return nil, err
+		}
+		material = append([]byte("rsa"), der...)
+	case *crypto.Key:
+		// The primary key fingerprint is stable across changes to the user ids and subkeys
+		material = append([]byte("pgp"), k.GetFingerprintBytes()...)
+	case *CurvePrivateKey:
+		return Fingerprint(k.Public())
+	case *CurvePublicKey:
+		material = append([]byte("x25519"), k.SigningKey...)
+		material = append(material, k.ExchangeKey.Bytes()...)
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %T", key)
+	}
+
+	sum := sha256.Sum256(material)
+	return sum[:], nil
+}
+
+// Combines the fingerprints of both parties into a safety number. The result does not
+// depend on the order of the arguments so both sides of a conversation see the same value.
+func SafetyNumber(fingerprintA, fingerprintB []byte) []byte {
+	if bytes.Compare(fingerprintA, fingerprintB) > 0 {
+		fingerprintA, fingerprintB = fingerprintB, fingerprintA
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte("OnionSoup Safety Number"))
+	hash.Write(fingerprintA)
+	hash.Write(fingerprintB)
+	return hash.Sum(nil)
+}
+
+// Renders a fingerprint as rows of four character hex groups.
+func FingerprintHexGrid(fingerprint []byte) string {
+	encoded := strings.ToUpper(hex.EncodeToString(fingerprint))
+
+	var grid strings.Builder
+	for i := 0; i < len(encoded); i += 4 {
+		if i > 0 {
+			if i%16 == 0 {
+				grid.WriteString("\n")
+			} else {
+				grid.WriteString(" ")
+			}
+		}
+		grid.WriteString(encoded[i:min(i+4, len(encoded))])
+	}
+
+	return grid.String()
+}
+
+// Renders the leading bytes of a fingerprint as words that are easy to compare aloud.
+func FingerprintWords(fingerprint []byte) []string {
+	words := make([]string, 0, fingerprintWordCount)
+	for _, b := range fingerprint[:min(fingerprintWordCount, len(fingerprint))] {
+		words = append(words, fingerprintWords[b])
+	}
+
+	return words
+}
@@ -0,0 +1,74 @@
+package crypt_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+)
+
+func TestFingerprint(t *testing.T) {
+	alicePrivate, alicePublic, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	bob, err := crypt.PGPGenerateKeyPair("Bob")
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	bobPublicBytes, err := crypt.PGPPublicKeyToBytes(bob)
+	if err != nil {
+		t.Fatalf("Error encoding public key: %s", err)
+	}
+
+	bobPublic, err := crypt.PGPPublicKeyToMem(bobPublicBytes)
+	if err != nil {
+		t.Fatalf("Error decoding public key: %s", err)
+	}
+
+	alicePrivateFingerprint, err := crypt.Fingerprint(alicePrivate)
+	if err != nil {
+		t.Fatalf("Error fingerprinting key: %s", err)
+	}
+
+	alicePublicFingerprint, err := crypt.Fingerprint(alicePublic)
+	if err != nil {
+		t.Fatalf("Error fingerprinting key: %s", err)
+	}
+
+	if !bytes.Equal(alicePrivateFingerprint, alicePublicFingerprint) {
+		t.Fatalf("Private and public fingerprints differ")
+	}
+
+	bobPrivateFingerprint, err := crypt.Fingerprint(bob)
+	if err != nil {
+		t.Fatalf("Error fingerprinting key: %s", err)
+	}
+
+	bobPublicFingerprint, err := crypt.Fingerprint(bobPublic)
+	if err != nil {
+		t.Fatalf("Error fingerprinting key: %s", err)
+	}
+
+	if !bytes.Equal(bobPrivateFingerprint, bobPublicFingerprint) {
+		t.Fatalf("Private and public fingerprints differ")
+	}
+
+	aliceView := crypt.SafetyNumber(alicePrivateFingerprint, bobPublicFingerprint)
+	bobView := crypt.SafetyNumber(bobPrivateFingerprint, alicePublicFingerprint)
+	if !bytes.Equal(aliceView, bobView) {
+		t.Fatalf("Safety numbers differ between parties")
+	}
+
+	grid := crypt.FingerprintHexGrid(aliceView)
+	if rows := strings.Split(grid, "\n"); len(rows) != 4 || len(rows[0]) != 19 {
+		t.Fatalf("Unexpected hex grid layout:\n%s", grid)
+	}
+
+	if words := crypt.FingerprintWords(aliceView); len(words) != 12 {
+		t.Fatalf("Expected 12 words, got %d", len(words))
+	}
+}
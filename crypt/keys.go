@@ -0,0 +1,250 @@
+package crypt
+
+import (
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+)
+
+// Returns the key type name used throughout OnionSoup for a private or public key.
+func KeyType(key any) (string, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return "rsa", nil
+	case *crypto.Key:
+		return "pgp", nil
+	case *CurvePrivateKey, *CurvePublicKey:
+		return "x25519", nil
+	default:
+		return "", fmt.Errorf("Unsupported key type: %T", key)
+	}
+}
+
+// Encodes a public key, or the public half of a private key, in the format shared with
+// contacts.
+func PublicKeyToBytes(key any) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return RSAPublicKeyToBytes(&k.PublicKey)
+	case *rsa.PublicKey:
+		return RSAPublicKeyToBytes(k)
+	case *crypto.Key:
+		return PGPPublicKeyToBytes(k)
+	case *CurvePrivateKey:
+		return CurvePublicKeyToBytes(k.Public())
+	case *CurvePublicKey:
+		return CurvePublicKeyToBytes(k)
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %T", key)
+	}
+}
+
+// Decodes a public key of the given key type.
+func PublicKeyToMem(keyType string, publicKey []byte) (any, error) {
+	switch keyType {
+	case "rsa":
+		return RSAPublicKeyToMem(publicKey)
+	case "pgp":
+		return PGPPublicKeyToMem(publicKey)
+	case "x25519":
+		return CurvePublicKeyToMem(publicKey)
+	default:
+		return nil, fmt.Errorf("Invalid key type")
+	}
+}
+
+// Encrypts the message to the recipient and signs it with the private key using the
+// current message version. PGP signatures are embedded in the message and the returned
+// signature is nil.
+func EncryptAndSignMessage(privateKey, recipientPublicKey any, message []byte) ([]byte, []byte, error) {
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		publicKey, ok := recipientPublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, nil, keyMismatch(privateKey, recipientPublicKey)
+		}
+		return RSAHybridEncryptAndSignMessage(k, publicKey, message)
+	case *crypto.Key:
+		publicKey, ok := recipientPublicKey.(*crypto.Key)
+		if !ok {
+			return nil, nil, keyMismatch(privateKey, recipientPublicKey)
+		}
+		emsg, err := PGPEncryptAndSignMessage(k, publicKey, message)
+		return emsg, nil, err
+	case *CurvePrivateKey:
+		publicKey, ok := recipientPublicKey.(*CurvePublicKey)
+		if !ok {
+			return nil, nil, keyMismatch(privateKey, recipientPublicKey)
+		}
+		return CurveEncryptAndSignMessage(k, publicKey, message)
+	default:
+		return nil, nil, fmt.Errorf("Unsupported key type: %T", privateKey)
+	}
+}
+
+// Encrypts the message to every recipient and signs it with the private key using the
+// multi recipient message version. PGP signatures are embedded in the message and the
+// returned signature is nil.
+func MultiEncryptAndSignMessage(privateKey any, recipientPublicKeys []any, message []byte) ([]byte, []byte, error) {
+	if len(recipientPublicKeys) == 0 {
+		return nil, nil, fmt.Errorf("No recipients")
+	}
+
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		publicKeys := make([]*rsa.PublicKey, len(recipientPublicKeys))
+		for i, recipient := range recipientPublicKeys {
+			publicKey, ok := recipient.(*rsa.PublicKey)
+			if !ok {
+				return nil, nil, keyMismatch(privateKey, recipient)
+			}
+			publicKeys[i] = publicKey
+		}
+		return RSAMultiEncryptAndSignMessage(k, publicKeys, message)
+	case *crypto.Key:
+		publicKeys := make([]*crypto.Key, len(recipientPublicKeys))
+		for i, recipient := range recipientPublicKeys {
+			publicKey, ok := recipient.(*crypto.Key)
+			if !ok {
+				return nil, nil, keyMismatch(privateKey, recipient)
+			}
+			publicKeys[i] = publicKey
+		}
+		emsg, err := PGPMultiEncryptAndSignMessage(k, publicKeys, message)
+		return emsg, nil, err
+	case *CurvePrivateKey:
+		publicKeys := make([]*CurvePublicKey, len(recipientPublicKeys))
+		for i, recipient := range recipientPublicKeys {
+			publicKey, ok := recipient.(*CurvePublicKey)
+			if !ok {
+				return nil, nil, keyMismatch(privateKey, recipient)
+			}
+			publicKeys[i] = publicKey
+		}
+		return CurveMultiEncryptAndSignMessage(k, publicKeys, message)
+	default:
+		return nil, nil, fmt.Errorf("Unsupported key type: %T", privateKey)
+	}
+}
+
+// Decrypts and verifies a message produced by EncryptAndSignMessage, or by an older
+// release when version says so.
+func DecryptAndVerifyMessage(version int, privateKey, senderPublicKey any, message, signature []byte) ([]byte, error) {
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		publicKey, ok := senderPublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, keyMismatch(privateKey, senderPublicKey)
+		}
+
+		switch version {
+		case MessageVersionLegacy:
+			return RSADecryptAndVerifyMessage(k, publicKey, message, signature)
+		case MessageVersionHybrid:
+			return RSAHybridDecryptAndVerifyMessage(k, publicKey, message, signature)
+		case MessageVersionMultiRecipient:
+			return RSAMultiDecryptAndVerifyMessage(k, publicKey, message, signature)
+		default:
+			return nil, fmt.Errorf("Unsupported message version: %d", version)
+		}
+	case *crypto.Key:
+		publicKey, ok := senderPublicKey.(*crypto.Key)
+		if !ok {
+			return nil, keyMismatch(privateKey, senderPublicKey)
+		}
+		return PGPDecryptAndVerifyMessage(k, publicKey, message)
+	case *CurvePrivateKey:
+		publicKey, ok := senderPublicKey.(*CurvePublicKey)
+		if !ok {
+			return nil, keyMismatch(privateKey, senderPublicKey)
+		}
+
+		if version == MessageVersionMultiRecipient {
+			return CurveMultiDecryptAndVerifyMessage(k, publicKey, message, signature)
+		}
+		return CurveDecryptAndVerifyMessage(k, publicKey, message, signature)
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %T", privateKey)
+	}
+}
+
+// Signs the message with the private key without encrypting it.
+func SignMessage(privateKey any, message []byte) ([]byte, error) {
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return RSASignMessage(k, message)
+	case *crypto.Key:
+		return PGPSignMessage(k, message)
+	case *CurvePrivateKey:
+		return CurveSignMessage(k, message), nil
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %T", privateKey)
+	}
+}
+
+// Verifies a signature produced by SignMessage with the sender's public key.
+func VerifyMessage(senderPublicKey any, message, signature []byte) error {
+	switch k := senderPublicKey.(type) {
+	case *rsa.PublicKey:
+		return RSAVerifyMessage(k, message, signature)
+	case *crypto.Key:
+		return PGPVerifyMessage(k, message, signature)
+	case *CurvePublicKey:
+		return CurveVerifyMessage(k, message, signature)
+	default:
+		return fmt.Errorf("Unsupported key type: %T", senderPublicKey)
+	}
+}
+
+func keyMismatch(privateKey, publicKey any) error {
+	return fmt.Errorf("Key types do not match: %T and %T", privateKey, publicKey)
+}
+
+// Lays out the session key wrapped for every recipient ahead of the sealed message. The
+// count and every wrapped key are length prefixed so the layout does not depend on the
+// key sizes.
+func packSessionKeys(wrappedKeys [][]byte, sealed []byte) ([]byte, error) {
+	if len(wrappedKeys) > 0xffff {
+		return nil, fmt.Errorf("Too many recipients")
+	}
+
+	message := binary.BigEndian.AppendUint16(nil, uint16(len(wrappedKeys)))
+	for _, wrappedKey := range wrappedKeys {
+		if len(wrappedKey) > 0xffff {
+			return nil, fmt.Errorf("Wrapped session key is too long")
+		}
+		message = binary.BigEndian.AppendUint16(message, uint16(len(wrappedKey)))
+		message = append(message, wrappedKey...)
+	}
+
+	return append(message, sealed...), nil
+}
+
+// Splits a message laid out by packSessionKeys.
+func unpackSessionKeys(message []byte) ([][]byte, []byte, error) {
+	if len(message) < 2 {
+		return nil, nil, fmt.Errorf("Message is too short")
+	}
+
+	count := int(binary.BigEndian.Uint16(message))
+	message = message[2:]
+
+	wrappedKeys := make([][]byte, 0, count)
+	for range count {
+		if len(message) < 2 {
+			return nil, nil, fmt.Errorf("Message is too short")
+		}
+
+		keyLength := int(binary.BigEndian.Uint16(message))
+		if len(message) < 2+keyLength {
+			return nil, nil, fmt.Errorf("Message is too short")
+		}
+
+		wrappedKeys = append(wrappedKeys, message[2:2+keyLength])
+		message = message[2+keyLength:]
+	}
+
+	return wrappedKeys, message, nil
+}
@@ -0,0 +1,61 @@
+package crypt_test
+
+import (
+	"testing"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+)
+
+func TestMultiRecipient(t *testing.T) {
+	generate := map[string]func() (any, any, error){
+		"rsa": func() (any, any, error) {
+			return crypt.RSAGenerateKeyPair(4096)
+		},
+		"pgp": func() (any, any, error) {
+			key, err := crypt.PGPGenerateKeyPair("")
+			return key, key, err
+		},
+		"x25519": func() (any, any, error) {
+			return crypt.CurveGenerateKeyPair()
+		},
+	}
+
+	for keyType, newKey := range generate {
+		t.Run(keyType, func(t *testing.T) {
+			var privateKeys, publicKeys []any
+			for range 4 {
+				privateKey, publicKey, err := newKey()
+				if err != nil {
+					t.Fatalf("Error generating key pair: %s", err)
+				}
+				privateKeys = append(privateKeys, privateKey)
+				publicKeys = append(publicKeys, publicKey)
+			}
+
+			// The first key sends to the next two, the last one is left out
+			packed, err := crypt.MultiEncryptAndPackMessage(privateKeys[0], publicKeys[1:3], []byte("Hello Team!"))
+			if err != nil {
+				t.Fatalf("Error encrypting message: %s", err)
+			}
+
+			for _, recipient := range privateKeys[1:3] {
+				msg, err := crypt.UnpackAndDecryptMessage(recipient, publicKeys[0], packed)
+				if err != nil {
+					t.Fatalf("Error decrypting message: %s", err)
+				}
+
+				if string(msg) != "Hello Team!" {
+					t.Fatalf("Message mismatch")
+				}
+			}
+
+			if _, err := crypt.UnpackAndDecryptMessage(privateKeys[3], publicKeys[0], packed); err == nil {
+				t.Fatalf("Expected error decrypting without being a recipient")
+			}
+
+			if _, err := crypt.UnpackAndDecryptMessage(privateKeys[1], publicKeys[3], packed); err == nil {
+				t.Fatalf("Expected error verifying with the wrong key")
+			}
+		})
+	}
+}
@@ -6,7 +6,24 @@ import (
 )
 
 func PGPEncryptAndSignMessage(privateKey *crypto.Key, publicKey *crypto.Key, message []byte) ([]byte, error) {
-	enc, err := crypto.PGP().Encryption().Recipient(publicKey).SigningKey(privateKey).New()
+	return PGPMultiEncryptAndSignMessage(privateKey, []*crypto.Key{publicKey}, message)
+}
+
+// Encrypts the message to every public key in one OpenPGP message, each recipient
+// decrypts it with PGPDecryptAndVerifyMessage.
+func PGPMultiEncryptAndSignMessage(privateKey *crypto.Key, publicKeys []*crypto.Key, message []byte) ([]byte, error) {
+	recipients, err := crypto.NewKeyRing(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, publicKey := range publicKeys {
+		if err := recipients.AddKey(publicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	enc, err := crypto.PGP().Encryption().Recipients(recipients).SigningKey(privateKey).New()
 	if err != nil {
 		return nil, err
 	}
@@ -35,9 +52,37 @@ func PGPDecryptAndVerifyMessage(privateKey *crypto.Key, publicKey *crypto.Key, m
 		return nil, err
 	}
 
+	// Decrypt succeeds for unsigned or wrongly signed messages, the result has to be checked
+	if err := decryptedMessage.SignatureError(); err != nil {
+		return nil, err
+	}
+
 	return decryptedMessage.Bytes(), nil
 }
 
+func PGPSignMessage(privateKey *crypto.Key, message []byte) ([]byte, error) {
+	signer, err := crypto.PGP().Sign().SigningKey(privateKey).Detached().New()
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.Sign(message, crypto.Bytes)
+}
+
+func PGPVerifyMessage(publicKey *crypto.Key, message []byte, signature []byte) error {
+	verifier, err := crypto.PGP().Verify().VerificationKey(publicKey).New()
+	if err != nil {
+		return err
+	}
+
+	result, err := verifier.VerifyDetached(message, signature, crypto.Bytes)
+	if err != nil {
+		return err
+	}
+
+	return result.SignatureError()
+}
+
 func PGPGenerateKeyPair(accountName string) (*crypto.Key, error) {
 	if accountName == "" {
 		accountName = "anon"
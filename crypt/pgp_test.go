@@ -40,5 +40,11 @@ func TestPGP(t *testing.T) {
 	}
 	t.Logf("%s", decryptedMessage)
 
+	_, err = crypt.PGPDecryptAndVerifyMessage(bob, bob, encryptedMessage)
+	if err == nil {
+		t.Error("Expected error verifying with the wrong key")
+		return
+	}
+
 	return
 }
@@ -0,0 +1,412 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// Upper bound on message keys derived ahead of time for out of order messages.
+	ratchetMaxSkip = 1000
+	// Keys of skipped messages that are kept, the oldest ones are dropped first.
+	ratchetMaxSkipped = 2 * ratchetMaxSkip
+	// Public ratchet key, previous chain length and message number.
+	ratchetHeaderSize = 32 + 4 + 4
+)
+
+// Ratchet is a Double Ratchet session. Every message is encrypted under a fresh key
+// from a symmetric chain and the chains are re-keyed with a new X25519 agreement each
+// time the conversation changes direction, so compromising the long term identity keys
+// or the current state does not expose earlier messages.
+type Ratchet struct {
+	state ratchetState
+	mux   sync.Mutex
+}
+
+type ratchetState struct {
+	self      *ecdh.PrivateKey
+	remote    *ecdh.PublicKey
+	rootKey   []byte
+	sendChain []byte
+	recvChain []byte
+	sendCount uint32
+	recvCount uint32
+	prevCount uint32
+	skipped   map[string][]byte
+	// Ids of the skipped keys, oldest first
+	skippedOrder []string
+}
+
+// Generates the ephemeral key each side contributes to the ratchet handshake.
+func RatchetGenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// Starts a session as the party that learnt the remote ephemeral key first. The
+// initiator can send immediately and the public half of selfKey must be delivered to
+// the responder.
+func NewRatchetInitiator(selfKey *ecdh.PrivateKey, remoteKey []byte) (*Ratchet, error) {
+	remote, shared, err := ratchetHandshake(selfKey, remoteKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Ratchet{state: ratchetState{
+		self:    selfKey,
+		remote:  remote,
+		skipped: make(map[string][]byte),
+	}}
+
+	r.state.rootKey, r.state.sendChain, err = ratchetRootKDF(shared, selfKey, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Starts a session as the party whose ephemeral key was sent to the initiator. The
+// responder steps the ratchet forward right away so it can also send immediately.
+func NewRatchetResponder(selfKey *ecdh.PrivateKey, remoteKey []byte) (*Ratchet, error) {
+	remote, shared, err := ratchetHandshake(selfKey, remoteKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Ratchet{state: ratchetState{
+		self:    selfKey,
+		rootKey: shared,
+		skipped: make(map[string][]byte),
+	}}
+
+	if err := r.state.step(remote); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Returns the public ratchet key currently used for sending.
+func (r *Ratchet) PublicKey() []byte {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.state.self.PublicKey().Bytes()
+}
+
+// Encrypts the message under the next sending key. The associated data is
+// authenticated but not included in the output.
+func (r *Ratchet) Encrypt(message, associatedData []byte) ([]byte, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var messageKey []byte
+	messageKey, r.state.sendChain = ratchetChainKDF(r.state.sendChain)
+
+	header := make([]byte, ratchetHeaderSize)
+	copy(header, r.state.self.PublicKey().Bytes())
+	binary.BigEndian.PutUint32(header[32:], r.state.prevCount)
+	binary.BigEndian.PutUint32(header[36:], r.state.sendCount)
+	r.state.sendCount++
+
+	additionalData := append(append([]byte{}, associatedData...), header...)
+	sealed, err := AESSeal(messageKey, message, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, sealed...), nil
+}
+
+// Decrypts a message produced by the remote session. The session state is only
+// advanced when the message authenticates.
+func (r *Ratchet) Decrypt(message, associatedData []byte) ([]byte, error) {
+	if len(message) < ratchetHeaderSize {
+		return nil, fmt.Errorf("Message is too short")
+	}
+
+	header, sealed := message[:ratchetHeaderSize], message[ratchetHeaderSize:]
+	prevCount := binary.BigEndian.Uint32(header[32:])
+	count := binary.BigEndian.Uint32(header[36:])
+	additionalData := append(append([]byte{}, associatedData...), header...)
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	// Messages that arrived out of order were given keys when they were skipped
+	id := ratchetSkippedID(header[:32], count)
+	if messageKey, ok := r.state.skipped[id]; ok {
+		plaintext, err := AESOpen(messageKey, sealed, additionalData)
+		if err != nil {
+			return nil, err
+		}
+
+		r.state.forget(id)
+		return plaintext, nil
+	}
+
+	state := r.state.clone()
+
+	if state.remote == nil || !bytes.Equal(header[:32], state.remote.Bytes()) {
+		remote, err := ecdh.X25519().NewPublicKey(header[:32])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := state.skip(prevCount); err != nil {
+			return nil, err
+		}
+
+		if err := state.step(remote); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := state.skip(count); err != nil {
+		return nil, err
+	}
+
+	var messageKey []byte
+	messageKey, state.recvChain = ratchetChainKDF(state.recvChain)
+	state.recvCount++
+
+	plaintext, err := AESOpen(messageKey, sealed, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	r.state = state
+	return plaintext, nil
+}
+
+// Serialized session state, it holds every secret of the session and has to be stored
+// encrypted.
+type ratchetSnapshot struct {
+	Self      []byte            `json:"self"`
+	Remote    []byte            `json:"remote,omitempty"`
+	RootKey   []byte            `json:"root_key"`
+	SendChain []byte            `json:"send_chain,omitempty"`
+	RecvChain []byte            `json:"recv_chain,omitempty"`
+	SendCount uint32            `json:"send_count"`
+	RecvCount uint32            `json:"recv_count"`
+	PrevCount uint32            `json:"prev_count"`
+	Skipped   map[string][]byte `json:"skipped,omitempty"`
+	// Ids of the skipped keys, oldest first. Sessions stored without it drop their
+	// skipped keys in the order of the ids.
+	SkippedOrder []string `json:"skipped_order,omitempty"`
+}
+
+// Serializes the session so it can be resumed after a restart.
+func (r *Ratchet) MarshalJSON() ([]byte, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	snapshot := ratchetSnapshot{
+		Self:      r.state.self.Bytes(),
+		RootKey:   r.state.rootKey,
+		SendChain: r.state.sendChain,
+		RecvChain: r.state.recvChain,
+		SendCount: r.state.sendCount,
+		RecvCount: r.state.recvCount,
+		PrevCount: r.state.prevCount,
+		Skipped:   r.state.skipped,
+
+		SkippedOrder: r.state.skippedOrder,
+	}
+	if r.state.remote != nil {
+		snapshot.Remote = r.state.remote.Bytes()
+	}
+
+	return json.Marshal(snapshot)
+}
+
+// Restores a session serialized by MarshalJSON.
+func (r *Ratchet) UnmarshalJSON(data []byte) error {
+	var snapshot ratchetSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	self, err := ecdh.X25519().NewPrivateKey(snapshot.Self)
+	if err != nil {
+		return err
+	}
+
+	state := ratchetState{
+		self:      self,
+		rootKey:   snapshot.RootKey,
+		sendChain: snapshot.SendChain,
+		recvChain: snapshot.RecvChain,
+		sendCount: snapshot.SendCount,
+		recvCount: snapshot.RecvCount,
+		prevCount: snapshot.PrevCount,
+		skipped:   snapshot.Skipped,
+	}
+	if state.skipped == nil {
+		state.skipped = make(map[string][]byte)
+	}
+
+	for _, id := range snapshot.SkippedOrder {
+		if _, ok := state.skipped[id]; ok {
+			state.skippedOrder = append(state.skippedOrder, id)
+		}
+	}
+	if len(state.skippedOrder) != len(state.skipped) {
+		state.skippedOrder = make([]string, 0, len(state.skipped))
+		for id := range state.skipped {
+			state.skippedOrder = append(state.skippedOrder, id)
+		}
+		sort.Strings(state.skippedOrder)
+	}
+
+	if len(snapshot.Remote) > 0 {
+		state.remote, err = ecdh.X25519().NewPublicKey(snapshot.Remote)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.state = state
+	return nil
+}
+
+// Performs a DH ratchet step after the remote party switched to a new ratchet key.
+func (s *ratchetState) step(remote *ecdh.PublicKey) error {
+	var err error
+
+	s.prevCount = s.sendCount
+	s.sendCount = 0
+	s.recvCount = 0
+	s.remote = remote
+
+	s.rootKey, s.recvChain, err = ratchetRootKDF(s.rootKey, s.self, s.remote)
+	if err != nil {
+		return err
+	}
+
+	s.self, err = RatchetGenerateKey()
+	if err != nil {
+		return err
+	}
+
+	s.rootKey, s.sendChain, err = ratchetRootKDF(s.rootKey, s.self, s.remote)
+	return err
+}
+
+// Stores the keys for receiving chain messages that have not arrived yet.
+func (s *ratchetState) skip(until uint32) error {
+	if s.recvChain == nil {
+		return nil
+	}
+
+	if until > s.recvCount+ratchetMaxSkip {
+		return fmt.Errorf("Too many skipped messages")
+	}
+
+	for s.recvCount < until {
+		var messageKey []byte
+		messageKey, s.recvChain = ratchetChainKDF(s.recvChain)
+
+		id := ratchetSkippedID(s.remote.Bytes(), s.recvCount)
+		s.skipped[id] = messageKey
+		s.skippedOrder = append(s.skippedOrder, id)
+		s.recvCount++
+	}
+
+	// The oldest skipped messages are the least likely to still arrive
+	if drop := len(s.skippedOrder) - ratchetMaxSkipped; drop > 0 {
+		for _, id := range s.skippedOrder[:drop] {
+			delete(s.skipped, id)
+		}
+		s.skippedOrder = append([]string{}, s.skippedOrder[drop:]...)
+	}
+
+	return nil
+}
+
+// Removes the key of a skipped message once it was used.
+func (s *ratchetState) forget(id string) {
+	delete(s.skipped, id)
+	if i := slices.Index(s.skippedOrder, id); i >= 0 {
+		s.skippedOrder = slices.Delete(s.skippedOrder, i, i+1)
+	}
+}
+
+func (s *ratchetState) clone() ratchetState {
+	c := *s
+	c.skipped = make(map[string][]byte, len(s.skipped))
+	for k, v := range s.skipped {
+		c.skipped[k] = v
+	}
+	c.skippedOrder = slices.Clone(s.skippedOrder)
+	return c
+}
+
+// Derives the initial root key from the agreement between both ephemeral keys.
+func ratchetHandshake(selfKey *ecdh.PrivateKey, remoteKey []byte) (*ecdh.PublicKey, []byte, error) {
+	remote, err := ecdh.X25519().NewPublicKey(remoteKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shared, err := selfKey.ECDH(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rootKey := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, shared, nil, []byte("OnionSoup Ratchet Handshake"))
+	if _, err := io.ReadFull(kdf, rootKey); err != nil {
+		return nil, nil, err
+	}
+
+	return remote, rootKey, nil
+}
+
+// Mixes a new agreement into the root key and returns the next root and chain keys.
+func ratchetRootKDF(rootKey []byte, self *ecdh.PrivateKey, remote *ecdh.PublicKey) ([]byte, []byte, error) {
+	shared, err := self.ECDH(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := make([]byte, 64)
+	kdf := hkdf.New(sha256.New, shared, rootKey, []byte("OnionSoup Ratchet Root"))
+	if _, err := io.ReadFull(kdf, out); err != nil {
+		return nil, nil, err
+	}
+
+	return out[:32], out[32:], nil
+}
+
+// Returns the message key for the current chain position and the next chain key.
+func ratchetChainKDF(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	messageKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+
+	return messageKey, mac.Sum(nil)
+}
+
+func ratchetSkippedID(remote []byte, count uint32) string {
+	return fmt.Sprintf("%s:%d", hex.EncodeToString(remote), count)
+}
@@ -0,0 +1,193 @@
+package crypt_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+)
+
+func newRatchetPair(t *testing.T) (*crypt.Ratchet, *crypt.Ratchet) {
+	responderKey, err := crypt.RatchetGenerateKey()
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	initiatorKey, err := crypt.RatchetGenerateKey()
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	initiator, err := crypt.NewRatchetInitiator(initiatorKey, responderKey.PublicKey().Bytes())
+	if err != nil {
+		t.Fatalf("Error starting initiator: %s", err)
+	}
+
+	responder, err := crypt.NewRatchetResponder(responderKey, initiatorKey.PublicKey().Bytes())
+	if err != nil {
+		t.Fatalf("Error starting responder: %s", err)
+	}
+
+	return initiator, responder
+}
+
+func TestRatchet(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	ad := []byte("conversation")
+
+	// Both sides may speak first and the conversation changes direction several times
+	for round := 0; round < 3; round++ {
+		for _, pair := range [][2]*crypt.Ratchet{{bob, alice}, {alice, bob}} {
+			for i := 0; i < 3; i++ {
+				message := fmt.Sprintf("round %d message %d", round, i)
+
+				emsg, err := pair[0].Encrypt([]byte(message), ad)
+				if err != nil {
+					t.Fatalf("Error encrypting message: %s", err)
+				}
+
+				msg, err := pair[1].Decrypt(emsg, ad)
+				if err != nil {
+					t.Fatalf("Error decrypting message: %s", err)
+				}
+
+				if string(msg) != message {
+					t.Fatalf("Expected %s, got %s", message, msg)
+				}
+			}
+		}
+	}
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	ad := []byte("conversation")
+
+	var messages [][]byte
+	for i := 0; i < 4; i++ {
+		emsg, err := alice.Encrypt([]byte(fmt.Sprintf("message %d", i)), ad)
+		if err != nil {
+			t.Fatalf("Error encrypting message: %s", err)
+		}
+		messages = append(messages, emsg)
+	}
+
+	for _, i := range []int{2, 0, 3, 1} {
+		msg, err := bob.Decrypt(messages[i], ad)
+		if err != nil {
+			t.Fatalf("Error decrypting message %d: %s", i, err)
+		}
+
+		if string(msg) != fmt.Sprintf("message %d", i) {
+			t.Fatalf("Message mismatch for %d", i)
+		}
+	}
+
+	// Keys are discarded once used so a replay fails
+	if _, err := bob.Decrypt(messages[1], ad); err == nil {
+		t.Fatalf("Expected error replaying message")
+	}
+}
+
+func TestRatchetSkippedEviction(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	ad := []byte("conversation")
+
+	var messages [][]byte
+	for i := 0; i < 4000; i++ {
+		emsg, err := alice.Encrypt([]byte(fmt.Sprintf("message %d", i)), ad)
+		if err != nil {
+			t.Fatalf("Error encrypting message: %s", err)
+		}
+		messages = append(messages, emsg)
+	}
+
+	// Every gap leaves keys behind, once too many are kept the oldest are dropped
+	for _, i := range []int{999, 1999, 2999, 3999} {
+		if _, err := bob.Decrypt(messages[i], ad); err != nil {
+			t.Fatalf("Error decrypting message %d: %s", i, err)
+		}
+	}
+
+	if msg, err := bob.Decrypt(messages[3998], ad); err != nil || string(msg) != "message 3998" {
+		t.Fatalf("Expected the newest skipped message to decrypt: %v", err)
+	}
+
+	if _, err := bob.Decrypt(messages[0], ad); err == nil {
+		t.Fatalf("Expected the oldest skipped message to be dropped")
+	}
+}
+
+func TestRatchetTampered(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	ad := []byte("conversation")
+
+	emsg, err := alice.Encrypt([]byte("Hello World!"), ad)
+	if err != nil {
+		t.Fatalf("Error encrypting message: %s", err)
+	}
+
+	if _, err := bob.Decrypt(emsg, []byte("other conversation")); err == nil {
+		t.Fatalf("Expected error with mismatched associated data")
+	}
+
+	tampered := append([]byte{}, emsg...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := bob.Decrypt(tampered, ad); err == nil {
+		t.Fatalf("Expected error with tampered message")
+	}
+
+	// Failed attempts must not advance the session
+	msg, err := bob.Decrypt(emsg, ad)
+	if err != nil {
+		t.Fatalf("Error decrypting message: %s", err)
+	}
+
+	if string(msg) != "Hello World!" {
+		t.Fatalf("Message mismatch")
+	}
+}
+
+func TestRatchetSerialization(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	ad := []byte("conversation")
+
+	// Leave a skipped key behind so it has to survive the round trip
+	skipped, err := alice.Encrypt([]byte("skipped"), ad)
+	if err != nil {
+		t.Fatalf("Error encrypting message: %s", err)
+	}
+
+	emsg, err := alice.Encrypt([]byte("hello"), ad)
+	if err != nil {
+		t.Fatalf("Error encrypting message: %s", err)
+	}
+
+	if _, err := bob.Decrypt(emsg, ad); err != nil {
+		t.Fatalf("Error decrypting message: %s", err)
+	}
+
+	data, err := json.Marshal(bob)
+	if err != nil {
+		t.Fatalf("Error serializing ratchet: %s", err)
+	}
+
+	restored := &crypt.Ratchet{}
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatalf("Error restoring ratchet: %s", err)
+	}
+
+	if msg, err := restored.Decrypt(skipped, ad); err != nil || string(msg) != "skipped" {
+		t.Fatalf("Restored ratchet lost the skipped message key: %v", err)
+	}
+
+	reply, err := restored.Encrypt([]byte("reply"), ad)
+	if err != nil {
+		t.Fatalf("Error encrypting message: %s", err)
+	}
+
+	if msg, err := alice.Decrypt(reply, ad); err != nil || string(msg) != "reply" {
+		t.Fatalf("Restored ratchet cannot continue the session: %v", err)
+	}
+}
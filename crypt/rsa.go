@@ -6,10 +6,14 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"fmt"
 )
 
+// Size in bytes of the AES session key wrapped by the hybrid RSA functions.
+const rsaSessionKeySize = 32
+
 // Encrypts and signs the message using the sender's private key and recipient's public key.
 // Returns the encrypted message on success and an error otherwise.
 func RSAEncryptAndSignMessage(senderPrivateKey *rsa.PrivateKey, recipientPublicKey *rsa.PublicKey, message []byte) ([]byte, []byte, error) {
@@ -61,6 +65,196 @@ func RSADecryptAndVerifyMessage(receiverPrivateKey *rsa.PrivateKey, senderPublic
 	return decryptedMessage, nil
 }
 
+// Encrypts the message under a random AES-GCM session key, wraps the session key to the
+// recipient's public key with RSA-OAEP and signs the message using the sender's private key.
+// Unlike RSAEncryptAndSignMessage the message length is not bounded by the key size.
+// Returns the encrypted message and signature on success and an error otherwise.
+func RSAHybridEncryptAndSignMessage(senderPrivateKey *rsa.PrivateKey, recipientPublicKey *rsa.PublicKey, message []byte) ([]byte, []byte, error) {
+	sessionKey := make([]byte, rsaSessionKeySize)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, nil, err
+	}
+
+	// Wrap the session key using the recipient's public key
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recipientPublicKey, sessionKey, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error wrapping session key: %v", err)
+	}
+
+	// Encrypt the message using the session key
+	sealed, err := AESSeal(sessionKey, message, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error encrypting message: %v", err)
+	}
+
+	// The wrapped key is length prefixed so the layout does not depend on the key size
+	encryptedMessage := make([]byte, 2, 2+len(wrappedKey)+len(sealed))
+	binary.BigEndian.PutUint16(encryptedMessage, uint16(len(wrappedKey)))
+	encryptedMessage = append(encryptedMessage, wrappedKey...)
+	encryptedMessage = append(encryptedMessage, sealed...)
+
+	// Sign the message using the sender's private key
+	hash := sha256.New()
+	hash.Write(message)
+	hashedMessage := hash.Sum(nil)
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, senderPrivateKey, crypto.SHA256, hashedMessage)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error signing message: %v", err)
+	}
+
+	return encryptedMessage, signature, nil
+}
+
+// Decrypts and verifies a message produced by RSAHybridEncryptAndSignMessage using the
+// recipient's private key and sender's public key.
+// Returns the decrypted message on success and an error otherwise.
+func RSAHybridDecryptAndVerifyMessage(receiverPrivateKey *rsa.PrivateKey, senderPublicKey *rsa.PublicKey, message []byte, signature []byte) ([]byte, error) {
+	// Safety check that the message and signature are not empty
+	if message == nil || signature == nil {
+		return nil, fmt.Errorf("Message and Signature cannot be empty")
+	}
+
+	if len(message) < 2 {
+		return nil, fmt.Errorf("Message is too short")
+	}
+
+	keyLength := int(binary.BigEndian.Uint16(message))
+	if len(message) < 2+keyLength {
+		return nil, fmt.Errorf("Message is too short")
+	}
+	wrappedKey, sealed := message[2:2+keyLength], message[2+keyLength:]
+
+	// Unwrap the session key using the recipient's private key
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, receiverPrivateKey, wrappedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error unwrapping session key: %v", err)
+	}
+
+	decryptedMessage, err := AESOpen(sessionKey, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting message: %v", err)
+	}
+
+	// Verify the signature using the sender's public key
+	hash := sha256.New()
+	hash.Write(decryptedMessage)
+	hashedMessage := hash.Sum(nil)
+
+	err = rsa.VerifyPKCS1v15(senderPublicKey, crypto.SHA256, hashedMessage, signature)
+	if err != nil {
+		return nil, fmt.Errorf("Error verifying message signature: %v", err)
+	}
+
+	return decryptedMessage, nil
+}
+
+// Encrypts the message under a random AES-GCM session key like RSAHybridEncryptAndSignMessage
+// and wraps the session key to every recipient's public key, so each recipient can decrypt
+// the same message.
+// Returns the encrypted message and signature on success and an error otherwise.
+func RSAMultiEncryptAndSignMessage(senderPrivateKey *rsa.PrivateKey, recipientPublicKeys []*rsa.PublicKey, message []byte) ([]byte, []byte, error) {
+	sessionKey := make([]byte, rsaSessionKeySize)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, nil, err
+	}
+
+	// Wrap the session key using every recipient's public key
+	wrappedKeys := make([][]byte, 0, len(recipientPublicKeys))
+	for _, recipientPublicKey := range recipientPublicKeys {
+		wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recipientPublicKey, sessionKey, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error wrapping session key: %v", err)
+		}
+		wrappedKeys = append(wrappedKeys, wrappedKey)
+	}
+
+	// Encrypt the message using the session key
+	sealed, err := AESSeal(sessionKey, message, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error encrypting message: %v", err)
+	}
+
+	encryptedMessage, err := packSessionKeys(wrappedKeys, sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Sign the message using the sender's private key
+	signature, err := RSASignMessage(senderPrivateKey, message)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encryptedMessage, signature, nil
+}
+
+// Decrypts and verifies a message produced by RSAMultiEncryptAndSignMessage using the
+// recipient's private key and sender's public key.
+// Returns the decrypted message on success and an error otherwise.
+func RSAMultiDecryptAndVerifyMessage(receiverPrivateKey *rsa.PrivateKey, senderPublicKey *rsa.PublicKey, message []byte, signature []byte) ([]byte, error) {
+	// Safety check that the message and signature are not empty
+	if message == nil || signature == nil {
+		return nil, fmt.Errorf("Message and Signature cannot be empty")
+	}
+
+	wrappedKeys, sealed, err := unpackSessionKeys(message)
+	if err != nil {
+		return nil, err
+	}
+
+	// The recipients are not named, so every wrapped key is tried
+	var sessionKey []byte
+	for _, wrappedKey := range wrappedKeys {
+		if sessionKey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, receiverPrivateKey, wrappedKey, nil); err == nil {
+			break
+		}
+	}
+	if sessionKey == nil {
+		return nil, fmt.Errorf("Error unwrapping session key: the message was not encrypted to this key")
+	}
+
+	decryptedMessage, err := AESOpen(sessionKey, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting message: %v", err)
+	}
+
+	// Verify the signature using the sender's public key
+	if err := RSAVerifyMessage(senderPublicKey, decryptedMessage, signature); err != nil {
+		return nil, err
+	}
+
+	return decryptedMessage, nil
+}
+
+// Signs the message using the sender's private key without encrypting it.
+func RSASignMessage(senderPrivateKey *rsa.PrivateKey, message []byte) ([]byte, error) {
+	hash := sha256.New()
+	hash.Write(message)
+	hashedMessage := hash.Sum(nil)
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, senderPrivateKey, crypto.SHA256, hashedMessage)
+	if err != nil {
+		return nil, fmt.Errorf("Error signing message: %v", err)
+	}
+
+	return signature, nil
+}
+
+// Verifies a signature produced by RSASignMessage using the sender's public key.
+func RSAVerifyMessage(senderPublicKey *rsa.PublicKey, message []byte, signature []byte) error {
+	hash := sha256.New()
+	hash.Write(message)
+	hashedMessage := hash.Sum(nil)
+
+	err := rsa.VerifyPKCS1v15(senderPublicKey, crypto.SHA256, hashedMessage, signature)
+	if err != nil {
+		return fmt.Errorf("Error verifying message signature: %v", err)
+	}
+
+	return nil
+}
+
 // Generates a new RSA Key Pair and returns them as pointers.
 func RSAGenerateKeyPair(size int) (*rsa.PrivateKey, *rsa.PublicKey, error) {
 	if size < 4096 {
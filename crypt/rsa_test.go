@@ -1,6 +1,9 @@
 package crypt_test
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/JustinTimperio/onionsoup/crypt"
@@ -31,3 +34,73 @@ func TestRSA(t *testing.T) {
 		t.Fatalf("Message mismatch")
 	}
 }
+
+func TestRSAHybrid(t *testing.T) {
+	alicePrivate, alicePublic, err := crypt.RSAGenerateKeyPair(4096)
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	bobPrivate, bobPublic, err := crypt.RSAGenerateKeyPair(4096)
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	// Well past the ~500 byte limit of a raw PKCS#1 v1.5 block for a 4096 bit key
+	message := []byte(strings.Repeat("Hello World! ", 1024))
+
+	emsg, sig, err := crypt.RSAHybridEncryptAndSignMessage(alicePrivate, bobPublic, message)
+	if err != nil {
+		t.Fatalf("Error encrypting message: %s", err)
+	}
+
+	msg, err := crypt.RSAHybridDecryptAndVerifyMessage(bobPrivate, alicePublic, emsg, sig)
+	if err != nil {
+		t.Fatalf("Error decrypting message: %s", err)
+	}
+
+	if string(msg) != string(message) {
+		t.Fatalf("Message mismatch")
+	}
+
+	_, err = crypt.RSAHybridDecryptAndVerifyMessage(alicePrivate, alicePublic, emsg, sig)
+	if err == nil {
+		t.Fatalf("Expected error decrypting with the wrong key")
+	}
+}
+
+func TestRSALegacyWrapper(t *testing.T) {
+	alicePrivate, alicePublic, err := crypt.RSAGenerateKeyPair(4096)
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	emsg, sig, err := crypt.RSAEncryptAndSignMessage(alicePrivate, alicePublic, []byte("Hello World!"))
+	if err != nil {
+		t.Fatalf("Error encrypting message: %s", err)
+	}
+
+	// Wrappers packed before versioning carry no version field at all
+	legacy, err := json.Marshal(map[string][]byte{"message": emsg, "signature": sig, "pubkey": nil})
+	if err != nil {
+		t.Fatalf("Error packing message: %s", err)
+	}
+
+	wrapper, err := crypt.UnpackMessage(base64.StdEncoding.EncodeToString(legacy))
+	if err != nil {
+		t.Fatalf("Error unpacking message: %s", err)
+	}
+
+	if wrapper.Version != crypt.MessageVersionLegacy {
+		t.Fatalf("Expected legacy version, got %d", wrapper.Version)
+	}
+
+	msg, err := crypt.RSADecryptAndVerifyMessage(alicePrivate, alicePublic, wrapper.Message, wrapper.Signature)
+	if err != nil {
+		t.Fatalf("Error decrypting message: %s", err)
+	}
+
+	if string(msg) != "Hello World!" {
+		t.Fatalf("Message mismatch")
+	}
+}
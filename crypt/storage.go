@@ -0,0 +1,61 @@
+package crypt
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"io"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Derives a 32 byte key for data stored at rest from a private key. The same private key
+// and purpose always produce the same key, so the data can be opened again as long as the
+// private key is kept.
+func StorageKey(privateKey any, purpose string) ([]byte, error) {
+	var material []byte
+
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		material = x509.MarshalPKCS1PrivateKey(k)
+	case *crypto.Key:
+		if !k.IsPrivate() {
+			return nil, fmt.Errorf("A private key is required")
+		}
+
+		var err error
+		material, err = k.Serialize()
+		if err != nil {
+			return nil, err
+		}
+	case *CurvePrivateKey:
+		material = append(k.SigningKey.Seed(), k.ExchangeKey.Bytes()...)
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %T", privateKey)
+	}
+
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, material, []byte("OnionSoup Storage"), []byte(purpose))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Derives a 32 byte key for data stored at rest from a passphrase using Argon2id with the
+// parameters used for key containers.
+func PassphraseKey(passphrase string, salt []byte) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("Passphrase cannot be empty")
+	}
+
+	if len(salt) < 16 {
+		return nil, fmt.Errorf("Salt is too short")
+	}
+
+	return argon2.IDKey([]byte(passphrase), salt, argon2Time, argon2Memory, argon2Threads, 32), nil
+}
@@ -0,0 +1,41 @@
+package crypt_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+)
+
+func TestStorageKey(t *testing.T) {
+	curveKey, _, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	pgpKey, err := crypt.PGPGenerateKeyPair("Alice")
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	for _, privateKey := range []any{curveKey, pgpKey} {
+		key, err := crypt.StorageKey(privateKey, "history")
+		if err != nil {
+			t.Fatalf("Error deriving storage key: %s", err)
+		}
+
+		again, err := crypt.StorageKey(privateKey, "history")
+		if err != nil || !bytes.Equal(key, again) {
+			t.Fatalf("Expected the same key for the same private key and purpose")
+		}
+
+		other, err := crypt.StorageKey(privateKey, "conversations")
+		if err != nil || bytes.Equal(key, other) {
+			t.Fatalf("Expected a different key for a different purpose")
+		}
+	}
+
+	if _, err := crypt.PassphraseKey("", make([]byte, 32)); err == nil {
+		t.Fatalf("Expected an empty passphrase to be rejected")
+	}
+}
@@ -0,0 +1,312 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Files written by EncryptStream start with the magic followed by the length prefixed
+	// JSON header.
+	streamMagic = "ONIONSOUP"
+
+	StreamVersion = 1
+	// Plaintext bytes sealed per chunk.
+	StreamChunkSize = 64 * 1024
+	// File extension of encrypted files.
+	StreamExtension = ".onionsoup"
+
+	maxStreamHeaderSize = 1024 * 1024
+	maxStreamChunkSize  = 16 * 1024 * 1024
+	// AES-GCM nonce and tag added to every chunk
+	streamChunkOverhead = 12 + 16
+
+	streamChunkMore  = 0
+	streamChunkFinal = 1
+)
+
+// StreamHeader describes a file encrypted by EncryptStream. The file is sealed in chunks
+// under a random session key, the session key is encrypted to every recipient and the
+// whole file is signed by the sender.
+type StreamHeader struct {
+	Version   int    `json:"version"`
+	KeyType   string `json:"key_type"`
+	ChunkSize int    `json:"chunk_size"`
+	// Name of the encrypted file without its directory
+	Name string `json:"name"`
+	// Size of the plaintext, -1 when it was not known in advance
+	Size   int64  `json:"size"`
+	Pubkey []byte `json:"pubkey"`
+	// The session key encrypted to every recipient and signed by the sender, see
+	// MultiEncryptAndSignMessage
+	SessionKey          []byte `json:"session_key"`
+	SessionKeySignature []byte `json:"session_key_signature"`
+
+	// Header as read, the file signature covers it
+	raw []byte
+}
+
+// Encrypts src to every recipient and signs it with the private key, writing the result
+// to dst. The input is read one chunk at a time so files of any size can be encrypted.
+// The name and size are stored in the header to name the decrypted file and show progress.
+func EncryptStream(dst io.Writer, src io.Reader, privateKey any, recipientPublicKeys []any, name string, size int64) error {
+	keyType, err := KeyType(privateKey)
+	if err != nil {
+		return err
+	}
+
+	pubkey, err := PublicKeyToBytes(privateKey)
+	if err != nil {
+		return err
+	}
+
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return err
+	}
+
+	wrappedKey, wrappedKeySignature, err := MultiEncryptAndSignMessage(privateKey, recipientPublicKeys, sessionKey)
+	if err != nil {
+		return err
+	}
+
+	header, err := json.Marshal(&StreamHeader{
+		Version:             StreamVersion,
+		KeyType:             keyType,
+		ChunkSize:           StreamChunkSize,
+		Name:                name,
+		Size:                size,
+		Pubkey:              pubkey,
+		SessionKey:          wrappedKey,
+		SessionKeySignature: wrappedKeySignature,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Everything written is hashed for the signature at the end
+	digest := sha256.New()
+	out := io.MultiWriter(dst, digest)
+
+	if _, err := io.WriteString(out, streamMagic); err != nil {
+		return err
+	}
+	if err := writeFrame(out, header); err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(src, StreamChunkSize)
+	chunk := make([]byte, StreamChunkSize)
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(in, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		flag := byte(streamChunkMore)
+		if _, peekErr := in.Peek(1); peekErr == io.EOF {
+			flag = streamChunkFinal
+		} else if peekErr != nil {
+			return peekErr
+		}
+
+		sealed, err := AESSeal(sessionKey, chunk[:n], streamChunkData(index, flag))
+		if err != nil {
+			return fmt.Errorf("Error encrypting file: %v", err)
+		}
+
+		if _, err := out.Write([]byte{flag}); err != nil {
+			return err
+		}
+		if err := writeFrame(out, sealed); err != nil {
+			return err
+		}
+
+		if flag == streamChunkFinal {
+			break
+		}
+	}
+
+	signature, err := SignMessage(privateKey, digest.Sum(nil))
+	if err != nil {
+		return err
+	}
+
+	return writeFrame(dst, signature)
+}
+
+// Reads the header of a file written by EncryptStream and leaves src at the first chunk.
+func ReadStreamHeader(src io.Reader) (*StreamHeader, error) {
+	magic := make([]byte, len(streamMagic))
+	if _, err := io.ReadFull(src, magic); err != nil || string(magic) != streamMagic {
+		return nil, fmt.Errorf("Not an encrypted OnionSoup file")
+	}
+
+	raw, err := readFrame(src, maxStreamHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &StreamHeader{raw: raw}
+	if err := json.Unmarshal(raw, header); err != nil {
+		return nil, err
+	}
+
+	if header.Version != StreamVersion {
+		return nil, fmt.Errorf("Unsupported file version: %d", header.Version)
+	}
+	if header.ChunkSize <= 0 || header.ChunkSize > maxStreamChunkSize {
+		return nil, fmt.Errorf("Invalid chunk size: %d", header.ChunkSize)
+	}
+
+	return header, nil
+}
+
+// Decrypts the chunks following the header into dst and verifies the file signature with
+// senderPublicKey, or with the public key in the header when senderPublicKey is nil.
+// The signature can only be checked after the last chunk, so everything written to dst
+// must be discarded when an error is returned.
+func DecryptStream(dst io.Writer, src io.Reader, header *StreamHeader, privateKey, senderPublicKey any) error {
+	if senderPublicKey == nil {
+		var err error
+		senderPublicKey, err = PublicKeyToMem(header.KeyType, header.Pubkey)
+		if err != nil {
+			return err
+		}
+	}
+
+	sessionKey, err := DecryptAndVerifyMessage(MessageVersionMultiRecipient, privateKey, senderPublicKey, header.SessionKey, header.SessionKeySignature)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.New()
+	digest.Write([]byte(streamMagic))
+	if err := writeFrame(digest, header.raw); err != nil {
+		return err
+	}
+
+	for index := uint64(0); ; index++ {
+		flag, sealed, err := readChunk(src, digest, header.ChunkSize+streamChunkOverhead)
+		if err != nil {
+			return err
+		}
+
+		chunk, err := AESOpen(sessionKey, sealed, streamChunkData(index, flag))
+		if err != nil {
+			return fmt.Errorf("Error decrypting file: %v", err)
+		}
+
+		if _, err := dst.Write(chunk); err != nil {
+			return err
+		}
+
+		if flag == streamChunkFinal {
+			break
+		}
+	}
+
+	signature, err := readFrame(src, maxStreamHeaderSize)
+	if err != nil {
+		return err
+	}
+
+	return VerifyMessage(senderPublicKey, digest.Sum(nil), signature)
+}
+
+// Decrypts into the file at path like DecryptStream. The plaintext is written to a
+// temporary file next to path that is only renamed once the signature was verified, so a
+// modified file never shows up at path.
+func DecryptStreamToFile(path string, src io.Reader, header *StreamHeader, privateKey, senderPublicKey any) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	if err := DecryptStream(tmp, src, header, privateKey, senderPublicKey); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Binds every chunk to its position and marks the last one, so chunks can not be
+// reordered and a truncated file is detected.
+func streamChunkData(index uint64, flag byte) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, index), flag)
+}
+
+func readChunk(src io.Reader, digest hash.Hash, maxSize int) (byte, []byte, error) {
+	flag := make([]byte, 1)
+	if _, err := io.ReadFull(src, flag); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, nil, fmt.Errorf("The file is truncated")
+		}
+		return 0, nil, err
+	}
+	if flag[0] != streamChunkMore && flag[0] != streamChunkFinal {
+		return 0, nil, fmt.Errorf("Invalid chunk")
+	}
+
+	sealed, err := readFrame(src, maxSize)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	digest.Write(flag)
+	writeFrame(digest, sealed)
+
+	return flag[0], sealed, nil
+}
+
+// Writes the data with a length prefix.
+func writeFrame(w io.Writer, data []byte) error {
+	if _, err := w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(data)))); err != nil {
+		return err
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+// Reads data written by writeFrame, refusing frames larger than maxSize.
+func readFrame(r io.Reader, maxSize int) ([]byte, error) {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(r, length); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("The file is truncated")
+		}
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(length)
+	if size > uint32(maxSize) {
+		return nil, fmt.Errorf("Frame is too large: %d bytes", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("The file is truncated")
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -0,0 +1,104 @@
+package crypt_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+)
+
+func TestStream(t *testing.T) {
+	alicePrivate, alicePublic, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	bobPrivate, bobPublic, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	// Empty, exactly one chunk and a few chunks with a partial last one
+	for _, size := range []int{0, crypt.StreamChunkSize, 3*crypt.StreamChunkSize + 100} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		var encrypted bytes.Buffer
+		if err := crypt.EncryptStream(&encrypted, bytes.NewReader(plaintext), alicePrivate, []any{bobPublic}, "notes.txt", int64(size)); err != nil {
+			t.Fatalf("Error encrypting file: %s", err)
+		}
+
+		src := bytes.NewReader(encrypted.Bytes())
+		header, err := crypt.ReadStreamHeader(src)
+		if err != nil {
+			t.Fatalf("Error reading header: %s", err)
+		}
+
+		if header.Name != "notes.txt" || header.Size != int64(size) || header.KeyType != "x25519" {
+			t.Fatalf("Header mismatch: %+v", header)
+		}
+
+		var decrypted bytes.Buffer
+		if err := crypt.DecryptStream(&decrypted, src, header, bobPrivate, alicePublic); err != nil {
+			t.Fatalf("Error decrypting file of %d bytes: %s", size, err)
+		}
+
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Fatalf("File mismatch for %d bytes", size)
+		}
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	alicePrivate, alicePublic, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	bobPrivate, bobPublic, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	plaintext := make([]byte, 2*crypt.StreamChunkSize+1)
+
+	var encrypted bytes.Buffer
+	if err := crypt.EncryptStream(&encrypted, bytes.NewReader(plaintext), alicePrivate, []any{bobPublic}, "", -1); err != nil {
+		t.Fatalf("Error encrypting file: %s", err)
+	}
+
+	decrypt := func(data []byte, sender any) error {
+		src := bytes.NewReader(data)
+		header, err := crypt.ReadStreamHeader(src)
+		if err != nil {
+			return err
+		}
+
+		return crypt.DecryptStream(&bytes.Buffer{}, src, header, bobPrivate, sender)
+	}
+
+	if err := decrypt(encrypted.Bytes(), nil); err != nil {
+		t.Fatalf("Error decrypting with the packed key: %s", err)
+	}
+
+	if err := decrypt(encrypted.Bytes(), bobPublic); err == nil {
+		t.Fatalf("Expected error verifying with the wrong key")
+	}
+
+	flipped := bytes.Clone(encrypted.Bytes())
+	flipped[len(flipped)/2] ^= 1
+	if err := decrypt(flipped, alicePublic); err == nil {
+		t.Fatalf("Expected error decrypting a modified file")
+	}
+
+	// Cut off in the middle of the last chunk
+	if err := decrypt(encrypted.Bytes()[:encrypted.Len()-200], alicePublic); err == nil {
+		t.Fatalf("Expected error decrypting a truncated file")
+	}
+
+	// Cut off right before the signature
+	if err := decrypt(encrypted.Bytes()[:encrypted.Len()-68], alicePublic); err == nil {
+		t.Fatalf("Expected error decrypting a file without its signature")
+	}
+}
@@ -0,0 +1,31 @@
+package crypt
+
+// One word for every byte value, used to read fingerprints aloud.
+var fingerprintWords = [256]string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alert", "alley", "alpha", "amber",
+	"anchor", "angle", "ankle", "apple", "apron", "arena", "armor", "arrow", "aspen", "atlas",
+	"attic", "autumn", "award", "bacon", "badge", "bagel", "baker", "bamboo", "banjo", "barn",
+	"basil", "basket", "beach", "beacon", "beaver", "bench", "berry", "bison", "blade", "blanket",
+	"blaze", "bloom", "board", "bonus", "boot", "border", "bottle", "bounce", "bracket", "branch",
+	"brave", "bread", "brick", "bridge", "brisk", "broom", "brush", "bubble", "bucket", "buffalo",
+	"bundle", "butter", "cabin", "cactus", "camel", "candle", "canoe", "canyon", "carbon", "cargo",
+	"carpet", "castle", "cedar", "cello", "chalk", "cherry", "chess", "chimney", "cinema", "circle",
+	"citrus", "clay", "cliff", "clock", "cloud", "clover", "cobalt", "cocoa", "comet", "copper",
+	"coral", "cotton", "cradle", "crane", "crater", "crayon", "cricket", "crown", "crystal", "cumin",
+	"dagger", "daisy", "delta", "denim", "desert", "diamond", "dingo", "dinner", "dolphin", "donkey",
+	"dragon", "drum", "eagle", "easel", "echo", "eclipse", "elbow", "ember", "emerald", "engine",
+	"falcon", "fabric", "feather", "fender", "fern", "fiddle", "finch", "flame", "flint", "flute",
+	"forest", "fossil", "fox", "galaxy", "garden", "garlic", "gazelle", "geyser", "ginger", "glacier",
+	"globe", "goblet", "gold", "gopher", "granite", "grape", "gravel", "guitar", "hammer", "harbor",
+	"harp", "hazel", "helmet", "heron", "hickory", "honey", "hornet", "husky", "igloo", "indigo",
+	"iris", "island", "ivory", "jacket", "jaguar", "jasmine", "jelly", "jewel", "jungle", "kayak",
+	"kernel", "kettle", "kiwi", "koala", "ladder", "lagoon", "lantern", "laser", "lemon", "lentil",
+	"lily", "linen", "lizard", "lobster", "locket", "lotus", "lunar", "magnet", "mango", "maple",
+	"marble", "meadow", "melon", "meteor", "mint", "mirror", "mitten", "monsoon", "mosaic", "moss",
+	"muffin", "mural", "nectar", "needle", "nickel", "noodle", "nutmeg", "oasis", "ocean", "olive",
+	"onion", "opal", "orbit", "orchid", "otter", "oyster", "paddle", "panda", "paper", "parrot",
+	"pasta", "peach", "pebble", "pepper", "piano", "pillow", "pine", "planet", "plum", "polar",
+	"poppy", "prism", "pumpkin", "puzzle", "quartz", "quill", "rabbit", "radar", "raven", "reef",
+	"ribbon", "river", "robin", "rocket", "saddle", "saffron", "salmon", "sapphire", "scarf",
+	"shadow", "shell", "silver", "socket", "spark", "spider",
+}
@@ -5,14 +5,37 @@ import (
 	"encoding/json"
 )
 
+const (
+	// Messages packed before the wrapper was versioned. RSA payloads in this
+	// format are raw PKCS#1 v1.5 ciphertexts bounded by the key size.
+	MessageVersionLegacy = 0
+	// RSA payloads carry an RSA-OAEP wrapped AES-GCM session key.
+	MessageVersionHybrid = 1
+	// Conversation payloads are encrypted by a Ratchet session and only signed with
+	// the long term keys.
+	MessageVersionRatchet = 2
+	// RSA and X25519 payloads carry one wrapped session key per recipient. PGP payloads
+	// list every recipient themselves and are not affected by the version.
+	MessageVersionMultiRecipient = 3
+
+	// The version stamped on newly packed messages.
+	MessageVersion = MessageVersionHybrid
+)
+
 type MessageWrapper struct {
+	Version   int    `json:"version,omitempty"`
 	Message   []byte `json:"message"`
 	Signature []byte `json:"signature"`
 	Pubkey    []byte `json:"pubkey"`
 }
 
 func PackMessage(message []byte, signature []byte, pubkey []byte) (string, error) {
+	return packMessage(MessageVersion, message, signature, pubkey)
+}
+
+func packMessage(version int, message []byte, signature []byte, pubkey []byte) (string, error) {
 	wrapper := &MessageWrapper{
+		Version:   version,
 		Message:   message,
 		Signature: signature,
 		Pubkey:    pubkey,
@@ -26,17 +49,77 @@ func PackMessage(message []byte, signature []byte, pubkey []byte) (string, error
 	return base64.StdEncoding.EncodeToString(jsonBytes), nil
 }
 
-func UnpackMessage(message string) ([]byte, []byte, []byte, error) {
+func UnpackMessage(message string) (*MessageWrapper, error) {
 	jsonBytes, err := base64.StdEncoding.DecodeString(message)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
 	wrapper := &MessageWrapper{}
 	err = json.Unmarshal(jsonBytes, wrapper)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
+	}
+
+	return wrapper, nil
+}
+
+// Encrypts and signs a single message and packs it together with the sender's public
+// key, the format produced by the Encrypt menu.
+func EncryptAndPackMessage(privateKey, recipientPublicKey any, message []byte) (string, error) {
+	emsg, sig, err := EncryptAndSignMessage(privateKey, recipientPublicKey, message)
+	if err != nil {
+		return "", err
+	}
+
+	pubkey, err := PublicKeyToBytes(privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return PackMessage(emsg, sig, pubkey)
+}
+
+// Encrypts and signs a single message to several recipients at once, every recipient
+// decrypts the same packed message with their own private key. Messages to a single
+// recipient are packed like EncryptAndPackMessage so older releases can read them.
+func MultiEncryptAndPackMessage(privateKey any, recipientPublicKeys []any, message []byte) (string, error) {
+	if len(recipientPublicKeys) == 1 {
+		return EncryptAndPackMessage(privateKey, recipientPublicKeys[0], message)
+	}
+
+	emsg, sig, err := MultiEncryptAndSignMessage(privateKey, recipientPublicKeys, message)
+	if err != nil {
+		return "", err
+	}
+
+	pubkey, err := PublicKeyToBytes(privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return packMessage(MessageVersionMultiRecipient, emsg, sig, pubkey)
+}
+
+// Unpacks and decrypts a single message. The signature is verified with senderPublicKey,
+// or with the public key packed into the message when senderPublicKey is nil.
+func UnpackAndDecryptMessage(privateKey, senderPublicKey any, message string) ([]byte, error) {
+	wrapper, err := UnpackMessage(message)
+	if err != nil {
+		return nil, err
+	}
+
+	if senderPublicKey == nil {
+		keyType, err := KeyType(privateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		senderPublicKey, err = PublicKeyToMem(keyType, wrapper.Pubkey)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return wrapper.Message, wrapper.Signature, wrapper.Pubkey, nil
+	return DecryptAndVerifyMessage(wrapper.Version, privateKey, senderPublicKey, wrapper.Message, wrapper.Signature)
 }
@@ -1,18 +1,9 @@
 package menus
 
 import (
-	"crypto/rsa"
-
 	"fyne.io/fyne/v2"
-	"github.com/ProtonMail/gopenpgp/v3/crypto"
 )
 
-var SingleMessageRSAPrivateKey *rsa.PrivateKey
-var SingleMessagePGPPrivateKey *crypto.Key
-var SingleMessagePublicKey string
-var SingleMessagePrivateKeyPath string
-var SingleMessageKeyType string
-
 type Menu struct {
 	Title string
 	View  func(w fyne.Window) fyne.CanvasObject
@@ -24,7 +15,8 @@ var (
 		"Conversations": {"Conversations", ServerView},
 		"Encrypt":       {"Encrypt", EncryptView},
 		"Decrypt":       {"Decrypt", DecryptView},
+		"Contacts":      {"Contacts", ContactsView},
 	}
 
-	MenuOrder = []string{"Home", "Conversations", "Encrypt", "Decrypt"}
+	MenuOrder = []string{"Home", "Conversations", "Encrypt", "Decrypt", "Contacts"}
 )
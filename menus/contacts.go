@@ -0,0 +1,281 @@
+package menus
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/server"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+var (
+	// Contact book kept with the default private key of the keyring, used while no
+	// server with its own contact book is running
+	contactBook    *server.ContactBook
+	contactBookKey any
+)
+
+// Returns the contact book of the running server, or the one kept in the local storage
+// of the default private key.
+func openContacts() (*server.ContactBook, error) {
+	if rh != nil && rh.Contacts != nil {
+		return rh.Contacts, nil
+	}
+
+	identity := keyring.Default()
+	if identity == nil {
+		return nil, fmt.Errorf("Unlock a private key on the Home screen to open the contact book")
+	}
+	privateKey := identity.PrivateKey
+
+	if contactBook == nil || contactBookKey != privateKey {
+		vault, err := server.OpenKeyVault(privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening the contact book: %s", err)
+		}
+
+		contactBook, contactBookKey = server.NewContactBook(vault), privateKey
+	}
+
+	return contactBook, nil
+}
+
+func trustLabels() []string {
+	return []string{server.TrustUnverified.String(), server.TrustVerified.String(), server.TrustUntrusted.String()}
+}
+
+// Renders the leading words of a hex encoded fingerprint.
+func fingerprintWords(fingerprint string) string {
+	b, err := hex.DecodeString(fingerprint)
+	if err != nil {
+		return fingerprint
+	}
+
+	return strings.Join(crypt.FingerprintWords(b), " ")
+}
+
+func ContactsView(w fyne.Window) fyne.CanvasObject {
+	screen := container.NewVBox()
+
+	var refresh func()
+	refresh = func() {
+		screen.Objects = nil
+
+		book, err := openContacts()
+		if err != nil {
+			screen.Add(widget.NewLabel(err.Error()))
+			screen.Refresh()
+			return
+		}
+
+		screen.Add(widget.NewButtonWithIcon("Add Contact", theme.ContentAddIcon(), func() {
+			showAddContact(book, w, refresh)
+		}))
+		screen.Add(widget.NewSeparator())
+
+		contacts, err := book.Contacts()
+		if err != nil {
+			screen.Add(widget.NewLabel(err.Error()))
+		}
+		if err == nil && len(contacts) == 0 {
+			screen.Add(widget.NewLabel("Contacts are added here or pinned the first time a conversation is started."))
+		}
+
+		for _, c := range contacts {
+			alias := c.Alias
+			details := fmt.Sprintf("%s key, %s", c.KeyType, fingerprintWords(c.Fingerprint))
+			if c.Address != "" {
+				details += fmt.Sprintf("\nLast seen at %s...%s on %s", c.Address[:5], c.Address[max(0, len(c.Address)-15):], c.LastSeen.Format("2006-01-02"))
+			}
+
+			trust := widget.NewSelect(trustLabels(), nil)
+			trust.SetSelected(c.Trust.String())
+			trust.OnChanged = func(s string) {
+				level, err := server.ParseTrustLevel(s)
+				if err == nil {
+					err = book.SetTrust(alias, level)
+				}
+				if err != nil {
+					dialog.ShowError(err, w)
+				}
+			}
+
+			remove := widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {
+				dialog.ShowConfirm("Remove Contact", fmt.Sprintf("Remove %s and their pinned key?", alias), func(b bool) {
+					if !b {
+						return
+					}
+
+					if err := book.Remove(alias); err != nil {
+						dialog.ShowError(err, w)
+					}
+					refresh()
+				}, w)
+			})
+
+			copyKey := widget.NewButtonWithIcon("", theme.ContentCopyIcon(), func() {
+				w.Clipboard().SetContent(string(c.PublicKey))
+			})
+
+			screen.Add(container.NewBorder(nil, nil, nil,
+				container.NewHBox(trust, copyKey, remove),
+				container.NewVBox(
+					widget.NewLabelWithStyle(alias, fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+					widget.NewLabel(details),
+				),
+			))
+		}
+
+		screen.Refresh()
+	}
+	refresh()
+
+	return container.NewVScroll(screen)
+}
+
+// Adds a contact from a pasted public key.
+func showAddContact(book *server.ContactBook, w fyne.Window, refresh func()) {
+	alias := widget.NewEntry()
+	keyType := widget.NewSelect([]string{"rsa", "pgp", "x25519"}, nil)
+	keyType.SetSelected("x25519")
+	publicKey := widget.NewEntry()
+	publicKey.MultiLine = true
+	publicKey.SetMinRowsVisible(5)
+	trust := widget.NewSelect(trustLabels(), nil)
+	trust.SetSelected(server.TrustUnverified.String())
+
+	d := dialog.NewForm(
+		"Add Contact",
+		"Add",
+		"Cancel",
+		[]*widget.FormItem{
+			{Text: "Alias", Widget: alias},
+			{Text: "Key Type", Widget: keyType},
+			{Text: "Public Key", Widget: publicKey},
+			{Text: "Trust", Widget: trust},
+		},
+		func(b bool) {
+			if !b {
+				return
+			}
+
+			level, err := server.ParseTrustLevel(trust.Selected)
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+
+			if _, err := book.Add(alias.Text, keyType.Selected, []byte(publicKey.Text), level); err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			refresh()
+		},
+		w,
+	)
+	d.Resize(fyne.NewSize(600, 400))
+	d.Show()
+}
+
+// Lets the user fill the public key and alias of the conversation dialogs from a contact,
+// see loadContactOptions.
+func contactSelect(w fyne.Window) *widget.Select {
+	s := widget.NewSelect(nil, func(alias string) {
+		book, err := openContacts()
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		c, ok := book.Contact(alias)
+		if !ok {
+			return
+		}
+
+		wrp.SetText(string(c.PublicKey))
+		wa.SetText(c.Alias)
+	})
+	s.PlaceHolder = "Paste a public key or select a contact"
+
+	return s
+}
+
+// Offers the current contacts in a select created by contactSelect.
+func loadContactOptions(s *widget.Select) {
+	s.Options = nil
+	if book, err := openContacts(); err == nil {
+		contacts, _ := book.Contacts()
+		for _, c := range contacts {
+			s.Options = append(s.Options, c.Alias)
+		}
+	}
+
+	s.ClearSelected()
+}
+
+// Warns about changed and untrusted keys. Keys pinned on the first conversation only
+// show up as unverified in the conversation header.
+func showKeyWarning(e server.Event, w fyne.Window) {
+	var keyErr *server.KeyError
+	if !errors.As(e.Err, &keyErr) {
+		dialog.ShowError(e.Err, w)
+		return
+	}
+
+	switch {
+	case keyErr.Status == server.KeyNew:
+		return
+
+	case keyErr.Status == server.KeyChanged:
+		message := widget.NewLabel(keyErr.Error() + ".\n\nOnly accept the new key after confirming it with your contact over a trusted channel.")
+		message.Wrapping = fyne.TextWrapWord
+
+		d := dialog.NewCustomConfirm("WARNING: Key Changed", "Accept New Key", "Keep Old Key", message, func(b bool) {
+			if !b || rh == nil {
+				return
+			}
+
+			if err := rh.AcceptKey(e.ConversationID); err != nil {
+				dialog.ShowError(err, w)
+			}
+			if cr := renderFor(e.ConversationID); cr != nil {
+				cr.UpdateHeader()
+			}
+		}, w)
+		d.Resize(fyne.NewSize(500, 250))
+		d.Show()
+
+	default:
+		dialog.ShowError(fmt.Errorf("WARNING: %s", keyErr), w)
+	}
+}
+
+// Flags a conversation whose contact is known with a different key and offers to accept
+// the new key.
+func (cr *conversationRender) keyWarningButton(c *server.Conversation) *widget.Button {
+	button := widget.NewButtonWithIcon("Key Changed", theme.WarningIcon(), func() {
+		keyErr := &server.KeyError{Status: server.KeyChanged}
+		if fingerprint, err := crypt.Fingerprint(c.RemotePublicKey); err == nil {
+			keyErr.Fingerprint = hex.EncodeToString(fingerprint)
+		}
+		if book, err := openContacts(); err == nil {
+			keyErr.Contact, _ = book.Contact(c.ConversationAlias)
+		}
+		if keyErr.Contact == nil {
+			keyErr.Contact = &server.Contact{Alias: c.ConversationAlias}
+		}
+
+		showKeyWarning(server.Event{Type: server.EventKeyWarning, ConversationID: c.ConversationID, Err: keyErr}, cr.Window)
+	})
+	button.Importance = widget.DangerImportance
+
+	return button
+}
@@ -1,17 +1,160 @@
 package menus
 
 import (
+	"bufio"
+	"encoding/hex"
 	"fmt"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/server"
 
 	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/data/binding"
 	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 )
 
+// Selected when the sender is not known in advance, the key packed into the message is
+// looked up in the contact book instead.
+const anySender = "Any Sender"
+
+// Shows who signed a decrypted message on a colored background.
+type senderBanner struct {
+	background *canvas.Rectangle
+	label      *widget.Label
+	container  *fyne.Container
+}
+
+func newSenderBanner() *senderBanner {
+	b := &senderBanner{
+		background: canvas.NewRectangle(color.Transparent),
+		label:      widget.NewLabelWithStyle("", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+	}
+	b.label.Wrapping = fyne.TextWrapWord
+	b.container = container.NewStack(b.background, container.NewPadded(b.label))
+	b.container.Hide()
+
+	return b
+}
+
+func (b *senderBanner) set(fill color.Color, text string) {
+	b.background.FillColor = fill
+	b.label.SetText(text)
+	b.background.Refresh()
+	b.container.Show()
+}
+
+func (b *senderBanner) clear() {
+	b.container.Hide()
+}
+
+// Verified messages were signed by the key pinned for a verified contact.
+func (b *senderBanner) verified(text string) {
+	b.set(theme.Color(theme.ColorNameSuccess), "VERIFIED: "+text)
+}
+
+func (b *senderBanner) unverified(text string) {
+	b.set(theme.Color(theme.ColorNameWarning), "UNVERIFIED: "+text)
+}
+
+func (b *senderBanner) mismatch(text string) {
+	b.set(theme.Color(theme.ColorNameError), "WARNING: "+text)
+}
+
+// Reports a message signed by the key of a contact.
+func (b *senderBanner) contact(c *server.Contact) {
+	switch c.Trust {
+	case server.TrustVerified:
+		b.verified(fmt.Sprintf("Signed by %s", c.Alias))
+	case server.TrustUntrusted:
+		b.mismatch(fmt.Sprintf("Signed by %s whose key is marked untrusted", c.Alias))
+	default:
+		b.unverified(fmt.Sprintf("Signed by %s, their key was not verified yet", c.Alias))
+	}
+}
+
+// Shows who signed a message or file verified with the public key packed into it. When an
+// expected sender is picked the banner warns unless their pinned key signed it, ok is false
+// in that case.
+func (b *senderBanner) report(expectedSender, keyType string, pubkey []byte) (bool, error) {
+	packedKey, err := crypt.PublicKeyToMem(keyType, pubkey)
+	if err != nil {
+		return false, err
+	}
+
+	fingerprint, err := crypt.Fingerprint(packedKey)
+	if err != nil {
+		return false, err
+	}
+	signer := fmt.Sprintf("an unknown key %s", strings.ReplaceAll(crypt.FingerprintHexGrid(fingerprint), "\n", " "))
+
+	book, bookErr := openContacts()
+	var packedContact *server.Contact
+	if bookErr == nil {
+		c, status, err := book.Resolve("", keyType, pubkey)
+		if err == nil && status == server.KeyMatch {
+			packedContact = c
+			signer = fmt.Sprintf("%s's key", c.Alias)
+		}
+	}
+
+	if expectedSender != anySender && bookErr == nil {
+		expected, ok := book.Contact(expectedSender)
+		if !ok {
+			return false, fmt.Errorf("Unknown contact: %s", expectedSender)
+		}
+
+		if expected.KeyType != keyType || expected.Fingerprint != hex.EncodeToString(fingerprint) {
+			b.mismatch(fmt.Sprintf("NOT signed by %s, it was signed by %s", expected.Alias, signer))
+			return false, nil
+		}
+
+		b.contact(expected)
+		return true, nil
+	}
+
+	switch {
+	case packedContact != nil:
+		b.contact(packedContact)
+	case bookErr != nil:
+		b.unverified(fmt.Sprintf("Signed by %s, the contact book could not be checked: %s", signer, bookErr))
+	default:
+		b.unverified(fmt.Sprintf("Signed by %s", signer))
+	}
+
+	return true, nil
+}
+
+// Returns the unlocked key that opens a message, starting with the picked one. Messages
+// to several recipients may be addressed to another unlocked key of the same type.
+func recipientIdentity(picked *Identity, open func(*Identity) error) (*Identity, error) {
+	err := open(picked)
+	if err == nil {
+		return picked, nil
+	}
+
+	for _, other := range keyring.Identities() {
+		if other.ID == picked.ID || other.KeyType != picked.KeyType {
+			continue
+		}
+
+		if open(other) == nil {
+			return other, nil
+		}
+	}
+
+	return nil, err
+}
+
 func DecryptView(w fyne.Window) fyne.CanvasObject {
 	var rawMessage string
 
@@ -22,70 +165,220 @@ func DecryptView(w fyne.Window) fyne.CanvasObject {
 	rawMessageInput.SetMinRowsVisible(5)
 	rawMessageInput.Wrapping = fyne.TextWrapWord
 
+	// Recipient
+	recipient := newIdentityPicker()
+
+	// Expected Sender
+	expectedSender := widget.NewSelect([]string{anySender}, nil)
+	if book, err := openContacts(); err == nil {
+		contacts, _ := book.Contacts()
+		for _, c := range contacts {
+			expectedSender.Options = append(expectedSender.Options, c.Alias)
+		}
+	}
+	expectedSender.SetSelected(anySender)
+
 	// Decrypted Message
 	decryptedMessage := widget.NewEntry()
 	decryptedMessage.MultiLine = true
 	decryptedMessage.SetMinRowsVisible(15)
 
-	// Private Key
-	decryptForm := &widget.Form{
-		Items: []*widget.FormItem{
-			{Text: "Raw Message", Widget: rawMessageInput},
-		},
-		OnSubmit: func() {
-			if rawMessage == "" {
-				dialog.ShowError(fmt.Errorf("No Message to Encrypt"), w)
-				return
-			}
+	banner := newSenderBanner()
 
-			emsg, sig, senderPubkey, err := crypt.UnpackMessage(rawMessage)
-			if err != nil {
-				dialog.ShowError(err, w)
-				return
-			}
+	keysForm := widget.NewForm(
+		widget.NewFormItem("Decrypt As", recipient),
+		widget.NewFormItem("Expected Sender", expectedSender),
+	)
 
-			switch SingleMessageKeyType {
-			case "pgp":
-				pubkey, err := crypt.PGPPublicKeyToMem(senderPubkey)
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
+	decryptMessage := widget.NewButtonWithIcon("Decrypt Message", theme.ConfirmIcon(), func() {
+		banner.clear()
+		decryptedMessage.SetText("")
 
-				msg, err := crypt.PGPDecryptAndVerifyMessage(SingleMessagePGPPrivateKey, pubkey, emsg)
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
+		if rawMessage == "" {
+			dialog.ShowError(fmt.Errorf("No Message to Encrypt"), w)
+			return
+		}
 
-				decryptedMessage.SetText(string(msg))
+		identity := recipient.Identity()
+		if identity == nil {
+			dialog.ShowError(fmt.Errorf("Key Type Not Selected"), w)
+			return
+		}
 
-			case "rsa":
-				pubkey, err := crypt.RSAPublicKeyToMem(senderPubkey)
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
+		wrapper, err := crypt.UnpackMessage(rawMessage)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		packedKey, err := crypt.PublicKeyToMem(identity.KeyType, wrapper.Pubkey)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		// The packed key proves the message was not altered after signing, only a
+		// pinned key proves who signed it
+		var msg []byte
+		opened, err := recipientIdentity(identity, func(id *Identity) (err error) {
+			msg, err = crypt.DecryptAndVerifyMessage(wrapper.Version, id.PrivateKey, packedKey, wrapper.Message, wrapper.Signature)
+			return err
+		})
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		recipient.SetSelected(opened.Name())
+		decryptedMessage.SetText(string(msg))
+
+		if _, err := banner.report(expectedSender.Selected, identity.KeyType, wrapper.Pubkey); err != nil {
+			dialog.ShowError(err, w)
+		}
+	})
+	decryptMessage.Importance = widget.HighImportance
+
+	// Encrypted File, decrypted in chunks so it may be larger than memory
+	var inputPath string
+	inputLabel := widget.NewLabel("No file selected")
+	inputDialog := dialog.NewFileOpen(func(f fyne.URIReadCloser, err error) {
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		if f == nil {
+			return
+		}
+		defer f.Close()
+
+		header, err := crypt.ReadStreamHeader(f)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		size := "unknown size"
+		if header.Size >= 0 {
+			size = formatSize(header.Size)
+		}
+
+		inputPath = f.URI().Path()
+		inputLabel.SetText(fmt.Sprintf("%s\nContains %s (%s) encrypted with %s keys", inputPath, filepath.Base(header.Name), size, header.KeyType))
+	}, w)
+	inputDialog.SetFilter(storage.NewExtensionFileFilter([]string{crypt.StreamExtension}))
+
+	decryptFile := widget.NewButtonWithIcon("Decrypt File", theme.ConfirmIcon(), func() {
+		banner.clear()
+
+		if inputPath == "" {
+			dialog.ShowError(fmt.Errorf("No file selected"), w)
+			return
+		}
+
+		identity := recipient.Identity()
+		if identity == nil {
+			dialog.ShowError(fmt.Errorf("Key Type Not Selected"), w)
+			return
+		}
+
+		src, err := os.Open(inputPath)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		info, err := src.Stat()
+		if err != nil {
+			src.Close()
+			dialog.ShowError(err, w)
+			return
+		}
+
+		r := bufio.NewReader(src)
+		header, err := crypt.ReadStreamHeader(r)
+		if err == nil && header.KeyType != identity.KeyType {
+			err = fmt.Errorf("The file was encrypted with %s keys", header.KeyType)
+		}
+		if err != nil {
+			src.Close()
+			dialog.ShowError(err, w)
+			return
+		}
+
+		packedKey, err := crypt.PublicKeyToMem(header.KeyType, header.Pubkey)
+		if err != nil {
+			src.Close()
+			dialog.ShowError(err, w)
+			return
+		}
+
+		// A file not signed by the expected sender is not written at all
+		ok, err := banner.report(expectedSender.Selected, header.KeyType, header.Pubkey)
+		if err == nil && !ok {
+			err = fmt.Errorf("The file was not signed by %s", expectedSender.Selected)
+		}
+		if err != nil {
+			src.Close()
+			dialog.ShowError(err, w)
+			return
+		}
+
+		opened, err := recipientIdentity(identity, func(id *Identity) error {
+			_, err := crypt.DecryptAndVerifyMessage(crypt.MessageVersionMultiRecipient, id.PrivateKey, packedKey, header.SessionKey, header.SessionKeySignature)
+			return err
+		})
+		if err != nil {
+			src.Close()
+			banner.clear()
+			dialog.ShowError(err, w)
+			return
+		}
+		recipient.SetSelected(opened.Name())
+
+		pickSavePath("Save Decrypted File", baseName(header.Name), w, func(path string) {
+			if path == "" {
+				src.Close()
+				banner.clear()
+				return
+			}
+
+			// The decrypted file is written next to path and only renamed over it once the
+			// signature was verified, an existing file is kept when decrypting fails
+			withProgress("Decrypting "+filepath.Base(path), r, info.Size(), w, func(r io.Reader) error {
+				return crypt.DecryptStreamToFile(path, r, header, opened.PrivateKey, packedKey)
+			}, func(err error) {
+				src.Close()
 
-				msg, err := crypt.RSADecryptAndVerifyMessage(SingleMessageRSAPrivateKey, pubkey, emsg, sig)
 				if err != nil {
+					banner.clear()
 					dialog.ShowError(err, w)
 					return
 				}
 
-				decryptedMessage.SetText(string(msg))
+				dialog.ShowInformation("Successfully Decrypted", fmt.Sprintf("Saved the decrypted file to %s", path), w)
+			})
+		})
+	})
+	decryptFile.Importance = widget.HighImportance
 
-			default:
-				dialog.ShowError(fmt.Errorf("Key Type Not Selected"), w)
-				return
-			}
-		},
-	}
-
-	return container.NewVBox(
-		decryptForm,
-		widget.NewSeparator(),
-		widget.NewLabel("Decrypted Message"),
-		decryptedMessage,
-	)
+	return container.NewVScroll(container.NewVBox(
+		keysForm,
+		banner.container,
+		container.NewAppTabs(
+			container.NewTabItemWithIcon("Message", theme.DocumentIcon(), container.NewVBox(
+				widget.NewForm(widget.NewFormItem("Raw Message", rawMessageInput)),
+				decryptMessage,
+				widget.NewSeparator(),
+				widget.NewLabel("Decrypted Message"),
+				decryptedMessage,
+			)),
+			container.NewTabItemWithIcon("File", theme.FileIcon(), container.NewVBox(
+				widget.NewForm(widget.NewFormItem("Encrypted File", container.NewBorder(nil, nil, nil,
+					widget.NewButtonWithIcon("Select File", theme.FolderOpenIcon(), inputDialog.Show),
+					inputLabel,
+				))),
+				decryptFile,
+			)),
+		),
+	))
 }
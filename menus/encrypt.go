@@ -1,7 +1,12 @@
 package menus
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/JustinTimperio/onionsoup/crypt"
 
@@ -9,11 +14,11 @@ import (
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/data/binding"
 	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 )
 
 func EncryptView(w fyne.Window) fyne.CanvasObject {
-	var recipientPublicKey string
 	var rawMessage string
 
 	// Input Message
@@ -22,83 +27,243 @@ func EncryptView(w fyne.Window) fyne.CanvasObject {
 	rawMessageInput.MultiLine = true
 	rawMessageInput.SetMinRowsVisible(15)
 
-	// Recipient Public Key
-	recipientPublicKeyInput := widget.NewEntryWithData(binding.BindString(&recipientPublicKey))
-	recipientPublicKeyInput.SetPlaceHolder("Paste your recipient's public key here")
-	recipientPublicKeyInput.MultiLine = true
-	recipientPublicKeyInput.SetMinRowsVisible(5)
-
-	encryptForm := &widget.Form{
-		Items: []*widget.FormItem{
-			{Text: "Recipient's Public Key", Widget: recipientPublicKeyInput},
-			{Text: "Raw Message", Widget: rawMessageInput},
-		},
-		OnSubmit: func() {
-			if rawMessage == "" || recipientPublicKey == "" {
-				dialog.ShowError(fmt.Errorf("Please fill in all fields"), w)
-				return
-			}
+	// Recipient Public Keys, every recipient decrypts the same message
+	var recipientInputs []*widget.Entry
+	recipients := container.NewVBox()
 
-			var emsg, sig []byte
-			switch SingleMessageKeyType {
-			case "rsa":
-				if SingleMessageRSAPrivateKey == nil {
-					dialog.ShowError(fmt.Errorf("No private key found"), w)
-					return
-				}
+	var addRecipient func(publicKey string)
+	addRecipient = func(publicKey string) {
+		input := widget.NewEntry()
+		input.SetPlaceHolder("Paste your recipient's public key here")
+		input.MultiLine = true
+		input.SetMinRowsVisible(5)
+		input.SetText(publicKey)
+		recipientInputs = append(recipientInputs, input)
 
-				pubkey, err := crypt.RSAPublicKeyToMem([]byte(recipientPublicKey))
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
+		var row *fyne.Container
+		remove := widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {
+			for i, r := range recipientInputs {
+				if r == input {
+					recipientInputs = append(recipientInputs[:i], recipientInputs[i+1:]...)
+					break
 				}
+			}
+			recipients.Remove(row)
+			if len(recipientInputs) == 0 {
+				addRecipient("")
+			}
+		})
 
-				emsg, sig, err = crypt.RSAEncryptAndSignMessage(SingleMessageRSAPrivateKey, pubkey, []byte(rawMessage))
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
+		row = container.NewBorder(nil, nil, nil, remove, input)
+		recipients.Add(row)
+	}
+	addRecipient("")
 
-			case "pgp":
-				if SingleMessagePGPPrivateKey == nil {
-					dialog.ShowError(fmt.Errorf("No private key found"), w)
-					return
-				}
+	// Adds a recipient from the contact book, an empty recipient is filled first
+	contact := widget.NewSelect(nil, func(alias string) {
+		book, err := openContacts()
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
 
-				pubkey, err := crypt.PGPPublicKeyToMem([]byte(recipientPublicKey))
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
+		c, ok := book.Contact(alias)
+		if !ok {
+			return
+		}
 
-				emsg, err = crypt.PGPEncryptAndSignMessage(SingleMessagePGPPrivateKey, pubkey, []byte(rawMessage))
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
+		if last := recipientInputs[len(recipientInputs)-1]; last.Text == "" {
+			last.SetText(string(c.PublicKey))
+			return
+		}
+		addRecipient(string(c.PublicKey))
+	})
+	loadContactOptions(contact)
+	contact.PlaceHolder = "Add a contact as recipient"
+
+	// Sender
+	sender := newIdentityPicker()
 
-			default:
-				dialog.ShowError(fmt.Errorf("No private key found"), w)
+	// Parses the recipients for the picked private key
+	recipientKeys := func() (*Identity, []any, error) {
+		identity := sender.Identity()
+		if identity == nil {
+			return nil, nil, fmt.Errorf("No private key found")
+		}
+
+		var pubkeys []any
+		for _, input := range recipientInputs {
+			if strings.TrimSpace(input.Text) == "" {
+				continue
+			}
+
+			pubkey, err := crypt.PublicKeyToMem(identity.KeyType, []byte(input.Text))
+			if err != nil {
+				return nil, nil, fmt.Errorf("Recipient %d: %s", len(pubkeys)+1, err)
+			}
+			pubkeys = append(pubkeys, pubkey)
+		}
+
+		if len(pubkeys) == 0 {
+			return nil, nil, fmt.Errorf("Please fill in all fields")
+		}
+
+		return identity, pubkeys, nil
+	}
+
+	clearRecipients := func() {
+		recipientInputs = nil
+		recipients.RemoveAll()
+		addRecipient("")
+		contact.ClearSelected()
+	}
+
+	keysForm := widget.NewForm(
+		widget.NewFormItem("Sign As", sender),
+		widget.NewFormItem("Recipients' Public Keys", recipients),
+		widget.NewFormItem("", container.NewHBox(
+			widget.NewButtonWithIcon("Add Recipient", theme.ContentAddIcon(), func() {
+				addRecipient("")
+			}),
+			contact,
+		)),
+	)
+
+	encryptMessage := widget.NewButtonWithIcon("Encrypt Message", theme.ConfirmIcon(), func() {
+		if rawMessage == "" {
+			dialog.ShowError(fmt.Errorf("Please fill in all fields"), w)
+			return
+		}
+
+		identity, pubkeys, err := recipientKeys()
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		packedMessage, err := crypt.MultiEncryptAndPackMessage(identity.PrivateKey, pubkeys, []byte(rawMessage))
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		// Show encrypted message
+		w.Clipboard().SetContent(packedMessage)
+		dialog.ShowInformation("Successfully Encrypted", "Sent encrypted message to clipboard!", w)
+
+		// Clear input fields
+		rawMessageInput.SetText("")
+		clearRecipients()
+	})
+	encryptMessage.Importance = widget.HighImportance
+
+	// Input File, read in chunks so it may be larger than memory
+	var inputPath string
+	inputLabel := widget.NewLabel("No file selected")
+	inputDialog := dialog.NewFileOpen(func(f fyne.URIReadCloser, err error) {
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		if f == nil {
+			return
+		}
+		f.Close()
+
+		info, err := os.Stat(f.URI().Path())
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		inputPath = f.URI().Path()
+		inputLabel.SetText(fmt.Sprintf("%s (%s)", inputPath, formatSize(info.Size())))
+	}, w)
+
+	encryptFile := widget.NewButtonWithIcon("Encrypt File", theme.ConfirmIcon(), func() {
+		if inputPath == "" {
+			dialog.ShowError(fmt.Errorf("No file selected"), w)
+			return
+		}
+
+		identity, pubkeys, err := recipientKeys()
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		pickSavePath("Save Encrypted File", filepath.Base(inputPath)+crypt.StreamExtension, w, func(path string) {
+			if path == "" {
+				return
+			}
+
+			src, err := os.Open(inputPath)
+			if err != nil {
+				dialog.ShowError(err, w)
 				return
 			}
 
-			packedMessage, err := crypt.PackMessage(emsg, sig, []byte(SingleMessagePublicKey))
+			info, err := src.Stat()
 			if err != nil {
+				src.Close()
 				dialog.ShowError(err, w)
 				return
 			}
 
-			// Show encrypted message
-			w.Clipboard().SetContent(packedMessage)
-			dialog.ShowInformation("Successfully Encrypted", "Sent encrypted message to clipboard!", w)
+			// Written next to path and only renamed over it once complete, so a failed
+			// encryption never leaves a partial file or loses an existing one
+			tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+			if err != nil {
+				src.Close()
+				dialog.ShowError(err, w)
+				return
+			}
 
-			// Clear input fields
-			rawMessageInput.SetText("")
-			recipientPublicKeyInput.SetText("")
-		},
-	}
+			name := filepath.Base(inputPath)
+			withProgress("Encrypting "+name, src, info.Size(), w, func(r io.Reader) error {
+				out := bufio.NewWriter(tmp)
+				if err := crypt.EncryptStream(out, r, identity.PrivateKey, pubkeys, name, info.Size()); err != nil {
+					return err
+				}
+				return out.Flush()
+			}, func(err error) {
+				src.Close()
+				if cerr := tmp.Close(); err == nil {
+					err = cerr
+				}
+				if err == nil {
+					err = os.Rename(tmp.Name(), path)
+				}
 
-	return container.NewStack(
-		encryptForm,
-	)
+				if err != nil {
+					os.Remove(tmp.Name())
+					dialog.ShowError(err, w)
+					return
+				}
+
+				dialog.ShowInformation("Successfully Encrypted", fmt.Sprintf("Saved the encrypted file to %s", path), w)
+				inputPath = ""
+				inputLabel.SetText("No file selected")
+			})
+		})
+	})
+	encryptFile.Importance = widget.HighImportance
+
+	return container.NewVScroll(container.NewVBox(
+		keysForm,
+		container.NewAppTabs(
+			container.NewTabItemWithIcon("Message", theme.DocumentIcon(), container.NewVBox(
+				widget.NewForm(widget.NewFormItem("Raw Message", rawMessageInput)),
+				encryptMessage,
+			)),
+			container.NewTabItemWithIcon("File", theme.FileIcon(), container.NewVBox(
+				widget.NewForm(widget.NewFormItem("File", container.NewBorder(nil, nil, nil,
+					widget.NewButtonWithIcon("Select File", theme.FolderOpenIcon(), inputDialog.Show),
+					inputLabel,
+				))),
+				encryptFile,
+			)),
+		),
+	))
 }
@@ -0,0 +1,126 @@
+package menus
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Reports how much of a file was read to a progress bar.
+type progressReader struct {
+	r     io.Reader
+	read  int64
+	total int64
+	bar   *widget.ProgressBar
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+
+	before := p.read
+	p.read += int64(n)
+	// Refreshing the bar for every chunk would slow down large files
+	if p.read>>20 != before>>20 {
+		p.bar.SetValue(float64(p.read) / float64(p.total))
+	}
+
+	return n, err
+}
+
+// Runs work in the background behind a dialog with a progress bar. The reader passed to
+// work advances the bar while the total bytes of r are read, done is called with the
+// result once the dialog is closed.
+func withProgress(title string, r io.Reader, total int64, w fyne.Window, work func(io.Reader) error, done func(error)) {
+	var bar fyne.CanvasObject
+	if total > 0 {
+		progress := widget.NewProgressBar()
+		r = &progressReader{r: r, total: total, bar: progress}
+		bar = progress
+	} else {
+		bar = widget.NewProgressBarInfinite()
+	}
+
+	d := dialog.NewCustomWithoutButtons(title, container.NewVBox(
+		widget.NewLabel(fmt.Sprintf("%s, this may take a while for large files...", title)),
+		bar,
+	), w)
+	d.Resize(fyne.NewSize(400, 100))
+	d.Show()
+
+	go func() {
+		err := work(r)
+		d.Hide()
+		done(err)
+	}()
+}
+
+// Asks for a folder and a file name to save to and confirms replacing an existing file.
+// A save dialog would create the file right away, so nothing is written here and the
+// caller only replaces the file once its contents are complete. done is called with an
+// empty path when the user cancels.
+func pickSavePath(title, name string, w fyne.Window, done func(path string)) {
+	folderDialog := dialog.NewFolderOpen(func(folder fyne.ListableURI, err error) {
+		if err != nil {
+			done("")
+			dialog.ShowError(err, w)
+			return
+		}
+
+		if folder == nil {
+			done("")
+			return
+		}
+
+		nameInput := widget.NewEntry()
+		nameInput.SetText(name)
+
+		dialog.ShowForm(title, "Save", "Cancel", []*widget.FormItem{
+			widget.NewFormItem("File Name", nameInput),
+		}, func(save bool) {
+			if !save {
+				done("")
+				return
+			}
+
+			name := baseName(nameInput.Text)
+			if name == "" {
+				done("")
+				dialog.ShowError(fmt.Errorf("Invalid file name"), w)
+				return
+			}
+
+			path := filepath.Join(folder.Path(), name)
+			if _, err := os.Stat(path); err == nil {
+				dialog.ShowConfirm("Replace File", fmt.Sprintf("%s already exists, replace it?", path), func(replace bool) {
+					if !replace {
+						done("")
+						return
+					}
+					done(path)
+				}, w)
+				return
+			}
+
+			done(path)
+		}, w)
+	}, w)
+	folderDialog.Show()
+}
+
+// Returns the base name of a file name picked by the sender or typed by the user, or an
+// empty string when it names no file.
+func baseName(name string) string {
+	name = filepath.Base(strings.TrimSpace(name))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return ""
+	}
+
+	return name
+}
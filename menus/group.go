@@ -0,0 +1,273 @@
+package menus
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/server"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Groups are listed next to conversations with this prefix on their tree id.
+const groupPrefix = "group/"
+
+// Widgets of the group currently shown in the server view.
+type groupRender struct {
+	GroupID    string
+	Handler    *server.RouteHandler
+	Fullscreen *fyne.Container
+	Messages   *fyne.Container
+	Header     *fyne.Container
+	Window     fyne.Window
+
+	// Bubbles of messages sent by this party by message id
+	sent map[string]*messageScreen
+}
+
+var activeGroup *groupRender
+
+// Returns the render of the group if it is the one on screen.
+func groupRenderFor(id string) *groupRender {
+	renderMux.Lock()
+	defer renderMux.Unlock()
+
+	if activeGroup == nil || activeGroup.GroupID != id {
+		return nil
+	}
+	return activeGroup
+}
+
+// Returns the labels of the established conversations and the conversation id of each.
+func activeConversations(h *server.RouteHandler) ([]string, map[string]string) {
+	var (
+		labels []string
+		ids    = make(map[string]string)
+	)
+	for _, id := range h.ConversationIDs() {
+		c, ok := h.Conversation(id)
+		if !ok || !c.Established || c.Ended {
+			continue
+		}
+
+		label := fmt.Sprintf("%s (%s)", c.ConversationAlias, id[:5])
+		labels = append(labels, label)
+		ids[label] = id
+	}
+
+	return labels, ids
+}
+
+// Lets the user name a group and pick the conversations whose parties are invited.
+func showCreateGroup(h *server.RouteHandler, w fyne.Window) {
+	labels, ids := activeConversations(h)
+	if len(labels) == 0 {
+		dialog.ShowError(fmt.Errorf("A group needs at least one active conversation"), w)
+		return
+	}
+
+	name := widget.NewEntry()
+	members := widget.NewCheckGroup(labels, nil)
+
+	dialog.ShowForm("New Group", "Create", "Cancel", []*widget.FormItem{
+		{Text: "Group Name", Widget: name},
+		{Text: "Members", Widget: members},
+	}, func(b bool) {
+		if !b {
+			return
+		}
+
+		var conversations []string
+		for _, label := range members.Selected {
+			conversations = append(conversations, ids[label])
+		}
+
+		if _, err := h.CreateGroup(name.Text, conversations); err != nil {
+			dialog.ShowError(err, w)
+		}
+	}, w)
+}
+
+func (gr *groupRender) UpdateHeader() {
+	g, ok := gr.Handler.Group(gr.GroupID)
+	if !ok {
+		return
+	}
+
+	gr.Header.Objects = []fyne.CanvasObject{gr.CreateHeader(g)}
+	gr.Header.Refresh()
+}
+
+// Shows the name and members of the group, the admin can add and remove members.
+func (gr *groupRender) CreateHeader(g *server.Group) *fyne.Container {
+	var aliases []string
+	for _, m := range gr.Handler.GroupMembers(g.GroupID) {
+		alias := m.Alias
+		if m.ID == g.SelfID {
+			alias += " (you)"
+		}
+		aliases = append(aliases, alias)
+	}
+
+	name := fmt.Sprintf("Group: %s", g.Name)
+	if g.Left {
+		name += " (left)"
+	}
+
+	header := container.NewHBox(
+		widget.NewLabel(name),
+		widget.NewLabel(fmt.Sprintf("Members: %s", strings.Join(aliases, ", "))),
+	)
+
+	if g.Left {
+		return container.NewCenter(header)
+	}
+
+	if g.Admin {
+		header.Add(widget.NewButtonWithIcon("Add Member", theme.ContentAddIcon(), func() {
+			gr.ShowAddMember()
+		}))
+		header.Add(widget.NewButtonWithIcon("Remove Member", theme.ContentRemoveIcon(), func() {
+			gr.ShowRemoveMember(g)
+		}))
+	}
+
+	leave := widget.NewButtonWithIcon("Leave Group", theme.LogoutIcon(), func() {
+		dialog.ShowConfirm("Leave Group", "Leave this group? A group left by its admin ends for everyone.", func(b bool) {
+			if !b {
+				return
+			}
+
+			if err := gr.Handler.LeaveGroup(gr.GroupID); err != nil {
+				dialog.ShowError(err, gr.Window)
+			}
+		}, gr.Window)
+	})
+	leave.Importance = widget.DangerImportance
+	header.Add(leave)
+
+	return container.NewCenter(header)
+}
+
+func (gr *groupRender) ShowAddMember() {
+	labels, ids := activeConversations(gr.Handler)
+	if len(labels) == 0 {
+		dialog.ShowError(fmt.Errorf("No active conversations"), gr.Window)
+		return
+	}
+
+	conversation := widget.NewSelect(labels, nil)
+	dialog.ShowForm("Add Member", "Add", "Cancel", []*widget.FormItem{
+		{Text: "Conversation", Widget: conversation},
+	}, func(b bool) {
+		if !b || conversation.Selected == "" {
+			return
+		}
+
+		if err := gr.Handler.AddGroupMember(gr.GroupID, ids[conversation.Selected]); err != nil {
+			dialog.ShowError(err, gr.Window)
+		}
+	}, gr.Window)
+}
+
+func (gr *groupRender) ShowRemoveMember(g *server.Group) {
+	var (
+		labels []string
+		ids    = make(map[string]string)
+	)
+	for _, m := range gr.Handler.GroupMembers(g.GroupID) {
+		if m.ID == g.SelfID {
+			continue
+		}
+
+		label := fmt.Sprintf("%s (%s)", m.Alias, m.ID[:5])
+		labels = append(labels, label)
+		ids[label] = m.ID
+	}
+
+	member := widget.NewSelect(labels, nil)
+	dialog.ShowForm("Remove Member", "Remove", "Cancel", []*widget.FormItem{
+		{Text: "Member", Widget: member},
+	}, func(b bool) {
+		if !b || member.Selected == "" {
+			return
+		}
+
+		if err := gr.Handler.RemoveGroupMember(gr.GroupID, ids[member.Selected]); err != nil {
+			dialog.ShowError(err, gr.Window)
+		}
+	}, gr.Window)
+}
+
+// Shows a new message of the group or the status of a message sent by this party.
+func (gr *groupRender) UpdateMessage(msg *server.Message) {
+	if m, ok := gr.sent[msg.ID]; ok {
+		m.SetStatus(msg.Status)
+		return
+	}
+
+	gr.Messages.Add(gr.newBubble(msg))
+	gr.Messages.Refresh()
+}
+
+func (gr *groupRender) newBubble(msg *server.Message) *messageScreen {
+	text := msg.Text
+	if !msg.Self {
+		text = fmt.Sprintf("%s: %s", msg.Sender, msg.Text)
+	}
+
+	m := newMessage(text, msg.Self, false, time.Unix(int64(msg.Time), 0))
+	if msg.Self {
+		m.status = msg.Status
+		gr.sent[msg.ID] = m
+	}
+
+	return m
+}
+
+// Builds the widgets of a group and makes it the active render.
+func renderGroup(g *server.Group, w fyne.Window) *groupRender {
+	gr := &groupRender{GroupID: g.GroupID, Handler: rh, Window: w, sent: make(map[string]*messageScreen)}
+
+	mContainer := container.NewVBox()
+	for _, m := range gr.Handler.GroupMessages(g.GroupID) {
+		mContainer.Add(gr.newBubble(m))
+	}
+
+	msg := widget.NewEntry()
+	send := widget.NewButtonWithIcon("",
+		theme.MailSendIcon(), func() {
+			if msg.Text == "" {
+				dialog.ShowError(fmt.Errorf("Empty Message"), w)
+				return
+			}
+
+			// The message is shown through the event subscription
+			if _, err := gr.Handler.SendGroup(g.GroupID, msg.Text); err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+
+			msg.SetText("")
+		},
+	)
+
+	controlBar := container.NewBorder(nil, nil, nil, send, msg)
+	messages := container.NewVScroll(mContainer)
+
+	gr.Header = container.NewStack(gr.CreateHeader(g))
+	gr.Messages = mContainer
+	gr.Fullscreen = container.NewBorder(gr.Header, controlBar, nil, nil, messages)
+
+	renderMux.Lock()
+	activeGroup = gr
+	activeRender = nil
+	renderMux.Unlock()
+
+	return gr
+}
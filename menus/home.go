@@ -1,9 +1,10 @@
 package menus
 
 import (
+	"encoding/hex"
 	"fmt"
-	"os"
 	"strconv"
+	"strings"
 
 	"github.com/JustinTimperio/onionsoup/crypt"
 	"github.com/JustinTimperio/onionsoup/data"
@@ -21,9 +22,81 @@ func HomeView(w fyne.Window) fyne.CanvasObject {
 	logo := canvas.NewImageFromResource(data.Logo)
 	logo.SetMinSize(fyne.NewSize(512, 512))
 
-	var screen *fyne.Container
+	screen := container.NewVBox()
+	var buttons *fyne.Container
 	var privateKeyDialog *dialog.FileDialog
 
+	// Every unlocked key is listed here, the other screens pick one of them
+	var refresh func()
+	refresh = func() {
+		screen.Objects = []fyne.CanvasObject{
+			container.NewCenter(container.NewVBox(
+				logo,
+				widget.NewLabelWithStyle(fmt.Sprintf("Version: %s", Version), fyne.TextAlignCenter, fyne.TextStyle{}),
+			)),
+			buttons,
+		}
+
+		identities := keyring.Identities()
+		if len(identities) > 0 {
+			screen.Add(widget.NewButton("Lock All Keys", func() {
+				keyring.LockAll()
+				refresh()
+			}))
+		}
+
+		var def string
+		if d := keyring.Default(); d != nil {
+			def = d.ID
+		}
+
+		for _, identity := range identities {
+			id := identity.ID
+			name := identity.Name()
+			if id == def {
+				name += " - Default"
+			}
+
+			details := container.NewVBox(
+				widget.NewLabelWithStyle(name, fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+			)
+			if identity.Path != "" {
+				details.Add(widget.NewLabel("Private key path: " + identity.Path))
+			}
+
+			if fingerprint, err := hex.DecodeString(id); err == nil {
+				grid := widget.NewLabel(crypt.FingerprintHexGrid(fingerprint))
+				grid.TextStyle = fyne.TextStyle{Monospace: true}
+
+				details.Add(widget.NewLabel("Key fingerprint:"))
+				details.Add(grid)
+				details.Add(widget.NewLabel(strings.Join(crypt.FingerprintWords(fingerprint), " ")))
+			}
+
+			publicKey := identity.PublicKey
+			actions := container.NewHBox(
+				widget.NewButton("Copy Public Key", func() {
+					w.Clipboard().SetContent(publicKey)
+				}),
+				widget.NewButton("Lock", func() {
+					keyring.Lock(id)
+					refresh()
+				}),
+			)
+			if id != def {
+				actions.Add(widget.NewButton("Make Default", func() {
+					keyring.SetDefault(id)
+					refresh()
+				}))
+			}
+
+			screen.Add(widget.NewSeparator())
+			screen.Add(container.NewBorder(nil, nil, nil, actions, details))
+		}
+
+		screen.Refresh()
+	}
+
 	// Generate RSA Keys
 	rsaGenerateSaveDialog := dialog.NewFileSave(func(f fyne.URIWriteCloser, err error) {
 		if err != nil {
@@ -42,6 +115,8 @@ func HomeView(w fyne.Window) fyne.CanvasObject {
 		pass2.PlaceHolder = "Password"
 		size := widget.NewEntry()
 		size.Text = "4096"
+		label := widget.NewEntry()
+		label.PlaceHolder = "Label"
 
 		saveKey := func() {
 			defer f.Close()
@@ -58,13 +133,13 @@ func HomeView(w fyne.Window) fyne.CanvasObject {
 				return
 			}
 
-			SingleMessageRSAPrivateKey, _, err = crypt.RSAGenerateKeyPair(s)
+			privateKey, _, err := crypt.RSAGenerateKeyPair(s)
 			if err != nil {
 				dialog.ShowError(err, w)
 				return
 			}
 
-			privateKeyPEM, err := crypt.RSAPrivateKeyToBytes(SingleMessageRSAPrivateKey, pass1.Text)
+			privateKeyPEM, err := crypt.SealPrivateKey("rsa", privateKey, pass1.Text, label.Text)
 			if err != nil {
 				dialog.ShowError(err, w)
 				return
@@ -76,29 +151,11 @@ func HomeView(w fyne.Window) fyne.CanvasObject {
 				return
 			}
 
-			PEM, err := crypt.RSAPublicKeyToBytes(&SingleMessageRSAPrivateKey.PublicKey)
-			if err != nil {
+			if _, err := keyring.Add("rsa", label.Text, f.URI().Path(), privateKey); err != nil {
 				dialog.ShowError(err, w)
 				return
 			}
-			SingleMessagePrivateKeyPath = f.URI().Path()
-			SingleMessagePublicKey = string(PEM)
-			SingleMessageKeyType = "rsa"
-
-			screen.Objects = []fyne.CanvasObject{
-				container.NewCenter(container.NewVBox(
-					logo,
-					widget.NewLabelWithStyle(fmt.Sprintf("Version: %s", Version), fyne.TextAlignCenter, fyne.TextStyle{}),
-				)), container.NewVBox(
-					widget.NewLabel("Loaded private key path: "+SingleMessagePrivateKeyPath),
-					widget.NewButton("Reload Private Key", privateKeyDialog.Show),
-					widget.NewButton("Copy Public Key", func() {
-						w.Clipboard().SetContent(SingleMessagePublicKey)
-					}),
-				),
-			}
-
-			screen.Refresh()
+			refresh()
 			dialog.ShowInformation("Keys Generated!", "Private Key Saved", w)
 		}
 
@@ -110,6 +167,7 @@ func HomeView(w fyne.Window) fyne.CanvasObject {
 				{Text: "Password", Widget: pass1},
 				{Text: "Confirm Password", Widget: pass2},
 				{Text: "Size", Widget: size},
+				{Text: "Label", Widget: label},
 			},
 			nil,
 			w,
@@ -147,13 +205,13 @@ func HomeView(w fyne.Window) fyne.CanvasObject {
 				}
 			}
 
-			SingleMessagePGPPrivateKey, err = crypt.PGPGenerateKeyPair(accountName.Text)
+			privateKey, err := crypt.PGPGenerateKeyPair(accountName.Text)
 			if err != nil {
 				dialog.ShowError(err, w)
 				return
 			}
 
-			privateKeyPEM, err := crypt.PGPPrivateKeyToBytes(SingleMessagePGPPrivateKey, pass1.Text)
+			privateKeyPEM, err := crypt.SealPrivateKey("pgp", privateKey, pass1.Text, accountName.Text)
 			if err != nil {
 				dialog.ShowError(err, w)
 				return
@@ -165,29 +223,11 @@ func HomeView(w fyne.Window) fyne.CanvasObject {
 				return
 			}
 
-			PEM, err := crypt.PGPPublicKeyToBytes(SingleMessagePGPPrivateKey)
-			if err != nil {
+			if _, err := keyring.Add("pgp", accountName.Text, f.URI().Path(), privateKey); err != nil {
 				dialog.ShowError(err, w)
 				return
 			}
-			SingleMessagePrivateKeyPath = f.URI().Path()
-			SingleMessagePublicKey = string(PEM)
-			SingleMessageKeyType = "pgp"
-
-			screen.Objects = []fyne.CanvasObject{
-				container.NewCenter(container.NewVBox(
-					logo,
-					widget.NewLabelWithStyle(fmt.Sprintf("Version: %s", Version), fyne.TextAlignCenter, fyne.TextStyle{}),
-				)), container.NewVBox(
-					widget.NewLabel("Loaded private key path: "+SingleMessagePrivateKeyPath),
-					widget.NewButton("Reload Private Key", privateKeyDialog.Show),
-					widget.NewButton("Copy Public Key", func() {
-						w.Clipboard().SetContent(SingleMessagePublicKey)
-					}),
-				),
-			}
-
-			screen.Refresh()
+			refresh()
 			dialog.ShowInformation("Keys Generated!", "Private Key Saved", w)
 		}
 
@@ -208,97 +248,100 @@ func HomeView(w fyne.Window) fyne.CanvasObject {
 
 	}, w)
 
-	// Select Private Key
-	privateKeyDialog = dialog.NewFileOpen(func(f fyne.URIReadCloser, err error) {
+	curveGenerateSaveDialog := dialog.NewFileSave(func(f fyne.URIWriteCloser, err error) {
 		if err != nil {
 			dialog.ShowError(err, w)
 			return
 		}
 
 		if f == nil {
-			dialog.ShowError(fmt.Errorf("No file selected"), w)
-			return
-		}
-
-		privateKeyPEM, err := os.ReadFile(f.URI().Path())
-		if err != nil {
-			dialog.ShowError(err, w)
-			f.Close()
+			dialog.ShowError(fmt.Errorf("File not selected"), w)
 			return
 		}
 
 		pass1 := widget.NewPasswordEntry()
+		pass2 := widget.NewPasswordEntry()
 		pass1.PlaceHolder = "Password"
-		kType := widget.NewSelect([]string{"pgp", "rsa"}, func(value string) {
-			SingleMessageKeyType = value
-		})
+		pass2.PlaceHolder = "Password"
+		label := widget.NewEntry()
+		label.PlaceHolder = "Label"
 
-		unlock := func() {
+		saveKey := func() {
 			defer f.Close()
 
-			switch SingleMessageKeyType {
-			case "rsa":
-				SingleMessageRSAPrivateKey, err = crypt.RSAPrivateKeyToMem(privateKeyPEM, pass1.Text)
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
-				PEM, err := crypt.RSAPublicKeyToBytes(&SingleMessageRSAPrivateKey.PublicKey)
-				if err != nil {
-					dialog.ShowError(err, w)
+			if pass1.Text != "" || pass2.Text != "" {
+				if pass1.Text != pass2.Text {
+					dialog.ShowError(fmt.Errorf("Passwords do not match"), w)
 					return
 				}
+			}
 
-				SingleMessagePublicKey = string(PEM)
-				SingleMessagePrivateKeyPath = f.URI().Path()
-
-				screen.Objects = []fyne.CanvasObject{
-					container.NewCenter(container.NewVBox(
-						logo,
-						widget.NewLabelWithStyle(fmt.Sprintf("Version: %s", Version), fyne.TextAlignCenter, fyne.TextStyle{}),
-					)), container.NewVBox(
-						widget.NewLabel("Loaded private key path: "+SingleMessagePrivateKeyPath),
-						widget.NewButton("Reload Private Key", privateKeyDialog.Show),
-						widget.NewButton("Copy Public Key", func() {
-							w.Clipboard().SetContent(SingleMessagePublicKey)
-						}),
-					),
-				}
-				screen.Refresh()
+			privateKey, _, err := crypt.CurveGenerateKeyPair()
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
 
-			case "pgp":
-				SingleMessagePGPPrivateKey, err = crypt.PGPPrivateKeyToMem(privateKeyPEM, pass1.Text)
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
+			privateKeyPEM, err := crypt.SealPrivateKey("x25519", privateKey, pass1.Text, label.Text)
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
 
-				PEM, err := crypt.PGPPublicKeyToBytes(SingleMessagePGPPrivateKey)
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
-				SingleMessagePublicKey = string(PEM)
-				SingleMessagePrivateKeyPath = f.URI().Path()
-
-				screen.Objects = []fyne.CanvasObject{
-					container.NewCenter(container.NewVBox(
-						logo,
-						widget.NewLabelWithStyle(fmt.Sprintf("Version: %s", Version), fyne.TextAlignCenter, fyne.TextStyle{}),
-					)), container.NewVBox(
-						widget.NewLabel("Loaded private key path: "+SingleMessagePrivateKeyPath),
-						widget.NewButton("Reload New Private Key", privateKeyDialog.Show),
-						widget.NewButton("Copy Public Key", func() {
-							w.Clipboard().SetContent(SingleMessagePublicKey)
-						}),
-					),
-				}
-				screen.Refresh()
+			_, err = f.Write(privateKeyPEM)
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
 
-			default:
-				dialog.ShowError(fmt.Errorf("No Key Type Selected"), w)
+			if _, err := keyring.Add("x25519", label.Text, f.URI().Path(), privateKey); err != nil {
+				dialog.ShowError(err, w)
 				return
 			}
+			refresh()
+			dialog.ShowInformation("Keys Generated!", "Private Key Saved", w)
+		}
+
+		d := dialog.NewForm(
+			"Add Password to Private Key File",
+			"Password Added",
+			"NO Password Added",
+			[]*widget.FormItem{
+				{Text: "Password", Widget: pass1},
+				{Text: "Confirm Password", Widget: pass2},
+				{Text: "Label", Widget: label},
+			},
+			nil,
+			w,
+		)
+		d.SetOnClosed(saveKey)
+		d.Show()
+
+	}, w)
+
+	// Select Private Key
+	privateKeyDialog = dialog.NewFileOpen(func(f fyne.URIReadCloser, err error) {
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		if f == nil {
+			dialog.ShowError(fmt.Errorf("No file selected"), w)
+			return
+		}
+
+		pass1 := widget.NewPasswordEntry()
+		pass1.PlaceHolder = "Password"
+
+		unlock := func() {
+			f.Close()
+
+			if _, err := keyring.Unlock(f.URI().Path(), pass1.Text); err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			refresh()
 		}
 
 		d := dialog.NewForm(
@@ -307,7 +350,6 @@ func HomeView(w fyne.Window) fyne.CanvasObject {
 			"NO Password",
 			[]*widget.FormItem{
 				{Text: "Password", Widget: pass1},
-				{Text: "Key Type", Widget: kType},
 			},
 			nil,
 			w,
@@ -317,33 +359,13 @@ func HomeView(w fyne.Window) fyne.CanvasObject {
 
 	}, w)
 
-	if SingleMessageRSAPrivateKey == nil && SingleMessagePGPPrivateKey == nil {
-		screen = container.NewVBox(
-			container.NewCenter(container.NewVBox(
-				logo,
-				widget.NewLabelWithStyle(fmt.Sprintf("Version: %s", Version), fyne.TextAlignCenter, fyne.TextStyle{}),
-			)), container.NewVBox(
-				widget.NewButton("Generate RSA Keys", rsaGenerateSaveDialog.Show),
-				widget.NewButton("Generate PGP Keys", pgpGenerateSaveDialog.Show),
-				widget.NewButton("Load Private Key", privateKeyDialog.Show),
-			),
-		)
-
-		return screen
-	}
-
-	screen = container.NewVBox(
-		container.NewCenter(container.NewVBox(
-			logo,
-			widget.NewLabelWithStyle(fmt.Sprintf("Version: %s", Version), fyne.TextAlignCenter, fyne.TextStyle{}),
-		)), container.NewVBox(
-			widget.NewLabel("Loaded private key path: "+SingleMessagePrivateKeyPath),
-			widget.NewButton("Reload Private Key", privateKeyDialog.Show),
-			widget.NewButton("Copy Public Key", func() {
-				w.Clipboard().SetContent(SingleMessagePublicKey)
-			}),
-		),
+	buttons = container.NewVBox(
+		widget.NewButton("Generate RSA Keys", rsaGenerateSaveDialog.Show),
+		widget.NewButton("Generate PGP Keys", pgpGenerateSaveDialog.Show),
+		widget.NewButton("Generate X25519 Keys", curveGenerateSaveDialog.Show),
+		widget.NewButton("Unlock Private Key", privateKeyDialog.Show),
 	)
+	refresh()
 
-	return screen
+	return container.NewVScroll(screen)
 }
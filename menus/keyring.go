@@ -0,0 +1,221 @@
+package menus
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+
+	"fyne.io/fyne/v2/widget"
+)
+
+// Identity is an unlocked private key held by the keyring.
+type Identity struct {
+	// Hex encoded fingerprint of the public key
+	ID      string
+	Label   string
+	KeyType string
+	// File the key was loaded from or saved to
+	Path       string
+	PrivateKey any
+	// PEM encoded
+	PublicKey string
+}
+
+// Returns the label and a short fingerprint to tell identities apart in pickers.
+func (i *Identity) Name() string {
+	label := i.Label
+	if label == "" {
+		label = "Unlabeled"
+	}
+
+	return fmt.Sprintf("%s (%s %s)", label, i.KeyType, i.ID[:8])
+}
+
+// Keyring holds the unlocked identities. Keys are only kept in memory and are unlocked
+// and locked on the Home screen, every other screen picks one of them.
+type Keyring struct {
+	identities []*Identity
+	// Used where no identity is picked, such as the contact book and the local API
+	defaultID string
+	mux       sync.Mutex
+}
+
+var keyring = &Keyring{}
+
+// Adds an unlocked private key, adding the same key again replaces its label and path.
+func (k *Keyring) Add(keyType, label, path string, privateKey any) (*Identity, error) {
+	publicKey, err := crypt.PublicKeyToBytes(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint, err := crypt.Fingerprint(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &Identity{
+		ID:         hex.EncodeToString(fingerprint),
+		Label:      label,
+		KeyType:    keyType,
+		Path:       path,
+		PrivateKey: privateKey,
+		PublicKey:  string(publicKey),
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	for i, existing := range k.identities {
+		if existing.ID == id.ID {
+			k.identities[i] = id
+			return id, nil
+		}
+	}
+
+	k.identities = append(k.identities, id)
+	if k.defaultID == "" {
+		k.defaultID = id.ID
+	}
+
+	return id, nil
+}
+
+// Reads a private key file and adds the key, see crypt.LoadPrivateKey.
+func (k *Keyring) Unlock(path, password string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	kc, privateKey, err := crypt.LoadPrivateKey(data, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.Add(kc.KeyType, kc.Label, path, privateKey)
+}
+
+// Removes an identity, it has to be unlocked again before it can be used.
+func (k *Keyring) Lock(id string) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	for i, identity := range k.identities {
+		if identity.ID == id {
+			k.identities = append(k.identities[:i], k.identities[i+1:]...)
+			break
+		}
+	}
+
+	if k.defaultID == id {
+		k.defaultID = ""
+		if len(k.identities) > 0 {
+			k.defaultID = k.identities[0].ID
+		}
+	}
+}
+
+// Removes every identity.
+func (k *Keyring) LockAll() {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	k.identities = nil
+	k.defaultID = ""
+}
+
+// Returns the unlocked identities in the order they were added.
+func (k *Keyring) Identities() []*Identity {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	return append([]*Identity{}, k.identities...)
+}
+
+// Returns the identity with the id or nil when it is locked.
+func (k *Keyring) Identity(id string) *Identity {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	for _, identity := range k.identities {
+		if identity.ID == id {
+			return identity
+		}
+	}
+
+	return nil
+}
+
+// Returns the default identity or nil when no key is unlocked.
+func (k *Keyring) Default() *Identity {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	for _, identity := range k.identities {
+		if identity.ID == k.defaultID {
+			return identity
+		}
+	}
+
+	return nil
+}
+
+func (k *Keyring) SetDefault(id string) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	k.defaultID = id
+}
+
+// Lets the user pick one of the unlocked identities, the default one is selected.
+// Identity returns nil when nothing is picked.
+type identityPicker struct {
+	*widget.Select
+	identities []*Identity
+}
+
+func newIdentityPicker() *identityPicker {
+	p := &identityPicker{Select: widget.NewSelect(nil, nil)}
+	p.PlaceHolder = "Unlock a private key on the Home screen"
+	p.Reload()
+
+	return p
+}
+
+// Offers the identities currently in the keyring.
+func (p *identityPicker) Reload() {
+	var selected *Identity
+	if picked := p.Identity(); picked != nil {
+		selected = keyring.Identity(picked.ID)
+	}
+
+	p.identities = keyring.Identities()
+	p.Options = make([]string, 0, len(p.identities))
+	for _, identity := range p.identities {
+		p.Options = append(p.Options, identity.Name())
+	}
+
+	switch {
+	case selected != nil:
+		p.SetSelected(selected.Name())
+	case keyring.Default() != nil:
+		p.SetSelected(keyring.Default().Name())
+	default:
+		p.ClearSelected()
+	}
+}
+
+// Returns the picked identity.
+func (p *identityPicker) Identity() *Identity {
+	for i, name := range p.Options {
+		if name == p.Selected && i < len(p.identities) {
+			return p.identities[i]
+		}
+	}
+
+	return nil
+}
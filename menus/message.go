@@ -0,0 +1,216 @@
+package menus
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/server"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+type messageScreen struct {
+	widget.BaseWidget
+	text   string
+	time   time.Time
+	self   bool
+	end    bool
+	status server.MessageStatus
+	retry  func()
+
+	// File carried by an attachment message and how to save it
+	attachment *server.Attachment
+	save       func()
+}
+type messageRender struct {
+	msg       *messageScreen
+	container *fyne.Container
+	bg        *canvas.Rectangle
+	timeText  *widget.Label
+	ticks     *fyne.Container
+	retry     *widget.Button
+}
+
+func newMessage(text string, self bool, end bool, time time.Time) *messageScreen {
+	m := &messageScreen{text: text, self: self, end: end, time: time}
+	m.ExtendBaseWidget(m)
+	return m
+}
+
+// Updates the delivery status shown below a message sent by this party.
+func (m *messageScreen) SetStatus(status server.MessageStatus) {
+	m.status = status
+	m.Refresh()
+}
+
+func (m *messageScreen) CreateRenderer() fyne.WidgetRenderer {
+	messageText := widget.NewLabel(m.text)
+	messageText.Wrapping = fyne.TextWrapWord
+
+	timeText := widget.NewLabel("")
+	timeText.TextStyle = fyne.TextStyle{Italic: true}
+
+	retry := widget.NewButtonWithIcon("Retry", theme.ViewRefreshIcon(), func() {
+		if m.retry != nil {
+			m.retry()
+		}
+	})
+
+	ticks := container.NewHBox()
+
+	bg := &canvas.Rectangle{FillColor: color.Transparent}
+
+	if m.self {
+		messageText.Alignment = fyne.TextAlignTrailing
+		timeText.Alignment = fyne.TextAlignTrailing
+	} else {
+		messageText.Alignment = fyne.TextAlignLeading
+		timeText.Alignment = fyne.TextAlignLeading
+	}
+
+	body := container.New(layout.NewVBoxLayout(), messageText)
+	if m.attachment != nil {
+		body = m.attachmentBody()
+	}
+	body.Add(container.NewBorder(nil, nil, nil, container.NewHBox(ticks, retry), timeText))
+
+	c := container.NewStack(bg, body)
+
+	r := &messageRender{
+		msg:       m,
+		container: c,
+		bg:        bg,
+		timeText:  timeText,
+		ticks:     ticks,
+		retry:     retry,
+	}
+	r.updateStatus()
+
+	return r
+}
+
+// Shows the name and size of an attachment with a button to save it, images are
+// previewed inline.
+func (m *messageScreen) attachmentBody() *fyne.Container {
+	a := m.attachment
+
+	name := widget.NewLabel(fmt.Sprintf("%s (%s)", a.Name, formatSize(int64(a.Size))))
+	name.Wrapping = fyne.TextWrapWord
+
+	save := widget.NewButtonWithIcon("Save", theme.DocumentSaveIcon(), func() {
+		if m.save != nil {
+			m.save()
+		}
+	})
+
+	body := container.New(layout.NewVBoxLayout())
+	if a.IsImage() {
+		preview := canvas.NewImageFromReader(bytes.NewReader(a.Data), a.Name)
+		preview.FillMode = canvas.ImageFillContain
+		preview.SetMinSize(fyne.NewSize(240, 180))
+		body.Add(preview)
+	}
+	body.Add(container.NewBorder(nil, nil, widget.NewIcon(theme.FileIcon()), save, name))
+
+	return body
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1024*1024*1024:
+		return fmt.Sprintf("%.1f GiB", float64(size)/1024/1024/1024)
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MiB", float64(size)/1024/1024)
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KiB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
+
+// Shows the time and delivery status, one tick once the remote server accepted the
+// message, two once the remote party acknowledged it and an eye once it was read.
+func (r *messageRender) updateStatus() {
+	text := r.msg.time.Format("15:04")
+	switch r.msg.status {
+	case server.StatusQueued, server.StatusSending, server.StatusFailed:
+		text += " " + r.msg.status.String()
+	}
+	r.timeText.SetText(text)
+
+	var ticks []fyne.CanvasObject
+	switch r.msg.status {
+	case server.StatusSent:
+		ticks = append(ticks, widget.NewIcon(theme.ConfirmIcon()))
+	case server.StatusDelivered:
+		ticks = append(ticks, widget.NewIcon(theme.ConfirmIcon()), widget.NewIcon(theme.ConfirmIcon()))
+	case server.StatusRead:
+		ticks = append(ticks, widget.NewIcon(theme.ConfirmIcon()), widget.NewIcon(theme.VisibilityIcon()))
+	}
+	r.ticks.Objects = ticks
+	r.ticks.Refresh()
+
+	if r.msg.status == server.StatusFailed {
+		r.retry.Show()
+	} else {
+		r.retry.Hide()
+	}
+}
+
+func (r *messageRender) MaxSize() fyne.Size {
+	return fyne.NewSize(0, 0)
+}
+
+func (r *messageRender) MinSize() fyne.Size {
+	return r.container.MinSize()
+
+}
+
+func (r *messageRender) Layout(s fyne.Size) {
+	size := r.MinSize()
+	size = size.Max(fyne.NewSize(s.Width-(s.Width/2.3), s.Height))
+	r.bg.FillColor = r.getBackgroundColor()
+	pos := fyne.NewPos(0, 0)
+
+	if r.msg.self {
+		pos = fyne.NewPos(s.Width-size.Width, 0)
+	}
+
+	r.container.Resize(size)
+	r.container.Move(pos)
+	r.container.Refresh()
+
+}
+
+func (r *messageRender) Objects() []fyne.CanvasObject {
+	return []fyne.CanvasObject{r.container}
+}
+
+func (r *messageRender) Refresh() {
+	r.updateStatus()
+	r.container.Refresh()
+}
+
+func (r *messageRender) BackgroundColor() color.Color {
+	return color.Transparent
+}
+
+func (r *messageRender) Destroy() {
+}
+
+func (r *messageRender) getBackgroundColor() color.Color {
+	if r.msg.end {
+		return theme.PrimaryColorNamed(theme.ColorRed)
+	}
+	if r.msg.self {
+		return theme.PrimaryColorNamed(theme.ColorBlue)
+	}
+	return theme.PrimaryColorNamed(theme.ColorGreen)
+}
@@ -0,0 +1,509 @@
+package menus
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/server"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Widgets of the conversation currently shown in the server view.
+type conversationRender struct {
+	ConversationID string
+	Handler        *server.RouteHandler
+	Fullscreen     *fyne.Container
+	Messages       *fyne.Container
+	Header         *fyne.Container
+	Typing         *widget.Label
+	Window         fyne.Window
+
+	// Bubbles of messages sent by this party by message id
+	sent map[string]*messageScreen
+	// When the typing indicator was last shown and a notification last sent
+	typingSince time.Time
+	typingSent  time.Time
+}
+
+var (
+	activeRender *conversationRender
+	renderMux    sync.Mutex
+)
+
+// Returns the render of the conversation if it is the one on screen.
+func renderFor(id string) *conversationRender {
+	renderMux.Lock()
+	defer renderMux.Unlock()
+
+	if activeRender == nil || activeRender.ConversationID != id {
+		return nil
+	}
+	return activeRender
+}
+
+// Applies server events to the widgets until the subscription is closed. The server
+// only publishes events, all widget updates happen here.
+func consumeEvents(events <-chan server.Event, w fyne.Window, refreshConvos func()) {
+	for e := range events {
+		switch e.Type {
+		case server.EventConversationCreated:
+			refreshConvos()
+
+		case server.EventConversationEstablished, server.EventConversationEnded:
+			if cr := renderFor(e.ConversationID); cr != nil {
+				cr.UpdateHeader()
+			}
+
+		case server.EventMessageReceived:
+			// Messages of the conversation on screen are read right away
+			if cr := renderFor(e.ConversationID); cr != nil {
+				cr.AddMessage(e.Message)
+				cr.Handler.MarkRead(e.ConversationID)
+			}
+
+			if e.Message.Attachment != nil {
+				promptSave(e.Message.Attachment, w)
+			}
+
+		case server.EventMessageStatus:
+			if cr := renderFor(e.ConversationID); cr != nil {
+				cr.UpdateStatus(e.Message)
+			}
+
+		case server.EventTyping:
+			if cr := renderFor(e.ConversationID); cr != nil {
+				cr.ShowTyping()
+			}
+
+		case server.EventGroupUpdated:
+			refreshConvos()
+			if gr := groupRenderFor(e.GroupID); gr != nil {
+				gr.UpdateHeader()
+			}
+
+		case server.EventGroupMessage:
+			if gr := groupRenderFor(e.GroupID); gr != nil {
+				gr.UpdateMessage(e.Message)
+			}
+
+		case server.EventDeliveryFailed:
+			dialog.ShowError(fmt.Errorf("Message not delivered: %s", e.Err), w)
+
+		case server.EventKeyWarning:
+			showKeyWarning(e, w)
+		}
+	}
+}
+
+func (cr *conversationRender) UpdateHeader() error {
+	c, ok := cr.Handler.Conversation(cr.ConversationID)
+	if !ok {
+		return nil
+	}
+
+	header, err := cr.CreateHeader(c, headerName(c))
+	if err != nil {
+		return nil
+	}
+
+	cr.Header.Objects = []fyne.CanvasObject{
+		header,
+	}
+
+	cr.Header.Refresh()
+	return nil
+}
+
+// Shows the safety number of the conversation and lets the user mark it as verified
+// once both parties have compared it out of band.
+func (cr *conversationRender) ShowSafetyNumber(c *server.Conversation) {
+	number, err := c.SafetyNumber()
+	if err != nil {
+		dialog.ShowError(err, cr.Window)
+		return
+	}
+
+	grid := widget.NewLabel(crypt.FingerprintHexGrid(number))
+	grid.TextStyle = fyne.TextStyle{Monospace: true}
+	grid.Alignment = fyne.TextAlignCenter
+
+	words := widget.NewLabel(strings.Join(crypt.FingerprintWords(number), " "))
+	words.Wrapping = fyne.TextWrapWord
+	words.Alignment = fyne.TextAlignCenter
+
+	content := container.NewVBox(
+		widget.NewLabel("Compare this number with your contact over a trusted channel."),
+		grid,
+		words,
+	)
+
+	if c.Verified {
+		dialog.ShowCustom("Safety Number (Verified)", "Close", content, cr.Window)
+		return
+	}
+
+	dialog.ShowCustomConfirm("Safety Number", "Mark Verified", "Close", content, func(b bool) {
+		if !b {
+			return
+		}
+
+		cr.Handler.SetVerified(c.ConversationID, true)
+		cr.UpdateHeader()
+	}, cr.Window)
+}
+
+func headerName(c *server.Conversation) string {
+	switch {
+	case c.Ended:
+		return "ended"
+	case c.Established:
+		return "active"
+	default:
+		return "pending"
+	}
+}
+
+func (cr *conversationRender) CreateHeader(c *server.Conversation, headerName string) (*fyne.Container, error) {
+	var header *fyne.Container
+	switch headerName {
+	case "pending":
+		header = container.NewHBox(
+			widget.NewLabel(fmt.Sprintf("Remote Address: PENDING")),
+			widget.NewLabel(fmt.Sprintf("Conversation ID: %s...%s", c.ConversationID[:5], c.ConversationID[len(c.ConversationID)-5:])),
+			widget.NewLabel(fmt.Sprintf("Token: %s...%s", c.SelfToken[:5], c.SelfToken[len(c.SelfToken)-5:])),
+			widget.NewLabel(fmt.Sprintf("Remote Token: PENDING")),
+			widget.NewLabel(fmt.Sprintf("Key Type: %s", c.KeyType)),
+			cr.safetyNumberButton(c),
+		)
+
+	case "active":
+		header = container.NewHBox(
+			widget.NewLabel(fmt.Sprintf("Remote Address: %s...%s", c.RemoteAddress[:5], c.RemoteAddress[len(c.RemoteAddress)-15:])),
+			widget.NewLabel(fmt.Sprintf("Conversation ID: %s...%s", c.ConversationID[:5], c.ConversationID[len(c.ConversationID)-5:])),
+			widget.NewLabel(fmt.Sprintf("Token: %s...%s", c.SelfToken[:5], c.SelfToken[len(c.SelfToken)-5:])),
+			widget.NewLabel(fmt.Sprintf("Remote Token: %s...%s", c.RemoteToken[:5], c.RemoteToken[len(c.RemoteToken)-5:])),
+			widget.NewLabel(fmt.Sprintf("Key Type: %s", c.KeyType)),
+			widget.NewLabel(fmt.Sprintf("Forward Secrecy: %t", c.Ratchet != nil)),
+			cr.safetyNumberButton(c),
+		)
+
+	case "ended":
+		header = container.NewHBox(
+			widget.NewLabel(fmt.Sprintf("Remote Address: ENDED")),
+			widget.NewLabel(fmt.Sprintf("Conversation ID: %s...%s", c.ConversationID[:5], c.ConversationID[len(c.ConversationID)-5:])),
+			widget.NewLabel(fmt.Sprintf("Token: ENDED")),
+			widget.NewLabel(fmt.Sprintf("Remote Token: ENDED")),
+			widget.NewLabel(fmt.Sprintf("Key Type: %s", c.KeyType)),
+		)
+
+	default:
+		return nil, fmt.Errorf("Bad Header Requested")
+	}
+
+	if c.KeyStatus == server.KeyChanged {
+		header.Add(cr.keyWarningButton(c))
+	}
+
+	if cr.Handler.History != nil {
+		header.Add(widget.NewButtonWithIcon("History", theme.HistoryIcon(), func() {
+			cr.ShowHistorySettings(c)
+		}))
+	}
+
+	return container.NewCenter(header), nil
+}
+
+func (cr *conversationRender) safetyNumberButton(c *server.Conversation) *widget.Button {
+	label := "Verify Safety Number"
+	if c.Verified {
+		label = "Verified"
+	}
+
+	button := widget.NewButtonWithIcon(label, theme.InfoIcon(), func() {
+		cr.ShowSafetyNumber(c)
+	})
+	if !c.Verified {
+		button.Importance = widget.WarningImportance
+	}
+
+	return button
+}
+
+// Lets the user choose how long the messages of the conversation are stored or delete
+// them right away.
+func (cr *conversationRender) ShowHistorySettings(c *server.Conversation) {
+	history := cr.Handler.History
+
+	current, err := history.Retention(c.ConversationID)
+	if err != nil {
+		dialog.ShowError(err, cr.Window)
+		return
+	}
+
+	retention := widget.NewSelect(retentionLabels(), nil)
+	retention.SetSelected(retentionLabel(current))
+
+	deleteHistory := widget.NewButtonWithIcon("Delete History", theme.DeleteIcon(), func() {
+		dialog.ShowConfirm("Delete History", "Delete every stored message of this conversation?", func(b bool) {
+			if !b {
+				return
+			}
+
+			if err := cr.Handler.ClearHistory(c.ConversationID); err != nil {
+				dialog.ShowError(err, cr.Window)
+				return
+			}
+
+			cr.Messages.Objects = nil
+			cr.Messages.Refresh()
+		}, cr.Window)
+	})
+	deleteHistory.Importance = widget.DangerImportance
+
+	dialog.ShowForm("Message History", "Save", "Cancel", []*widget.FormItem{
+		{Text: "Keep Messages", Widget: retention},
+		{Text: "", Widget: deleteHistory},
+	}, func(b bool) {
+		if !b {
+			return
+		}
+
+		err := history.SetRetention(c.ConversationID, retentionPeriods[retention.Selected])
+		if err != nil {
+			dialog.ShowError(err, cr.Window)
+		}
+	}, cr.Window)
+}
+
+func (cr *conversationRender) AddMessage(msg *server.Message) error {
+	if cr.Messages == nil {
+		return nil
+	}
+
+	cr.Messages.Add(cr.newBubble(msg))
+	cr.Messages.Refresh()
+	return nil
+}
+
+// Shows the delivery status of a sent message, messages queued since the conversation
+// was opened are added.
+func (cr *conversationRender) UpdateStatus(msg *server.Message) {
+	if m, ok := cr.sent[msg.ID]; ok {
+		m.SetStatus(msg.Status)
+		return
+	}
+
+	cr.AddMessage(msg)
+}
+
+// How long the typing indicator stays without a new notification, and how often one is sent.
+const typingTimeout = 5 * time.Second
+
+// Shows that the remote party is writing until no notification arrived for a while.
+func (cr *conversationRender) ShowTyping() {
+	cr.Typing.SetText("typing...")
+
+	shown := time.Now()
+	cr.typingSince = shown
+	time.AfterFunc(typingTimeout, func() {
+		if cr.typingSince == shown {
+			cr.Typing.SetText("")
+		}
+	})
+}
+
+func (cr *conversationRender) newBubble(msg *server.Message) *messageScreen {
+	m := newMessage(msg.Text, msg.Self, msg.Final(), time.Unix(int64(msg.Time), 0))
+	if a := msg.Attachment; a != nil {
+		m.attachment = a
+		m.save = func() {
+			saveAttachment(a, cr.Window)
+		}
+	}
+
+	if !msg.Self || msg.ID == "" {
+		return m
+	}
+
+	id := msg.ID
+	m.status = msg.Status
+	m.retry = func() {
+		if err := cr.Handler.RetryMessage(cr.ConversationID, id); err != nil {
+			dialog.ShowError(err, cr.Window)
+		}
+	}
+	cr.sent[id] = m
+
+	return m
+}
+
+// Asks whether a received file should be saved, it can also be saved later from its message.
+func promptSave(a *server.Attachment, w fyne.Window) {
+	text := fmt.Sprintf("Received %s (%s). Save it?", a.Name, formatSize(int64(a.Size)))
+	dialog.ShowConfirm("File Received", text, func(b bool) {
+		if b {
+			saveAttachment(a, w)
+		}
+	}, w)
+}
+
+func saveAttachment(a *server.Attachment, w fyne.Window) {
+	d := dialog.NewFileSave(func(f fyne.URIWriteCloser, err error) {
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		if f == nil {
+			return
+		}
+		defer f.Close()
+
+		if _, err := f.Write(a.Data); err != nil {
+			dialog.ShowError(err, w)
+		}
+	}, w)
+	d.SetFileName(a.Name)
+	d.Show()
+}
+
+// Lets the user pick a file and sends it as an attachment.
+func (cr *conversationRender) ShowAttach() {
+	dialog.ShowFileOpen(func(f fyne.URIReadCloser, err error) {
+		if err != nil {
+			dialog.ShowError(err, cr.Window)
+			return
+		}
+		if f == nil {
+			return
+		}
+		defer f.Close()
+
+		data, err := io.ReadAll(io.LimitReader(f, server.MaxAttachmentSize+1))
+		if err != nil {
+			dialog.ShowError(err, cr.Window)
+			return
+		}
+
+		// Failures are shown through the event subscription
+		cr.Handler.SendAttachment(cr.ConversationID, f.URI().Name(), data)
+	}, cr.Window)
+}
+
+func (cr *conversationRender) EndConversation() {
+	cr.Fullscreen.Objects = []fyne.CanvasObject{
+		container.NewVBox(),
+	}
+	cr.Fullscreen.Refresh()
+}
+
+// Builds the widgets of a conversation and makes it the active render.
+func renderMessages(c *server.Conversation, w fyne.Window, refreshConvos func()) *conversationRender {
+	cr := &conversationRender{ConversationID: c.ConversationID, Handler: rh, Window: w, sent: make(map[string]*messageScreen)}
+
+	mContainer := container.NewVBox()
+	for _, m := range cr.Handler.Messages(c.ConversationID) {
+		mContainer.Add(cr.newBubble(m))
+	}
+
+	msg := widget.NewEntry()
+	msg.OnChanged = func(text string) {
+		if text == "" || time.Since(cr.typingSent) < typingTimeout {
+			return
+		}
+
+		cr.typingSent = time.Now()
+		go cr.Handler.SendTyping(c.ConversationID)
+	}
+	cr.Typing = widget.NewLabel("")
+	cr.Typing.TextStyle = fyne.TextStyle{Italic: true}
+
+	send := widget.NewButtonWithIcon("",
+		theme.MailSendIcon(), func() {
+
+			if msg.Text == "" {
+				dialog.ShowError(fmt.Errorf("Empty Message"), w)
+				return
+			}
+
+			// Queued messages and failures are shown through the event subscription
+			if _, err := cr.Handler.Send(c.ConversationID, msg.Text, false); err != nil {
+				return
+			}
+
+			msg.SetText("")
+		},
+	)
+
+	attach := widget.NewButtonWithIcon("",
+		theme.FileIcon(), func() {
+			if !c.Established || c.Ended {
+				dialog.ShowError(fmt.Errorf("Conversation is not active"), w)
+				return
+			}
+
+			cr.ShowAttach()
+		},
+	)
+
+	cancel := widget.NewButtonWithIcon("",
+		theme.CancelIcon(), func() {
+			if !c.Established || c.Ended {
+				dialog.ShowError(fmt.Errorf("Conversation is not active"), w)
+				return
+			}
+
+			if msg.Text == "" {
+				msg.Text = "Ended Conversation"
+			}
+
+			if _, err := cr.Handler.Send(c.ConversationID, msg.Text, true); err != nil {
+				return
+			}
+
+			msg.SetText("")
+		},
+	)
+
+	destroy := widget.NewButtonWithIcon("",
+		theme.DeleteIcon(), func() {
+			if c.Established && !c.Ended {
+				if msg.Text == "" {
+					msg.Text = "Ended Conversation"
+				}
+
+				cr.Handler.Send(c.ConversationID, msg.Text, true)
+			}
+
+			cr.EndConversation()
+			cr.Handler.DeleteConversation(c.ConversationID)
+			refreshConvos()
+		},
+	)
+
+	controlBar := container.NewBorder(cr.Typing, nil, container.NewHBox(destroy, cancel), container.NewHBox(attach, send), msg)
+	messages := container.NewVScroll(mContainer)
+
+	header, _ := cr.CreateHeader(c, headerName(c))
+
+	cr.Header = header
+	cr.Messages = mContainer
+	cr.Fullscreen = container.NewBorder(header, controlBar, nil, nil, messages)
+
+	renderMux.Lock()
+	activeRender = cr
+	activeGroup = nil
+	renderMux.Unlock()
+
+	cr.Handler.MarkRead(c.ConversationID)
+
+	return cr
+}
@@ -1,32 +1,105 @@
 package menus
 
 import (
-	"crypto/rsa"
 	"fmt"
-	"os"
-	"sort"
+	"strings"
+	"time"
 
+	"github.com/JustinTimperio/onionsoup/api"
 	"github.com/JustinTimperio/onionsoup/crypt"
 	"github.com/JustinTimperio/onionsoup/server"
+	"github.com/JustinTimperio/onionsoup/storage"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/data/binding"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/widget"
-	"github.com/ProtonMail/gopenpgp/v3/crypto"
-	"github.com/labstack/echo/v4"
 )
 
+const (
+	preferenceTorMode        = "TorMode"
+	preferenceControlAddress = "TorControlAddress"
+	preferenceControlSocket  = "TorControlSocket"
+	preferenceStorageMode    = "StorageMode"
+	preferenceHistory        = "SaveHistory"
+	preferenceResume         = "ResumeConversations"
+	preferenceReadReceipts   = "ReadReceipts"
+	preferenceRetention      = "HistoryRetention"
+	preferenceAPI            = "LocalAPI"
+	preferenceAPIAddress     = "LocalAPIAddress"
+	preferenceTokenExpiry    = "TokenExpiry"
+
+	storageOff        = "Off"
+	storagePassphrase = "Passphrase"
+	storagePrivateKey = "Loaded Private Key"
+)
+
+// Retention periods offered for message history.
+var retentionPeriods = map[string]time.Duration{
+	"Forever": 0,
+	"1 Day":   24 * time.Hour,
+	"7 Days":  7 * 24 * time.Hour,
+	"30 Days": 30 * 24 * time.Hour,
+}
+
+func retentionLabels() []string {
+	return []string{"Forever", "1 Day", "7 Days", "30 Days"}
+}
+
+// How long generated conversation tokens are accepted.
+var tokenExpiries = map[string]time.Duration{
+	"Never":  0,
+	"1 Hour": time.Hour,
+	"1 Day":  server.DefaultTokenTTL,
+	"7 Days": 7 * 24 * time.Hour,
+}
+
+func tokenExpiryLabels() []string {
+	return []string{"1 Hour", "1 Day", "7 Days", "Never"}
+}
+
+func retentionLabel(retention time.Duration) string {
+	for label, d := range retentionPeriods {
+		if d == retention {
+			return label
+		}
+	}
+	return "Forever"
+}
+
+// Opens the local storage selected when starting the server, nil when it is off.
+func openStorage(mode, passphrase string) (*storage.Vault, error) {
+	var (
+		vault *storage.Vault
+		err   error
+	)
+
+	switch mode {
+	case storagePassphrase:
+		vault, err = server.OpenPassphraseVault(passphrase)
+	case storagePrivateKey:
+		identity := keyring.Default()
+		if identity == nil {
+			return nil, fmt.Errorf("Unlock a private key on the Home screen to protect the local storage with it")
+		}
+		vault, err = server.OpenKeyVault(identity.PrivateKey)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening local storage: %s", err)
+	}
+
+	return vault, nil
+}
+
 var (
 	rh           *server.RouteHandler
+	apiServer    *api.Server
 	currentConvo string
 	serverScreen *fyne.Container
 
-	dialogPrivKey any
-	dialogPubKey  any
-	dialogKeyType string
-
 	convoAlias     string
 	convoPubString string
 	convoToken     string
@@ -51,118 +124,31 @@ func ServerView(w fyne.Window) fyne.CanvasObject {
 		convoToken = ""
 		convoAlias = ""
 		convoPubString = ""
-		dialogKeyType = ""
-		dialogPrivKey = nil
-		dialogPubKey = nil
 	}
 
-	// Select Private Key
-	privateKeyDialog := dialog.NewFileOpen(func(f fyne.URIReadCloser, err error) {
-		if err != nil {
-			dialog.ShowError(err, w)
+	// Conversations are started as one of the unlocked keys
+	identity := newIdentityPicker()
+	wrp.MultiLine = true
+	contact := contactSelect(w)
+
+	startConversation := func(b bool) {
+		if !b {
 			return
 		}
 
-		if f == nil {
-			dialog.ShowError(fmt.Errorf("No file selected"), w)
+		id := identity.Identity()
+		if id == nil {
+			dialog.ShowError(fmt.Errorf("No private key selected"), w)
 			return
 		}
 
-		privateKeyPEM, err := os.ReadFile(f.URI().Path())
+		rpk, err := crypt.PublicKeyToMem(id.KeyType, []byte(convoPubString))
 		if err != nil {
 			dialog.ShowError(err, w)
-			f.Close()
 			return
 		}
 
-		pass := widget.NewPasswordEntry()
-		pass.PlaceHolder = "Password"
-		kType := widget.NewSelect([]string{"pgp", "rsa"}, func(value string) {
-			dialogKeyType = value
-		})
-
-		unlock := func(b bool) {
-			if !b {
-				return
-			}
-
-			defer f.Close()
-
-			switch dialogKeyType {
-			case "rsa":
-				dialogPrivKey, err = crypt.RSAPrivateKeyToMem(privateKeyPEM, pass.Text)
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
-				dialogPubKey, err = crypt.RSAPublicKeyToBytes(&dialogPrivKey.(*rsa.PrivateKey).PublicKey)
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
-
-			case "pgp":
-				dialogPrivKey, err = crypt.PGPPrivateKeyToMem(privateKeyPEM, pass.Text)
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
-
-				dialogPubKey, err = crypt.PGPPublicKeyToBytes(dialogPrivKey.(*crypto.Key))
-				if err != nil {
-					dialog.ShowError(err, w)
-					return
-				}
-
-			default:
-				dialog.ShowError(fmt.Errorf("No Key Type Selected"), w)
-				return
-			}
-		}
-
-		d := dialog.NewForm(
-			"Unlock Private Key File",
-			"Password",
-			"NO Password",
-			[]*widget.FormItem{
-				{Text: "Password", Widget: pass},
-				{Text: "Key Type", Widget: kType},
-			},
-			unlock,
-			w,
-		)
-		d.Show()
-	}, w)
-
-	wpk := widget.NewButton("Select Private Key", privateKeyDialog.Show)
-	wrp.MultiLine = true
-
-	startConversation := func(b bool) {
-		if !b {
-			return
-		}
-
-		var rpk any
-		var err error
-		switch dialogKeyType {
-		case "rsa":
-			rpk, err = crypt.RSAPublicKeyToMem([]byte(convoPubString))
-			if err != nil {
-				dialog.ShowError(err, w)
-				return
-			}
-		case "pgp":
-			rpk, err = crypt.PGPPublicKeyToMem([]byte(convoPubString))
-			if err != nil {
-				dialog.ShowError(err, w)
-				return
-			}
-		default:
-			dialog.ShowError(fmt.Errorf("invalid key type"), w)
-			return
-		}
-
-		err = rh.BootstrapConversation(convoToken, dialogPrivKey, dialogPubKey, rpk, convoAlias, w)
+		err = rh.BootstrapConversation(convoToken, id.PrivateKey, []byte(id.PublicKey), rpk, convoAlias)
 		if err != nil {
 			dialog.ShowError(err, w)
 			return
@@ -171,34 +157,30 @@ func ServerView(w fyne.Window) fyne.CanvasObject {
 		clearVars()
 	}
 
+	tokenExpiry := widget.NewSelect(tokenExpiryLabels(), nil)
+	tokenExpiry.SetSelected(fyne.CurrentApp().Preferences().StringWithFallback(preferenceTokenExpiry, "1 Day"))
+
 	generateConversation := func(b bool) {
 		if !b {
 			return
 		}
 
-		var rpk any
-		var err error
-		switch dialogKeyType {
-		case "rsa":
-			rpk, err = crypt.RSAPublicKeyToMem([]byte(convoPubString))
-			if err != nil {
-				dialog.ShowError(err, w)
-				return
-			}
-
-		case "pgp":
-			rpk, err = crypt.PGPPublicKeyToMem([]byte(convoPubString))
-			if err != nil {
-				dialog.ShowError(err, w)
-				return
-			}
+		id := identity.Identity()
+		if id == nil {
+			dialog.ShowError(fmt.Errorf("No private key selected"), w)
+			return
+		}
 
-		default:
-			dialog.ShowError(fmt.Errorf("invalid key type"), w)
+		rpk, err := crypt.PublicKeyToMem(id.KeyType, []byte(convoPubString))
+		if err != nil {
+			dialog.ShowError(err, w)
 			return
 		}
 
-		t, err := rh.GenerateConversation(dialogPrivKey, dialogPubKey, rpk, dialogKeyType, convoAlias, w)
+		fyne.CurrentApp().Preferences().SetString(preferenceTokenExpiry, tokenExpiry.Selected)
+		rh.TokenTTL = tokenExpiries[tokenExpiry.Selected]
+
+		t, err := rh.GenerateConversation(id.PrivateKey, []byte(id.PublicKey), rpk, id.KeyType, convoAlias)
 		if err != nil {
 			dialog.ShowError(err, w)
 			return
@@ -207,7 +189,6 @@ func ServerView(w fyne.Window) fyne.CanvasObject {
 
 		w.Clipboard().SetContent(t)
 		dialog.NewInformation("Token Copied to Clipboard", "Token copied to clipboard.", w).Show()
-		serverScreen.Refresh()
 	}
 
 	startConversationDialog := dialog.NewForm(
@@ -215,7 +196,8 @@ func ServerView(w fyne.Window) fyne.CanvasObject {
 		"Start",
 		"Cancel",
 		[]*widget.FormItem{
-			{Text: "Select Private Key File", Widget: wpk},
+			{Text: "Private Key", Widget: identity},
+			{Text: "Contact", Widget: contact},
 			{Text: "Enter Public Key", Widget: wrp},
 			{Text: "Conversation Token", Widget: wt},
 			{Text: "Conversation Alias", Widget: wa},
@@ -229,64 +211,105 @@ func ServerView(w fyne.Window) fyne.CanvasObject {
 		"Generate",
 		"Cancel",
 		[]*widget.FormItem{
-			{Text: "Select Private Key File", Widget: wpk},
+			{Text: "Private Key", Widget: identity},
+			{Text: "Contact", Widget: contact},
 			{Text: "Enter Public Key", Widget: wrp},
 			{Text: "Conversation Alias", Widget: wa},
+			{Text: "Token Expires", Widget: tokenExpiry},
 		},
 		generateConversation,
 		w,
 	)
 
-	startServer = widget.NewButton("Start Server", func() {
+	launchServer := func(conf server.Config, history *server.History, store *server.ConversationStore, contacts *server.ContactBook, readReceipts bool, apiAddress string) {
 		convos := container.NewStack()
 
+		rh, err = server.NewRouteHandler(conf)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("Error starting route handler: %s", err), w)
+			return
+		}
+		rh.History = history
+		rh.Store = store
+		rh.Contacts = contacts
+		rh.ReadReceipts = readReceipts
+
+		var convoList *widget.Tree
+		refreshConvos := func() {
+			convoList.Refresh()
+		}
+
 		setConvos := func(c *server.Conversation) {
-			c.RenderMessages(w, rh)
+			cr := renderMessages(c, w, refreshConvos)
+			convos.Objects = []fyne.CanvasObject{
+				cr.Fullscreen,
+			}
+			convos.Refresh()
+		}
+		setGroup := func(g *server.Group) {
+			gr := renderGroup(g, w)
 			convos.Objects = []fyne.CanvasObject{
-				c.Render.Fullscreen,
+				gr.Fullscreen,
 			}
 			convos.Refresh()
 		}
+		convoList = makeConvos(setConvos, setGroup)
 
-		rh, err = server.NewRouteHandler()
-		if err != nil {
-			dialog.ShowError(fmt.Errorf("Error starting route handler: %s", err), w)
-			return
+		events, _ := rh.Subscribe()
+		go consumeEvents(events, w, refreshConvos)
+		rh.Start()
+
+		if apiAddress != "" {
+			if err := startAPI(apiAddress, w); err != nil {
+				dialog.ShowError(fmt.Errorf("Error starting local API: %s", err), w)
+			}
 		}
-		rh.ConversationScreen = convos
 
-		e := echo.New()
-		e.Listener = rh.Receiver
-		e.POST("/message", rh.Message)
-		e.POST("/bootstrap", rh.Bootstrap)
-		go e.Start("")
+		if err := rh.LoadConversations(); err != nil {
+			dialog.ShowError(fmt.Errorf("Error loading stored conversations: %s", err), w)
+		}
 
-		split := container.NewHSplit(makeConvos(setConvos), convos)
+		split := container.NewHSplit(container.NewBorder(nil, nil, nil, nil, convoList), convos)
 		split.Offset = 0.10
 
 		serverScreen.Objects = []fyne.CanvasObject{container.NewBorder(container.NewCenter(
 			container.NewHBox(
 				widget.NewLabel(fmt.Sprintf("Running on %s...%s", rh.URL[:5], rh.URL[len(rh.URL)-15:])),
-				widget.NewButton("Generate Conversation Token", generateConversationDialog.Show),
-				widget.NewButton("Import Conversation Token", startConversationDialog.Show),
+				widget.NewButton("Generate Conversation Token", func() {
+					identity.Reload()
+					loadContactOptions(contact)
+					generateConversationDialog.Show()
+				}),
+				widget.NewButton("Import Conversation Token", func() {
+					identity.Reload()
+					loadContactOptions(contact)
+					startConversationDialog.Show()
+				}),
+				widget.NewButton("Invitations", func() {
+					showInvitations(w, refreshConvos)
+				}),
+				widget.NewButton("New Group", func() {
+					showCreateGroup(rh, w)
+				}),
 				widget.NewButton("Stop Server", func() {
 					if rh != nil {
-						e.Close()
-						for _, convo := range rh.Conversations {
-							if !convo.Ended && convo.Established {
-								pmsg, err := convo.PackMessage("Ended Conversation", true)
-								if err != nil {
-									dialog.ShowError(err, w)
-									return
+						// Stored conversations stay open so they can be resumed later
+						if rh.Store == nil {
+							for _, id := range rh.ConversationIDs() {
+								convo, _ := rh.Conversation(id)
+								if !convo.Ended && convo.Established {
+									rh.Send(id, "Ended Conversation", true)
+									rh.DeleteConversation(id)
 								}
-
-								rh.SendMessage(pmsg, convo.RemoteAddress, server.MessagePath)
-								convo.Ended = true
-								convo.Render.EndConversation()
-								rh.DeleteConversation(convo.ConversationID)
 							}
 						}
 
+						if apiServer != nil {
+							apiServer.Close()
+							apiServer = nil
+						}
+
+						// Closing the handler also ends the event subscription
 						rh.Close()
 						rh = nil
 					}
@@ -303,7 +326,136 @@ func ServerView(w fyne.Window) fyne.CanvasObject {
 			)), nil, nil, nil, split)}
 
 		serverScreen.Refresh()
-	})
+	}
+
+	persistent := widget.NewCheck("Keep the same .onion address", nil)
+	rotate := widget.NewCheck("Replace the stored address with a new one", nil)
+	onionPass := widget.NewPasswordEntry()
+	onionPass.PlaceHolder = "Password"
+
+	prefs := fyne.CurrentApp().Preferences()
+	torMode := widget.NewSelect([]string{server.TorModeAuto, server.TorModeSystem, server.TorModeEmbedded}, nil)
+	torMode.SetSelected(prefs.StringWithFallback(preferenceTorMode, server.TorModeAuto))
+	controlAddress := widget.NewEntry()
+	controlAddress.PlaceHolder = server.DefaultControlAddress
+	controlAddress.SetText(prefs.String(preferenceControlAddress))
+	controlSocket := widget.NewEntry()
+	controlSocket.PlaceHolder = "/run/tor/control"
+	controlSocket.SetText(prefs.String(preferenceControlSocket))
+	controlPass := widget.NewPasswordEntry()
+	controlPass.PlaceHolder = "Cookie authentication when empty"
+	storageMode := widget.NewSelect([]string{storageOff, storagePassphrase, storagePrivateKey}, nil)
+	storageMode.SetSelected(prefs.StringWithFallback(preferenceStorageMode, storageOff))
+	storagePass := widget.NewPasswordEntry()
+	storagePass.PlaceHolder = "Passphrase"
+	saveHistory := widget.NewCheck("Save message history", nil)
+	saveHistory.SetChecked(prefs.BoolWithFallback(preferenceHistory, true))
+	resume := widget.NewCheck("Resume conversations after a restart", nil)
+	resume.SetChecked(prefs.Bool(preferenceResume))
+	readReceipts := widget.NewCheck("Tell contacts when I read their messages", nil)
+	readReceipts.SetChecked(prefs.Bool(preferenceReadReceipts))
+	retention := widget.NewSelect(retentionLabels(), nil)
+	retention.SetSelected(prefs.StringWithFallback(preferenceRetention, "Forever"))
+	localAPI := widget.NewCheck("Let local scripts use this server", nil)
+	localAPI.SetChecked(prefs.Bool(preferenceAPI))
+	apiAddress := widget.NewEntry()
+	apiAddress.SetText(prefs.StringWithFallback(preferenceAPIAddress, api.DefaultAddress))
+
+	startServerDialog := dialog.NewForm(
+		"Start Server",
+		"Start",
+		"Cancel",
+		[]*widget.FormItem{
+			{Text: "Persistent Address", Widget: persistent},
+			{Text: "Address Key Password", Widget: onionPass},
+			{Text: "Rotate Address", Widget: rotate},
+			{Text: "Tor", Widget: torMode},
+			{Text: "Control Port", Widget: controlAddress},
+			{Text: "Control Socket", Widget: controlSocket},
+			{Text: "Control Password", Widget: controlPass},
+			{Text: "Local Storage", Widget: storageMode},
+			{Text: "Storage Passphrase", Widget: storagePass},
+			{Text: "Message History", Widget: saveHistory},
+			{Text: "Keep Messages", Widget: retention},
+			{Text: "Conversations", Widget: resume},
+			{Text: "Read Receipts", Widget: readReceipts},
+			{Text: "Local API", Widget: localAPI},
+			{Text: "API Address", Widget: apiAddress},
+		},
+		func(b bool) {
+			if !b {
+				return
+			}
+
+			conf := server.Config{
+				TorMode:         torMode.Selected,
+				ControlAddress:  controlAddress.Text,
+				ControlSocket:   controlSocket.Text,
+				ControlPassword: controlPass.Text,
+			}
+			prefs.SetString(preferenceTorMode, conf.TorMode)
+			prefs.SetString(preferenceControlAddress, conf.ControlAddress)
+			prefs.SetString(preferenceControlSocket, conf.ControlSocket)
+
+			if persistent.Checked {
+				path, err := server.DefaultOnionKeyPath()
+				if err != nil {
+					dialog.ShowError(err, w)
+					return
+				}
+
+				conf.OnionKey, err = server.LoadOrCreateOnionKey(path, onionPass.Text, rotate.Checked)
+				if err != nil {
+					dialog.ShowError(fmt.Errorf("Error loading onion address key: %s", err), w)
+					return
+				}
+			}
+
+			prefs.SetString(preferenceStorageMode, storageMode.Selected)
+			prefs.SetBool(preferenceHistory, saveHistory.Checked)
+			prefs.SetBool(preferenceResume, resume.Checked)
+			prefs.SetBool(preferenceReadReceipts, readReceipts.Checked)
+			prefs.SetString(preferenceRetention, retention.Selected)
+			prefs.SetBool(preferenceAPI, localAPI.Checked)
+			prefs.SetString(preferenceAPIAddress, apiAddress.Text)
+			vault, err := openStorage(storageMode.Selected, storagePass.Text)
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+
+			var (
+				history *server.History
+				store   *server.ConversationStore
+			)
+			if vault != nil && saveHistory.Checked {
+				history = server.NewHistory(vault)
+				history.DefaultRetention = retentionPeriods[retention.Selected]
+			}
+			if vault != nil && resume.Checked {
+				store = server.NewConversationStore(vault)
+			}
+
+			// Without local storage the contact book kept with the default key is used
+			contacts, _ := openContacts()
+			if vault != nil {
+				contacts = server.NewContactBook(vault)
+			}
+
+			onionPass.SetText("")
+			controlPass.SetText("")
+			storagePass.SetText("")
+			rotate.SetChecked(false)
+			address := ""
+			if localAPI.Checked {
+				address = apiAddress.Text
+			}
+			launchServer(conf, history, store, contacts, readReceipts.Checked, address)
+		},
+		w,
+	)
+
+	startServer = widget.NewButton("Start Server", startServerDialog.Show)
 
 	if serverScreen == nil {
 		serverScreen = container.NewBorder(
@@ -318,23 +470,89 @@ func ServerView(w fyne.Window) fyne.CanvasObject {
 	return serverScreen
 }
 
-func makeConvos(setWindow func(c *server.Conversation)) fyne.CanvasObject {
+// Serves the local API for the running server with the default key and shows the
+// bearer token.
+func startAPI(address string, w fyne.Window) error {
+	identity := keyring.Default()
+	if identity == nil {
+		return fmt.Errorf("Unlock a private key on the Home screen to use the local API")
+	}
+
+	s, err := api.NewServer(rh, identity.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Listen(address); err != nil {
+		return err
+	}
+	apiServer = s
+
+	token := widget.NewEntry()
+	token.SetText(s.Token)
+	dialog.ShowCustomConfirm("Local API", "Copy Token", "Close", container.NewVBox(
+		widget.NewLabel(fmt.Sprintf("Scripts on this computer can use the API at http://%s with this token.", s.Addr())),
+		token,
+	), func(b bool) {
+		if b {
+			w.Clipboard().SetContent(s.Token)
+		}
+	}, w)
+
+	return nil
+}
+
+// Lists generated tokens that were not used yet so they can be revoked.
+func showInvitations(w fyne.Window, refresh func()) {
+	var d dialog.Dialog
+
+	invitations := rh.Invitations()
+	if len(invitations) == 0 {
+		dialog.ShowInformation("Invitations", "There are no outstanding invitations.", w)
+		return
+	}
+
+	rows := container.NewVBox()
+	for _, inv := range invitations {
+		expires := "Never expires"
+		if !inv.Expires.IsZero() {
+			expires = "Expires " + inv.Expires.Format("2006-01-02 15:04")
+		}
+
+		id := inv.ConversationID
+		rows.Add(container.NewBorder(nil, nil, nil,
+			widget.NewButton("Revoke", func() {
+				if err := rh.RevokeInvitation(id); err != nil {
+					dialog.ShowError(err, w)
+					return
+				}
+				refresh()
+				d.Hide()
+				showInvitations(w, refresh)
+			}),
+			widget.NewLabel(fmt.Sprintf("%s (%s)", inv.Alias, expires)),
+		))
+	}
+
+	d = dialog.NewCustom("Invitations", "Close", container.NewVScroll(rows), w)
+	d.Resize(fyne.NewSize(500, 300))
+	d.Show()
+}
+
+func makeConvos(setWindow func(c *server.Conversation), setGroup func(g *server.Group)) *widget.Tree {
 	a := fyne.CurrentApp()
 
 	tree := &widget.Tree{
 		ChildUIDs: func(uid string) []string {
-			var order []string
-			if rh == nil {
-				return order
+			if rh == nil || uid != "" {
+				return nil
 			}
-			for k := range rh.Conversations {
-				order = append(order, k)
-			}
-			sort.Slice(order, func(i, j int) bool {
-				return order[i] < order[j]
-			})
 
-			return order
+			ids := rh.ConversationIDs()
+			for _, id := range rh.GroupIDs() {
+				ids = append(ids, groupPrefix+id)
+			}
+			return ids
 		},
 		IsBranch: func(uid string) bool {
 			if uid == "" {
@@ -347,7 +565,19 @@ func makeConvos(setWindow func(c *server.Conversation)) fyne.CanvasObject {
 			return widget.NewLabel("Conversation")
 		},
 		UpdateNode: func(uid string, branch bool, obj fyne.CanvasObject) {
-			t, ok := rh.Conversations[uid]
+			if rh == nil {
+				return
+			}
+
+			if id, ok := strings.CutPrefix(uid, groupPrefix); ok {
+				if g, ok := rh.Group(id); ok {
+					obj.(*widget.Label).TextStyle = fyne.TextStyle{Bold: true}
+					obj.(*widget.Label).SetText(g.Name)
+				}
+				return
+			}
+
+			t, ok := rh.Conversation(uid)
 			if !ok {
 				return
 			}
@@ -355,12 +585,23 @@ func makeConvos(setWindow func(c *server.Conversation)) fyne.CanvasObject {
 			obj.(*widget.Label).TextStyle = fyne.TextStyle{}
 		},
 		OnSelected: func(uid string) {
-			if t, ok := rh.Conversations[uid]; ok {
+			if rh == nil {
+				return
+			}
+
+			if id, ok := strings.CutPrefix(uid, groupPrefix); ok {
+				if g, ok := rh.Group(id); ok {
+					setGroup(g)
+				}
+				return
+			}
+
+			if t, ok := rh.Conversation(uid); ok {
 				a.Preferences().SetString(currentConvo, uid)
 				setWindow(t)
 			}
 		},
 	}
 
-	return container.NewBorder(nil, nil, nil, nil, tree)
+	return tree
 }
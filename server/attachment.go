@@ -0,0 +1,357 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Largest file that can be sent in a conversation.
+	MaxAttachmentSize = 16 * 1024 * 1024
+	// Files are split so a failed request only repeats a small part.
+	attachmentChunkSize = 256 * 1024
+	// Attachments a conversation receives at the same time and their combined size,
+	// further files are refused until one of them completed.
+	maxIncomingAttachments = 8
+	maxIncomingSize        = 4 * MaxAttachmentSize
+)
+
+// Attachment is a file sent in a conversation.
+type Attachment struct {
+	Name string
+	// Detected from the contents by the receiver, the sender's claim is not trusted.
+	MimeType string
+	Size     int
+	Data     []byte
+}
+
+// Returns whether the attachment can be shown as an image.
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.MimeType, "image/")
+}
+
+// Body of an attachment message, every chunk repeats the description of the file.
+type attachmentChunk struct {
+	AttachmentID string `json:"attachment_id"`
+	Name         string `json:"name"`
+	Size         int    `json:"size"`
+	Digest       []byte `json:"digest"`
+	Index        int    `json:"index"`
+	Count        int    `json:"count"`
+	ChunkDigest  []byte `json:"chunk_digest"`
+	Data         []byte `json:"data"`
+}
+
+// Chunks of an attachment that is still being received.
+type incomingAttachment struct {
+	name   string
+	size   int
+	digest []byte
+	chunks [][]byte
+	count  int
+}
+
+// Sends a file in the conversation. The file is split into chunks that are encrypted
+// like any other message and delivered through the outbox, so a failed transfer resumes
+// with the missing chunks. The receiver acknowledges the file once every chunk arrived
+// and the digest matches.
+func (rh *RouteHandler) SendAttachment(id, name string, data []byte) (*Message, error) {
+	msg, err := rh.sendAttachment(id, name, data)
+	if err != nil {
+		rh.events.publish(Event{Type: EventDeliveryFailed, ConversationID: id, Err: err})
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (rh *RouteHandler) sendAttachment(id, name string, data []byte) (*Message, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("File is empty")
+	}
+	if len(data) > MaxAttachmentSize {
+		return nil, fmt.Errorf("File is larger than %d MiB", MaxAttachmentSize/1024/1024)
+	}
+	name = attachmentName(name)
+
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	convo, ok := rh.Conversations[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown conversation")
+	}
+
+	if convo.Ended || convo.ending() {
+		return nil, fmt.Errorf("Conversation has ended")
+	}
+
+	if !convo.Established {
+		return nil, fmt.Errorf("Conversation is not established")
+	}
+
+	now := time.Now()
+	msg := &Message{
+		ID:     uuid.New().String(),
+		Kind:   KindAttachment,
+		Text:   name,
+		Time:   int(now.Unix()),
+		Self:   true,
+		Status: StatusQueued,
+		Attachment: &Attachment{
+			Name:     name,
+			MimeType: http.DetectContentType(data),
+			Size:     len(data),
+			Data:     data,
+		},
+	}
+
+	entries, err := convo.attachmentEntries(msg, now)
+	if err != nil {
+		return nil, err
+	}
+
+	convo.outbox = append(convo.outbox, entries...)
+	rh.recordMessage(convo, msg)
+	rh.saveConversation(convo)
+	rh.events.publish(Event{Type: EventMessageStatus, ConversationID: id, Message: msg})
+
+	rh.background(func() { rh.deliver(id, true) })
+	return msg.snapshot(), nil
+}
+
+// Splits the file of an attachment message into outbox entries, one per chunk. Must be
+// called with the lock held.
+func (c *Conversation) attachmentEntries(msg *Message, now time.Time) ([]*outboxEntry, error) {
+	data := msg.Attachment.Data
+	digest := sha256.Sum256(data)
+
+	count := (len(data) + attachmentChunkSize - 1) / attachmentChunkSize
+	entries := make([]*outboxEntry, 0, count)
+	for i := 0; i < count; i++ {
+		part := data[i*attachmentChunkSize : min((i+1)*attachmentChunkSize, len(data))]
+		chunkDigest := sha256.Sum256(part)
+
+		body, err := json.Marshal(attachmentChunk{
+			AttachmentID: msg.ID,
+			Name:         msg.Attachment.Name,
+			Size:         len(data),
+			Digest:       digest[:],
+			Index:        i,
+			Count:        count,
+			ChunkDigest:  chunkDigest[:],
+			Data:         part,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		packed, err := c.pack(Message{ID: uuid.New().String(), Kind: KindAttachment, Time: msg.Time, Body: body})
+		if err != nil {
+			return nil, err
+		}
+
+		// Every chunk delivers the same message so the status covers the whole file
+		entries = append(entries, &outboxEntry{
+			ID:      msg.ID,
+			Kind:    KindAttachment,
+			Text:    msg.Attachment.Name,
+			Time:    msg.Time,
+			Packed:  packed,
+			Created: now,
+			message: msg,
+		})
+	}
+
+	return entries, nil
+}
+
+// Collects a chunk and publishes the attachment once it is complete. Must be called with
+// the lock held.
+func (rh *RouteHandler) receiveChunk(convo *Conversation, msg *Message) {
+	chunk, ok := parseChunk(msg.Body)
+	if !ok {
+		return
+	}
+
+	if !convo.canReceive(chunk) {
+		rh.refuseAttachment(convo, chunk.AttachmentID, fmt.Errorf("Too many files are being received, %q was refused", attachmentName(chunk.Name)))
+		return
+	}
+
+	in, ok := convo.collectChunk(chunk)
+	if !ok {
+		return
+	}
+
+	if in.count < len(in.chunks) {
+		// The sender does not send delivered chunks again, they have to survive a restart
+		if rh.Store != nil {
+			rh.Store.saveChunk(convo.ConversationID, chunk.AttachmentID, msg.Body)
+		}
+		return
+	}
+	delete(convo.incoming, chunk.AttachmentID)
+	if rh.Store != nil {
+		rh.Store.deleteChunks(convo.ConversationID, chunk.AttachmentID)
+	}
+
+	data := bytes.Join(in.chunks, nil)
+	digest := sha256.Sum256(data)
+	if len(data) != in.size || !bytes.Equal(digest[:], in.digest) {
+		rh.refuseAttachment(convo, chunk.AttachmentID, fmt.Errorf("File %q does not match its digest", in.name))
+		return
+	}
+
+	received := &Message{
+		ID:   chunk.AttachmentID,
+		Kind: KindAttachment,
+		Text: in.name,
+		Time: msg.Time,
+		Attachment: &Attachment{
+			Name:     in.name,
+			MimeType: http.DetectContentType(data),
+			Size:     len(data),
+			Data:     data,
+		},
+	}
+
+	rh.queueControl(convo, Message{Kind: KindAck, Acknowledges: []string{received.ID}})
+	convo.unread = append(convo.unread, received.ID)
+
+	rh.recordMessage(convo, received)
+	rh.events.publish(Event{Type: EventMessageReceived, ConversationID: convo.ConversationID, Message: received})
+}
+
+// Tells the remote party that an attachment was not received so it can be sent again.
+// Must be called with the lock held.
+func (rh *RouteHandler) refuseAttachment(convo *Conversation, id string, err error) {
+	rh.queueControl(convo, Message{Kind: KindNack, Acknowledges: []string{id}})
+	rh.events.publish(Event{Type: EventDeliveryFailed, ConversationID: convo.ConversationID, Err: err})
+}
+
+// Fails the attachments the remote party refused, their remaining chunks are dropped and
+// the file can be sent again with RetryMessage. Must be called with the lock held.
+func (rh *RouteHandler) applyNack(convo *Conversation, nack *Message) {
+	for _, id := range nack.Acknowledges {
+		var msg *Message
+		for _, m := range convo.Messages {
+			if m.Self && m.ID == id && m.Kind == KindAttachment {
+				msg = m
+			}
+		}
+		if msg == nil || msg.Status >= StatusDelivered || msg.Status == StatusFailed {
+			continue
+		}
+
+		outbox := convo.outbox[:0]
+		for _, e := range convo.outbox {
+			if e.ID != id || e.Control {
+				outbox = append(outbox, e)
+			}
+		}
+		convo.outbox = outbox
+
+		rh.updateStatus(convo, msg, StatusFailed)
+		rh.events.publish(Event{
+			Type:           EventDeliveryFailed,
+			ConversationID: convo.ConversationID,
+			Message:        msg,
+			Err:            fmt.Errorf("Remote party could not receive the file"),
+		})
+	}
+
+	rh.saveConversation(convo)
+}
+
+// Decodes and checks a chunk received in a conversation or loaded from the store.
+func parseChunk(body []byte) (*attachmentChunk, bool) {
+	var chunk attachmentChunk
+	if err := json.Unmarshal(body, &chunk); err != nil {
+		return nil, false
+	}
+
+	// The sender splits files into full chunks, so the size bounds the memory a file takes
+	if chunk.Count <= 0 || chunk.Index < 0 || chunk.Index >= chunk.Count || chunk.Size > MaxAttachmentSize ||
+		chunk.Count != (chunk.Size+attachmentChunkSize-1)/attachmentChunkSize || len(chunk.Data) > attachmentChunkSize {
+		return nil, false
+	}
+
+	chunkDigest := sha256.Sum256(chunk.Data)
+	if !bytes.Equal(chunkDigest[:], chunk.ChunkDigest) {
+		return nil, false
+	}
+
+	return &chunk, true
+}
+
+// Returns whether a chunk fits within the limits on attachments being received, chunks of
+// attachments that are already being received always fit. Must be called with the lock held.
+func (c *Conversation) canReceive(chunk *attachmentChunk) bool {
+	if _, ok := c.incoming[chunk.AttachmentID]; ok {
+		return true
+	}
+
+	size := chunk.Size
+	for _, in := range c.incoming {
+		size += in.size
+	}
+
+	return len(c.incoming) < maxIncomingAttachments && size <= maxIncomingSize
+}
+
+// Adds a chunk to the attachment it belongs to, chunks that were already collected or do
+// not match the attachment are refused.
+func (c *Conversation) collectChunk(chunk *attachmentChunk) (*incomingAttachment, bool) {
+	if c.incoming == nil {
+		c.incoming = make(map[string]*incomingAttachment)
+	}
+
+	in, ok := c.incoming[chunk.AttachmentID]
+	if !ok {
+		in = &incomingAttachment{
+			name:   attachmentName(chunk.Name),
+			size:   chunk.Size,
+			digest: chunk.Digest,
+			chunks: make([][]byte, chunk.Count),
+		}
+		c.incoming[chunk.AttachmentID] = in
+	}
+
+	if len(in.chunks) != chunk.Count || in.chunks[chunk.Index] != nil {
+		return nil, false
+	}
+	in.chunks[chunk.Index] = chunk.Data
+	in.count++
+
+	return in, true
+}
+
+// Returns the ids of the attachments that are still being received.
+func (c *Conversation) incomingIDs() []string {
+	ids := make([]string, 0, len(c.incoming))
+	for id := range c.incoming {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Strips any directories from a file name sent by the remote party.
+func attachmentName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." || name == "" {
+		return "attachment"
+	}
+	return name
+}
@@ -0,0 +1,284 @@
+package server_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/server"
+)
+
+func TestAttachment(t *testing.T) {
+	aliceConvo, _, alice, bob := startConversation(t, "x25519")
+	id := aliceConvo.ConversationID
+
+	aliceEvents, unsubscribeAlice := alice.rh.Subscribe()
+	defer unsubscribeAlice()
+	bobEvents, unsubscribeBob := bob.rh.Subscribe()
+	defer unsubscribeBob()
+
+	// Large enough to be split into several chunks
+	data := make([]byte, 600*1024)
+	rand.Read(data)
+
+	msg, err := alice.rh.SendAttachment(id, "../../notes.bin", data)
+	if err != nil {
+		t.Fatalf("Error sending attachment: %s", err)
+	}
+
+	var received *server.Message
+	timeout := time.After(10 * time.Second)
+	for received == nil {
+		select {
+		case e := <-bobEvents:
+			if e.Type == server.EventMessageReceived {
+				received = e.Message
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for the attachment")
+		}
+	}
+
+	a := received.Attachment
+	if a == nil || received.Kind != server.KindAttachment || received.ID != msg.ID {
+		t.Fatalf("Expected attachment %s, got %+v", msg.ID, received)
+	}
+	if a.Name != "notes.bin" {
+		t.Fatalf("Expected the name without directories, got %q", a.Name)
+	}
+	if !bytes.Equal(a.Data, data) {
+		t.Fatalf("Attachment data does not match")
+	}
+
+	// Bob acknowledges the file once it is complete
+	waitStatus(t, aliceEvents, msg, server.StatusDelivered)
+
+	if _, err := alice.rh.SendAttachment(id, "empty", nil); err == nil {
+		t.Fatalf("Expected an empty file to be refused")
+	}
+}
+
+// Lets a number of messages through and refuses the rest until it is opened. A stalling
+// gate never answers instead, like a circuit that stopped responding.
+type gatedTransport struct {
+	next    http.RoundTripper
+	allow   int
+	stall   bool
+	mux     sync.Mutex
+	refused chan struct{}
+	// Requests to other paths pass, server.MessagePath when empty.
+	path string
+}
+
+func (g *gatedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	path := g.path
+	if path == "" {
+		path = server.MessagePath
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/"+path) {
+		g.mux.Lock()
+		if g.allow == 0 {
+			stall := g.stall
+			g.mux.Unlock()
+			select {
+			case g.refused <- struct{}{}:
+			default:
+			}
+			if stall {
+				<-r.Context().Done()
+				return nil, r.Context().Err()
+			}
+			return nil, fmt.Errorf("Gate is closed")
+		}
+		if g.allow > 0 {
+			g.allow--
+		}
+		g.mux.Unlock()
+	}
+
+	return g.next.RoundTrip(r)
+}
+
+func (g *gatedTransport) open() {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	g.allow = -1
+}
+
+func TestAttachmentReceiverRestart(t *testing.T) {
+	aliceConvo, _, alice, bob := startConversation(t, "x25519")
+	id := aliceConvo.ConversationID
+	dir := t.TempDir()
+
+	bob.rh.Store = server.NewConversationStore(newVault(t, dir, bob.privateKey))
+	alice.rh.Retry = server.RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Expiry: 10 * time.Second}
+
+	// Two of the three chunks reach Bob before he goes away
+	gate := &gatedTransport{next: alice.rh.Sender.Transport, allow: 2, refused: make(chan struct{}, 1)}
+	alice.rh.Sender.Transport = gate
+
+	aliceEvents, unsubscribeAlice := alice.rh.Subscribe()
+	defer unsubscribeAlice()
+
+	data := make([]byte, 600*1024)
+	rand.Read(data)
+
+	msg, err := alice.rh.SendAttachment(id, "notes.bin", data)
+	if err != nil {
+		t.Fatalf("Error sending attachment: %s", err)
+	}
+
+	select {
+	case <-gate.refused:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the first chunks")
+	}
+
+	// Bob restarts on a new address, Alice no longer has the chunks he received
+	bob.rh.Close()
+
+	lt, err := server.NewLoopbackTransport()
+	if err != nil {
+		t.Fatalf("Error creating transport: %s", err)
+	}
+
+	rh := server.NewRouteHandlerWithTransport(lt)
+	rh.Store = server.NewConversationStore(newVault(t, dir, bob.privateKey))
+	rh.Start()
+	t.Cleanup(rh.Close)
+
+	bobEvents, unsubscribeBob := rh.Subscribe()
+	defer unsubscribeBob()
+
+	if err := rh.LoadConversations(); err != nil {
+		t.Fatalf("Error loading conversations: %s", err)
+	}
+	gate.open()
+
+	var received *server.Message
+	timeout := time.After(10 * time.Second)
+	for received == nil {
+		select {
+		case e := <-bobEvents:
+			if e.Type == server.EventMessageReceived {
+				received = e.Message
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for the attachment")
+		}
+	}
+
+	if received.ID != msg.ID || received.Attachment == nil || !bytes.Equal(received.Attachment.Data, data) {
+		t.Fatalf("Attachment received after the restart does not match")
+	}
+
+	waitStatus(t, aliceEvents, msg, server.StatusDelivered)
+}
+
+func TestAttachmentRefused(t *testing.T) {
+	aliceConvo, _, alice, bob := startConversation(t, "x25519")
+	id := aliceConvo.ConversationID
+	dir := t.TempDir()
+
+	bob.rh.Store = server.NewConversationStore(newVault(t, dir, bob.privateKey))
+	alice.rh.Retry = server.RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Expiry: 10 * time.Second}
+
+	gate := &gatedTransport{next: alice.rh.Sender.Transport, allow: 2, refused: make(chan struct{}, 1)}
+	alice.rh.Sender.Transport = gate
+
+	aliceEvents, unsubscribeAlice := alice.rh.Subscribe()
+	defer unsubscribeAlice()
+
+	data := make([]byte, 600*1024)
+	rand.Read(data)
+
+	msg, err := alice.rh.SendAttachment(id, "notes.bin", data)
+	if err != nil {
+		t.Fatalf("Error sending attachment: %s", err)
+	}
+
+	select {
+	case <-gate.refused:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the first chunks")
+	}
+	bob.rh.Close()
+
+	// A chunk that is consistent on its own but not with the file is only noticed once
+	// the file is complete
+	v := newVault(t, dir, bob.privateKey)
+	name := "incoming/" + id + "/" + msg.ID
+	records, err := v.Records(name)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Expected two stored chunks: %v", err)
+	}
+
+	var chunk map[string]json.RawMessage
+	if err := json.Unmarshal(records[0], &chunk); err != nil {
+		t.Fatalf("Error decoding chunk: %s", err)
+	}
+	var part []byte
+	json.Unmarshal(chunk["data"], &part)
+	part[0] ^= 0xff
+	chunkDigest := sha256.Sum256(part)
+	chunk["data"], _ = json.Marshal(part)
+	chunk["chunk_digest"], _ = json.Marshal(chunkDigest[:])
+	records[0], _ = json.Marshal(chunk)
+
+	if err := v.Rewrite(name, records); err != nil {
+		t.Fatalf("Error rewriting chunks: %s", err)
+	}
+
+	lt, err := server.NewLoopbackTransport()
+	if err != nil {
+		t.Fatalf("Error creating transport: %s", err)
+	}
+
+	rh := server.NewRouteHandlerWithTransport(lt)
+	rh.Store = server.NewConversationStore(newVault(t, dir, bob.privateKey))
+	rh.Start()
+	t.Cleanup(rh.Close)
+
+	bobEvents, unsubscribeBob := rh.Subscribe()
+	defer unsubscribeBob()
+
+	if err := rh.LoadConversations(); err != nil {
+		t.Fatalf("Error loading conversations: %s", err)
+	}
+	gate.open()
+
+	// Bob refuses the file and Alice can send it again
+	waitStatus(t, aliceEvents, msg, server.StatusFailed)
+
+	if err := alice.rh.RetryMessage(id, msg.ID); err != nil {
+		t.Fatalf("Error retrying attachment: %s", err)
+	}
+
+	var received *server.Message
+	timeout := time.After(10 * time.Second)
+	for received == nil {
+		select {
+		case e := <-bobEvents:
+			if e.Type == server.EventMessageReceived {
+				received = e.Message
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for the attachment")
+		}
+	}
+
+	if received.ID != msg.ID || !bytes.Equal(received.Attachment.Data, data) {
+		t.Fatalf("Attachment received after the retry does not match")
+	}
+
+	waitStatus(t, aliceEvents, msg, server.StatusDelivered)
+}
@@ -1,29 +1,113 @@
 package server
 
 import (
-	"crypto/rsa"
+	"crypto/ecdh"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	"sort"
+	"time"
 
 	"github.com/JustinTimperio/onionsoup/crypt"
 
-	"fyne.io/fyne/v2"
-	"github.com/ProtonMail/gopenpgp/v3/crypto"
 	"github.com/google/uuid"
 )
 
+// Returns a random alphanumeric string from the system CSPRNG. Bytes outside the largest
+// multiple of the charset size are skipped so every character is equally likely.
 func randomString(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	result := make([]byte, length)
-	for i := range result {
-		result[i] = charset[rand.Intn(len(charset))]
+	const limit = 256 - 256%len(charset)
+
+	result := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(result) < length {
+		// The system CSPRNG does not fail on supported platforms
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+
+		for _, b := range buf {
+			if int(b) < limit && len(result) < length {
+				result = append(result, charset[int(b)%len(charset)])
+			}
+		}
 	}
 	return string(result)
 }
 
-func (rh *RouteHandler) BootstrapConversation(token string, privateKey, publicKey, remotePublicKey any, alias string, w fyne.Window) error {
+// How long generated bootstrap tokens are accepted by default.
+const DefaultTokenTTL = 24 * time.Hour
+
+// Invitation is a bootstrap token that was generated but not used yet.
+type Invitation struct {
+	ConversationID string
+	Alias          string
+	Created        time.Time
+	// Zero when the token does not expire
+	Expires time.Time
+}
+
+// Returns the outstanding invitations, oldest first.
+func (rh *RouteHandler) Invitations() []Invitation {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	var invitations []Invitation
+	for _, c := range rh.Conversations {
+		if c.Established || c.Ended {
+			continue
+		}
+
+		invitations = append(invitations, Invitation{
+			ConversationID: c.ConversationID,
+			Alias:          c.ConversationAlias,
+			Created:        c.Created,
+			Expires:        c.Expires,
+		})
+	}
+
+	sort.Slice(invitations, func(i, j int) bool {
+		return invitations[i].Created.Before(invitations[j].Created)
+	})
+	return invitations
+}
+
+// Revokes an outstanding invitation, its token is refused from now on.
+func (rh *RouteHandler) RevokeInvitation(id string) error {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	c, ok := rh.Conversations[id]
+	if !ok || c.Established || c.Ended {
+		return fmt.Errorf("No outstanding invitation")
+	}
+
+	delete(rh.Conversations, id)
+	if rh.Store != nil {
+		rh.Store.Delete(id)
+	}
+	rh.events.publish(Event{Type: EventConversationEnded, ConversationID: id})
+
+	return nil
+}
+
+// Ends invitations whose token expired. Must be called with the lock held.
+func (rh *RouteHandler) expireInvitations() {
+	now := time.Now()
+	for _, c := range rh.Conversations {
+		if c.Established || c.Ended || c.Expires.IsZero() || now.Before(c.Expires) {
+			continue
+		}
+
+		c.Ended = true
+		rh.saveConversation(c)
+		rh.events.publish(Event{Type: EventConversationEnded, ConversationID: c.ConversationID})
+	}
+}
+
+func (rh *RouteHandler) BootstrapConversation(token string, privateKey any, publicKey []byte, remotePublicKey any, alias string) error {
 
 	var (
 		messageJson []byte
@@ -41,14 +125,16 @@ func (rh *RouteHandler) BootstrapConversation(token string, privateKey, publicKe
 		return err
 	}
 
-	switch request.EncryptionType {
-	case "rsa":
-		messageJson, err = crypt.RSADecryptAndVerifyMessage(privateKey.(*rsa.PrivateKey), remotePublicKey.(*rsa.PublicKey), request.Auth, request.Signature)
-	case "pgp":
-		messageJson, err = crypt.PGPDecryptAndVerifyMessage(privateKey.(*crypto.Key), remotePublicKey.(*crypto.Key), request.Auth)
-	default:
-		err = fmt.Errorf("Invalid key type")
+	// The token names the key type, it has to match the keys the conversation uses
+	keyType, err := crypt.KeyType(privateKey)
+	if err != nil {
+		return err
+	}
+	if request.EncryptionType != keyType {
+		return fmt.Errorf("Token uses %q keys but a %q key was provided", request.EncryptionType, keyType)
 	}
+
+	messageJson, err = crypt.DecryptAndVerifyMessage(request.Version, privateKey, remotePublicKey, request.Auth, request.Signature)
 	if err != nil {
 		return err
 	}
@@ -59,6 +145,28 @@ func (rh *RouteHandler) BootstrapConversation(token string, privateKey, publicKe
 		return err
 	}
 
+	// Tokens from before expiry was introduced carry no expiry
+	if auth.Expires != 0 && time.Now().Unix() > auth.Expires {
+		return fmt.Errorf("Token has expired")
+	}
+
+	// Peers that offer a ratchet key get a forward secret session
+	var (
+		ratchetKey *ecdh.PrivateKey
+		ratchet    *crypt.Ratchet
+	)
+	if len(auth.RatchetKey) > 0 {
+		ratchetKey, err = crypt.RatchetGenerateKey()
+		if err != nil {
+			return err
+		}
+
+		ratchet, err = crypt.NewRatchetInitiator(ratchetKey, auth.RatchetKey)
+		if err != nil {
+			return err
+		}
+	}
+
 	b, ch, err := NewConversationHandle(
 		rh.URL,
 		auth.Address,
@@ -70,29 +178,46 @@ func (rh *RouteHandler) BootstrapConversation(token string, privateKey, publicKe
 		remotePublicKey,
 		privateKey,
 		publicKey,
-		w,
-		rh,
+		ratchetKey,
 	)
 	if err != nil {
 		return err
 	}
+	ch.Ratchet = ratchet
+	ch.ratchetKey = nil
 
-	err = rh.SendMessage(b, ch.RemoteAddress, BootstrapPath)
-	if err != nil {
-		return err
+	// The other party can write as soon as it accepted the bootstrap, which may be before
+	// its response arrives, so the conversation has to be known already
+	rh.mux.Lock()
+	if _, ok := rh.Conversations[ch.ConversationID]; ok {
+		rh.mux.Unlock()
+		return fmt.Errorf("Conversation already exists")
 	}
+	rh.addConversation(ch)
+	rh.mux.Unlock()
 
-	ch.Established = true
+	err = rh.SendMessage(b, ch.RemoteAddress, BootstrapPath)
 
 	rh.mux.Lock()
 	defer rh.mux.Unlock()
 
-	rh.Conversations[request.ID] = ch
+	if err != nil {
+		ch.Ended = true
+		delete(rh.Conversations, ch.ConversationID)
+		rh.saveConversation(ch)
+		rh.events.publish(Event{Type: EventConversationEnded, ConversationID: ch.ConversationID})
+		return err
+	}
+
+	ch.Established = true
+	rh.saveConversation(ch)
+	rh.seenContact(ch)
+	rh.events.publish(Event{Type: EventConversationEstablished, ConversationID: request.ID})
 
 	return nil
 }
 
-func (rh *RouteHandler) GenerateConversation(privateKey, publicKey, remotePublicKey any, keyType, alias string, w fyne.Window) (string, error) {
+func (rh *RouteHandler) GenerateConversation(privateKey any, publicKey []byte, remotePublicKey any, keyType, alias string) (string, error) {
 
 	var (
 		messageJson []byte
@@ -101,28 +226,33 @@ func (rh *RouteHandler) GenerateConversation(privateKey, publicKey, remotePublic
 		err         error
 	)
 
+	ratchetKey, err := crypt.RatchetGenerateKey()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
 	var auth StartConversation
 	auth.Address = rh.URL
 	auth.Token = randomString(128)
+	auth.RatchetKey = ratchetKey.PublicKey().Bytes()
+	auth.Created = now.Unix()
+	if rh.TokenTTL > 0 {
+		auth.Expires = now.Add(rh.TokenTTL).Unix()
+	}
 
 	messageJson, err = json.Marshal(auth)
 	if err != nil {
 		return "", err
 	}
 
-	switch keyType {
-	case "rsa":
-		emsg, sig, err = crypt.RSAEncryptAndSignMessage(privateKey.(*rsa.PrivateKey), remotePublicKey.(*rsa.PublicKey), messageJson)
-	case "pgp":
-		emsg, err = crypt.PGPEncryptAndSignMessage(privateKey.(*crypto.Key), remotePublicKey.(*crypto.Key), messageJson)
-	default:
-		err = fmt.Errorf("Invalid key type")
-	}
+	emsg, sig, err = crypt.EncryptAndSignMessage(privateKey, remotePublicKey, messageJson)
 	if err != nil {
 		return "", err
 	}
 
 	var authWrapper StartConversationWrapper
+	authWrapper.Version = crypt.MessageVersion
 	authWrapper.Auth = emsg
 	authWrapper.Signature = sig
 	authWrapper.ID = uuid.New().String()
@@ -145,17 +275,20 @@ func (rh *RouteHandler) GenerateConversation(privateKey, publicKey, remotePublic
 		remotePublicKey,
 		privateKey,
 		publicKey,
-		w,
-		rh,
+		ratchetKey,
 	)
 	if err != nil {
 		return "", err
 	}
+	ch.Created = time.Unix(auth.Created, 0)
+	if auth.Expires != 0 {
+		ch.Expires = time.Unix(auth.Expires, 0)
+	}
 
 	rh.mux.Lock()
 	defer rh.mux.Unlock()
 
-	rh.Conversations[authWrapper.ID] = ch
+	rh.addConversation(ch)
 
 	return authB64, nil
 }
@@ -0,0 +1,469 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/storage"
+)
+
+// TrustLevel records how much a contact's key is trusted.
+type TrustLevel int
+
+const (
+	// The key was pinned the first time it was used and was not compared yet.
+	TrustUnverified TrustLevel = iota
+	// The fingerprint or a safety number was compared with the contact.
+	TrustVerified
+	// The key was marked as not belonging to the contact.
+	TrustUntrusted
+)
+
+func (t TrustLevel) String() string {
+	switch t {
+	case TrustUnverified:
+		return "unverified"
+	case TrustVerified:
+		return "verified"
+	case TrustUntrusted:
+		return "untrusted"
+	default:
+		return "unknown"
+	}
+}
+
+// Parses the name returned by String.
+func ParseTrustLevel(name string) (TrustLevel, error) {
+	for _, t := range []TrustLevel{TrustUnverified, TrustVerified, TrustUntrusted} {
+		if t.String() == name {
+			return t, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Invalid trust level: %q", name)
+}
+
+// KeyStatus is the result of resolving a public key against the contact book.
+type KeyStatus int
+
+const (
+	// No contact holds the key.
+	KeyUnknown KeyStatus = iota
+	// The key was pinned to a new contact.
+	KeyNew
+	// The key belongs to a contact.
+	KeyMatch
+	// The contact is known with a different key.
+	KeyChanged
+)
+
+func (s KeyStatus) String() string {
+	switch s {
+	case KeyUnknown:
+		return "unknown"
+	case KeyNew:
+		return "new"
+	case KeyMatch:
+		return "match"
+	case KeyChanged:
+		return "changed"
+	default:
+		return "invalid"
+	}
+}
+
+// Contact is a pinned public key with its alias. Aliases are unique in a contact book.
+type Contact struct {
+	Alias   string `json:"alias"`
+	KeyType string `json:"key_type"`
+	// PEM encoded
+	PublicKey []byte `json:"public_key"`
+	// Hex encoded, see crypt.Fingerprint
+	Fingerprint string     `json:"fingerprint"`
+	Address     string     `json:"address,omitempty"`
+	Trust       TrustLevel `json:"trust"`
+	Added       time.Time  `json:"added"`
+	LastSeen    time.Time  `json:"last_seen,omitempty"`
+}
+
+// Returns a warning for a resolved key, empty when it belongs to a trusted contact.
+func KeyWarning(c *Contact, status KeyStatus, fingerprint string) string {
+	switch status {
+	case KeyUnknown:
+		return fmt.Sprintf("The key %s does not belong to any contact", fingerprint)
+	case KeyNew:
+		return fmt.Sprintf("First conversation with %s, the key %s was pinned but not verified", c.Alias, fingerprint)
+	case KeyChanged:
+		return fmt.Sprintf("The key of %s changed from %s to %s, it may not be the same person", c.Alias, c.Fingerprint, fingerprint)
+	}
+
+	if c != nil && c.Trust == TrustUntrusted {
+		return fmt.Sprintf("The key of %s is marked untrusted", c.Alias)
+	}
+
+	return ""
+}
+
+// KeyError is the error of an EventKeyWarning.
+type KeyError struct {
+	// Contact the key resolved to, nil when it is unknown
+	Contact     *Contact
+	Status      KeyStatus
+	Fingerprint string
+}
+
+func (e *KeyError) Error() string {
+	return KeyWarning(e.Contact, e.Status, e.Fingerprint)
+}
+
+// ContactBook keeps pinned public keys in an encrypted vault. Keys are pinned the first
+// time they are seen, afterwards a different key for the same alias is reported as
+// changed instead of being trusted.
+type ContactBook struct {
+	vault *storage.Vault
+	mux   sync.Mutex
+}
+
+// Keeps contacts in the vault, see OpenKeyVault and OpenPassphraseVault.
+func NewContactBook(vault *storage.Vault) *ContactBook {
+	return &ContactBook{vault: vault}
+}
+
+const contactsName = "contacts"
+
+// Returns the hex encoded fingerprint of a PEM encoded public key.
+func PublicKeyFingerprint(keyType string, publicKey []byte) (string, error) {
+	key, err := crypt.PublicKeyToMem(keyType, publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	fingerprint, err := crypt.Fingerprint(key)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(fingerprint), nil
+}
+
+// Returns every contact sorted by alias.
+func (b *ContactBook) Contacts() ([]*Contact, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	contacts, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(contacts, func(i, j int) bool {
+		return strings.ToLower(contacts[i].Alias) < strings.ToLower(contacts[j].Alias)
+	})
+	return contacts, nil
+}
+
+// Returns the contact with the alias.
+func (b *ContactBook) Contact(alias string) (*Contact, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	contacts, err := b.load()
+	if err != nil {
+		return nil, false
+	}
+
+	c := findAlias(contacts, alias)
+	return c, c != nil
+}
+
+// Adds a contact, the alias must not be taken yet.
+func (b *ContactBook) Add(alias, keyType string, publicKey []byte, trust TrustLevel) (*Contact, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	contacts, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newContact(alias, keyType, publicKey, trust)
+	if err != nil {
+		return nil, err
+	}
+	if findAlias(contacts, alias) != nil {
+		return nil, fmt.Errorf("A contact named %q already exists", alias)
+	}
+
+	return c, b.save(append(contacts, c))
+}
+
+// Removes a contact.
+func (b *ContactBook) Remove(alias string) error {
+	return b.update(alias, func(contacts []*Contact, i int) []*Contact {
+		return append(contacts[:i], contacts[i+1:]...)
+	})
+}
+
+// Sets the trust level of a contact.
+func (b *ContactBook) SetTrust(alias string, trust TrustLevel) error {
+	return b.update(alias, func(contacts []*Contact, i int) []*Contact {
+		contacts[i].Trust = trust
+		return contacts
+	})
+}
+
+// Replaces the pinned key of a contact after a change was confirmed. The new key starts
+// out unverified.
+func (b *ContactBook) SetKey(alias, keyType string, publicKey []byte) error {
+	fingerprint, err := PublicKeyFingerprint(keyType, publicKey)
+	if err != nil {
+		return err
+	}
+
+	return b.update(alias, func(contacts []*Contact, i int) []*Contact {
+		contacts[i].KeyType = keyType
+		contacts[i].PublicKey = publicKey
+		contacts[i].Fingerprint = fingerprint
+		contacts[i].Trust = TrustUnverified
+		return contacts
+	})
+}
+
+// Records the onion address the contact holding the key was last reached at.
+func (b *ContactBook) SetAddress(fingerprint, address string) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	contacts, err := b.load()
+	if err != nil {
+		return err
+	}
+
+	c := findFingerprint(contacts, fingerprint)
+	if c == nil {
+		return nil
+	}
+
+	c.Address = address
+	c.LastSeen = time.Now()
+	return b.save(contacts)
+}
+
+// Resolves a PEM encoded public key. The key is looked up by fingerprint first, when no
+// contact holds it and alias names a contact the key is reported as changed.
+func (b *ContactBook) Resolve(alias, keyType string, publicKey []byte) (*Contact, KeyStatus, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	contacts, err := b.load()
+	if err != nil {
+		return nil, KeyUnknown, err
+	}
+
+	return resolve(contacts, alias, keyType, publicKey)
+}
+
+// Resolves a key like Resolve and pins it to a new contact named alias when it is
+// unknown, trust on first use.
+func (b *ContactBook) Pin(alias, keyType string, publicKey []byte) (*Contact, KeyStatus, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	contacts, err := b.load()
+	if err != nil {
+		return nil, KeyUnknown, err
+	}
+
+	c, status, err := resolve(contacts, alias, keyType, publicKey)
+	if err != nil || status != KeyUnknown || alias == "" {
+		return c, status, err
+	}
+
+	c, err = newContact(alias, keyType, publicKey, TrustUnverified)
+	if err != nil {
+		return nil, KeyUnknown, err
+	}
+
+	return c, KeyNew, b.save(append(contacts, c))
+}
+
+func resolve(contacts []*Contact, alias, keyType string, publicKey []byte) (*Contact, KeyStatus, error) {
+	fingerprint, err := PublicKeyFingerprint(keyType, publicKey)
+	if err != nil {
+		return nil, KeyUnknown, err
+	}
+
+	if c := findFingerprint(contacts, fingerprint); c != nil {
+		return c, KeyMatch, nil
+	}
+	if c := findAlias(contacts, alias); c != nil {
+		return c, KeyChanged, nil
+	}
+
+	return nil, KeyUnknown, nil
+}
+
+func newContact(alias, keyType string, publicKey []byte, trust TrustLevel) (*Contact, error) {
+	if alias == "" {
+		return nil, fmt.Errorf("Contact alias is empty")
+	}
+
+	fingerprint, err := PublicKeyFingerprint(keyType, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Contact{
+		Alias:       alias,
+		KeyType:     keyType,
+		PublicKey:   publicKey,
+		Fingerprint: fingerprint,
+		Trust:       trust,
+		Added:       time.Now(),
+	}, nil
+}
+
+func findAlias(contacts []*Contact, alias string) *Contact {
+	for _, c := range contacts {
+		if alias != "" && strings.EqualFold(c.Alias, alias) {
+			return c
+		}
+	}
+	return nil
+}
+
+func findFingerprint(contacts []*Contact, fingerprint string) *Contact {
+	for _, c := range contacts {
+		if c.Fingerprint == fingerprint {
+			return c
+		}
+	}
+	return nil
+}
+
+// Applies a change to the contact with the alias and saves the result.
+func (b *ContactBook) update(alias string, change func(contacts []*Contact, i int) []*Contact) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	contacts, err := b.load()
+	if err != nil {
+		return err
+	}
+
+	for i, c := range contacts {
+		if strings.EqualFold(c.Alias, alias) {
+			return b.save(change(contacts, i))
+		}
+	}
+
+	return fmt.Errorf("Unknown contact: %q", alias)
+}
+
+// Must be called with the lock held.
+func (b *ContactBook) load() ([]*Contact, error) {
+	data, err := b.vault.Get(contactsName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var contacts []*Contact
+	err = json.Unmarshal(data, &contacts)
+	return contacts, err
+}
+
+// Must be called with the lock held.
+func (b *ContactBook) save(contacts []*Contact) error {
+	data, err := json.Marshal(contacts)
+	if err != nil {
+		return err
+	}
+
+	return b.vault.Put(contactsName, data)
+}
+
+// Resolves the remote key of a conversation against the contact book and pins it when
+// it is unknown. Must be called with the lock held.
+func (rh *RouteHandler) pinContact(c *Conversation) {
+	if rh.Contacts == nil {
+		return
+	}
+
+	publicKey, err := crypt.PublicKeyToBytes(c.RemotePublicKey)
+	if err != nil {
+		return
+	}
+
+	contact, status, err := rh.Contacts.Pin(c.ConversationAlias, c.KeyType, publicKey)
+	if err != nil {
+		rh.events.publish(Event{Type: EventKeyWarning, ConversationID: c.ConversationID, Err: fmt.Errorf("Key could not be checked against the contact book: %s", err)})
+		return
+	}
+
+	c.KeyStatus = status
+	if contact != nil {
+		c.contact = contact.Alias
+	}
+
+	fingerprint, _ := PublicKeyFingerprint(c.KeyType, publicKey)
+	if KeyWarning(contact, status, fingerprint) != "" {
+		rh.events.publish(Event{Type: EventKeyWarning, ConversationID: c.ConversationID, Err: &KeyError{contact, status, fingerprint}})
+	}
+}
+
+// Records the address a contact was reached at. Must be called with the lock held.
+func (rh *RouteHandler) seenContact(c *Conversation) {
+	if rh.Contacts == nil || c.KeyStatus == KeyChanged || c.RemoteAddress == "" {
+		return
+	}
+
+	fingerprint, err := crypt.Fingerprint(c.RemotePublicKey)
+	if err != nil {
+		return
+	}
+
+	// The contact book is best effort like the history
+	rh.Contacts.SetAddress(hex.EncodeToString(fingerprint), c.RemoteAddress)
+}
+
+// Pins the current remote key of a conversation after the user confirmed a change, the
+// contact starts out unverified again.
+func (rh *RouteHandler) AcceptKey(id string) error {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	c, ok := rh.Conversations[id]
+	if !ok {
+		return fmt.Errorf("Unknown conversation")
+	}
+	if rh.Contacts == nil {
+		return fmt.Errorf("No contact book")
+	}
+	if c.KeyStatus != KeyChanged {
+		return nil
+	}
+
+	publicKey, err := crypt.PublicKeyToBytes(c.RemotePublicKey)
+	if err != nil {
+		return err
+	}
+
+	if err := rh.Contacts.SetKey(c.contact, c.KeyType, publicKey); err != nil {
+		return err
+	}
+
+	c.KeyStatus = KeyMatch
+	rh.seenContact(c)
+	return nil
+}
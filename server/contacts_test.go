@@ -0,0 +1,128 @@
+package server_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/server"
+)
+
+func TestContactBook(t *testing.T) {
+	alice := newPeer(t, "x25519")
+	bob := newPeer(t, "x25519")
+	mallory := newPeer(t, "x25519")
+	dir := t.TempDir()
+
+	bobKey, _ := crypt.PublicKeyToBytes(bob.publicKey)
+	malloryKey, _ := crypt.PublicKeyToBytes(mallory.publicKey)
+
+	book := server.NewContactBook(newVault(t, dir, alice.privateKey))
+
+	c, status, err := book.Pin("Bob", "x25519", bobKey)
+	if err != nil || status != server.KeyNew || c.Trust != server.TrustUnverified {
+		t.Fatalf("Expected Bob's key to be pinned, got %v %v", status, err)
+	}
+
+	// Contacts survive reopening the vault
+	book = server.NewContactBook(newVault(t, dir, alice.privateKey))
+
+	if c, status, _ := book.Resolve("", "x25519", bobKey); status != server.KeyMatch || c.Alias != "Bob" {
+		t.Fatalf("Expected Bob's key to match, got %v", status)
+	}
+	if _, status, _ := book.Resolve("", "x25519", malloryKey); status != server.KeyUnknown {
+		t.Fatalf("Expected an unknown key, got %v", status)
+	}
+	if _, status, _ := book.Pin("bob", "x25519", malloryKey); status != server.KeyChanged {
+		t.Fatalf("Expected a different key for Bob to be reported, got %v", status)
+	}
+
+	if c, _ := book.Contact("Bob"); c.Fingerprint == "" || string(c.PublicKey) != string(bobKey) {
+		t.Fatalf("A changed key must not replace the pinned key")
+	}
+
+	if err := book.SetKey("Bob", "x25519", malloryKey); err != nil {
+		t.Fatalf("Error replacing key: %s", err)
+	}
+	if _, status, _ := book.Resolve("Bob", "x25519", malloryKey); status != server.KeyMatch {
+		t.Fatalf("Expected the replaced key to match, got %v", status)
+	}
+
+	if _, err := book.Add("Bob", "x25519", bobKey, server.TrustVerified); err == nil {
+		t.Fatalf("Expected a duplicate alias to be refused")
+	}
+	if err := book.Remove("Bob"); err != nil {
+		t.Fatalf("Error removing contact: %s", err)
+	}
+	if contacts, _ := book.Contacts(); len(contacts) != 0 {
+		t.Fatalf("Expected no contacts, got %d", len(contacts))
+	}
+}
+
+func TestConversationKeyWarning(t *testing.T) {
+	alice := newPeer(t, "x25519")
+	bob := newPeer(t, "x25519")
+	mallory := newPeer(t, "x25519")
+
+	alice.rh.Contacts = server.NewContactBook(newVault(t, t.TempDir(), alice.privateKey))
+	events, unsubscribe := alice.rh.Subscribe()
+	defer unsubscribe()
+
+	warning := func() server.Event {
+		t.Helper()
+
+		for {
+			if e := nextEvent(t, events); e.Type == server.EventKeyWarning {
+				return e
+			}
+		}
+	}
+
+	token, err := alice.rh.GenerateConversation(alice.privateKey, alice.encodedKey, bob.publicKey, "x25519", "Bob")
+	if err != nil {
+		t.Fatalf("Error generating conversation: %s", err)
+	}
+	first := warning()
+
+	if err := bob.rh.BootstrapConversation(token, bob.privateKey, bob.encodedKey, alice.publicKey, "Alice"); err != nil {
+		t.Fatalf("Error bootstrapping conversation: %s", err)
+	}
+
+	c, _ := alice.rh.Conversation(first.ConversationID)
+	if c.KeyStatus != server.KeyNew {
+		t.Fatalf("Expected the first key to be pinned, got %v", c.KeyStatus)
+	}
+
+	contact, ok := alice.rh.Contacts.Contact("Bob")
+	if !ok || contact.Address != bob.rh.URL {
+		t.Fatalf("Expected Bob's address to be recorded, got %+v", contact)
+	}
+
+	alice.rh.SetVerified(c.ConversationID, true)
+	if contact, _ := alice.rh.Contacts.Contact("Bob"); contact.Trust != server.TrustVerified {
+		t.Fatalf("Expected a verified safety number to verify the contact")
+	}
+
+	// Someone else claims to be Bob
+	if _, err := alice.rh.GenerateConversation(alice.privateKey, alice.encodedKey, mallory.publicKey, "x25519", "Bob"); err != nil {
+		t.Fatalf("Error generating conversation: %s", err)
+	}
+
+	changed := warning()
+	var keyErr *server.KeyError
+	if !errors.As(changed.Err, &keyErr) || keyErr.Status != server.KeyChanged || keyErr.Contact.Alias != "Bob" {
+		t.Fatalf("Expected a changed key to be reported, got %v", changed.Err)
+	}
+
+	c, _ = alice.rh.Conversation(changed.ConversationID)
+	if c.KeyStatus != server.KeyChanged {
+		t.Fatalf("Expected the conversation to be marked, got %v", c.KeyStatus)
+	}
+
+	if err := alice.rh.AcceptKey(c.ConversationID); err != nil {
+		t.Fatalf("Error accepting key: %s", err)
+	}
+	if contact, _ := alice.rh.Contacts.Contact("Bob"); contact.Trust != server.TrustUnverified {
+		t.Fatalf("Expected an accepted key to start out unverified")
+	}
+}
@@ -1,37 +1,105 @@
 package server
 
 import (
-	"crypto/rsa"
+	"crypto/ecdh"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/JustinTimperio/onionsoup/crypt"
 
-	"fyne.io/fyne/v2"
-	"github.com/ProtonMail/gopenpgp/v3/crypto"
+	"github.com/google/uuid"
 )
 
+// MessageKind says what a message carries. Receivers ignore kinds they do not know so
+// new kinds can be introduced without breaking older peers.
+type MessageKind string
+
+const (
+	// Text written by the user.
+	KindText MessageKind = "text"
+	// The final text of the conversation, nothing is accepted after it.
+	KindEnd MessageKind = "end"
+	// The sender decrypted and verified the messages in Acknowledges.
+	KindAck MessageKind = "ack"
+	// The sender viewed the messages in Acknowledges.
+	KindRead MessageKind = "read"
+	// The sender is writing a message.
+	KindTyping MessageKind = "typing"
+	// Reserved for replacing the long term keys of a conversation.
+	KindKeyRotation MessageKind = "key_rotation"
+	// Part of a file, the Body describes it.
+	KindAttachment MessageKind = "attachment"
+	// Checks that the remote party is reachable, the response is the answer.
+	KindPing MessageKind = "ping"
+	// Carries a group operation, the Body describes it.
+	KindGroup MessageKind = "group"
+	// The sender could not receive the attachments in Acknowledges, they have to be sent
+	// again.
+	KindNack MessageKind = "nack"
+)
+
+// Message is the envelope of everything exchanged in an established conversation.
 type Message struct {
-	Text         string `json:"text"`
-	Time         int    `json:"time"`
-	Token        string `json:"token"`
-	FinalMessage bool   `json:"final_message"`
-	Self         bool   `json:"_"`
+	ID    string      `json:"id"`
+	Kind  MessageKind `json:"kind"`
+	Text  string      `json:"text,omitempty"`
+	Time  int         `json:"time"`
+	Token string      `json:"token"`
+
+	// Messages an ack, read or nack refers to
+	Acknowledges []string `json:"acknowledges,omitempty"`
+	// Payload of kinds that carry more than text
+	Body json.RawMessage `json:"body,omitempty"`
+
+	Self bool `json:"-"`
+	// Delivery state of messages sent by this party
+	Status MessageStatus `json:"-"`
+	// File of an attachment message once it was sent or fully received
+	Attachment *Attachment `json:"-"`
+	// Alias of the member that wrote a group message
+	Sender string `json:"-"`
+}
+
+// Returns whether the message ended the conversation.
+func (m *Message) Final() bool {
+	return m.Kind == KindEnd
+}
+
+// Returns a copy of the message. Messages of a conversation are updated with the lock
+// held, copies are handed out so they can be read without it.
+func (m *Message) snapshot() *Message {
+	msg := *m
+	return &msg
 }
 
 type MessageWrapper struct {
+	Version   int    `json:"version,omitempty"`
 	Message   []byte `json:"message"`
 	Signature []byte `json:"signature"`
 	ID        string `json:"id"`
 }
 
 type StartConversation struct {
+	Address    string `json:"address"`
+	Token      string `json:"token"`
+	RatchetKey []byte `json:"ratchet_key,omitempty"`
+	// Unix times the token was generated and stops being accepted, set in tokens only
+	Created int64 `json:"created,omitempty"`
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// Sent inside a StartConversationWrapper to tell the remote party the conversation
+// continues at a new address after a restart.
+type ResumeConversation struct {
 	Address string `json:"address"`
 	Token   string `json:"token"`
+	Time    int64  `json:"time"`
 }
 
 type StartConversationWrapper struct {
+	Version        int    `json:"version,omitempty"`
 	EncryptionType string `json:"encryption_type"`
 	ID             string `json:"id"`
 	Auth           []byte `json:"auth"`
@@ -42,17 +110,44 @@ type Conversation struct {
 	ConversationAlias string
 	ConversationID    string
 	Messages          []*Message
-	Render            *ConversationRender
 
 	// Self
-	SelfToken      string
-	SelfPublicKey  any
+	SelfToken string
+	// Encoded public key of SelfPrivateKey, see crypt.PublicKeyToBytes
+	SelfPublicKey  []byte
 	SelfPrivateKey any
 
 	// Internal
 	KeyType     string
 	Established bool
 	Ended       bool
+	Verified    bool
+	// Result of resolving the remote key against the contact book, KeyUnknown when
+	// there is none
+	KeyStatus KeyStatus
+	Ratchet   *crypt.Ratchet
+	// When the bootstrap token was generated and stops being accepted, zero for
+	// conversations started from a token and tokens without expiry
+	Created time.Time
+	Expires time.Time
+
+	// Alias of the contact the remote key resolved to
+	contact string
+	// Ephemeral handshake key held until the remote ratchet key arrives
+	ratchetKey *ecdh.PrivateKey
+	// Time of the newest accepted resume request, older ones are replays
+	lastResume int64
+
+	// Messages waiting for delivery in the order they were sent
+	outbox []*outboxEntry
+	// Held while the outbox is delivered so messages leave in order
+	delivering sync.Mutex
+	// Digests of recently accepted messages
+	received []string
+	// Received messages without a read receipt yet
+	unread []string
+	// Attachments missing chunks, the chunks are kept in the store until they are complete
+	incoming map[string]*incomingAttachment
 
 	// Remote
 	RemoteAddress   string
@@ -62,33 +157,29 @@ type Conversation struct {
 
 func NewConversationHandle(
 	sAddress, rAddress, keyType, conversationAlias, remoteToken, selfToken, convoID string,
-	receiverPublicKey, senderPrivateKey, senderPublicKey any,
-	w fyne.Window, rh *RouteHandler) ([]byte, *Conversation, error) {
+	receiverPublicKey, senderPrivateKey any, senderPublicKey []byte, ratchetKey *ecdh.PrivateKey) ([]byte, *Conversation, error) {
 
 	var ac = &StartConversation{
 		Address: sAddress,
 		Token:   selfToken,
 	}
 
+	if ratchetKey != nil {
+		ac.RatchetKey = ratchetKey.PublicKey().Bytes()
+	}
+
 	acJBytes, err := json.Marshal(ac)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	var message, sig []byte
-	switch keyType {
-	case "rsa":
-		message, sig, err = crypt.RSAEncryptAndSignMessage(senderPrivateKey.(*rsa.PrivateKey), receiverPublicKey.(*rsa.PublicKey), acJBytes)
-	case "pgp":
-		message, err = crypt.PGPEncryptAndSignMessage(senderPrivateKey.(*crypto.Key), receiverPublicKey.(*crypto.Key), acJBytes)
-	default:
-		err = fmt.Errorf("Invalid key type")
-	}
+	message, sig, err := crypt.EncryptAndSignMessage(senderPrivateKey, receiverPublicKey, acJBytes)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	var sc = &StartConversationWrapper{
+		Version:        crypt.MessageVersion,
 		EncryptionType: keyType,
 		ID:             convoID,
 		Auth:           message,
@@ -104,7 +195,6 @@ func NewConversationHandle(
 		ConversationID:    convoID,
 		ConversationAlias: conversationAlias,
 		Messages:          make([]*Message, 0),
-		Render:            &ConversationRender{},
 
 		KeyType:     keyType,
 		Established: false,
@@ -117,38 +207,72 @@ func NewConversationHandle(
 		RemoteAddress:   rAddress,
 		RemoteToken:     remoteToken,
 		RemotePublicKey: receiverPublicKey,
+
+		ratchetKey: ratchetKey,
 	}
 
 	return scJBytes, c, nil
 }
 
+// Returns the safety number both parties can compare out of band to confirm that
+// neither public key was substituted.
+func (h *Conversation) SafetyNumber() ([]byte, error) {
+	self, err := crypt.Fingerprint(h.SelfPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := crypt.Fingerprint(h.RemotePublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return crypt.SafetyNumber(self, remote), nil
+}
+
 func (h *Conversation) PackMessage(message string, end bool) ([]byte, error) {
-	msg := Message{
-		Text:         message,
-		Time:         int(time.Now().Unix()),
-		Token:        h.RemoteToken,
-		FinalMessage: end,
+	kind := KindText
+	if end {
+		kind = KindEnd
 	}
 
+	return h.pack(Message{
+		ID:   uuid.New().String(),
+		Kind: kind,
+		Text: message,
+		Time: int(time.Now().Unix()),
+	})
+}
+
+// Packs any message of the conversation, the token is filled in.
+func (h *Conversation) pack(msg Message) ([]byte, error) {
+	msg.Token = h.RemoteToken
+
 	msgBytes, err := json.Marshal(msg)
 	if err != nil {
 		return nil, err
 	}
 
 	var messageJson, sig []byte
-	switch h.KeyType {
-	case "rsa":
-		messageJson, sig, err = crypt.RSAEncryptAndSignMessage(h.SelfPrivateKey.(*rsa.PrivateKey), h.RemotePublicKey.(*rsa.PublicKey), msgBytes)
-	case "pgp":
-		messageJson, err = crypt.PGPEncryptAndSignMessage(h.SelfPrivateKey.(*crypto.Key), h.RemotePublicKey.(*crypto.Key), msgBytes)
-	default:
-		err = fmt.Errorf("Invalid key type")
+	version := crypt.MessageVersion
+	if h.Ratchet != nil {
+		// The ratchet provides confidentiality, the long term keys only authenticate
+		version = crypt.MessageVersionRatchet
+		messageJson, err = h.Ratchet.Encrypt(msgBytes, []byte(h.ConversationID))
+		if err != nil {
+			return nil, err
+		}
+
+		sig, err = crypt.SignMessage(h.SelfPrivateKey, messageJson)
+	} else {
+		messageJson, sig, err = crypt.EncryptAndSignMessage(h.SelfPrivateKey, h.RemotePublicKey, msgBytes)
 	}
 	if err != nil {
 		return nil, err
 	}
 
 	var messageWrapper = &MessageWrapper{
+		Version:   version,
 		Message:   messageJson,
 		Signature: sig,
 		ID:        h.ConversationID,
@@ -162,19 +286,31 @@ func (h *Conversation) PackMessage(message string, end bool) ([]byte, error) {
 	return mwJBytes, nil
 }
 
-func (h *Conversation) UnpackMessage(eMessage, sig []byte) (*Message, error) {
+func (h *Conversation) UnpackMessage(version int, eMessage, sig []byte) (*Message, error) {
 	var (
 		err         error
 		messageJson []byte
 	)
 
-	switch h.KeyType {
-	case "rsa":
-		messageJson, err = crypt.RSADecryptAndVerifyMessage(h.SelfPrivateKey.(*rsa.PrivateKey), h.RemotePublicKey.(*rsa.PublicKey), eMessage, sig)
-	case "pgp":
-		messageJson, err = crypt.PGPDecryptAndVerifyMessage(h.SelfPrivateKey.(*crypto.Key), h.RemotePublicKey.(*crypto.Key), eMessage)
+	switch {
+	case version == crypt.MessageVersionRatchet:
+		if h.Ratchet == nil {
+			return nil, fmt.Errorf("No ratchet session established")
+		}
+
+		err = crypt.VerifyMessage(h.RemotePublicKey, eMessage, sig)
+		if err != nil {
+			return nil, err
+		}
+
+		messageJson, err = h.Ratchet.Decrypt(eMessage, []byte(h.ConversationID))
+
+	case h.Ratchet != nil:
+		// Refuse to fall back to the long term keys once forward secrecy was negotiated
+		err = fmt.Errorf("Conversation requires ratchet messages")
+
 	default:
-		err = fmt.Errorf("Invalid key type")
+		messageJson, err = crypt.DecryptAndVerifyMessage(version, h.SelfPrivateKey, h.RemotePublicKey, eMessage, sig)
 	}
 	if err != nil {
 		return nil, err
@@ -186,6 +322,19 @@ func (h *Conversation) UnpackMessage(eMessage, sig []byte) (*Message, error) {
 		return nil, fmt.Errorf("Error Parsing Message")
 	}
 
+	// Peers from before message kinds only sent text with a final flag
+	if message.Kind == "" {
+		var legacy struct {
+			FinalMessage bool `json:"final_message"`
+		}
+		json.Unmarshal(messageJson, &legacy)
+
+		message.Kind = KindText
+		if legacy.FinalMessage {
+			message.Kind = KindEnd
+		}
+	}
+
 	if message.Token != h.SelfToken {
 		return nil, fmt.Errorf("Invalid Token")
 	}
@@ -0,0 +1,182 @@
+package server
+
+import "sync"
+
+type EventType int
+
+const (
+	// A conversation was added, either by generating a token or importing one.
+	EventConversationCreated EventType = iota
+	// The remote party completed the bootstrap and messages can be exchanged.
+	EventConversationEstablished
+	// A message from the remote party was decrypted and verified.
+	EventMessageReceived
+	// Either party sent its final message.
+	EventConversationEnded
+	// A message could not be packed or delivered to the remote party.
+	EventDeliveryFailed
+	// A message sent by this party was queued, is being sent, was delivered or failed.
+	EventMessageStatus
+	// The remote party is writing a message.
+	EventTyping
+	// A group was joined or its members changed, GroupID is set instead of ConversationID.
+	EventGroupUpdated
+	// A message was added to a group or its status changed.
+	EventGroupMessage
+	// The key of a conversation partner is new, changed or untrusted, Err describes it.
+	EventKeyWarning
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConversationCreated:
+		return "conversation_created"
+	case EventConversationEstablished:
+		return "conversation_established"
+	case EventMessageReceived:
+		return "message_received"
+	case EventConversationEnded:
+		return "conversation_ended"
+	case EventDeliveryFailed:
+		return "delivery_failed"
+	case EventMessageStatus:
+		return "message_status"
+	case EventTyping:
+		return "typing"
+	case EventGroupUpdated:
+		return "group_updated"
+	case EventGroupMessage:
+		return "group_message"
+	case EventKeyWarning:
+		return "key_warning"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change to a conversation or group. Message is set for received
+// messages, status changes and failed deliveries, Err is set for failed deliveries and
+// key warnings. Message is a copy taken when the event was published, so subscribers can
+// read it while the handler keeps updating the conversation.
+type Event struct {
+	Type           EventType
+	ConversationID string
+	GroupID        string
+	Message        *Message
+	Err            error
+}
+
+// Fans events out to subscribers. Every subscriber has its own unbounded queue so a slow
+// consumer never blocks the request handlers or other subscribers.
+type eventBus struct {
+	subscribers map[*subscriber]struct{}
+	mux         sync.Mutex
+}
+
+type subscriber struct {
+	events chan Event
+	queue  []Event
+	notify chan struct{}
+	done   chan struct{}
+	mux    sync.Mutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[*subscriber]struct{})}
+}
+
+// Returns a channel receiving every event published from now on and a function that
+// cancels the subscription. The channel is closed once the subscription is cancelled
+// or the RouteHandler is closed.
+func (rh *RouteHandler) Subscribe() (<-chan Event, func()) {
+	s := &subscriber{
+		events: make(chan Event),
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	rh.events.mux.Lock()
+	rh.events.subscribers[s] = struct{}{}
+	rh.events.mux.Unlock()
+
+	go s.run()
+
+	return s.events, func() {
+		rh.events.unsubscribe(s)
+	}
+}
+
+// Events carrying a message are published with the lock of the handler held, the copy
+// is taken before it is released.
+func (b *eventBus) publish(e Event) {
+	if e.Message != nil {
+		e.Message = e.Message.snapshot()
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	for s := range b.subscribers {
+		s.push(e)
+	}
+}
+
+func (b *eventBus) unsubscribe(s *subscriber) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if _, ok := b.subscribers[s]; ok {
+		delete(b.subscribers, s)
+		close(s.done)
+	}
+}
+
+func (b *eventBus) close() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	for s := range b.subscribers {
+		delete(b.subscribers, s)
+		close(s.done)
+	}
+}
+
+func (s *subscriber) push(e Event) {
+	s.mux.Lock()
+	s.queue = append(s.queue, e)
+	s.mux.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Forwards queued events in order until the subscription is cancelled.
+func (s *subscriber) run() {
+	defer close(s.events)
+
+	for {
+		s.mux.Lock()
+		if len(s.queue) == 0 {
+			s.mux.Unlock()
+
+			select {
+			case <-s.notify:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mux.Unlock()
+
+		select {
+		case s.events <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Group is a conversation between several parties. The admin that created the group
+// has a conversation with every member and orders the group: members post to the admin,
+// the admin numbers every message and membership change and forwards it to all members,
+// so every member applies them in the same order. Members trust the admin to relay the
+// sender of a message faithfully. Groups are kept in the Store and their messages in the
+// History of the RouteHandler when those are set.
+type Group struct {
+	GroupID string
+	Name    string
+	// Members in the order they joined, the admin first
+	Members  []*GroupMember
+	Messages []*Message
+
+	// Whether this party created the group
+	Admin bool
+	// Member id of this party
+	SelfID string
+	// Conversation with the admin, empty for the admin
+	AdminConversation string
+	// This party left or was removed, nothing is accepted anymore
+	Left bool
+
+	// Sequence number of the last applied operation
+	seq int
+	// Operations that arrived before an earlier one
+	early map[int]*groupMessage
+	// Messages posted by this party that the admin has not ordered yet
+	pending []*Message
+}
+
+// GroupMember is a party of a group. Members are identified by an id chosen by the admin,
+// the id of the conversation with the admin is not shared with the other members.
+type GroupMember struct {
+	ID    string `json:"id"`
+	Alias string `json:"alias"`
+
+	// Conversation of the admin with the member
+	conversationID string
+}
+
+type groupOp string
+
+const (
+	// Admin to a new member, carries the current members and sequence number.
+	groupInvite groupOp = "invite"
+	// Admin to the members, Members joined.
+	groupAdd groupOp = "add"
+	// Admin to the members and the removed member, Member left.
+	groupRemove groupOp = "remove"
+	// Admin to the members, a text written by Sender.
+	groupText groupOp = "text"
+	// Member to the admin, a text to order and forward.
+	groupPost groupOp = "post"
+	// Member to the admin, the member leaves the group.
+	groupLeave groupOp = "leave"
+)
+
+// Body of a group message.
+type groupMessage struct {
+	GroupID   string         `json:"group_id"`
+	Op        groupOp        `json:"op"`
+	Seq       int            `json:"seq,omitempty"`
+	Name      string         `json:"name,omitempty"`
+	Member    string         `json:"member,omitempty"`
+	Members   []*GroupMember `json:"members,omitempty"`
+	MessageID string         `json:"message_id,omitempty"`
+	Sender    string         `json:"sender,omitempty"`
+	Text      string         `json:"text,omitempty"`
+	Time      int            `json:"time,omitempty"`
+}
+
+// Returns the member with the given id.
+func (g *Group) member(id string) *GroupMember {
+	for _, m := range g.Members {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// Returns the member the admin has the conversation with.
+func (g *Group) memberByConversation(id string) *GroupMember {
+	for _, m := range g.Members {
+		if m.conversationID != "" && m.conversationID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// Returns the group with the given id.
+func (rh *RouteHandler) Group(id string) (*Group, bool) {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	g, ok := rh.Groups[id]
+	return g, ok
+}
+
+// Returns the ids of all groups in a stable order.
+func (rh *RouteHandler) GroupIDs() []string {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	ids := make([]string, 0, len(rh.Groups))
+	for id := range rh.Groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Returns a copy of the members of a group.
+func (rh *RouteHandler) GroupMembers(id string) []GroupMember {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	g, ok := rh.Groups[id]
+	if !ok {
+		return nil
+	}
+
+	members := make([]GroupMember, 0, len(g.Members))
+	for _, m := range g.Members {
+		members = append(members, *m)
+	}
+	return members
+}
+
+// Returns a copy of the messages of a group in the order of the group, messages this
+// party posted that are not ordered yet come last.
+func (rh *RouteHandler) GroupMessages(id string) []*Message {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	g, ok := rh.Groups[id]
+	if !ok {
+		return nil
+	}
+
+	messages := make([]*Message, 0, len(g.Messages)+len(g.pending))
+	for _, m := range g.Messages {
+		messages = append(messages, m.snapshot())
+	}
+	for _, m := range g.pending {
+		messages = append(messages, m.snapshot())
+	}
+	return messages
+}
+
+// Creates a group administered by this party with the other parties of the given
+// established conversations as members.
+func (rh *RouteHandler) CreateGroup(name string, conversationIDs []string) (*Group, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Group name is empty")
+	}
+
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	g := &Group{
+		GroupID: uuid.New().String(),
+		Name:    name,
+		Admin:   true,
+		SelfID:  uuid.New().String(),
+	}
+	g.Members = []*GroupMember{{ID: g.SelfID, Alias: "Admin"}}
+
+	for _, id := range conversationIDs {
+		m, err := rh.newMember(g, id)
+		if err != nil {
+			return nil, err
+		}
+		g.Members = append(g.Members, m)
+	}
+
+	rh.Groups[g.GroupID] = g
+	for _, m := range g.Members[1:] {
+		rh.invite(g, m)
+	}
+	rh.saveGroup(g)
+	rh.events.publish(Event{Type: EventGroupUpdated, GroupID: g.GroupID})
+
+	return g, nil
+}
+
+// Adds the other party of an established conversation to a group administered by this
+// party.
+func (rh *RouteHandler) AddGroupMember(groupID, conversationID string) error {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	g, err := rh.adminGroup(groupID)
+	if err != nil {
+		return err
+	}
+
+	m, err := rh.newMember(g, conversationID)
+	if err != nil {
+		return err
+	}
+
+	rh.order(g, &groupMessage{Op: groupAdd, Members: []*GroupMember{m}})
+	rh.invite(g, m)
+	return nil
+}
+
+// Removes a member from a group administered by this party.
+func (rh *RouteHandler) RemoveGroupMember(groupID, memberID string) error {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	g, err := rh.adminGroup(groupID)
+	if err != nil {
+		return err
+	}
+
+	if memberID == g.SelfID {
+		return fmt.Errorf("The admin cannot be removed")
+	}
+	if g.member(memberID) == nil {
+		return fmt.Errorf("Unknown member")
+	}
+
+	rh.order(g, &groupMessage{Op: groupRemove, Member: memberID})
+	return nil
+}
+
+// Leaves a group. A group left by its admin ends for every member.
+func (rh *RouteHandler) LeaveGroup(groupID string) error {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	g, ok := rh.Groups[groupID]
+	if !ok {
+		return fmt.Errorf("Unknown group")
+	}
+	if g.Left {
+		return nil
+	}
+
+	if g.Admin {
+		for _, m := range append([]*GroupMember{}, g.Members[1:]...) {
+			rh.order(g, &groupMessage{Op: groupRemove, Member: m.ID})
+		}
+	} else {
+		convo, ok := rh.Conversations[g.AdminConversation]
+		if ok && !convo.Ended {
+			rh.queueGroup(convo, &groupMessage{GroupID: g.GroupID, Op: groupLeave})
+		}
+	}
+
+	g.Left = true
+	rh.saveGroup(g)
+	rh.events.publish(Event{Type: EventGroupUpdated, GroupID: groupID})
+	return nil
+}
+
+// Sends a text to every member of a group. Texts of members are shown once the admin
+// ordered them, until then they keep StatusQueued.
+func (rh *RouteHandler) SendGroup(groupID, text string) (*Message, error) {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	g, ok := rh.Groups[groupID]
+	if !ok {
+		return nil, fmt.Errorf("Unknown group")
+	}
+	if g.Left {
+		return nil, fmt.Errorf("Group has ended")
+	}
+
+	gm := &groupMessage{
+		GroupID:   groupID,
+		Op:        groupText,
+		MessageID: uuid.New().String(),
+		Sender:    g.SelfID,
+		Text:      text,
+		Time:      int(time.Now().Unix()),
+	}
+
+	if g.Admin {
+		return rh.order(g, gm).snapshot(), nil
+	}
+
+	convo, ok := rh.Conversations[g.AdminConversation]
+	if !ok || convo.Ended {
+		return nil, fmt.Errorf("Conversation with the group admin has ended")
+	}
+
+	msg := &Message{
+		ID:     gm.MessageID,
+		Kind:   KindText,
+		Text:   text,
+		Time:   gm.Time,
+		Self:   true,
+		Status: StatusQueued,
+		Sender: g.member(g.SelfID).Alias,
+	}
+	g.pending = append(g.pending, msg)
+	rh.saveGroup(g)
+
+	gm.Op = groupPost
+	rh.queueGroup(convo, gm)
+	rh.events.publish(Event{Type: EventGroupMessage, GroupID: groupID, Message: msg})
+
+	return msg.snapshot(), nil
+}
+
+// Returns an active group administered by this party. Must be called with the lock held.
+func (rh *RouteHandler) adminGroup(id string) (*Group, error) {
+	g, ok := rh.Groups[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown group")
+	}
+	if !g.Admin {
+		return nil, fmt.Errorf("Only the group admin can change its members")
+	}
+	if g.Left {
+		return nil, fmt.Errorf("Group has ended")
+	}
+	return g, nil
+}
+
+// Creates a member for the other party of a conversation. Must be called with the lock held.
+func (rh *RouteHandler) newMember(g *Group, conversationID string) (*GroupMember, error) {
+	convo, ok := rh.Conversations[conversationID]
+	if !ok {
+		return nil, fmt.Errorf("Unknown conversation")
+	}
+	if !convo.Established || convo.Ended {
+		return nil, fmt.Errorf("Conversation with %s is not active", convo.ConversationAlias)
+	}
+	if g.memberByConversation(conversationID) != nil {
+		return nil, fmt.Errorf("%s is already a member", convo.ConversationAlias)
+	}
+
+	return &GroupMember{
+		ID:             uuid.New().String(),
+		Alias:          convo.ConversationAlias,
+		conversationID: conversationID,
+	}, nil
+}
+
+// Sends the current state of the group to a new member. Must be called with the lock held.
+func (rh *RouteHandler) invite(g *Group, m *GroupMember) {
+	convo, ok := rh.Conversations[m.conversationID]
+	if !ok {
+		return
+	}
+
+	rh.queueGroup(convo, &groupMessage{
+		GroupID: g.GroupID,
+		Op:      groupInvite,
+		Seq:     g.seq,
+		Name:    g.Name,
+		Member:  m.ID,
+		Members: g.Members,
+	})
+}
+
+// Numbers an operation, forwards it to every member and applies it. Removed members
+// receive their removal. Must be called with the lock held.
+func (rh *RouteHandler) order(g *Group, gm *groupMessage) *Message {
+	g.seq++
+	gm.GroupID = g.GroupID
+	gm.Seq = g.seq
+
+	for _, m := range g.Members {
+		convo, ok := rh.Conversations[m.conversationID]
+		if !ok || convo.Ended {
+			continue
+		}
+		rh.queueGroup(convo, gm)
+	}
+
+	msg := rh.applyGroup(g, gm)
+	rh.saveGroup(g)
+	return msg
+}
+
+// Writes the state of the group to the store, groups that were left are removed since
+// nothing happens in them anymore. Must be called with the lock held.
+func (rh *RouteHandler) saveGroup(g *Group) {
+	if rh.Store == nil {
+		return
+	}
+
+	// Best effort like the conversations
+	if g.Left {
+		rh.Store.DeleteGroup(g.GroupID)
+	} else {
+		rh.Store.SaveGroup(g)
+	}
+}
+
+// Queues a group message in a conversation. Must be called with the lock held.
+func (rh *RouteHandler) queueGroup(convo *Conversation, gm *groupMessage) {
+	body, err := json.Marshal(gm)
+	if err != nil {
+		return
+	}
+
+	rh.queueControl(convo, Message{Kind: KindGroup, Body: body})
+}
+
+// Handles a group message received in a conversation. Must be called with the lock held.
+func (rh *RouteHandler) receiveGroup(convo *Conversation, msg *Message) {
+	var gm groupMessage
+	if err := json.Unmarshal(msg.Body, &gm); err != nil {
+		return
+	}
+
+	g, ok := rh.Groups[gm.GroupID]
+
+	switch gm.Op {
+	case groupInvite:
+		if gm.GroupID == "" {
+			return
+		}
+
+		// A member that left or was removed can be added again by the same admin, the
+		// group starts over from the state in the invite
+		if ok && (!g.Left || g.Admin || g.AdminConversation != convo.ConversationID) {
+			return
+		}
+
+		var messages []*Message
+		if ok {
+			messages = g.Messages
+		} else if rh.History != nil {
+			messages, _ = rh.History.Load(gm.GroupID)
+		}
+
+		g = &Group{
+			GroupID:           gm.GroupID,
+			Name:              gm.Name,
+			Members:           gm.Members,
+			Messages:          messages,
+			SelfID:            gm.Member,
+			AdminConversation: convo.ConversationID,
+			seq:               gm.Seq,
+		}
+		if g.member(g.SelfID) == nil {
+			return
+		}
+
+		rh.Groups[g.GroupID] = g
+		rh.saveGroup(g)
+		rh.events.publish(Event{Type: EventGroupUpdated, GroupID: g.GroupID})
+
+	case groupPost, groupLeave:
+		// Only the admin orders the group and only members can post
+		if !ok || !g.Admin || g.Left {
+			return
+		}
+
+		m := g.memberByConversation(convo.ConversationID)
+		if m == nil {
+			return
+		}
+
+		if gm.Op == groupLeave {
+			rh.order(g, &groupMessage{Op: groupRemove, Member: m.ID})
+			return
+		}
+
+		rh.order(g, &groupMessage{
+			Op:        groupText,
+			MessageID: gm.MessageID,
+			Sender:    m.ID,
+			Text:      gm.Text,
+			Time:      int(time.Now().Unix()),
+		})
+
+	case groupAdd, groupRemove, groupText:
+		// Ordered operations are only accepted from the admin
+		if !ok || g.Admin || g.Left || g.AdminConversation != convo.ConversationID {
+			return
+		}
+
+		if gm.Seq <= g.seq {
+			return
+		}
+
+		if g.early == nil {
+			g.early = make(map[int]*groupMessage)
+		}
+		g.early[gm.Seq] = &gm
+
+		for !g.Left {
+			next, ok := g.early[g.seq+1]
+			if !ok {
+				break
+			}
+			delete(g.early, next.Seq)
+
+			g.seq = next.Seq
+			rh.applyGroup(g, next)
+		}
+		rh.saveGroup(g)
+	}
+}
+
+// Applies an ordered operation and returns the message of a text. Must be called with
+// the lock held.
+func (rh *RouteHandler) applyGroup(g *Group, gm *groupMessage) *Message {
+	switch gm.Op {
+	case groupAdd:
+		for _, m := range gm.Members {
+			if g.member(m.ID) == nil {
+				g.Members = append(g.Members, m)
+			}
+		}
+		rh.events.publish(Event{Type: EventGroupUpdated, GroupID: g.GroupID})
+
+	case groupRemove:
+		for i, m := range g.Members {
+			if m.ID == gm.Member {
+				g.Members = append(g.Members[:i], g.Members[i+1:]...)
+				break
+			}
+		}
+		if gm.Member == g.SelfID {
+			g.Left = true
+		}
+		rh.events.publish(Event{Type: EventGroupUpdated, GroupID: g.GroupID})
+
+	case groupText:
+		msg := &Message{
+			ID:     gm.MessageID,
+			Kind:   KindText,
+			Text:   gm.Text,
+			Time:   gm.Time,
+			Self:   gm.Sender == g.SelfID,
+			Sender: gm.Sender,
+		}
+		if m := g.member(gm.Sender); m != nil {
+			msg.Sender = m.Alias
+		}
+
+		// A text of this party was ordered by the admin, ids are chosen by the members so
+		// only texts the admin ordered as this party are matched
+		for i, p := range g.pending {
+			if gm.Sender == g.SelfID && p.ID == gm.MessageID {
+				g.pending = append(g.pending[:i], g.pending[i+1:]...)
+				msg = p
+				msg.Status = StatusSent
+				break
+			}
+		}
+
+		g.Messages = append(g.Messages, msg)
+		if rh.History != nil {
+			rh.History.Record(g.GroupID, msg)
+		}
+		rh.events.publish(Event{Type: EventGroupMessage, GroupID: g.GroupID, Message: msg})
+		return msg
+	}
+
+	return nil
+}
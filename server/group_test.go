@@ -0,0 +1,250 @@
+package server_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/server"
+)
+
+// Starts a conversation between two existing peers and returns its id.
+func connect(t *testing.T, keyType string, from, to *peer, alias string) string {
+	t.Helper()
+
+	token, err := from.rh.GenerateConversation(from.privateKey, from.encodedKey, to.publicKey, keyType, alias)
+	if err != nil {
+		t.Fatalf("Error generating conversation: %s", err)
+	}
+
+	known := make(map[string]bool)
+	for _, id := range to.rh.ConversationIDs() {
+		known[id] = true
+	}
+
+	if err := to.rh.BootstrapConversation(token, to.privateKey, to.encodedKey, from.publicKey, "Admin"); err != nil {
+		t.Fatalf("Error bootstrapping conversation: %s", err)
+	}
+
+	for _, id := range to.rh.ConversationIDs() {
+		if !known[id] {
+			return id
+		}
+	}
+
+	t.Fatalf("Conversation was not created")
+	return ""
+}
+
+// Waits until the given number of texts of a group was ordered and returns them in order.
+func waitGroupTexts(t *testing.T, events <-chan server.Event, groupID string, count int) []string {
+	t.Helper()
+
+	var (
+		texts   []string
+		seen    = make(map[string]bool)
+		timeout = time.After(10 * time.Second)
+	)
+	for len(texts) < count {
+		select {
+		case e := <-events:
+			// Texts of this party are published once more when the admin ordered them
+			if e.Type != server.EventGroupMessage || e.GroupID != groupID || seen[e.Message.ID] {
+				continue
+			}
+			if e.Message.Self && e.Message.Status != server.StatusSent {
+				continue
+			}
+
+			seen[e.Message.ID] = true
+			texts = append(texts, e.Message.Sender+": "+e.Message.Text)
+		case <-timeout:
+			t.Fatalf("Timed out waiting for group messages")
+		}
+	}
+
+	return texts
+}
+
+// Waits until the group is known and has the given number of members.
+func waitMembers(t *testing.T, p *peer, groupID string, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := p.rh.Group(groupID); ok && len(p.rh.GroupMembers(groupID)) == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Timed out waiting for %d group members", count)
+}
+
+func TestGroup(t *testing.T) {
+	admin := newPeer(t, "x25519")
+	bob := newPeer(t, "x25519")
+	carol := newPeer(t, "x25519")
+
+	adminBob := connect(t, "x25519", admin, bob, "Bob")
+	adminCarol := connect(t, "x25519", admin, carol, "Carol")
+
+	bobEvents, unsubscribeBob := bob.rh.Subscribe()
+	defer unsubscribeBob()
+	carolEvents, unsubscribeCarol := carol.rh.Subscribe()
+	defer unsubscribeCarol()
+
+	g, err := admin.rh.CreateGroup("Team", []string{adminBob})
+	if err != nil {
+		t.Fatalf("Error creating group: %s", err)
+	}
+	waitMembers(t, bob, g.GroupID, 2)
+
+	if err := admin.rh.AddGroupMember(g.GroupID, adminCarol); err != nil {
+		t.Fatalf("Error adding member: %s", err)
+	}
+	waitMembers(t, carol, g.GroupID, 3)
+	waitMembers(t, bob, g.GroupID, 3)
+
+	// Texts are ordered by the admin so every member sees the same order
+	if _, err := bob.rh.SendGroup(g.GroupID, "from bob"); err != nil {
+		t.Fatalf("Error sending group message: %s", err)
+	}
+	if _, err := admin.rh.SendGroup(g.GroupID, "from admin"); err != nil {
+		t.Fatalf("Error sending group message: %s", err)
+	}
+
+	bobTexts := waitGroupTexts(t, bobEvents, g.GroupID, 2)
+	carolTexts := waitGroupTexts(t, carolEvents, g.GroupID, 2)
+	for i := range bobTexts {
+		if bobTexts[i] != carolTexts[i] {
+			t.Fatalf("Members disagree on the order: %q %q", bobTexts, carolTexts)
+		}
+	}
+	if !slices.Contains(bobTexts, "Bob: from bob") || !slices.Contains(bobTexts, "Admin: from admin") {
+		t.Fatalf("Unexpected group messages %q", bobTexts)
+	}
+
+	// Only the admin changes the members
+	if err := bob.rh.RemoveGroupMember(g.GroupID, g.SelfID); err == nil {
+		t.Fatalf("Expected a member to be refused changing the group")
+	}
+
+	var carolID string
+	for _, m := range admin.rh.GroupMembers(g.GroupID) {
+		if m.Alias == "Carol" {
+			carolID = m.ID
+		}
+	}
+	if err := admin.rh.RemoveGroupMember(g.GroupID, carolID); err != nil {
+		t.Fatalf("Error removing member: %s", err)
+	}
+	waitMembers(t, bob, g.GroupID, 2)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if cg, _ := carol.rh.Group(g.GroupID); cg != nil && cg.Left {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Removed member did not leave the group")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := carol.rh.SendGroup(g.GroupID, "still here"); err == nil {
+		t.Fatalf("Expected a removed member to be refused sending")
+	}
+
+	// A removed member can be added again
+	if err := admin.rh.AddGroupMember(g.GroupID, adminCarol); err != nil {
+		t.Fatalf("Error adding member again: %s", err)
+	}
+	waitMembers(t, carol, g.GroupID, 3)
+
+	if _, err := carol.rh.SendGroup(g.GroupID, "back again"); err != nil {
+		t.Fatalf("Error sending group message after rejoining: %s", err)
+	}
+	if texts := waitGroupTexts(t, bobEvents, g.GroupID, 1); texts[0] != "Carol: back again" {
+		t.Fatalf("Unexpected group messages %q", texts)
+	}
+}
+
+func TestGroupRestart(t *testing.T) {
+	admin := newPeer(t, "x25519")
+	bob := newPeer(t, "x25519")
+	dir := t.TempDir()
+
+	v := newVault(t, dir, admin.privateKey)
+	admin.rh.Store = server.NewConversationStore(v)
+	admin.rh.History = server.NewHistory(v)
+
+	adminBob := connect(t, "x25519", admin, bob, "Bob")
+
+	bobEvents, unsubscribeBob := bob.rh.Subscribe()
+	defer unsubscribeBob()
+
+	g, err := admin.rh.CreateGroup("Team", []string{adminBob})
+	if err != nil {
+		t.Fatalf("Error creating group: %s", err)
+	}
+	waitMembers(t, bob, g.GroupID, 2)
+
+	if _, err := bob.rh.SendGroup(g.GroupID, "before"); err != nil {
+		t.Fatalf("Error sending group message: %s", err)
+	}
+	waitGroupTexts(t, bobEvents, g.GroupID, 1)
+
+	// The admin restarts on a new address
+	admin.rh.Close()
+
+	lt, err := server.NewLoopbackTransport()
+	if err != nil {
+		t.Fatalf("Error creating transport: %s", err)
+	}
+
+	rh := server.NewRouteHandlerWithTransport(lt)
+	v = newVault(t, dir, admin.privateKey)
+	rh.Store = server.NewConversationStore(v)
+	rh.History = server.NewHistory(v)
+	rh.Start()
+	t.Cleanup(rh.Close)
+
+	events, unsubscribe := rh.Subscribe()
+	defer unsubscribe()
+
+	if err := rh.LoadConversations(); err != nil {
+		t.Fatalf("Error loading conversations: %s", err)
+	}
+
+	timeout := time.After(10 * time.Second)
+	for resumed := false; !resumed; {
+		select {
+		case e := <-events:
+			resumed = e.Type == server.EventConversationEstablished
+		case <-timeout:
+			t.Fatalf("Timed out waiting for the conversation to resume")
+		}
+	}
+
+	if len(rh.GroupMembers(g.GroupID)) != 2 {
+		t.Fatalf("Expected the group to be restored with its members")
+	}
+	messages := rh.GroupMessages(g.GroupID)
+	if len(messages) != 1 || messages[0].Sender != "Bob" || messages[0].Text != "before" {
+		t.Fatalf("Expected the group messages to be restored")
+	}
+
+	// Numbering continues where it stopped, so the members accept what follows
+	if _, err := rh.SendGroup(g.GroupID, "after"); err != nil {
+		t.Fatalf("Error sending group message: %s", err)
+	}
+	if _, err := bob.rh.SendGroup(g.GroupID, "reply"); err != nil {
+		t.Fatalf("Error sending group message: %s", err)
+	}
+
+	texts := waitGroupTexts(t, bobEvents, g.GroupID, 2)
+	if !slices.Equal(texts, []string{"Admin: after", "Bob: reply"}) {
+		t.Fatalf("Expected the group to continue after the restart, got %v", texts)
+	}
+}
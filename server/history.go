@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/storage"
+)
+
+// History keeps the messages of every conversation in an encrypted vault so they can be
+// shown again after the conversation is reopened. Messages older than the retention
+// period of their conversation are removed when the history is loaded.
+type History struct {
+	// Retention used for conversations without their own setting, zero keeps
+	// messages forever.
+	DefaultRetention time.Duration
+
+	vault *storage.Vault
+}
+
+type historyRecord struct {
+	ID   string      `json:"id,omitempty"`
+	Kind MessageKind `json:"kind"`
+	Text string      `json:"text"`
+	Time int         `json:"time"`
+	Self bool        `json:"self"`
+	// Alias of the member that wrote a group message
+	Sender string `json:"sender,omitempty"`
+}
+
+// Keeps message history in the vault, see OpenKeyVault and OpenPassphraseVault.
+func NewHistory(vault *storage.Vault) *History {
+	return &History{vault: vault}
+}
+
+func historyName(id string) string {
+	return "history/" + id
+}
+
+func retentionName(id string) string {
+	return "retention/" + id
+}
+
+// Adds a message to the history of a conversation.
+func (h *History) Record(id string, msg *Message) error {
+	record, err := json.Marshal(historyRecord{
+		ID:     msg.ID,
+		Kind:   msg.Kind,
+		Text:   msg.Text,
+		Time:   msg.Time,
+		Self:   msg.Self,
+		Sender: msg.Sender,
+	})
+	if err != nil {
+		return err
+	}
+
+	return h.vault.Append(historyName(id), record)
+}
+
+// Returns the messages of a conversation that are within its retention period and
+// removes the expired ones.
+func (h *History) Load(id string) ([]*Message, error) {
+	records, err := h.vault.Records(historyName(id))
+	if err != nil {
+		return nil, err
+	}
+
+	retention, err := h.Retention(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		messages = make([]*Message, 0, len(records))
+		kept     = make([][]byte, 0, len(records))
+		cutoff   = time.Now().Add(-retention).Unix()
+	)
+	for _, record := range records {
+		var r historyRecord
+		if err := json.Unmarshal(record, &r); err != nil {
+			return nil, err
+		}
+
+		if retention > 0 && int64(r.Time) < cutoff {
+			continue
+		}
+
+		kept = append(kept, record)
+		messages = append(messages, &Message{
+			ID:     r.ID,
+			Kind:   r.Kind,
+			Text:   r.Text,
+			Time:   r.Time,
+			Self:   r.Self,
+			Sender: r.Sender,
+		})
+	}
+
+	if len(kept) < len(records) {
+		if err := h.vault.Rewrite(historyName(id), kept); err != nil {
+			return nil, err
+		}
+	}
+
+	return messages, nil
+}
+
+// Returns how long messages of a conversation are kept, zero means forever.
+func (h *History) Retention(id string) (time.Duration, error) {
+	value, err := h.vault.Get(retentionName(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return h.DefaultRetention, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	seconds, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Sets how long messages of a conversation are kept and removes the ones that expired.
+func (h *History) SetRetention(id string, retention time.Duration) error {
+	err := h.vault.Put(retentionName(id), []byte(strconv.FormatInt(int64(retention/time.Second), 10)))
+	if err != nil {
+		return err
+	}
+
+	_, err = h.Load(id)
+	return err
+}
+
+// Removes the stored messages and settings of a conversation.
+func (h *History) Delete(id string) error {
+	if err := h.vault.Delete(historyName(id)); err != nil {
+		return err
+	}
+
+	return h.vault.Delete(retentionName(id))
+}
@@ -0,0 +1,113 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/server"
+	"github.com/JustinTimperio/onionsoup/storage"
+)
+
+func newVault(t *testing.T, dir string, privateKey any) *storage.Vault {
+	t.Helper()
+
+	key, err := crypt.StorageKey(privateKey, "vault")
+	if err != nil {
+		t.Fatalf("Error deriving storage key: %s", err)
+	}
+
+	v, err := storage.OpenVault(dir, key)
+	if err != nil {
+		t.Fatalf("Error opening vault: %s", err)
+	}
+
+	return v
+}
+
+func newHistory(t *testing.T, dir string, privateKey any) *server.History {
+	t.Helper()
+
+	return server.NewHistory(newVault(t, dir, privateKey))
+}
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	privateKey, _, err := crypt.CurveGenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	h := newHistory(t, dir, privateKey)
+
+	now := int(time.Now().Unix())
+	messages := []*server.Message{
+		{Text: "Old", Time: now - 3*86400, Self: true},
+		{Text: "Hello", Time: now - 60},
+		{Kind: server.KindEnd, Text: "Goodbye", Time: now, Self: true},
+	}
+	for _, m := range messages {
+		if err := h.Record("conversation", m); err != nil {
+			t.Fatalf("Error recording message: %s", err)
+		}
+	}
+
+	// The key derived from the same private key opens the history again
+	h = newHistory(t, dir, privateKey)
+
+	loaded, err := h.Load("conversation")
+	if err != nil {
+		t.Fatalf("Error loading history: %s", err)
+	}
+
+	if len(loaded) != 3 || loaded[0].Time != messages[0].Time || !loaded[2].Self || !loaded[2].Final() {
+		t.Fatalf("Loaded history does not match the recorded messages")
+	}
+
+	if err := h.SetRetention("conversation", 24*time.Hour); err != nil {
+		t.Fatalf("Error setting retention: %s", err)
+	}
+
+	loaded, err = h.Load("conversation")
+	if err != nil || len(loaded) != 2 || loaded[0].Text != "Hello" {
+		t.Fatalf("Expected the expired message to be removed")
+	}
+
+	if err := h.Delete("conversation"); err != nil {
+		t.Fatalf("Error deleting history: %s", err)
+	}
+
+	if loaded, _ := h.Load("conversation"); len(loaded) != 0 {
+		t.Fatalf("Expected no messages after delete")
+	}
+}
+
+func TestConversationHistory(t *testing.T) {
+	aliceConvo, bobConvo, alice, bob := startConversation(t, "x25519")
+	alice.rh.History = newHistory(t, t.TempDir(), alice.privateKey)
+
+	if _, err := alice.rh.Send(aliceConvo.ConversationID, "Hello Bob", false); err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+
+	if _, err := bob.rh.Send(bobConvo.ConversationID, "Hello Alice", false); err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+
+	loaded, err := alice.rh.History.Load(aliceConvo.ConversationID)
+	if err != nil {
+		t.Fatalf("Error loading history: %s", err)
+	}
+
+	if len(loaded) != 2 || !loaded[0].Self || loaded[1].Self || loaded[1].Text != "Hello Alice" {
+		t.Fatalf("History does not hold both directions of the conversation")
+	}
+
+	if err := alice.rh.ClearHistory(aliceConvo.ConversationID); err != nil {
+		t.Fatalf("Error clearing history: %s", err)
+	}
+
+	if len(alice.rh.Messages(aliceConvo.ConversationID)) != 0 {
+		t.Fatalf("Expected messages to be cleared")
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+)
+
+// Returns the directory OnionSoup keeps its local state in.
+func DefaultDataDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "onionsoup"), nil
+}
+
+// Returns the default location of the persistent onion service key.
+func DefaultOnionKeyPath() (string, error) {
+	dir, err := DefaultDataDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "onion.key"), nil
+}
+
+// Generates a new onion service key. The .onion address is derived from this key, so
+// replacing it rotates the address.
+func GenerateOnionKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+var errOnionKeyPassword = errors.New("A password is required to protect the onion service key")
+
+// Encrypts the onion service key with the password and writes it to path. Anyone holding
+// the key can take over the address, so it is never written without a password.
+func SaveOnionKey(path string, key ed25519.PrivateKey, password string) error {
+	if password == "" {
+		return errOnionKeyPassword
+	}
+
+	sealed, err := crypt.SealPrivateKey("onion", key, password, "Onion Service")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, sealed, 0600)
+}
+
+// Reads and decrypts an onion service key written by SaveOnionKey.
+func LoadOnionKey(path string, password string) (ed25519.PrivateKey, error) {
+	key, _, err := loadOnionKey(path, password)
+	return key, err
+}
+
+// Like LoadOnionKey, also returns whether the key file was encrypted.
+func loadOnionKey(path string, password string) (ed25519.PrivateKey, bool, error) {
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	kc, key, err := crypt.LoadPrivateKey(sealed, password)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if kc.KeyType != "onion" {
+		return nil, false, fmt.Errorf("%s does not hold an onion service key", path)
+	}
+
+	return key.(ed25519.PrivateKey), kc.KDF != crypt.KDFNone, nil
+}
+
+// Loads the onion service key at path, creating it when it does not exist yet or when
+// rotate is set. A key that was stored without a password is encrypted with it.
+func LoadOrCreateOnionKey(path string, password string, rotate bool) (ed25519.PrivateKey, error) {
+	if password == "" {
+		return nil, errOnionKeyPassword
+	}
+
+	if !rotate {
+		key, encrypted, err := loadOnionKey(path, password)
+		if err == nil && !encrypted {
+			err = SaveOnionKey(path, key, password)
+		}
+		if err == nil || !os.IsNotExist(err) {
+			return key, err
+		}
+	}
+
+	key, err := GenerateOnionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return key, SaveOnionKey(path, key, password)
+}
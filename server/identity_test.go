@@ -0,0 +1,112 @@
+package server_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/server"
+)
+
+func TestOnionKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "onion.key")
+
+	key, err := server.GenerateOnionKey()
+	if err != nil {
+		t.Fatalf("Error generating onion key: %s", err)
+	}
+
+	if err := server.SaveOnionKey(path, key, ""); err == nil {
+		t.Fatalf("Expected saving without a password to fail")
+	}
+
+	if err := server.SaveOnionKey(path, key, "hunter2"); err != nil {
+		t.Fatalf("Error saving onion key: %s", err)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the key file to be readable by the owner only")
+	}
+
+	loaded, err := server.LoadOnionKey(path, "hunter2")
+	if err != nil {
+		t.Fatalf("Error loading onion key: %s", err)
+	}
+	if !loaded.Equal(key) {
+		t.Fatalf("Loaded onion key does not match")
+	}
+
+	if _, err := server.LoadOnionKey(path, "wrong"); err == nil {
+		t.Fatalf("Expected a wrong password to fail")
+	}
+	if _, err := server.LoadOnionKey(path, ""); err == nil {
+		t.Fatalf("Expected an empty password to fail")
+	}
+}
+
+func TestLoadOrCreateOnionKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "onion.key")
+
+	if _, err := server.LoadOrCreateOnionKey(path, "", false); err == nil {
+		t.Fatalf("Expected an empty password to be refused")
+	}
+
+	key, err := server.LoadOrCreateOnionKey(path, "hunter2", false)
+	if err != nil {
+		t.Fatalf("Error creating onion key: %s", err)
+	}
+
+	// The address stays the same across restarts
+	again, err := server.LoadOrCreateOnionKey(path, "hunter2", false)
+	if err != nil {
+		t.Fatalf("Error loading onion key: %s", err)
+	}
+	if !again.Equal(key) {
+		t.Fatalf("Expected the stored onion key to be loaded")
+	}
+
+	if _, err := server.LoadOrCreateOnionKey(path, "wrong", false); err == nil {
+		t.Fatalf("Expected a wrong password to fail")
+	}
+
+	rotated, err := server.LoadOrCreateOnionKey(path, "hunter2", true)
+	if err != nil {
+		t.Fatalf("Error rotating onion key: %s", err)
+	}
+	if rotated.Equal(key) {
+		t.Fatalf("Expected rotation to create a new key")
+	}
+
+	loaded, err := server.LoadOnionKey(path, "hunter2")
+	if err != nil || !loaded.Equal(rotated) {
+		t.Fatalf("Expected the rotated key to replace the stored one")
+	}
+}
+
+func TestLoadOrCreateOnionKeyLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "onion.key")
+
+	key, err := server.GenerateOnionKey()
+	if err != nil {
+		t.Fatalf("Error generating onion key: %s", err)
+	}
+
+	// Keys used to be written without a password
+	sealed, err := crypt.SealPrivateKey("onion", key, "", "Onion Service")
+	if err != nil {
+		t.Fatalf("Error sealing onion key: %s", err)
+	}
+	if err := os.WriteFile(path, sealed, 0600); err != nil {
+		t.Fatalf("Error writing onion key: %s", err)
+	}
+
+	loaded, err := server.LoadOrCreateOnionKey(path, "hunter2", false)
+	if err != nil || !loaded.Equal(key) {
+		t.Fatalf("Expected the stored key to be kept: %v", err)
+	}
+
+	if _, err := server.LoadOnionKey(path, "wrong"); err == nil {
+		t.Fatalf("Expected the key to be encrypted with the password")
+	}
+}
@@ -0,0 +1,457 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MessageStatus tracks the delivery of a message sent by this party. Statuses are
+// ordered, a message only moves to a later status once it was acknowledged.
+type MessageStatus int
+
+const (
+	// Received messages and messages restored from the history have no delivery to track.
+	StatusNone MessageStatus = iota
+	// The message expired before it could be delivered, it can be retried manually.
+	StatusFailed
+	// Waiting in the outbox for the next delivery attempt.
+	StatusQueued
+	// A delivery attempt is in progress.
+	StatusSending
+	// The remote server accepted the message.
+	StatusSent
+	// The remote party acknowledged that it decrypted and verified the message.
+	StatusDelivered
+	// The remote party sent a read receipt for the message.
+	StatusRead
+)
+
+func (s MessageStatus) String() string {
+	switch s {
+	case StatusNone:
+		return "none"
+	case StatusFailed:
+		return "failed"
+	case StatusQueued:
+		return "queued"
+	case StatusSending:
+		return "sending"
+	case StatusSent:
+		return "sent"
+	case StatusDelivered:
+		return "delivered"
+	case StatusRead:
+		return "read"
+	default:
+		return "unknown"
+	}
+}
+
+// RetryPolicy controls how queued messages are redelivered after a failed attempt.
+type RetryPolicy struct {
+	// Delay after the first failed attempt, it doubles with every further failure.
+	InitialBackoff time.Duration
+	// Upper bound of the delay between attempts.
+	MaxBackoff time.Duration
+	// How long a message is retried before it is marked failed, zero retries forever.
+	Expiry time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	InitialBackoff: 5 * time.Second,
+	MaxBackoff:     5 * time.Minute,
+	Expiry:         24 * time.Hour,
+}
+
+// Returns the delay before the next attempt. Half of it is random so peers that failed
+// together do not retry together.
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempts && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// How often the outbox is checked for messages that are due.
+const outboxInterval = time.Second
+
+// Number of delivered message digests kept per conversation to recognize redeliveries.
+const receivedWindow = 256
+
+// A packed message waiting to be delivered. The message is packed once so every attempt
+// sends the same ciphertext and the ratchet only advances once.
+type outboxEntry struct {
+	ID          string      `json:"id"`
+	Kind        MessageKind `json:"kind"`
+	Text        string      `json:"text"`
+	Time        int         `json:"time"`
+	Packed      []byte      `json:"packed"`
+	Attempts    int         `json:"attempts"`
+	Created     time.Time   `json:"created"`
+	NextAttempt time.Time   `json:"next_attempt"`
+	Failed      bool        `json:"failed"`
+	// Control messages such as acknowledgements are not shown to the user
+	Control bool `json:"control,omitempty"`
+
+	message *Message
+}
+
+// Returns the message the entry delivers, creating it for entries restored from the store.
+func (e *outboxEntry) Message() *Message {
+	if e.message == nil {
+		status := StatusQueued
+		if e.Failed {
+			status = StatusFailed
+		}
+
+		e.message = &Message{
+			ID:     e.ID,
+			Kind:   e.Kind,
+			Text:   e.Text,
+			Time:   e.Time,
+			Self:   true,
+			Status: status,
+		}
+	}
+
+	return e.message
+}
+
+// Links restored outbox entries to the messages loaded from the history, messages
+// missing from the history are added.
+func (c *Conversation) attachOutbox() {
+	for _, entry := range c.outbox {
+		if entry.Control {
+			continue
+		}
+
+		found := false
+		for _, m := range c.Messages {
+			if m.Self && m.ID == entry.ID {
+				m.Status = entry.Message().Status
+				entry.message = m
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			c.Messages = append(c.Messages, entry.Message())
+		}
+	}
+}
+
+// Returns whether the entry was still in the outbox.
+func (c *Conversation) removeEntry(entry *outboxEntry) bool {
+	for i, e := range c.outbox {
+		if e == entry {
+			c.outbox = append(c.outbox[:i], c.outbox[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether parts of the message are still in the outbox.
+func (c *Conversation) pending(id string) bool {
+	for _, e := range c.outbox {
+		if e.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether a final message is waiting to be delivered.
+func (c *Conversation) ending() bool {
+	for _, entry := range c.outbox {
+		if entry.Kind == KindEnd && !entry.Failed {
+			return true
+		}
+	}
+	return false
+}
+
+// Identifies a packed message, a sender whose response was lost delivers it again.
+func messageDigest(packed []byte) string {
+	digest := sha256.Sum256(packed)
+	return hex.EncodeToString(digest[:])
+}
+
+// Returns whether the message with the digest was accepted before.
+func (c *Conversation) wasReceived(digest string) bool {
+	for _, seen := range c.received {
+		if seen == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// Remembers an accepted message so a redelivery is acknowledged without processing it again.
+func (c *Conversation) markReceived(digest string) {
+	c.received = append(c.received, digest)
+	if len(c.received) > receivedWindow {
+		c.received = c.received[len(c.received)-receivedWindow:]
+	}
+}
+
+// Queues a control message such as an acknowledgement and delivers it in the
+// background. Must be called with the lock held.
+func (rh *RouteHandler) queueControl(c *Conversation, msg Message) {
+	now := time.Now()
+	msg.ID = uuid.New().String()
+	msg.Time = int(now.Unix())
+
+	packed, err := c.pack(msg)
+	if err != nil {
+		return
+	}
+
+	c.outbox = append(c.outbox, &outboxEntry{
+		ID:      msg.ID,
+		Kind:    msg.Kind,
+		Time:    msg.Time,
+		Packed:  packed,
+		Created: now,
+		Control: true,
+	})
+	rh.saveConversation(c)
+
+	rh.background(func() { rh.deliver(c.ConversationID, true) })
+}
+
+// Puts a failed message back into the outbox and attempts to deliver it right away.
+// Attachments continue with the chunks that were not delivered yet, or are sent whole again
+// when the remote party refused them.
+func (rh *RouteHandler) RetryMessage(id, messageID string) error {
+	rh.mux.Lock()
+	convo, ok := rh.Conversations[id]
+	if !ok {
+		rh.mux.Unlock()
+		return fmt.Errorf("Unknown conversation")
+	}
+
+	var retry *outboxEntry
+	for _, e := range convo.outbox {
+		if e.ID == messageID && e.Failed && !e.Control {
+			e.Failed = false
+			e.Attempts = 0
+			e.Created = time.Now()
+			e.NextAttempt = time.Time{}
+			retry = e
+		}
+	}
+	// Attachments the remote party refused are split into chunks again
+	if retry == nil {
+		entries, err := convo.refusedAttachment(messageID)
+		if err != nil {
+			rh.mux.Unlock()
+			return err
+		}
+		convo.outbox = append(convo.outbox, entries...)
+		retry = entries[0]
+	}
+
+	rh.setStatus(convo, retry, StatusQueued)
+	rh.saveConversation(convo)
+	rh.mux.Unlock()
+
+	rh.deliver(id, true)
+	return nil
+}
+
+// Returns new outbox entries for an attachment the remote party refused. Must be called
+// with the lock held.
+func (c *Conversation) refusedAttachment(id string) ([]*outboxEntry, error) {
+	for _, m := range c.Messages {
+		if !m.Self || m.ID != id || m.Kind != KindAttachment || m.Status != StatusFailed || c.pending(id) {
+			continue
+		}
+
+		// Files are not kept in the history
+		if m.Attachment == nil || len(m.Attachment.Data) == 0 {
+			return nil, fmt.Errorf("File is no longer available, it has to be sent again")
+		}
+
+		return c.attachmentEntries(m, time.Now())
+	}
+
+	return nil, fmt.Errorf("No failed message to retry")
+}
+
+// Marks the message of an entry and publishes the change. Must be called with the lock held.
+func (rh *RouteHandler) setStatus(c *Conversation, entry *outboxEntry, status MessageStatus) {
+	if entry.Control {
+		return
+	}
+
+	rh.updateStatus(c, entry.Message(), status)
+}
+
+// Acknowledged messages keep their status when a late redelivery finishes. Must be
+// called with the lock held.
+func (rh *RouteHandler) updateStatus(c *Conversation, msg *Message, status MessageStatus) {
+	if msg.Status >= StatusDelivered && status < msg.Status {
+		return
+	}
+
+	msg.Status = status
+	rh.events.publish(Event{Type: EventMessageStatus, ConversationID: c.ConversationID, Message: msg})
+}
+
+// Delivers the due messages of a conversation in order until the outbox is empty or an
+// attempt fails. Only one delivery per conversation runs at a time, wait blocks until a
+// running one finished instead of leaving the outbox to it.
+func (rh *RouteHandler) deliver(id string, wait bool) {
+	rh.mux.Lock()
+	convo, ok := rh.Conversations[id]
+	rh.mux.Unlock()
+	if !ok {
+		return
+	}
+
+	if wait {
+		convo.delivering.Lock()
+	} else if !convo.delivering.TryLock() {
+		return
+	}
+	defer convo.delivering.Unlock()
+
+	for {
+		if rh.stopped() {
+			return
+		}
+
+		rh.mux.Lock()
+		if _, ok := rh.Conversations[id]; !ok {
+			rh.mux.Unlock()
+			return
+		}
+
+		var entry *outboxEntry
+		for _, e := range convo.outbox {
+			if !e.Failed {
+				entry = e
+				break
+			}
+		}
+		if entry == nil || time.Now().Before(entry.NextAttempt) {
+			rh.mux.Unlock()
+			return
+		}
+
+		if rh.Retry.Expiry > 0 && time.Since(entry.Created) > rh.Retry.Expiry {
+			rh.failEntry(convo, entry, fmt.Errorf("Message expired after %d attempts", entry.Attempts))
+			rh.saveConversation(convo)
+			rh.mux.Unlock()
+			continue
+		}
+
+		rh.setStatus(convo, entry, StatusSending)
+		remoteAddress := convo.RemoteAddress
+		rh.mux.Unlock()
+
+		// The lock is not held while sending so both parties can message each other at once
+		err := rh.SendMessage(entry.Packed, remoteAddress, MessagePath)
+
+		rh.mux.Lock()
+		entry.Attempts++
+
+		// A message the remote party refused is not retried, it would be refused again
+		var status *StatusError
+		if errors.As(err, &status) && status.Rejected() {
+			rh.failEntry(convo, entry, err)
+			rh.saveConversation(convo)
+			rh.mux.Unlock()
+			continue
+		}
+
+		if err != nil {
+			entry.NextAttempt = time.Now().Add(rh.Retry.backoff(entry.Attempts))
+			rh.setStatus(convo, entry, StatusQueued)
+			rh.saveConversation(convo)
+			rh.mux.Unlock()
+			return
+		}
+
+		// An attachment is sent once its last chunk was accepted, unless the remote party
+		// refused it in the meantime
+		if convo.removeEntry(entry) && !convo.pending(entry.ID) {
+			rh.setStatus(convo, entry, StatusSent)
+		}
+		if entry.Kind == KindEnd {
+			convo.Ended = true
+			rh.events.publish(Event{Type: EventConversationEnded, ConversationID: id})
+		}
+		rh.saveConversation(convo)
+		rh.mux.Unlock()
+	}
+}
+
+// Gives up on an entry that cannot be delivered. Failed messages stay in the outbox until
+// the user retries them, control messages are dropped. Must be called with the lock held.
+func (rh *RouteHandler) failEntry(convo *Conversation, entry *outboxEntry, err error) {
+	if entry.Control {
+		convo.removeEntry(entry)
+		return
+	}
+
+	// Chunks of an attachment fail together and are retried together
+	for _, e := range convo.outbox {
+		if e.ID == entry.ID {
+			e.Failed = true
+		}
+	}
+	rh.setStatus(convo, entry, StatusFailed)
+	rh.events.publish(Event{
+		Type:           EventDeliveryFailed,
+		ConversationID: convo.ConversationID,
+		Message:        entry.Message(),
+		Err:            err,
+	})
+}
+
+// Retries due messages of every conversation and ends expired invitations until the
+// handler is closed.
+func (rh *RouteHandler) runOutbox() {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rh.stop:
+			return
+		case <-ticker.C:
+		}
+
+		rh.mux.Lock()
+		rh.expireInvitations()
+
+		var due []string
+		for id, convo := range rh.Conversations {
+			if len(convo.outbox) > 0 {
+				due = append(due, id)
+			}
+		}
+		rh.mux.Unlock()
+
+		for _, id := range due {
+			rh.background(func() { rh.deliver(id, false) })
+		}
+	}
+}
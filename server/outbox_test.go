@@ -0,0 +1,141 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/server"
+)
+
+// Waits for the status of a message sent by the peer.
+func waitStatus(t *testing.T, events <-chan server.Event, msg *server.Message, status server.MessageStatus) {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == server.EventMessageStatus && e.Message.ID == msg.ID && e.Message.Status == status {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for the message to be %s", status)
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	aliceConvo, _, alice, bob := startConversation(t, "x25519")
+	id := aliceConvo.ConversationID
+	alice.rh.Retry = server.RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Expiry: 3 * time.Second}
+
+	// Bob cannot be reached until the gate is opened
+	gate := &gatedTransport{next: alice.rh.Sender.Transport}
+	alice.rh.Sender.Transport = gate
+
+	events, unsubscribe := alice.rh.Subscribe()
+	defer unsubscribe()
+
+	// Messages that cannot be delivered before they expire fail and can be retried
+	expired, err := alice.rh.Send(id, "Are you there?", false)
+	if err != nil {
+		t.Fatalf("Error queueing message: %s", err)
+	}
+	waitStatus(t, events, expired, server.StatusFailed)
+
+	msg, err := alice.rh.Send(id, "Hello Bob", false)
+	if err != nil {
+		t.Fatalf("Error queueing message: %s", err)
+	}
+	waitStatus(t, events, msg, server.StatusQueued)
+
+	gate.open()
+	waitStatus(t, events, msg, server.StatusDelivered)
+
+	if messages := bob.rh.Messages(id); len(messages) != 1 || messages[0].Text != "Hello Bob" {
+		t.Fatalf("Bob did not receive the queued message")
+	}
+
+	if err := alice.rh.RetryMessage(id, expired.ID); err != nil {
+		t.Fatalf("Error retrying message: %s", err)
+	}
+	waitStatus(t, events, expired, server.StatusDelivered)
+
+	if messages := bob.rh.Messages(id); len(messages) != 2 || messages[1].Text != "Are you there?" {
+		t.Fatalf("Bob did not receive the retried message")
+	}
+
+	// Bob does not know the conversation anymore, refused messages fail right away
+	bob.rh.DeleteConversation(id)
+
+	start := time.Now()
+	refused, err := alice.rh.Send(id, "Hello?", false)
+	if err != nil {
+		t.Fatalf("Error queueing message: %s", err)
+	}
+	waitStatus(t, events, refused, server.StatusFailed)
+
+	if time.Since(start) >= alice.rh.Retry.Expiry {
+		t.Fatalf("Expected a refused message to fail before it expires")
+	}
+}
+
+func TestOutboxStalled(t *testing.T) {
+	aliceConvo, _, alice, bob := startConversation(t, "x25519")
+	id := aliceConvo.ConversationID
+	alice.rh.Retry = server.RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Expiry: 10 * time.Second}
+
+	// Requests to Bob hang until they time out
+	gate := &gatedTransport{next: alice.rh.Sender.Transport, stall: true}
+	alice.rh.Sender.Transport = gate
+	alice.rh.Sender.Timeout = 100 * time.Millisecond
+
+	events, unsubscribe := alice.rh.Subscribe()
+	defer unsubscribe()
+
+	sent := make(chan *server.Message, 1)
+	go func() {
+		msg, err := alice.rh.Send(id, "Hello Bob", false)
+		if err != nil {
+			t.Errorf("Error queueing message: %s", err)
+		}
+		sent <- msg
+	}()
+
+	var msg *server.Message
+	select {
+	case msg = <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Send is blocked by a stalled request")
+	}
+	if msg == nil {
+		return
+	}
+
+	gate.open()
+	waitStatus(t, events, msg, server.StatusDelivered)
+
+	if messages := bob.rh.Messages(id); len(messages) != 1 || messages[0].Text != "Hello Bob" {
+		t.Fatalf("Bob did not receive the message")
+	}
+}
+
+func TestRedelivery(t *testing.T) {
+	aliceConvo, _, alice, bob := startConversation(t, "x25519")
+
+	pmsg, err := aliceConvo.PackMessage("Hello Bob", false)
+	if err != nil {
+		t.Fatalf("Error packing message: %s", err)
+	}
+
+	// A sender that lost the response delivers the same message again
+	for i := 0; i < 2; i++ {
+		if err := alice.rh.SendMessage(pmsg, aliceConvo.RemoteAddress, server.MessagePath); err != nil {
+			t.Fatalf("Error delivering message: %s", err)
+		}
+	}
+
+	if messages := bob.rh.Messages(aliceConvo.ConversationID); len(messages) != 1 {
+		t.Fatalf("Expected the redelivered message once got %d", len(messages))
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+// Updates the status of the messages an acknowledgement refers to. Must be called with
+// the lock held.
+func (rh *RouteHandler) applyReceipt(c *Conversation, receipt *Message) {
+	status := StatusDelivered
+	if receipt.Kind == KindRead {
+		status = StatusRead
+	}
+
+	for _, id := range receipt.Acknowledges {
+		for _, m := range c.Messages {
+			if m.Self && m.ID == id && status > m.Status {
+				rh.updateStatus(c, m, status)
+			}
+		}
+	}
+}
+
+// Sends a read receipt for the messages received since the last call when read receipts
+// are enabled. Called when the user views the conversation.
+func (rh *RouteHandler) MarkRead(id string) {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	convo, ok := rh.Conversations[id]
+	if !ok || len(convo.unread) == 0 {
+		return
+	}
+
+	unread := convo.unread
+	convo.unread = nil
+
+	if rh.ReadReceipts && !convo.Ended {
+		rh.queueControl(convo, Message{Kind: KindRead, Acknowledges: unread})
+	}
+}
@@ -0,0 +1,27 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/JustinTimperio/onionsoup/server"
+)
+
+func TestReceipts(t *testing.T) {
+	aliceConvo, _, alice, bob := startConversation(t, "pgp")
+	id := aliceConvo.ConversationID
+
+	events, unsubscribe := alice.rh.Subscribe()
+	defer unsubscribe()
+
+	msg, err := alice.rh.Send(id, "Hello Bob", false)
+	if err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+
+	// Bob acknowledges every message it decrypted
+	waitStatus(t, events, msg, server.StatusDelivered)
+
+	bob.rh.ReadReceipts = true
+	bob.rh.MarkRead(id)
+	waitStatus(t, events, msg, server.StatusRead)
+}
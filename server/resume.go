@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+
+	"github.com/labstack/echo/v4"
+)
+
+// How far the clock of a resume request may be off before it is refused.
+const resumeWindow = 5 * time.Minute
+
+// Restores the conversations and groups kept in the Store and asks the other party of
+// every active conversation to continue at the current address. The resume requests are
+// sent in the background until the other party accepted them, see resume.
+func (rh *RouteHandler) LoadConversations() error {
+	if rh.Store == nil {
+		return nil
+	}
+
+	conversations, err := rh.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	groups, err := rh.Store.LoadGroups()
+	if err != nil {
+		return err
+	}
+
+	rh.mux.Lock()
+	var resume []string
+	for _, c := range conversations {
+		if _, ok := rh.Conversations[c.ConversationID]; ok {
+			continue
+		}
+
+		rh.addConversation(c)
+		if c.Established && !c.Ended {
+			resume = append(resume, c.ConversationID)
+		}
+	}
+
+	for _, g := range groups {
+		if _, ok := rh.Groups[g.GroupID]; ok {
+			continue
+		}
+
+		if rh.History != nil {
+			if messages, err := rh.History.Load(g.GroupID); err == nil {
+				g.Messages = messages
+			}
+		}
+		rh.Groups[g.GroupID] = g
+		rh.events.publish(Event{Type: EventGroupUpdated, GroupID: g.GroupID})
+	}
+	rh.mux.Unlock()
+
+	for _, id := range resume {
+		rh.background(func() { rh.resume(id) })
+	}
+
+	return nil
+}
+
+// Sends the resume request of a conversation until the other party accepted it, it may
+// come online long after this party. Failed attempts are retried with the backoff of the
+// outbox, the first failure is published as EventDeliveryFailed. A refused request is
+// not retried.
+func (rh *RouteHandler) resume(id string) {
+	for attempts := 1; ; attempts++ {
+		err := rh.ResumeConversation(id)
+		if err == nil {
+			return
+		}
+
+		var status *StatusError
+		rejected := errors.As(err, &status) && status.Rejected()
+		if attempts == 1 || rejected {
+			rh.events.publish(Event{Type: EventDeliveryFailed, ConversationID: id, Err: err})
+		}
+		if rejected || !rh.resumable(id) {
+			return
+		}
+
+		select {
+		case <-rh.stop:
+			return
+		case <-time.After(rh.Retry.backoff(attempts)):
+		}
+	}
+}
+
+// Returns whether the conversation can still be resumed.
+func (rh *RouteHandler) resumable(id string) bool {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	convo, ok := rh.Conversations[id]
+	return ok && convo.Established && !convo.Ended
+}
+
+// Tells the other party of an established conversation that it continues at the
+// current address. The request proves knowledge of the conversation token and is signed
+// with the long term keys.
+func (rh *RouteHandler) ResumeConversation(id string) error {
+	rh.mux.Lock()
+	convo, ok := rh.Conversations[id]
+	if !ok {
+		rh.mux.Unlock()
+		return fmt.Errorf("Unknown conversation")
+	}
+
+	if !convo.Established || convo.Ended {
+		rh.mux.Unlock()
+		return fmt.Errorf("Conversation is not active")
+	}
+
+	auth, err := json.Marshal(ResumeConversation{
+		Address: rh.URL,
+		Token:   convo.RemoteToken,
+		Time:    time.Now().Unix(),
+	})
+	if err != nil {
+		rh.mux.Unlock()
+		return err
+	}
+
+	emsg, sig, err := crypt.EncryptAndSignMessage(convo.SelfPrivateKey, convo.RemotePublicKey, auth)
+	remoteAddress := convo.RemoteAddress
+	keyType := convo.KeyType
+	rh.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	request, err := json.Marshal(StartConversationWrapper{
+		Version:        crypt.MessageVersion,
+		EncryptionType: keyType,
+		ID:             id,
+		Auth:           emsg,
+		Signature:      sig,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = rh.SendMessage(request, remoteAddress, ResumePath)
+	if err != nil {
+		return err
+	}
+
+	rh.events.publish(Event{Type: EventConversationEstablished, ConversationID: id})
+	return nil
+}
+
+func (rh *RouteHandler) Resume(c echo.Context) error {
+	request := &StartConversationWrapper{}
+	if err := c.Bind(request); err != nil {
+		return err
+	}
+
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	convo, ok := rh.Conversations[request.ID]
+	if !ok || !convo.Established || convo.Ended {
+		return echo.ErrUnauthorized
+	}
+
+	messageJson, err := crypt.DecryptAndVerifyMessage(request.Version, convo.SelfPrivateKey, convo.RemotePublicKey, request.Auth, request.Signature)
+	if err != nil {
+		return echo.ErrUnauthorized
+	}
+
+	var auth ResumeConversation
+	if err := json.Unmarshal(messageJson, &auth); err != nil {
+		return echo.ErrBadRequest
+	}
+
+	if auth.Token != convo.SelfToken {
+		return echo.ErrUnauthorized
+	}
+
+	// Every request is only accepted once and only while it is fresh
+	sent := time.Unix(auth.Time, 0)
+	if time.Since(sent).Abs() > resumeWindow || auth.Time <= convo.lastResume {
+		return echo.ErrUnauthorized
+	}
+
+	convo.lastResume = auth.Time
+	convo.RemoteAddress = auth.Address
+	rh.saveConversation(convo)
+	rh.seenContact(convo)
+	rh.events.publish(Event{Type: EventConversationEstablished, ConversationID: convo.ConversationID})
+
+	return nil
+}
@@ -2,14 +2,14 @@ package server
 
 import (
 	"bytes"
-	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/JustinTimperio/onionsoup/crypt"
 
-	"github.com/ProtonMail/gopenpgp/v3/crypto"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 )
 
@@ -26,14 +26,132 @@ func (rh *RouteHandler) SendMessage(packedMessage []byte, url, path string) erro
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("Invalid Status Code: %d", resp.StatusCode)
+		return &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	return nil
 }
 
+// StatusError is returned by SendMessage when the remote party answered with another
+// status than 200.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Invalid Status Code: %d", e.StatusCode)
+}
+
+// Returns whether the remote party refused the message itself, such as for an unknown or
+// ended conversation. Sending it again gets the same answer.
+func (e *StatusError) Rejected() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// Packs a message into the outbox of the conversation and makes the first delivery
+// attempt. Messages that cannot be delivered right away stay queued and are retried
+// with backoff, the conversation is marked as ended once a final message is delivered.
+// Messages that cannot be queued or expire are published as EventDeliveryFailed.
+// The returned message is a copy, later changes of its status are published as
+// EventMessageStatus.
+func (rh *RouteHandler) Send(id, text string, final bool) (*Message, error) {
+	msg, err := rh.send(id, text, final)
+	if err != nil {
+		rh.events.publish(Event{Type: EventDeliveryFailed, ConversationID: id, Message: msg, Err: err})
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (rh *RouteHandler) send(id, text string, final bool) (*Message, error) {
+	rh.mux.Lock()
+	convo, ok := rh.Conversations[id]
+	if !ok {
+		rh.mux.Unlock()
+		return nil, fmt.Errorf("Unknown conversation")
+	}
+
+	if convo.Ended || convo.ending() {
+		rh.mux.Unlock()
+		return nil, fmt.Errorf("Conversation has ended")
+	}
+
+	if !convo.Established {
+		rh.mux.Unlock()
+		return nil, fmt.Errorf("Conversation is not established")
+	}
+
+	kind := KindText
+	if final {
+		kind = KindEnd
+	}
+
+	now := time.Now()
+	entry := &outboxEntry{
+		ID:      uuid.New().String(),
+		Kind:    kind,
+		Text:    text,
+		Time:    int(now.Unix()),
+		Created: now,
+	}
+
+	packed, err := convo.pack(Message{ID: entry.ID, Kind: kind, Text: text, Time: entry.Time})
+	if err != nil {
+		rh.mux.Unlock()
+		return nil, err
+	}
+	entry.Packed = packed
+	msg := entry.Message()
+
+	convo.outbox = append(convo.outbox, entry)
+	rh.recordMessage(convo, msg)
+	// Packing advanced the ratchet
+	rh.saveConversation(convo)
+	rh.events.publish(Event{Type: EventMessageStatus, ConversationID: id, Message: msg})
+	sent := msg.snapshot()
+	rh.mux.Unlock()
+
+	rh.deliver(id, true)
+	return sent, nil
+}
+
+// Tells the remote party that the user is writing. Typing notifications are best effort
+// and never queued.
+func (rh *RouteHandler) SendTyping(id string) error {
+	return rh.sendDirect(id, KindTyping)
+}
+
+// Checks that the remote party is reachable and accepts messages of the conversation.
+func (rh *RouteHandler) Ping(id string) error {
+	return rh.sendDirect(id, KindPing)
+}
+
+// Delivers a control message once without the outbox.
+func (rh *RouteHandler) sendDirect(id string, kind MessageKind) error {
+	rh.mux.Lock()
+	convo, ok := rh.Conversations[id]
+	if !ok || !convo.Established || convo.Ended {
+		rh.mux.Unlock()
+		return fmt.Errorf("Conversation is not active")
+	}
+
+	packed, err := convo.pack(Message{ID: uuid.New().String(), Kind: kind, Time: int(time.Now().Unix())})
+	if err == nil {
+		rh.saveConversation(convo)
+	}
+	remoteAddress := convo.RemoteAddress
+	rh.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return rh.SendMessage(packed, remoteAddress, MessagePath)
+}
+
 func (rh *RouteHandler) Message(c echo.Context) error {
 	var mw MessageWrapper
 	if err := c.Bind(&mw); err != nil {
@@ -48,27 +166,63 @@ func (rh *RouteHandler) Message(c echo.Context) error {
 		return echo.ErrUnauthorized
 	}
 
+	// The sender retries when it did not see the response, accept without processing again
+	digest := messageDigest(mw.Message)
+	if convo.wasReceived(digest) {
+		return nil
+	}
+
 	if convo.Ended {
 		return echo.ErrUnauthorized
 	}
 
-	msg, err := convo.UnpackMessage(mw.Message, mw.Signature)
+	msg, err := convo.UnpackMessage(mw.Version, mw.Message, mw.Signature)
 	if err != nil {
 		return echo.ErrUnauthorized
 	}
 	msg.Self = false
+	convo.markReceived(digest)
 
-	if msg.FinalMessage {
-		convo.Ended = true
-		convo.Render.UpdateHeader(convo, "ended")
+	switch msg.Kind {
+	case KindText, KindEnd:
+		rh.receiveText(convo, msg)
+	case KindAck, KindRead:
+		rh.applyReceipt(convo, msg)
+	case KindTyping:
+		rh.events.publish(Event{Type: EventTyping, ConversationID: convo.ConversationID})
+	case KindAttachment:
+		rh.receiveChunk(convo, msg)
+	case KindNack:
+		rh.applyNack(convo, msg)
+	case KindGroup:
+		rh.receiveGroup(convo, msg)
+	case KindPing:
+		// Accepting the message is the answer
+	default:
+		// Kinds this version does not handle yet are accepted and dropped
 	}
 
-	err = convo.Render.AddMessage(*msg)
-	if err != nil {
-		return echo.ErrInternalServerError
+	// Every message advanced the ratchet
+	rh.saveConversation(convo)
+	return nil
+}
+
+// Keeps a received text and acknowledges it. Must be called with the lock held.
+func (rh *RouteHandler) receiveText(convo *Conversation, msg *Message) {
+	// The conversation is over after a final message so there is nobody to acknowledge to
+	if msg.Final() {
+		convo.Ended = true
+	} else if msg.ID != "" {
+		rh.queueControl(convo, Message{Kind: KindAck, Acknowledges: []string{msg.ID}})
+		convo.unread = append(convo.unread, msg.ID)
 	}
 
-	return nil
+	rh.recordMessage(convo, msg)
+	rh.events.publish(Event{Type: EventMessageReceived, ConversationID: convo.ConversationID, Message: msg})
+
+	if msg.Final() {
+		rh.events.publish(Event{Type: EventConversationEnded, ConversationID: convo.ConversationID})
+	}
 }
 
 func (rh *RouteHandler) Bootstrap(c echo.Context) error {
@@ -85,19 +239,16 @@ func (rh *RouteHandler) Bootstrap(c echo.Context) error {
 	rh.mux.Lock()
 	defer rh.mux.Unlock()
 
+	// Every token is accepted once and only until it expires
 	convo, ok := rh.Conversations[startConversation.ID]
-	if !ok {
+	if !ok || convo.Established || convo.Ended {
 		return echo.ErrUnauthorized
 	}
-
-	switch convo.KeyType {
-	case "rsa":
-		messageJson, err = crypt.RSADecryptAndVerifyMessage(convo.SelfPrivateKey.(*rsa.PrivateKey), convo.RemotePublicKey.(*rsa.PublicKey), startConversation.Auth, startConversation.Signature)
-	case "pgp":
-		messageJson, err = crypt.PGPDecryptAndVerifyMessage(convo.SelfPrivateKey.(*crypto.Key), convo.RemotePublicKey.(*crypto.Key), startConversation.Auth)
-	default:
-		err = fmt.Errorf("Invalid key type")
+	if !convo.Expires.IsZero() && time.Now().After(convo.Expires) {
+		return echo.ErrUnauthorized
 	}
+
+	messageJson, err = crypt.DecryptAndVerifyMessage(startConversation.Version, convo.SelfPrivateKey, convo.RemotePublicKey, startConversation.Auth, startConversation.Signature)
 	if err != nil {
 		return err
 	}
@@ -108,10 +259,21 @@ func (rh *RouteHandler) Bootstrap(c echo.Context) error {
 		return err
 	}
 
+	// Complete the ratchet handshake started when the token was generated
+	if convo.ratchetKey != nil && len(auth.RatchetKey) > 0 {
+		convo.Ratchet, err = crypt.NewRatchetResponder(convo.ratchetKey, auth.RatchetKey)
+		if err != nil {
+			return err
+		}
+		convo.ratchetKey = nil
+	}
+
 	convo.Established = true
 	convo.RemoteToken = auth.Token
 	convo.RemoteAddress = auth.Address
-	convo.Render.UpdateHeader(convo, "active")
+	rh.saveConversation(convo)
+	rh.seenContact(convo)
+	rh.events.publish(Event{Type: EventConversationEstablished, ConversationID: convo.ConversationID})
 
 	return nil
 }
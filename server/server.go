@@ -2,78 +2,339 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
 	"net/http"
-	"os"
-	"path"
+	"sort"
 	"sync"
 	"time"
 
-	"fyne.io/fyne/v2"
-	"github.com/cretz/bine/tor"
+	"github.com/labstack/echo/v4"
 )
 
 const (
 	MessagePath   = "message"
 	BootstrapPath = "bootstrap"
+	ResumePath    = "resume"
 )
 
+// Longest a request to the remote party may take. Circuits can be slow to build, but a
+// stalled one must count as a failed attempt instead of holding the outbox.
+const sendTimeout = 2 * time.Minute
+
+// Longest Close waits for requests of the remote party that are still being handled.
+const shutdownTimeout = 5 * time.Second
+
 type RouteHandler struct {
-	Conversations      map[string]*Conversation
-	ConversationScreen *fyne.Container
-	Receiver           *tor.OnionService
-	Sender             http.Client
-	Tor                *tor.Tor
-	URL                string
+	Conversations map[string]*Conversation
+	Groups        map[string]*Group
+	Transport     Transport
+	Sender        http.Client
+	URL           string
+
+	// History stores the messages of every conversation when set, it is opt-in and nil
+	// keeps messages in memory only.
+	History *History
+	// Store keeps the state of every conversation when set so they can be resumed
+	// after a restart, nil keeps conversations in memory only.
+	Store *ConversationStore
+	// Contacts pins the key of every conversation partner when set, keys that are new
+	// or changed are reported with EventKeyWarning.
+	Contacts *ContactBook
+	// Retry controls redelivery of queued messages, see DefaultRetryPolicy.
+	Retry RetryPolicy
+	// ReadReceipts tells the remote party when received messages were viewed, see
+	// MarkRead. Delivery acknowledgements are always sent.
+	ReadReceipts bool
+	// TokenTTL is how long generated bootstrap tokens are accepted, zero accepts them
+	// until they are used or revoked. See DefaultTokenTTL.
+	TokenTTL time.Duration
 
-	mux *sync.Mutex
+	echo   *echo.Echo
+	events *eventBus
+	stop   chan struct{}
+	mux    *sync.Mutex
+
+	// Deliveries running in the background, Close waits for them so nothing is written
+	// to the store after it returned.
+	work    sync.WaitGroup
+	workMux sync.Mutex
 }
 
-func NewRouteHandler() (*RouteHandler, error) {
+// Config controls how the RouteHandler publishes its onion service.
+type Config struct {
+	// OnionKey keeps the .onion address stable across restarts. A new random
+	// address is created when it is nil.
+	OnionKey ed25519.PrivateKey
+
+	// TorMode is one of TorModeAuto, TorModeSystem or TorModeEmbedded, auto is used
+	// when empty.
+	TorMode string
+	// ControlAddress is the host:port of a running tor's control port, defaults to
+	// DefaultControlAddress.
+	ControlAddress string
+	// ControlSocket is the path of a control socket, used instead of ControlAddress.
+	ControlSocket string
+	// ControlPassword is used when tor only accepts HashedControlPassword
+	// authentication, cookie authentication needs no configuration.
+	ControlPassword string
+}
 
-	t, err := tor.Start(nil, &tor.StartConf{
-		DataDir: path.Join(os.TempDir(), "tor", randomString(10)),
-	})
+// Creates a RouteHandler reachable through a tor onion service.
+func NewRouteHandler(conf Config) (*RouteHandler, error) {
+	t, err := NewTorTransport(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	listenCtx, listenCancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	defer listenCancel()
+	return NewRouteHandlerWithTransport(t), nil
+}
 
-	onion, err := t.Listen(listenCtx, &tor.ListenConf{RemotePorts: []int{80}, Version3: true})
-	if err != nil {
-		return nil, err
+// Creates a RouteHandler on top of an already listening transport.
+func NewRouteHandlerWithTransport(t Transport) *RouteHandler {
+	return &RouteHandler{
+		Conversations: make(map[string]*Conversation),
+		Groups:        make(map[string]*Group),
+		Transport:     t,
+		Sender:        http.Client{Transport: &http.Transport{DialContext: t.DialContext}, Timeout: sendTimeout},
+		URL:           t.Address(),
+		Retry:         DefaultRetryPolicy,
+		TokenTTL:      DefaultTokenTTL,
+
+		events: newEventBus(),
+		stop:   make(chan struct{}),
+		mux:    &sync.Mutex{},
 	}
+}
 
-	sendCtx, sendCancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	defer sendCancel()
+// Serves the conversation protocol on the transport listener and retries queued
+// messages in the background.
+func (rh *RouteHandler) Start() {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Listener = rh.Transport.Listener()
+	e.POST("/"+MessagePath, rh.Message)
+	e.POST("/"+BootstrapPath, rh.Bootstrap)
+	e.POST("/"+ResumePath, rh.Resume)
 
-	d, err := t.Dialer(sendCtx, nil)
-	if err != nil {
-		return nil, err
+	rh.echo = e
+	go e.Start("")
+	go rh.runOutbox()
+}
+
+// Returns the conversation with the given id.
+func (rh *RouteHandler) Conversation(id string) (*Conversation, bool) {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	c, ok := rh.Conversations[id]
+	return c, ok
+}
+
+// ConversationInfo is a snapshot of the state of a conversation, it can be read without
+// the lock while the conversation keeps changing.
+type ConversationInfo struct {
+	ID            string
+	Alias         string
+	KeyType       string
+	RemoteAddress string
+	Established   bool
+	Ended         bool
+	Verified      bool
+	KeyStatus     KeyStatus
+	Created       time.Time
+	Expires       time.Time
+}
+
+// Must be called with the lock held.
+func (c *Conversation) info() ConversationInfo {
+	return ConversationInfo{
+		ID:            c.ConversationID,
+		Alias:         c.ConversationAlias,
+		KeyType:       c.KeyType,
+		RemoteAddress: c.RemoteAddress,
+		Established:   c.Established,
+		Ended:         c.Ended,
+		Verified:      c.Verified,
+		KeyStatus:     c.KeyStatus,
+		Created:       c.Created,
+		Expires:       c.Expires,
 	}
+}
 
-	t.DeleteDataDirOnClose = true
-	t.StopProcessOnClose = true
+// Returns a snapshot of the conversation with the given id.
+func (rh *RouteHandler) ConversationInfo(id string) (ConversationInfo, bool) {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
 
-	return &RouteHandler{
-		Conversations: make(map[string]*Conversation),
-		Tor:           t,
-		Sender:        http.Client{Transport: &http.Transport{DialContext: d.DialContext}},
-		Receiver:      onion,
-		URL:           onion.String(),
+	c, ok := rh.Conversations[id]
+	if !ok {
+		return ConversationInfo{}, false
+	}
 
-		mux: &sync.Mutex{},
-	}, nil
+	return c.info(), true
+}
+
+// Returns the ids of all conversations in a stable order.
+func (rh *RouteHandler) ConversationIDs() []string {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	ids := make([]string, 0, len(rh.Conversations))
+	for id := range rh.Conversations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Returns a copy of the messages exchanged in a conversation. The messages are copied as
+// well, their status keeps changing while the conversation goes on.
+func (rh *RouteHandler) Messages(id string) []*Message {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	c, ok := rh.Conversations[id]
+	if !ok {
+		return nil
+	}
+
+	messages := make([]*Message, 0, len(c.Messages))
+	for _, m := range c.Messages {
+		messages = append(messages, m.snapshot())
+	}
+
+	return messages
+}
+
+// Removes the messages of a conversation from memory and from the history.
+func (rh *RouteHandler) ClearHistory(id string) error {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	if c, ok := rh.Conversations[id]; ok {
+		c.Messages = make([]*Message, 0)
+	}
+
+	if rh.History == nil {
+		return nil
+	}
+
+	return rh.History.Delete(id)
+}
+
+// Keeps the message in memory and in the history. Must be called with the lock held.
+func (rh *RouteHandler) recordMessage(c *Conversation, msg *Message) {
+	c.Messages = append(c.Messages, msg)
+
+	// History is best effort, a full disk must not stop the conversation
+	if rh.History != nil {
+		rh.History.Record(c.ConversationID, msg)
+	}
+}
+
+// Adds a conversation and restores its stored messages. Must be called with the lock held.
+func (rh *RouteHandler) addConversation(c *Conversation) {
+	if rh.History != nil {
+		if messages, err := rh.History.Load(c.ConversationID); err == nil {
+			c.Messages = messages
+		}
+	}
+
+	c.attachOutbox()
+
+	rh.Conversations[c.ConversationID] = c
+	rh.saveConversation(c)
+	rh.events.publish(Event{Type: EventConversationCreated, ConversationID: c.ConversationID})
+	rh.pinContact(c)
+}
+
+// Writes the state of the conversation to the store, ended conversations are removed
+// since they cannot be resumed. Must be called with the lock held.
+func (rh *RouteHandler) saveConversation(c *Conversation) {
+	if rh.Store == nil {
+		return
+	}
+
+	// The store is best effort like the history, the conversation only loses the
+	// ability to be resumed
+	if c.Ended {
+		rh.Store.Delete(c.ConversationID)
+	} else {
+		rh.Store.Save(c)
+	}
+}
+
+// Marks whether the safety number of a conversation was compared with the other party.
+func (rh *RouteHandler) SetVerified(id string, verified bool) {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
+	if c, ok := rh.Conversations[id]; ok {
+		c.Verified = verified
+		rh.saveConversation(c)
+
+		// A compared safety number also verifies the pinned key
+		if verified && rh.Contacts != nil && (c.KeyStatus == KeyNew || c.KeyStatus == KeyMatch) {
+			rh.Contacts.SetTrust(c.contact, TrustVerified)
+		}
+	}
 }
 
 func (rh *RouteHandler) DeleteConversation(id string) {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+
 	delete(rh.Conversations, id)
-	rh.ConversationScreen.Refresh()
+	if rh.Store != nil {
+		rh.Store.Delete(id)
+	}
+}
+
+// Runs f in the background unless the RouteHandler was closed, Close waits for it.
+func (rh *RouteHandler) background(f func()) {
+	rh.workMux.Lock()
+	defer rh.workMux.Unlock()
+
+	select {
+	case <-rh.stop:
+		return
+	default:
+	}
+
+	rh.work.Add(1)
+	go func() {
+		defer rh.work.Done()
+		f()
+	}()
+}
+
+// Returns whether Close was called.
+func (rh *RouteHandler) stopped() bool {
+	select {
+	case <-rh.stop:
+		return true
+	default:
+		return false
+	}
 }
 
 func (rh *RouteHandler) Close() {
-	rh.Receiver.Close()
-	rh.Tor.Close()
-	rh.ConversationScreen.Refresh()
+	rh.workMux.Lock()
+	if !rh.stopped() {
+		close(rh.stop)
+	}
+	rh.workMux.Unlock()
+
+	// Requests that are being handled finish before the listener goes away
+	if rh.echo != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		rh.echo.Shutdown(ctx)
+		cancel()
+		rh.echo.Close()
+	}
+	rh.work.Wait()
+	rh.Transport.Close()
+	rh.events.close()
 }
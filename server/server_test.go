@@ -0,0 +1,427 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/server"
+)
+
+type peer struct {
+	rh         *server.RouteHandler
+	privateKey any
+	publicKey  any
+	// publicKey as crypt.PublicKeyToBytes encodes it
+	encodedKey []byte
+}
+
+func newPeer(t *testing.T, keyType string) *peer {
+	t.Helper()
+
+	var (
+		privateKey any
+		err        error
+	)
+
+	switch keyType {
+	case "rsa":
+		privateKey, _, err = crypt.RSAGenerateKeyPair(4096)
+	case "pgp":
+		privateKey, err = crypt.PGPGenerateKeyPair("Test")
+	case "x25519":
+		privateKey, _, err = crypt.CurveGenerateKeyPair()
+	}
+	if err != nil {
+		t.Fatalf("Error generating key pair: %s", err)
+	}
+
+	publicBytes, err := crypt.PublicKeyToBytes(privateKey)
+	if err != nil {
+		t.Fatalf("Error encoding public key: %s", err)
+	}
+
+	publicKey, err := crypt.PublicKeyToMem(keyType, publicBytes)
+	if err != nil {
+		t.Fatalf("Error decoding public key: %s", err)
+	}
+
+	lt, err := server.NewLoopbackTransport()
+	if err != nil {
+		t.Fatalf("Error creating transport: %s", err)
+	}
+
+	rh := server.NewRouteHandlerWithTransport(lt)
+	rh.Start()
+	t.Cleanup(rh.Close)
+
+	return &peer{rh: rh, privateKey: privateKey, publicKey: publicKey, encodedKey: publicBytes}
+}
+
+// Runs the bootstrap handshake between two peers and returns both sides of the conversation.
+func startConversation(t *testing.T, keyType string) (*server.Conversation, *server.Conversation, *peer, *peer) {
+	t.Helper()
+
+	alice := newPeer(t, keyType)
+	bob := newPeer(t, keyType)
+
+	token, err := alice.rh.GenerateConversation(alice.privateKey, alice.encodedKey, bob.publicKey, keyType, "Bob")
+	if err != nil {
+		t.Fatalf("Error generating conversation: %s", err)
+	}
+
+	err = bob.rh.BootstrapConversation(token, bob.privateKey, bob.encodedKey, alice.publicKey, "Alice")
+	if err != nil {
+		t.Fatalf("Error bootstrapping conversation: %s", err)
+	}
+
+	if len(alice.rh.Conversations) != 1 || len(bob.rh.Conversations) != 1 {
+		t.Fatalf("Expected one conversation on each side")
+	}
+
+	var aliceConvo, bobConvo *server.Conversation
+	for id, c := range alice.rh.Conversations {
+		aliceConvo, bobConvo = c, bob.rh.Conversations[id]
+	}
+
+	if bobConvo == nil {
+		t.Fatalf("Conversation IDs do not match")
+	}
+
+	if !aliceConvo.Established || !bobConvo.Established {
+		t.Fatalf("Conversation was not established")
+	}
+
+	if aliceConvo.Ratchet == nil || bobConvo.Ratchet == nil {
+		t.Fatalf("Ratchet was not negotiated")
+	}
+
+	return aliceConvo, bobConvo, alice, bob
+}
+
+func sendMessage(t *testing.T, from *peer, c *server.Conversation, text string) error {
+	t.Helper()
+
+	pmsg, err := c.PackMessage(text, false)
+	if err != nil {
+		t.Fatalf("Error packing message: %s", err)
+	}
+
+	return from.rh.SendMessage(pmsg, c.RemoteAddress, server.MessagePath)
+}
+
+func TestConversation(t *testing.T) {
+	for _, keyType := range []string{"rsa", "pgp", "x25519"} {
+		t.Run(keyType, func(t *testing.T) {
+			aliceConvo, bobConvo, alice, bob := startConversation(t, keyType)
+
+			if err := sendMessage(t, bob, bobConvo, "Hello Alice"); err != nil {
+				t.Fatalf("Error sending message: %s", err)
+			}
+
+			if err := sendMessage(t, alice, aliceConvo, "Hello Bob"); err != nil {
+				t.Fatalf("Error sending message: %s", err)
+			}
+
+			if len(aliceConvo.Messages) != 1 || aliceConvo.Messages[0].Text != "Hello Alice" {
+				t.Fatalf("Alice did not receive the message")
+			}
+
+			if len(bobConvo.Messages) != 1 || bobConvo.Messages[0].Text != "Hello Bob" {
+				t.Fatalf("Bob did not receive the message")
+			}
+		})
+	}
+}
+
+func TestConversationInvalidToken(t *testing.T) {
+	aliceConvo, bobConvo, _, bob := startConversation(t, "x25519")
+
+	bobConvo.RemoteToken = "invalid"
+	if err := sendMessage(t, bob, bobConvo, "Hello Alice"); err == nil {
+		t.Fatalf("Expected message with an invalid token to be rejected")
+	}
+
+	if len(aliceConvo.Messages) != 0 {
+		t.Fatalf("Message with an invalid token was delivered")
+	}
+}
+
+func TestBootstrapUnknownConversation(t *testing.T) {
+	alice := newPeer(t, "x25519")
+	bob := newPeer(t, "x25519")
+
+	token, err := alice.rh.GenerateConversation(alice.privateKey, alice.encodedKey, bob.publicKey, "x25519", "Bob")
+	if err != nil {
+		t.Fatalf("Error generating conversation: %s", err)
+	}
+
+	for id := range alice.rh.Conversations {
+		alice.rh.DeleteConversation(id)
+	}
+
+	err = bob.rh.BootstrapConversation(token, bob.privateKey, bob.encodedKey, alice.publicKey, "Alice")
+	if err == nil {
+		t.Fatalf("Expected bootstrap of a deleted conversation to fail")
+	}
+}
+
+func TestTokenSingleUse(t *testing.T) {
+	alice := newPeer(t, "x25519")
+	bob := newPeer(t, "x25519")
+
+	token, err := alice.rh.GenerateConversation(alice.privateKey, alice.encodedKey, bob.publicKey, "x25519", "Bob")
+	if err != nil {
+		t.Fatalf("Error generating conversation: %s", err)
+	}
+
+	if err := bob.rh.BootstrapConversation(token, bob.privateKey, bob.encodedKey, alice.publicKey, "Alice"); err != nil {
+		t.Fatalf("Error bootstrapping conversation: %s", err)
+	}
+
+	// A replayed token would otherwise redirect the conversation to the sender
+	if err := bob.rh.BootstrapConversation(token, bob.privateKey, bob.encodedKey, alice.publicKey, "Alice"); err == nil {
+		t.Fatalf("Expected a used token to be refused")
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	alice := newPeer(t, "x25519")
+	bob := newPeer(t, "x25519")
+	alice.rh.TokenTTL = time.Nanosecond
+
+	token, err := alice.rh.GenerateConversation(alice.privateKey, alice.encodedKey, bob.publicKey, "x25519", "Bob")
+	if err != nil {
+		t.Fatalf("Error generating conversation: %s", err)
+	}
+
+	invitations := alice.rh.Invitations()
+	if len(invitations) != 1 || invitations[0].Alias != "Bob" || invitations[0].Expires.IsZero() {
+		t.Fatalf("Unexpected invitations %+v", invitations)
+	}
+
+	// Expiry has a granularity of one second
+	time.Sleep(time.Until(invitations[0].Expires.Add(time.Second)))
+
+	err = bob.rh.BootstrapConversation(token, bob.privateKey, bob.encodedKey, alice.publicKey, "Alice")
+	if err == nil {
+		t.Fatalf("Expected an expired token to be refused")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(alice.rh.Invitations()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expired invitation was not ended")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRevokeInvitation(t *testing.T) {
+	alice := newPeer(t, "x25519")
+	bob := newPeer(t, "x25519")
+
+	token, err := alice.rh.GenerateConversation(alice.privateKey, alice.encodedKey, bob.publicKey, "x25519", "Bob")
+	if err != nil {
+		t.Fatalf("Error generating conversation: %s", err)
+	}
+
+	invitations := alice.rh.Invitations()
+	if len(invitations) != 1 {
+		t.Fatalf("Expected one invitation, got %d", len(invitations))
+	}
+
+	if err := alice.rh.RevokeInvitation(invitations[0].ConversationID); err != nil {
+		t.Fatalf("Error revoking invitation: %s", err)
+	}
+
+	err = bob.rh.BootstrapConversation(token, bob.privateKey, bob.encodedKey, alice.publicKey, "Alice")
+	if err == nil {
+		t.Fatalf("Expected a revoked token to be refused")
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan server.Event) server.Event {
+	t.Helper()
+
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for an event")
+	}
+
+	return server.Event{}
+}
+
+func TestConversationEvents(t *testing.T) {
+	alice := newPeer(t, "x25519")
+	bob := newPeer(t, "x25519")
+
+	events, unsubscribe := alice.rh.Subscribe()
+	defer unsubscribe()
+
+	token, err := alice.rh.GenerateConversation(alice.privateKey, alice.encodedKey, bob.publicKey, "x25519", "Bob")
+	if err != nil {
+		t.Fatalf("Error generating conversation: %s", err)
+	}
+
+	e := nextEvent(t, events)
+	if e.Type != server.EventConversationCreated {
+		t.Fatalf("Expected %s got %s", server.EventConversationCreated, e.Type)
+	}
+	id := e.ConversationID
+
+	err = bob.rh.BootstrapConversation(token, bob.privateKey, bob.encodedKey, alice.publicKey, "Alice")
+	if err != nil {
+		t.Fatalf("Error bootstrapping conversation: %s", err)
+	}
+
+	if e := nextEvent(t, events); e.Type != server.EventConversationEstablished || e.ConversationID != id {
+		t.Fatalf("Expected %s got %s", server.EventConversationEstablished, e.Type)
+	}
+
+	if _, err := bob.rh.Send(id, "Goodbye Alice", true); err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+
+	e = nextEvent(t, events)
+	if e.Type != server.EventMessageReceived || e.Message.Text != "Goodbye Alice" || !e.Message.Final() {
+		t.Fatalf("Expected the final message to be received")
+	}
+
+	if e := nextEvent(t, events); e.Type != server.EventConversationEnded {
+		t.Fatalf("Expected %s got %s", server.EventConversationEnded, e.Type)
+	}
+
+	if _, err := alice.rh.Send(id, "Hello Bob", false); err == nil {
+		t.Fatalf("Expected sending to an ended conversation to fail")
+	}
+
+	if e := nextEvent(t, events); e.Type != server.EventDeliveryFailed || e.Err == nil {
+		t.Fatalf("Expected %s got %s", server.EventDeliveryFailed, e.Type)
+	}
+}
+
+func TestMessageKinds(t *testing.T) {
+	aliceConvo, _, alice, bob := startConversation(t, "x25519")
+	id := aliceConvo.ConversationID
+
+	events, unsubscribe := bob.rh.Subscribe()
+	defer unsubscribe()
+
+	if err := alice.rh.Ping(id); err != nil {
+		t.Fatalf("Error pinging: %s", err)
+	}
+
+	if err := alice.rh.SendTyping(id); err != nil {
+		t.Fatalf("Error sending typing notification: %s", err)
+	}
+
+	if e := nextEvent(t, events); e.Type != server.EventTyping || e.ConversationID != id {
+		t.Fatalf("Expected %s got %s", server.EventTyping, e.Type)
+	}
+
+	// A kind from a newer version is accepted and ignored
+	future, err := json.Marshal(map[string]any{
+		"id":    "future",
+		"kind":  "future_kind",
+		"time":  time.Now().Unix(),
+		"token": aliceConvo.RemoteToken,
+	})
+	if err != nil {
+		t.Fatalf("Error encoding message: %s", err)
+	}
+
+	emsg, err := aliceConvo.Ratchet.Encrypt(future, []byte(id))
+	if err != nil {
+		t.Fatalf("Error encrypting message: %s", err)
+	}
+
+	wrapper, err := json.Marshal(server.MessageWrapper{
+		Version:   crypt.MessageVersionRatchet,
+		Message:   emsg,
+		Signature: crypt.CurveSignMessage(alice.privateKey.(*crypt.CurvePrivateKey), emsg),
+		ID:        id,
+	})
+	if err != nil {
+		t.Fatalf("Error encoding wrapper: %s", err)
+	}
+
+	if err := alice.rh.SendMessage(wrapper, aliceConvo.RemoteAddress, server.MessagePath); err != nil {
+		t.Fatalf("Expected an unknown kind to be accepted: %s", err)
+	}
+
+	if _, err := alice.rh.Send(id, "Hello Bob", false); err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+
+	if e := nextEvent(t, events); e.Type != server.EventMessageReceived || e.Message.Kind != server.KindText {
+		t.Fatalf("Expected the text after the unknown kind to be received")
+	}
+
+	if messages := bob.rh.Messages(id); len(messages) != 1 {
+		t.Fatalf("Expected only the text message to be kept got %d", len(messages))
+	}
+}
+
+// Holds the response to the bootstrap request until released.
+type heldBootstrap struct {
+	next    http.RoundTripper
+	release chan struct{}
+}
+
+func (h *heldBootstrap) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := h.next.RoundTrip(r)
+	if strings.HasSuffix(r.URL.Path, "/"+server.BootstrapPath) {
+		<-h.release
+	}
+
+	return resp, err
+}
+
+func TestBootstrapEarlyMessage(t *testing.T) {
+	alice := newPeer(t, "x25519")
+	bob := newPeer(t, "x25519")
+
+	held := &heldBootstrap{next: bob.rh.Sender.Transport, release: make(chan struct{})}
+	bob.rh.Sender.Transport = held
+
+	events, unsubscribe := alice.rh.Subscribe()
+	defer unsubscribe()
+
+	token, err := alice.rh.GenerateConversation(alice.privateKey, alice.encodedKey, bob.publicKey, "x25519", "Bob")
+	if err != nil {
+		t.Fatalf("Error generating conversation: %s", err)
+	}
+	id := nextEvent(t, events).ConversationID
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bob.rh.BootstrapConversation(token, bob.privateKey, bob.encodedKey, alice.publicKey, "Alice")
+	}()
+
+	if e := nextEvent(t, events); e.Type != server.EventConversationEstablished {
+		t.Fatalf("Expected %s got %s", server.EventConversationEstablished, e.Type)
+	}
+
+	// Alice writes before Bob saw the response to his bootstrap request
+	msg, err := alice.rh.Send(id, "Hello Bob", false)
+	if err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+	waitStatus(t, events, msg, server.StatusDelivered)
+
+	close(held.release)
+	if err := <-done; err != nil {
+		t.Fatalf("Error bootstrapping conversation: %s", err)
+	}
+
+	messages := bob.rh.Messages(id)
+	if len(messages) != 1 || messages[0].Text != "Hello Bob" {
+		t.Fatalf("Expected Bob to receive the early message")
+	}
+}
@@ -0,0 +1,442 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+	"github.com/JustinTimperio/onionsoup/storage"
+)
+
+// Returns the directory the encrypted local state is kept in by default.
+func DefaultVaultDir() (string, error) {
+	dir, err := DefaultDataDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "vault"), nil
+}
+
+// Opens the default vault keyed from a private key. Every private key has its own vault.
+func OpenKeyVault(privateKey any) (*storage.Vault, error) {
+	dir, err := DefaultVaultDir()
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint, err := crypt.Fingerprint(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := crypt.StorageKey(privateKey, "vault")
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.OpenVault(filepath.Join(dir, hex.EncodeToString(fingerprint[:8])), key)
+}
+
+// Opens the default vault keyed from a profile passphrase.
+func OpenPassphraseVault(passphrase string) (*storage.Vault, error) {
+	dir, err := DefaultVaultDir()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, "passphrase")
+
+	key, err := storage.PassphraseKey(dir, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.OpenVault(dir, key)
+}
+
+// ConversationStore keeps the state of conversations and groups in an encrypted vault so
+// they can be resumed after a restart. The state includes the private key and ratchet
+// session of every conversation.
+type ConversationStore struct {
+	vault *storage.Vault
+}
+
+// Serialized form of a Conversation.
+type conversationState struct {
+	ID              string         `json:"id"`
+	Alias           string         `json:"alias"`
+	KeyType         string         `json:"key_type"`
+	SelfToken       string         `json:"self_token"`
+	SelfPrivateKey  []byte         `json:"self_private_key"`
+	RemoteAddress   string         `json:"remote_address"`
+	RemoteToken     string         `json:"remote_token"`
+	RemotePublicKey []byte         `json:"remote_public_key"`
+	Established     bool           `json:"established"`
+	Verified        bool           `json:"verified"`
+	Ratchet         *crypt.Ratchet `json:"ratchet,omitempty"`
+	RatchetKey      []byte         `json:"ratchet_key,omitempty"`
+	LastResume      int64          `json:"last_resume,omitempty"`
+	Outbox          []*outboxEntry `json:"outbox,omitempty"`
+	Received        []string       `json:"received,omitempty"`
+	Incoming        []string       `json:"incoming,omitempty"`
+	Created         time.Time      `json:"created,omitempty"`
+	Expires         time.Time      `json:"expires,omitempty"`
+}
+
+// Keeps conversation state in the vault, see OpenKeyVault and OpenPassphraseVault.
+func NewConversationStore(vault *storage.Vault) *ConversationStore {
+	return &ConversationStore{vault: vault}
+}
+
+const conversationIndex = "conversations"
+
+func conversationName(id string) string {
+	return "conversation/" + id
+}
+
+// Writes the current state of a conversation.
+func (s *ConversationStore) Save(c *Conversation) error {
+	privateKey, err := crypt.SealPrivateKey(c.KeyType, c.SelfPrivateKey, "", c.ConversationAlias)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := crypt.PublicKeyToBytes(c.RemotePublicKey)
+	if err != nil {
+		return err
+	}
+
+	state := conversationState{
+		ID:              c.ConversationID,
+		Alias:           c.ConversationAlias,
+		KeyType:         c.KeyType,
+		SelfToken:       c.SelfToken,
+		SelfPrivateKey:  privateKey,
+		RemoteAddress:   c.RemoteAddress,
+		RemoteToken:     c.RemoteToken,
+		RemotePublicKey: publicKey,
+		Established:     c.Established,
+		Verified:        c.Verified,
+		Ratchet:         c.Ratchet,
+		LastResume:      c.lastResume,
+		Outbox:          c.outbox,
+		Received:        c.received,
+		Incoming:        c.incomingIDs(),
+		Created:         c.Created,
+		Expires:         c.Expires,
+	}
+	if c.ratchetKey != nil {
+		state.RatchetKey = c.ratchetKey.Bytes()
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := s.vault.Put(conversationName(c.ConversationID), data); err != nil {
+		return err
+	}
+
+	return s.updateIndex(conversationIndex, c.ConversationID, true)
+}
+
+// Removes the state of a conversation, it can no longer be resumed.
+func (s *ConversationStore) Delete(id string) error {
+	// Attachments that never completed
+	if data, err := s.vault.Get(conversationName(id)); err == nil {
+		var state conversationState
+		if json.Unmarshal(data, &state) == nil {
+			for _, attachmentID := range state.Incoming {
+				s.deleteChunks(id, attachmentID)
+			}
+		}
+	}
+
+	if err := s.vault.Delete(conversationName(id)); err != nil {
+		return err
+	}
+
+	return s.updateIndex(conversationIndex, id, false)
+}
+
+// Returns every stored conversation.
+func (s *ConversationStore) Load() ([]*Conversation, error) {
+	ids, err := s.index(conversationIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	conversations := make([]*Conversation, 0, len(ids))
+	for _, id := range ids {
+		data, err := s.vault.Get(conversationName(id))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := s.restoreConversation(data)
+		if err != nil {
+			return nil, err
+		}
+
+		conversations = append(conversations, c)
+	}
+
+	return conversations, nil
+}
+
+func (s *ConversationStore) restoreConversation(data []byte) (*Conversation, error) {
+	var state conversationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	_, privateKey, err := crypt.LoadPrivateKey(state.SelfPrivateKey, "")
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := crypt.PublicKeyToBytes(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	remotePublicKey, err := crypt.PublicKeyToMem(state.KeyType, state.RemotePublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conversation{
+		ConversationID:    state.ID,
+		ConversationAlias: state.Alias,
+		Messages:          make([]*Message, 0),
+
+		SelfToken:      state.SelfToken,
+		SelfPrivateKey: privateKey,
+		SelfPublicKey:  publicKey,
+
+		KeyType:     state.KeyType,
+		Established: state.Established,
+		Verified:    state.Verified,
+		Ratchet:     state.Ratchet,
+		Created:     state.Created,
+		Expires:     state.Expires,
+
+		RemoteAddress:   state.RemoteAddress,
+		RemoteToken:     state.RemoteToken,
+		RemotePublicKey: remotePublicKey,
+
+		lastResume: state.LastResume,
+		outbox:     state.Outbox,
+		received:   state.Received,
+	}
+
+	if len(state.RatchetKey) > 0 {
+		c.ratchetKey, err = ecdh.X25519().NewPrivateKey(state.RatchetKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, attachmentID := range state.Incoming {
+		chunks, err := s.vault.Records(incomingName(state.ID, attachmentID))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, body := range chunks {
+			if chunk, ok := parseChunk(body); ok && chunk.AttachmentID == attachmentID {
+				c.collectChunk(chunk)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// Serialized form of a Group, the messages are kept in the History.
+type groupState struct {
+	ID                string                `json:"id"`
+	Name              string                `json:"name"`
+	Members           []groupMemberState    `json:"members"`
+	Admin             bool                  `json:"admin,omitempty"`
+	SelfID            string                `json:"self_id"`
+	AdminConversation string                `json:"admin_conversation,omitempty"`
+	Seq               int                   `json:"seq"`
+	Early             map[int]*groupMessage `json:"early,omitempty"`
+	Pending           []*Message            `json:"pending,omitempty"`
+}
+
+type groupMemberState struct {
+	ID             string `json:"id"`
+	Alias          string `json:"alias"`
+	ConversationID string `json:"conversation_id,omitempty"`
+}
+
+const groupIndex = "groups"
+
+func groupName(id string) string {
+	return "group/" + id
+}
+
+// Writes the current state of a group.
+func (s *ConversationStore) SaveGroup(g *Group) error {
+	state := groupState{
+		ID:                g.GroupID,
+		Name:              g.Name,
+		Members:           make([]groupMemberState, 0, len(g.Members)),
+		Admin:             g.Admin,
+		SelfID:            g.SelfID,
+		AdminConversation: g.AdminConversation,
+		Seq:               g.seq,
+		Early:             g.early,
+		Pending:           g.pending,
+	}
+	for _, m := range g.Members {
+		state.Members = append(state.Members, groupMemberState{ID: m.ID, Alias: m.Alias, ConversationID: m.conversationID})
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := s.vault.Put(groupName(g.GroupID), data); err != nil {
+		return err
+	}
+
+	return s.updateIndex(groupIndex, g.GroupID, true)
+}
+
+// Removes the state of a group.
+func (s *ConversationStore) DeleteGroup(id string) error {
+	if err := s.vault.Delete(groupName(id)); err != nil {
+		return err
+	}
+
+	return s.updateIndex(groupIndex, id, false)
+}
+
+// Returns every stored group without its messages.
+func (s *ConversationStore) LoadGroups() ([]*Group, error) {
+	ids, err := s.index(groupIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]*Group, 0, len(ids))
+	for _, id := range ids {
+		data, err := s.vault.Get(groupName(id))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var state groupState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+
+		g := &Group{
+			GroupID:           state.ID,
+			Name:              state.Name,
+			Messages:          make([]*Message, 0),
+			Admin:             state.Admin,
+			SelfID:            state.SelfID,
+			AdminConversation: state.AdminConversation,
+			seq:               state.Seq,
+			early:             state.Early,
+			pending:           state.Pending,
+		}
+		for _, m := range state.Members {
+			g.Members = append(g.Members, &GroupMember{ID: m.ID, Alias: m.Alias, conversationID: m.ConversationID})
+		}
+
+		// Texts that wait for the admin were posted by this party
+		if self := g.member(g.SelfID); self != nil {
+			for _, m := range g.pending {
+				m.Self = true
+				m.Status = StatusQueued
+				m.Sender = self.Alias
+			}
+		}
+
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
+
+func incomingName(id, attachmentID string) string {
+	return "incoming/" + id + "/" + attachmentID
+}
+
+// Keeps a chunk of an attachment that is still being received.
+func (s *ConversationStore) saveChunk(id, attachmentID string, body []byte) error {
+	return s.vault.Append(incomingName(id, attachmentID), body)
+}
+
+// Removes the chunks of an attachment once it is complete.
+func (s *ConversationStore) deleteChunks(id, attachmentID string) error {
+	return s.vault.Delete(incomingName(id, attachmentID))
+}
+
+func (s *ConversationStore) index(name string) ([]string, error) {
+	data, err := s.vault.Get(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	err = json.Unmarshal(data, &ids)
+	return ids, err
+}
+
+func (s *ConversationStore) updateIndex(name, id string, present bool) error {
+	ids, err := s.index(name)
+	if err != nil {
+		return err
+	}
+
+	set := make(map[string]bool, len(ids)+1)
+	for _, existing := range ids {
+		set[existing] = true
+	}
+
+	if set[id] == present {
+		return nil
+	}
+
+	if present {
+		set[id] = true
+	} else {
+		delete(set, id)
+	}
+
+	ids = ids[:0]
+	for existing := range set {
+		ids = append(ids, existing)
+	}
+	sort.Strings(ids)
+
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+
+	return s.vault.Put(name, data)
+}
@@ -0,0 +1,174 @@
+package server_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/onionsoup/server"
+)
+
+func TestConversationStore(t *testing.T) {
+	aliceConvo, _, alice, _ := startConversation(t, "pgp")
+	dir := t.TempDir()
+
+	store := server.NewConversationStore(newVault(t, dir, alice.privateKey))
+	if err := store.Save(aliceConvo); err != nil {
+		t.Fatalf("Error saving conversation: %s", err)
+	}
+
+	loaded, err := server.NewConversationStore(newVault(t, dir, alice.privateKey)).Load()
+	if err != nil {
+		t.Fatalf("Error loading conversations: %s", err)
+	}
+
+	if len(loaded) != 1 {
+		t.Fatalf("Expected one stored conversation got %d", len(loaded))
+	}
+
+	c := loaded[0]
+	if c.ConversationID != aliceConvo.ConversationID || c.SelfToken != aliceConvo.SelfToken ||
+		c.RemoteToken != aliceConvo.RemoteToken || c.RemoteAddress != aliceConvo.RemoteAddress || !c.Established {
+		t.Fatalf("Stored conversation does not match")
+	}
+
+	stored, err := c.SafetyNumber()
+	if err != nil {
+		t.Fatalf("Error computing safety number: %s", err)
+	}
+
+	original, _ := aliceConvo.SafetyNumber()
+	if string(stored) != string(original) || !bytes.Equal(c.SelfPublicKey, aliceConvo.SelfPublicKey) {
+		t.Fatalf("Stored conversation keys do not match")
+	}
+
+	if err := store.Delete(c.ConversationID); err != nil {
+		t.Fatalf("Error deleting conversation: %s", err)
+	}
+
+	if loaded, _ := store.Load(); len(loaded) != 0 {
+		t.Fatalf("Expected no conversations after delete")
+	}
+}
+
+func TestConversationResume(t *testing.T) {
+	aliceConvo, bobConvo, alice, bob := startConversation(t, "x25519")
+	id := aliceConvo.ConversationID
+	dir := t.TempDir()
+
+	alice.rh.Store = server.NewConversationStore(newVault(t, dir, alice.privateKey))
+	alice.rh.SetVerified(id, true)
+
+	if _, err := alice.rh.Send(id, "Hello Bob", false); err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+
+	if _, err := bob.rh.Send(id, "Hello Alice", false); err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+
+	// Alice restarts on a new address
+	alice.rh.Close()
+
+	lt, err := server.NewLoopbackTransport()
+	if err != nil {
+		t.Fatalf("Error creating transport: %s", err)
+	}
+
+	rh := server.NewRouteHandlerWithTransport(lt)
+	rh.Store = server.NewConversationStore(newVault(t, dir, alice.privateKey))
+	rh.Start()
+	t.Cleanup(rh.Close)
+
+	events, unsubscribe := rh.Subscribe()
+	defer unsubscribe()
+
+	if err := rh.LoadConversations(); err != nil {
+		t.Fatalf("Error loading conversations: %s", err)
+	}
+
+	if e := nextEvent(t, events); e.Type != server.EventConversationCreated || e.ConversationID != id {
+		t.Fatalf("Expected %s got %s", server.EventConversationCreated, e.Type)
+	}
+
+	if e := nextEvent(t, events); e.Type != server.EventConversationEstablished {
+		t.Fatalf("Expected %s got %s: %v", server.EventConversationEstablished, e.Type, e.Err)
+	}
+
+	resumed, ok := rh.Conversation(id)
+	if !ok || !resumed.Verified {
+		t.Fatalf("Expected the resumed conversation to stay verified")
+	}
+
+	if bobConvo.RemoteAddress != rh.URL {
+		t.Fatalf("Expected bob to learn the new address")
+	}
+
+	// The restored ratchet continues the session in both directions
+	if _, err := bob.rh.Send(id, "Welcome back", false); err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+
+	if _, err := rh.Send(id, "Thanks Bob", false); err != nil {
+		t.Fatalf("Error sending message: %s", err)
+	}
+
+	messages := bob.rh.Messages(id)
+	if len(messages) != 4 || messages[3].Text != "Thanks Bob" {
+		t.Fatalf("Bob did not receive the message sent after the restart")
+	}
+}
+
+func TestConversationResumeLate(t *testing.T) {
+	aliceConvo, _, alice, bob := startConversation(t, "x25519")
+	id := aliceConvo.ConversationID
+	dir := t.TempDir()
+
+	alice.rh.Store = server.NewConversationStore(newVault(t, dir, alice.privateKey))
+	alice.rh.SetVerified(id, true)
+	alice.rh.Close()
+
+	lt, err := server.NewLoopbackTransport()
+	if err != nil {
+		t.Fatalf("Error creating transport: %s", err)
+	}
+
+	// Bob is offline when Alice restarts and only comes back later
+	rh := server.NewRouteHandlerWithTransport(lt)
+	rh.Store = server.NewConversationStore(newVault(t, dir, alice.privateKey))
+	rh.Retry = server.RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	gate := &gatedTransport{next: rh.Sender.Transport, path: server.ResumePath, refused: make(chan struct{}, 1)}
+	rh.Sender.Transport = gate
+	rh.Start()
+	t.Cleanup(rh.Close)
+
+	events, unsubscribe := rh.Subscribe()
+	defer unsubscribe()
+
+	if err := rh.LoadConversations(); err != nil {
+		t.Fatalf("Error loading conversations: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-gate.refused:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for the resume request")
+		}
+	}
+	gate.open()
+
+	timeout := time.After(10 * time.Second)
+	for established := false; !established; {
+		select {
+		case e := <-events:
+			established = e.Type == server.EventConversationEstablished
+		case <-timeout:
+			t.Fatalf("Timed out waiting for the conversation to resume")
+		}
+	}
+
+	if info, _ := bob.rh.ConversationInfo(id); info.RemoteAddress != rh.URL {
+		t.Fatalf("Expected bob to learn the new address")
+	}
+}
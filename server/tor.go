@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+)
+
+const (
+	// Attach to a running tor and launch one only when none is reachable.
+	TorModeAuto = "auto"
+	// Only attach to a running tor through its control port.
+	TorModeSystem = "system"
+	// Always launch a dedicated tor process.
+	TorModeEmbedded = "embedded"
+
+	DefaultControlAddress = "127.0.0.1:9051"
+)
+
+// TorTransport publishes an onion service and dials peers through tor.
+type TorTransport struct {
+	Tor   *tor.Tor
+	Onion *tor.OnionService
+
+	dialer *tor.Dialer
+}
+
+func NewTorTransport(conf Config) (*TorTransport, error) {
+	t, launched, err := startTor(conf, attachTor, launchTor)
+	if err != nil {
+		return nil, err
+	}
+
+	listenCtx, listenCancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer listenCancel()
+
+	// Waiting for the service to be published would enable the network of a system tor
+	listenConf := &tor.ListenConf{RemotePorts: []int{80}, Version3: true, NoWait: !launched}
+	if conf.OnionKey != nil {
+		listenConf.Key = conf.OnionKey
+	}
+
+	onion, err := t.Listen(listenCtx, listenConf)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	sendCtx, sendCancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer sendCancel()
+
+	d, err := torDialer(sendCtx, t, launched)
+	if err != nil {
+		onion.Close()
+		t.Close()
+		return nil, err
+	}
+
+	return &TorTransport{Tor: t, Onion: onion, dialer: d}, nil
+}
+
+func (tt *TorTransport) Listener() net.Listener {
+	return tt.Onion
+}
+
+func (tt *TorTransport) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return tt.dialer.DialContext(ctx, network, address)
+}
+
+func (tt *TorTransport) Address() string {
+	return tt.Onion.String()
+}
+
+func (tt *TorTransport) Close() error {
+	tt.Onion.Close()
+	return tt.Tor.Close()
+}
+
+// Connects to tor as selected by the config, attach and launch are attachTor and
+// launchTor outside of tests. Reports whether the returned tor was launched by us and
+// should be stopped when the handler closes.
+func startTor(conf Config, attach func(Config) (*tor.Tor, error), launch func() (*tor.Tor, error)) (*tor.Tor, bool, error) {
+	switch conf.TorMode {
+	case TorModeEmbedded:
+		t, err := launch()
+		return t, true, err
+
+	case TorModeSystem:
+		t, err := attach(conf)
+		return t, false, err
+
+	case TorModeAuto, "":
+		t, err := attach(conf)
+		if err == nil {
+			return t, false, nil
+		}
+
+		t, err = launch()
+		return t, true, err
+
+	default:
+		return nil, false, fmt.Errorf("Invalid tor mode: %s", conf.TorMode)
+	}
+}
+
+// Launches a new tor process with a throw away data directory.
+func launchTor() (*tor.Tor, error) {
+	t, err := tor.Start(nil, &tor.StartConf{
+		DataDir: path.Join(os.TempDir(), "tor", randomString(10)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.DeleteDataDirOnClose = true
+	t.StopProcessOnClose = true
+
+	return t, nil
+}
+
+// Attaches to an already running tor through its control port or control socket.
+// Authentication uses the cookie file when tor offers it and the password otherwise.
+func attachTor(conf Config) (*tor.Tor, error) {
+	network, address := controlEndpoint(conf)
+	conn, err := net.DialTimeout(network, address, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach tor control port: %v", err)
+	}
+
+	ctrl := control.NewConn(textproto.NewConn(conn))
+	if err := ctrl.Authenticate(conf.ControlPassword); err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("Unable to authenticate with tor control port: %v", err)
+	}
+
+	// Onion services created over this connection are removed when it closes, the
+	// process itself belongs to the system and is left running
+	return &tor.Tor{Control: ctrl}, nil
+}
+
+// Returns the network and address of the control port, a control socket takes precedence.
+func controlEndpoint(conf Config) (string, string) {
+	if conf.ControlSocket != "" {
+		return "unix", conf.ControlSocket
+	}
+	if conf.ControlAddress != "" {
+		return "tcp", conf.ControlAddress
+	}
+	return "tcp", DefaultControlAddress
+}
+
+// Returns a dialer through the tor SOCKS port. A system tor is not asked to change
+// its network setting.
+func torDialer(ctx context.Context, t *tor.Tor, launched bool) (*tor.Dialer, error) {
+	return t.Dialer(ctx, &tor.DialConf{SkipEnableNetwork: !launched})
+}
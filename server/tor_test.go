@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cretz/bine/tor"
+)
+
+// Answers a tor control connection that needs no authentication.
+func fakeControl(t *testing.T, network, address string) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					switch strings.Fields(line)[0] {
+					case "PROTOCOLINFO":
+						fmt.Fprint(conn, "250-PROTOCOLINFO 1\r\n250-AUTH METHODS=NULL\r\n250-VERSION Tor=\"0.4.8.0\"\r\n250 OK\r\n")
+					case "AUTHENTICATE":
+						fmt.Fprint(conn, "250 OK\r\n")
+					case "QUIT":
+						fmt.Fprint(conn, "250 closing connection\r\n")
+						return
+					default:
+						fmt.Fprint(conn, "510 Unrecognized command\r\n")
+					}
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+// Returns an address nothing listens on.
+func closedAddress(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	return address
+}
+
+func TestControlEndpoint(t *testing.T) {
+	tests := []struct {
+		conf    Config
+		network string
+		address string
+	}{
+		{Config{}, "tcp", DefaultControlAddress},
+		{Config{ControlAddress: "127.0.0.1:9151"}, "tcp", "127.0.0.1:9151"},
+		{Config{ControlSocket: "/run/tor/control"}, "unix", "/run/tor/control"},
+		{Config{ControlAddress: "127.0.0.1:9151", ControlSocket: "/run/tor/control"}, "unix", "/run/tor/control"},
+	}
+
+	for _, test := range tests {
+		network, address := controlEndpoint(test.conf)
+		if network != test.network || address != test.address {
+			t.Fatalf("Expected %s %s for %+v, got %s %s", test.network, test.address, test.conf, network, address)
+		}
+	}
+}
+
+func TestAttachTor(t *testing.T) {
+	l := fakeControl(t, "tcp", "127.0.0.1:0")
+
+	tr, err := attachTor(Config{ControlAddress: l.Addr().String()})
+	if err != nil {
+		t.Fatalf("Error attaching to the control port: %s", err)
+	}
+	if !tr.Control.Authenticated || tr.StopProcessOnClose {
+		t.Fatalf("Expected an authenticated connection to a tor that is left running")
+	}
+	tr.Close()
+
+	// The socket is used even when the control port cannot be reached
+	socket := filepath.Join(t.TempDir(), "control")
+	fakeControl(t, "unix", socket)
+
+	tr, err = attachTor(Config{ControlAddress: closedAddress(t), ControlSocket: socket})
+	if err != nil {
+		t.Fatalf("Error attaching to the control socket: %s", err)
+	}
+	tr.Close()
+
+	if _, err := attachTor(Config{ControlAddress: closedAddress(t)}); err == nil {
+		t.Fatalf("Expected an unreachable control port to fail")
+	}
+}
+
+func TestStartTor(t *testing.T) {
+	l := fakeControl(t, "tcp", "127.0.0.1:0")
+	reachable := Config{ControlAddress: l.Addr().String()}
+	unreachable := Config{ControlAddress: closedAddress(t)}
+
+	tests := []struct {
+		mode        string
+		conf        Config
+		launched    bool
+		err         bool
+		launchCalls int
+	}{
+		{"", reachable, false, false, 0},
+		{TorModeAuto, reachable, false, false, 0},
+		{TorModeAuto, unreachable, true, false, 1},
+		{TorModeSystem, unreachable, false, true, 0},
+		{TorModeEmbedded, reachable, true, false, 1},
+		{"bogus", reachable, false, true, 0},
+	}
+
+	for _, test := range tests {
+		calls := 0
+		launch := func() (*tor.Tor, error) {
+			calls++
+			return &tor.Tor{}, nil
+		}
+
+		conf := test.conf
+		conf.TorMode = test.mode
+
+		tr, launched, err := startTor(conf, attachTor, launch)
+		if (err != nil) != test.err || launched != test.launched || calls != test.launchCalls {
+			t.Fatalf("Mode %q: expected launched %v, error %v and %d launches, got %v, %v and %d",
+				test.mode, test.launched, test.err, test.launchCalls, launched, err, calls)
+		}
+		if err == nil && !launched {
+			tr.Close()
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"net"
+)
+
+// Transport carries the conversation protocol between peers. The RouteHandler serves
+// incoming requests from the Listener and reaches peers through DialContext using the
+// address they advertised.
+type Transport interface {
+	// Listener accepts connections addressed to Address.
+	Listener() net.Listener
+	// DialContext connects to the Address of a remote transport.
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	// Address is what peers use to reach this transport.
+	Address() string
+	Close() error
+}
+
+// LoopbackTransport serves plain TCP on localhost. It provides no anonymity and is
+// meant for tests and machines without tor.
+type LoopbackTransport struct {
+	listener net.Listener
+	dialer   net.Dialer
+}
+
+func NewLoopbackTransport() (*LoopbackTransport, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoopbackTransport{listener: listener}, nil
+}
+
+func (lt *LoopbackTransport) Listener() net.Listener {
+	return lt.listener
+}
+
+func (lt *LoopbackTransport) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return lt.dialer.DialContext(ctx, network, address)
+}
+
+func (lt *LoopbackTransport) Address() string {
+	return lt.listener.Addr().String()
+}
+
+func (lt *LoopbackTransport) Close() error {
+	return lt.listener.Close()
+}
@@ -0,0 +1,259 @@
+// Package storage keeps OnionSoup state on disk encrypted under a single key.
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/JustinTimperio/onionsoup/crypt"
+)
+
+const (
+	// Holds a known value encrypted under the vault key to detect a wrong key early.
+	checkFile = "vault.check"
+	// Holds the random salt passphrase keys are derived with.
+	saltFile  = "vault.salt"
+	checkText = "OnionSoup Vault"
+)
+
+var ErrWrongKey = errors.New("Vault cannot be opened with this key")
+
+// Vault stores named entries in a directory. Entry names are replaced by a keyed hash
+// and the contents are encrypted with AES-GCM, the name is authenticated with every
+// record so entries cannot be swapped.
+//
+// An entry either holds a single value written by Put or a log of records written by
+// Append.
+type Vault struct {
+	dir string
+	key []byte
+	mux sync.Mutex
+}
+
+// Opens the vault in dir with a 32 byte key, creating it when it does not exist.
+func OpenVault(dir string, key []byte) (*Vault, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Vault key must be 32 bytes")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	v := &Vault{dir: dir, key: key}
+
+	sealed, err := os.ReadFile(filepath.Join(dir, checkFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		sealed, err = crypt.AESSeal(key, []byte(checkText), []byte(checkFile))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := writeFile(filepath.Join(dir, checkFile), sealed); err != nil {
+			return nil, err
+		}
+
+	case err != nil:
+		return nil, err
+
+	default:
+		check, err := crypt.AESOpen(key, sealed, []byte(checkFile))
+		if err != nil || string(check) != checkText {
+			return nil, ErrWrongKey
+		}
+	}
+
+	return v, nil
+}
+
+// Derives the key of the vault in dir from a passphrase. The salt is created with the
+// vault and kept next to it.
+func PassphraseKey(dir, passphrase string) ([]byte, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, saltFile)
+	salt, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		salt = make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+
+		if err := writeFile(path, salt); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return crypt.PassphraseKey(passphrase, salt)
+}
+
+// Replaces the value of an entry.
+func (v *Vault) Put(name string, value []byte) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	sealed, err := crypt.AESSeal(v.key, value, []byte(name))
+	if err != nil {
+		return err
+	}
+
+	return writeFile(v.path(name), sealed)
+}
+
+// Returns the value of an entry, the error wraps os.ErrNotExist when it was never written.
+func (v *Vault) Get(name string) ([]byte, error) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	sealed, err := os.ReadFile(v.path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := crypt.AESOpen(v.key, sealed, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt vault entry: %v", err)
+	}
+
+	return value, nil
+}
+
+// Adds a record to the end of an entry's log.
+func (v *Vault) Append(name string, record []byte) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	line, err := v.sealRecord(name, record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(v.path(name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Returns the records of an entry's log in the order they were appended. A log that was
+// never written has no records.
+func (v *Vault) Records(name string) ([][]byte, error) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	f, err := os.Open(v.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		sealed, err := base64.StdEncoding.DecodeString(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("Corrupt vault record: %v", err)
+		}
+
+		record, err := crypt.AESOpen(v.key, sealed, []byte(name))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt vault record: %v", err)
+		}
+
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// Replaces an entry's log with the given records.
+func (v *Vault) Rewrite(name string, records [][]byte) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	var buf bytes.Buffer
+	for _, record := range records {
+		line, err := v.sealRecord(name, record)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+	}
+
+	return writeFile(v.path(name), buf.Bytes())
+}
+
+// Removes an entry. Deleting an entry that does not exist is not an error.
+func (v *Vault) Delete(name string) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	err := os.Remove(v.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (v *Vault) sealRecord(name string, record []byte) ([]byte, error) {
+	sealed, err := crypt.AESSeal(v.key, record, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// Maps an entry name to a file name that does not reveal it.
+func (v *Vault) path(name string) string {
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write([]byte(name))
+	return filepath.Join(v.dir, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Writes the file through a temporary file so a crash never leaves it half written.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
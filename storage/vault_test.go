@@ -0,0 +1,109 @@
+package storage_test
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/JustinTimperio/onionsoup/storage"
+)
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	return key
+}
+
+func TestVault(t *testing.T) {
+	dir := t.TempDir()
+	key := newKey(t)
+
+	v, err := storage.OpenVault(dir, key)
+	if err != nil {
+		t.Fatalf("Error opening vault: %s", err)
+	}
+
+	if _, err := v.Get("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected a missing entry to report os.ErrNotExist, got %v", err)
+	}
+
+	if err := v.Put("settings", []byte("value")); err != nil {
+		t.Fatalf("Error writing entry: %s", err)
+	}
+
+	for _, record := range []string{"one", "two", "three"} {
+		if err := v.Append("log", []byte(record)); err != nil {
+			t.Fatalf("Error appending record: %s", err)
+		}
+	}
+
+	// Reopening with the same key sees the same entries
+	v, err = storage.OpenVault(dir, key)
+	if err != nil {
+		t.Fatalf("Error reopening vault: %s", err)
+	}
+
+	value, err := v.Get("settings")
+	if err != nil || string(value) != "value" {
+		t.Fatalf("Entry mismatch: %q %v", value, err)
+	}
+
+	records, err := v.Records("log")
+	if err != nil || len(records) != 3 || string(records[2]) != "three" {
+		t.Fatalf("Records mismatch: %q %v", records, err)
+	}
+
+	if err := v.Rewrite("log", records[1:2]); err != nil {
+		t.Fatalf("Error rewriting records: %s", err)
+	}
+
+	records, err = v.Records("log")
+	if err != nil || len(records) != 1 || string(records[0]) != "two" {
+		t.Fatalf("Records mismatch after rewrite: %q %v", records, err)
+	}
+
+	if err := v.Delete("log"); err != nil {
+		t.Fatalf("Error deleting entry: %s", err)
+	}
+
+	if records, err := v.Records("log"); err != nil || len(records) != 0 {
+		t.Fatalf("Expected no records after delete: %q %v", records, err)
+	}
+
+	if _, err := storage.OpenVault(dir, newKey(t)); !errors.Is(err, storage.ErrWrongKey) {
+		t.Fatalf("Expected opening with the wrong key to fail, got %v", err)
+	}
+}
+
+func TestVaultPassphrase(t *testing.T) {
+	dir := t.TempDir()
+
+	key, err := storage.PassphraseKey(dir, "passphrase")
+	if err != nil {
+		t.Fatalf("Error deriving key: %s", err)
+	}
+
+	if _, err := storage.OpenVault(dir, key); err != nil {
+		t.Fatalf("Error opening vault: %s", err)
+	}
+
+	again, err := storage.PassphraseKey(dir, "passphrase")
+	if err != nil || string(again) != string(key) {
+		t.Fatalf("Expected the same passphrase to derive the same key")
+	}
+
+	wrong, err := storage.PassphraseKey(dir, "wrong")
+	if err != nil {
+		t.Fatalf("Error deriving key: %s", err)
+	}
+
+	if _, err := storage.OpenVault(dir, wrong); !errors.Is(err, storage.ErrWrongKey) {
+		t.Fatalf("Expected opening with the wrong passphrase to fail, got %v", err)
+	}
+}